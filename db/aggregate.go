@@ -0,0 +1,487 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// DefaultCountProgressEvery is the number of instances CountProgress
+// scans between calls to its progress callback, unless the db sets
+// another with WithNewCountProgressEvery.
+const DefaultCountProgressEvery = 1000
+
+// maxHistogramBuckets is the maximum number of buckets of a Histogram.
+const maxHistogramBuckets = 1 << 16
+
+// CountProgress returns the number of instances matching q, calling
+// progress with the number of instances scanned so far, matching or not,
+// every DefaultCountProgressEvery instances, or as many as the db sets,
+// and once when the count is done.
+// It stops early, returning the context error, if ctx is done.
+// Sort, Limit and Skip are ignored.
+func (t *Txn) CountProgress(ctx context.Context, q *Query, progress func(scanned int)) (int, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	every := t.collection.db.countProgressEvery
+	if every <= 0 {
+		every = DefaultCountProgressEvery
+	}
+	var scanned, count int
+	q.onScan = func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		scanned++
+		if progress != nil && scanned%every == 0 {
+			progress(scanned)
+		}
+		return nil
+	}
+	if err := t.iterate(q, func(MarshaledResult) (bool, error) {
+		count++
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if progress != nil && scanned%every != 0 {
+		progress(scanned)
+	}
+	return count, nil
+}
+
+// CountDistinct returns the number of distinct values of field among the
+// instances matching q. Values are compared by their JSON representation,
+// so 1 and "1" are distinct. Instances where field is missing or null are
+// skipped. Sort, Limit and Skip are ignored.
+func (t *Txn) CountDistinct(q *Query, field string) (int, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	field = resolveAlias(q.Aliases, field)
+	set := make(map[string]struct{})
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		key, ok, err := distinctKey(res.MarshaledValue, field, q.maxPathDepth)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			set[key] = struct{}{}
+		}
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+	return len(set), nil
+}
+
+// DistinctMulti returns the distinct tuples of the values of fields among
+// the instances matching q, e.g. the distinct country and plan pairs of
+// users, in the order they're first found. Tuple components are strings,
+// bools or numbers, and a field missing or null in an instance is the zero
+// Value, with no member set, so tuples missing a component are distinct
+// from others. Instances where a field is an object or an array are
+// skipped. Sort, Limit and Skip are ignored.
+func (t *Txn) DistinctMulti(q *Query, fields ...string) ([][]Value, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("distinct tuples require at least one field")
+	}
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([]string, len(fields))
+	for i, field := range fields {
+		resolved[i] = resolveAlias(q.Aliases, field)
+	}
+	seen := make(map[string]struct{})
+	var tuples [][]Value
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		tuple := make([]Value, len(resolved))
+		for i, field := range resolved {
+			value, err := traverseFieldPathMap(res.MarshaledValue, field, q.maxPathDepth)
+			if err != nil || !value.IsValid() {
+				continue
+			}
+			if tuple[i] = createValue(value.Interface()); tuple[i].value() == nil {
+				return true, nil
+			}
+		}
+		b, err := json.Marshal(tuple)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := seen[string(b)]; !ok {
+			seen[string(b)] = struct{}{}
+			tuples = append(tuples, tuple)
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return tuples, nil
+}
+
+// GroupByCount returns the number of instances matching q for each value
+// of field, keyed by the value: strings as is and other values by their
+// JSON representation. Instances where field is missing or null are
+// skipped. Sort, Limit and Skip are ignored.
+func (t *Txn) GroupByCount(q *Query, field string) (map[string]int, error) {
+	return t.GroupByCountHaving(q, field, 0)
+}
+
+// GroupByCountHaving is like GroupByCount, but only returns the groups
+// with at least minCount instances, like a SQL HAVING clause, e.g.
+// countries with at least 100 users.
+func (t *Txn) GroupByCountHaving(q *Query, field string, minCount int) (map[string]int, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	field = resolveAlias(q.Aliases, field)
+	counts := make(map[string]int)
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		key, ok, err := groupKey(res.MarshaledValue, field, q.maxPathDepth)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			counts[key]++
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	for key, count := range counts {
+		if count < minCount {
+			delete(counts, key)
+		}
+	}
+	return counts, nil
+}
+
+// MissingGroup is the key of the group GroupBy puts instances where the
+// field is missing or null in. It's a NUL character, rather than "null" as
+// null is represented in JSON, so that it doesn't collide with the group of
+// a string value such as "null".
+const MissingGroup = "\x00"
+
+// GroupBy returns the instances matching q grouped by the value of field,
+// keyed as by GroupByCount, with instances where field is missing or null
+// in MissingGroup. Within each group, instances are in the order of the
+// query's sort, if any. Limit and Skip are ignored.
+func (t *Txn) GroupBy(q *Query, field string) (map[string][][]byte, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	field = resolveAlias(q.Aliases, field)
+	var values []MarshaledResult
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		values = append(values, res)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := sortResults(values, q); err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(values))
+	for i := range values {
+		key, ok, err := groupKey(values[i].MarshaledValue, field, q.maxPathDepth)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			key = MissingGroup
+		}
+		keys[i] = key
+	}
+	if err := projectFields(values, q); err != nil {
+		return nil, err
+	}
+	groups := make(map[string][][]byte)
+	for i, key := range keys {
+		groups[key] = append(groups[key], values[i].Value)
+	}
+	return groups, nil
+}
+
+// Histogram counts the instances matching q by the value of the numeric
+// field, in buckets of bucketSize from min to max, e.g. ages 0 to 9, 10
+// to 19 and so on. Buckets include their lower bound and exclude their
+// upper bound, except for the last, which includes max. Values outside
+// [min, max] are skipped rather than clamped into the edge buckets, as are
+// instances where field is missing or isn't a number. Sort, Limit and
+// Skip are ignored.
+func (t *Txn) Histogram(q *Query, field string, min, max, bucketSize float64) ([]int, error) {
+	if !(bucketSize > 0) || math.IsInf(bucketSize, 0) {
+		return nil, fmt.Errorf("bucket size must be positive, got %v", bucketSize)
+	}
+	if !(min < max) || math.IsInf(min, 0) || math.IsInf(max, 0) {
+		return nil, fmt.Errorf("histogram range must be finite and not empty, got [%v, %v]", min, max)
+	}
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	n := math.Ceil((max - min) / bucketSize)
+	if n > maxHistogramBuckets {
+		return nil, fmt.Errorf("histogram can't have more than %d buckets, got %v", maxHistogramBuckets, n)
+	}
+	field = resolveAlias(q.Aliases, field)
+	buckets := make([]int, int(n))
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		value, err := traverseFieldPathMap(res.MarshaledValue, field, q.maxPathDepth)
+		if err != nil || !value.IsValid() {
+			return true, nil
+		}
+		f, ok := value.Interface().(float64)
+		if !ok || f < min || f > max {
+			return true, nil
+		}
+		i := int((f - min) / bucketSize)
+		if i >= len(buckets) {
+			i = len(buckets) - 1
+		}
+		buckets[i]++
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// AggOp is an aggregate operation over the numeric values of a field.
+type AggOp int
+
+const (
+	// AggCount counts the values.
+	AggCount AggOp = iota
+	// AggSum sums the values.
+	AggSum
+	// AggAvg averages the values.
+	AggAvg
+	// AggMin returns the least value.
+	AggMin
+	// AggMax returns the greatest value.
+	AggMax
+)
+
+// FindWithAggregate is like Find, but also returns the aggregate op of the
+// numeric field over all the instances matching q, computed in the same
+// scan, regardless of Skip and Limit. Instances where field is missing or
+// isn't a number are left out of the aggregate, and the average, minimum
+// and maximum of no values are NaN. When q is sorted in memory, all the
+// matches are buffered to be sorted before Skip and Limit apply, as with
+// Find; otherwise only the returned ones are.
+func (t *Txn) FindWithAggregate(q *Query, field string, op AggOp) ([][]byte, float64, error) {
+	if op < AggCount || op > AggMax {
+		return nil, 0, fmt.Errorf("unknown aggregate operation %d", op)
+	}
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	field = resolveAlias(q.Aliases, field)
+	agg := aggregator{op: op}
+	values, _, err := t.collect(q, collector{
+		keep: func(res MarshaledResult) (bool, error) {
+			agg.addField(res.MarshaledValue, field, q.maxPathDepth)
+			return true, nil
+		},
+		scanAll: true,
+	})
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, 0, err
+	}
+	return resultValues(values), agg.result(), err
+}
+
+// AggregateStream returns the aggregate op of the numeric field over the
+// instances matching q, as FindWithAggregate does, in a single pass which
+// doesn't keep the instances. After every `every` matching instances, and
+// once more after the last one unless it was just reported, it calls emit
+// with the running aggregate and the number of matching instances so far,
+// e.g. to show partial results on a live dashboard. emit may be nil. It
+// stops early, returning the context error, if ctx is done. Other errors
+// iterating the instances, such as reading them from the datastore, end
+// the stream silently, as they do for Find, and the aggregate so far is
+// returned. Sort, Limit and Skip are ignored.
+func (t *Txn) AggregateStream(ctx context.Context, q *Query, field string, op AggOp, every int, emit func(partial float64, scanned int)) (float64, error) {
+	if op < AggCount || op > AggMax {
+		return 0, fmt.Errorf("unknown aggregate operation %d", op)
+	}
+	if every <= 0 {
+		return 0, fmt.Errorf("emit interval must be positive, got %d", every)
+	}
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	field = resolveAlias(q.Aliases, field)
+	q.onScan = func() error {
+		return ctx.Err()
+	}
+	agg := aggregator{op: op}
+	var count int
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		agg.addField(res.MarshaledValue, field, q.maxPathDepth)
+		count++
+		if emit != nil && count%every == 0 {
+			emit(agg.result(), count)
+		}
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if emit != nil && count%every != 0 {
+		emit(agg.result(), count)
+	}
+	return agg.result(), nil
+}
+
+// FindOutliers returns the instances matching q whose numeric field lies
+// more than sigma standard deviations from the mean of field over all the
+// matches, e.g. with a sigma of 3 for anomaly detection. It scans the
+// matches twice, once to compute the mean and the population standard
+// deviation and once to find the outliers, so it costs about as much as
+// two Finds. Instances where field is missing or isn't a number are
+// neither counted nor returned, and with fewer than two numbers, or ones
+// all equal, there are no outliers. Sort, Limit and Skip apply to the
+// outliers.
+func (t *Txn) FindOutliers(q *Query, field string, sigma float64) ([][]byte, error) {
+	if sigma < 0 || math.IsNaN(sigma) || math.IsInf(sigma, 0) {
+		return nil, fmt.Errorf("sigma must be finite and non-negative, got %v", sigma)
+	}
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	field = resolveAlias(q.Aliases, field)
+	number := func(v map[string]interface{}) (float64, bool) {
+		value, err := traverseFieldPathMap(v, field, q.maxPathDepth)
+		if err != nil || !value.IsValid() {
+			return 0, false
+		}
+		f, ok := value.Interface().(float64)
+		return f, ok
+	}
+
+	// Welford's algorithm, which is numerically stable.
+	var n int
+	var mean, m2 float64
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		if f, ok := number(res.MarshaledValue); ok {
+			n++
+			delta := f - mean
+			mean += delta / float64(n)
+			m2 += delta * (f - mean)
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	stddev := math.Sqrt(m2 / float64(n))
+	if n < 2 || stddev == 0 {
+		return [][]byte{}, nil
+	}
+
+	values, _, err := t.collect(q, collector{
+		keep: func(res MarshaledResult) (bool, error) {
+			f, ok := number(res.MarshaledValue)
+			return ok && math.Abs(f-mean) > sigma*stddev, nil
+		},
+	})
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, err
+	}
+	return resultValues(values), err
+}
+
+// aggregator accumulates values for an aggregate operation.
+type aggregator struct {
+	op       AggOp
+	n        int
+	sum      float64
+	min, max float64
+}
+
+func (a *aggregator) add(f float64) {
+	if a.n == 0 || f < a.min {
+		a.min = f
+	}
+	if a.n == 0 || f > a.max {
+		a.max = f
+	}
+	a.n++
+	a.sum += f
+}
+
+// addField adds the value of field in v, if it's a number.
+func (a *aggregator) addField(v map[string]interface{}, field string, maxDepth int) {
+	value, err := traverseFieldPathMap(v, field, maxDepth)
+	if err == nil && value.IsValid() {
+		if f, ok := value.Interface().(float64); ok {
+			a.add(f)
+		}
+	}
+}
+
+func (a *aggregator) result() float64 {
+	switch a.op {
+	case AggCount:
+		return float64(a.n)
+	case AggSum:
+		return a.sum
+	}
+	if a.n == 0 {
+		return math.NaN()
+	}
+	switch a.op {
+	case AggAvg:
+		return a.sum / float64(a.n)
+	case AggMin:
+		return a.min
+	default:
+		return a.max
+	}
+}
+
+// groupKey returns the value of field in v as a string, or false if the
+// field is missing or null.
+func groupKey(v map[string]interface{}, field string, maxDepth int) (string, bool, error) {
+	value, err := traverseFieldPathMap(v, field, maxDepth)
+	if err != nil || !value.IsValid() {
+		return "", false, nil
+	}
+	if s, ok := value.Interface().(string); ok {
+		return s, true, nil
+	}
+	return distinctKey(v, field, maxDepth)
+}
+
+// distinctKey returns the stringified value of field in v, or false if
+// the field is missing or null.
+func distinctKey(v map[string]interface{}, field string, maxDepth int) (string, bool, error) {
+	value, err := traverseFieldPathMap(v, field, maxDepth)
+	if err != nil || !value.IsValid() {
+		return "", false, nil
+	}
+	b, err := json.Marshal(value.Interface())
+	if err != nil {
+		return "", false, err
+	}
+	return string(b), true, nil
+}
@@ -0,0 +1,435 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/util"
+)
+
+type member struct {
+	ID      core.InstanceID `json:"_id"`
+	Name    string
+	Country string `json:",omitempty"`
+	Plan    string `json:",omitempty"`
+	Age     float64
+}
+
+var members = []member{
+	{Name: "Alice", Country: "US", Plan: "pro", Age: 31},
+	{Name: "Bob", Country: "US", Plan: "free", Age: 17},
+	{Name: "Carol", Country: "AR", Plan: "pro", Age: 45},
+	{Name: "Dave", Country: "DE", Plan: "free", Age: 23},
+	{Name: "Erin", Plan: "free", Age: 64},
+	{Name: "Frank", Country: "AR", Age: 9},
+}
+
+func createCollectionWithMembers(t *testing.T, opts ...NewOption) (*Collection, []member, func()) {
+	db, clean := createTestDB(t, opts...)
+	c, err := db.NewCollection(CollectionConfig{
+		Name:   "Member",
+		Schema: util.SchemaFromInstance(&member{}, false),
+	})
+	checkErr(t, err)
+	membersCopy := make([]member, len(members))
+	for i := range members {
+		id, err := c.Create(util.JSONFromInstance(members[i]))
+		checkErr(t, err)
+		membersCopy[i] = members[i]
+		membersCopy[i].ID = id
+	}
+	return c, membersCopy, clean
+}
+
+func TestCountDistinct(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithMembers(t)
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		field string
+		count int
+	}{
+		{name: "AllCountries", query: nil, field: "Country", count: 3},
+		{name: "AllPlans", query: nil, field: "Plan", count: 2},
+		{name: "AdultCountries", query: Where("Age").Ge(float64(18)), field: "Country", count: 3},
+		{name: "MinorCountries", query: Where("Age").Lt(float64(18)), field: "Country", count: 2},
+		{name: "NoMatches", query: Where("Age").Gt(float64(100)), field: "Country", count: 0},
+		{name: "MissingField", query: nil, field: "Missing", count: 0},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var count int
+			err := c.ReadTxn(func(txn *Txn) (err error) {
+				count, err = txn.CountDistinct(tc.query, tc.field)
+				return err
+			})
+			checkErr(t, err)
+			if count != tc.count {
+				t.Fatalf("wrong distinct count, expected: %d, got: %d", tc.count, count)
+			}
+		})
+	}
+}
+
+func TestCountProgress(t *testing.T) {
+	t.Parallel()
+	c, data, clean := createCollectionWithMembers(t)
+	defer clean()
+
+	var calls []int
+	var count int
+	err := c.ReadTxn(func(txn *Txn) (err error) {
+		count, err = txn.CountProgress(context.Background(), Where("Age").Ge(float64(18)), func(scanned int) {
+			calls = append(calls, scanned)
+		})
+		return err
+	})
+	checkErr(t, err)
+	if count != 4 {
+		t.Fatalf("wrong count, expected: %d, got: %d", 4, count)
+	}
+	if len(calls) != 1 || calls[0] != len(data) {
+		t.Fatalf("expected a final progress call with %d scanned, got: %v", len(data), calls)
+	}
+
+	// With progress every 4 instances, there's an intermediate call too.
+	pc, _, pclean := createCollectionWithMembers(t, WithNewCountProgressEvery(4))
+	defer pclean()
+	calls = nil
+	err = pc.ReadTxn(func(txn *Txn) (err error) {
+		count, err = txn.CountProgress(context.Background(), Where("Age").Ge(float64(18)), func(scanned int) {
+			calls = append(calls, scanned)
+		})
+		return err
+	})
+	checkErr(t, err)
+	if expected := []int{4, len(data)}; count != 4 || !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected count 4 with progress calls %v, got: %d with %v", expected, count, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = c.ReadTxn(func(txn *Txn) error {
+		_, err := txn.CountProgress(ctx, nil, nil)
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a canceled count, got: %v", err)
+	}
+}
+
+func TestGroupByCountHaving(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithMembers(t)
+	defer clean()
+
+	tests := []struct {
+		name     string
+		query    *Query
+		field    string
+		minCount int
+		counts   map[string]int
+	}{
+		{name: "AllCountries", query: nil, field: "Country", counts: map[string]int{"US": 2, "AR": 2, "DE": 1}},
+		{name: "CountriesHaving2", query: nil, field: "Country", minCount: 2, counts: map[string]int{"US": 2, "AR": 2}},
+		{name: "AdultCountriesHaving2", query: Where("Age").Ge(float64(18)), field: "Country", minCount: 2, counts: map[string]int{}},
+		{name: "PlansHaving3", query: nil, field: "Plan", minCount: 3, counts: map[string]int{"free": 3}},
+		{name: "Ages", query: Where("Age").Gt(float64(40)), field: "Age", counts: map[string]int{"45": 1, "64": 1}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var counts map[string]int
+			err := c.ReadTxn(func(txn *Txn) (err error) {
+				counts, err = txn.GroupByCountHaving(tc.query, tc.field, tc.minCount)
+				return err
+			})
+			checkErr(t, err)
+			if !reflect.DeepEqual(counts, tc.counts) {
+				t.Fatalf("wrong group counts, expected: %v, got: %v", tc.counts, counts)
+			}
+		})
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithMembers(t)
+	defer clean()
+
+	tests := []struct {
+		name       string
+		query      *Query
+		field      string
+		min, max   float64
+		bucketSize float64
+		buckets    []int
+	}{
+		{name: "Decades", field: "Age", min: 0, max: 60, bucketSize: 10, buckets: []int{1, 1, 1, 1, 1, 0}},
+		{name: "Boundaries", field: "Age", min: 17, max: 31, bucketSize: 7, buckets: []int{2, 1}},
+		{name: "PartialLastBucket", field: "Age", min: 9, max: 45, bucketSize: 15, buckets: []int{3, 1, 1}},
+		{name: "Adults", query: Where("Age").Ge(float64(18)), field: "Age", min: 0, max: 100, bucketSize: 50, buckets: []int{3, 1}},
+		{name: "NonNumeric", field: "Country", min: 0, max: 10, bucketSize: 5, buckets: []int{0, 0}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var buckets []int
+			err := c.ReadTxn(func(txn *Txn) (err error) {
+				buckets, err = txn.Histogram(tc.query, tc.field, tc.min, tc.max, tc.bucketSize)
+				return err
+			})
+			checkErr(t, err)
+			if !reflect.DeepEqual(buckets, tc.buckets) {
+				t.Fatalf("wrong buckets, expected: %v, got: %v", tc.buckets, buckets)
+			}
+		})
+	}
+
+	err := c.ReadTxn(func(txn *Txn) error {
+		if _, err := txn.Histogram(nil, "Age", 0, 10, 0); err == nil {
+			t.Fatal("expected an error for an empty bucket size")
+		}
+		if _, err := txn.Histogram(nil, "Age", 10, 10, 1); err == nil {
+			t.Fatal("expected an error for an empty range")
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestFindWithAggregate(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithMembers(t)
+	defer clean()
+
+	// Ages of US members are 31 and 17, and of all members sum to 189.
+	tests := []struct {
+		name  string
+		query *Query
+		op    AggOp
+		rows  []string
+		agg   float64
+	}{
+		{name: "Sum", query: OrderBy("Name").LimitTo(2), op: AggSum, rows: []string{"Alice", "Bob"}, agg: 189},
+		{name: "Count", query: OrderByDesc("Age").SkipNum(1).LimitTo(1), op: AggCount, rows: []string{"Carol"}, agg: 6},
+		{name: "Avg", query: Where("Country").Eq("US").LimitTo(1), op: AggAvg, rows: nil, agg: 24},
+		{name: "Min", query: (&Query{}).LimitTo(3), op: AggMin, rows: nil, agg: 9},
+		{name: "Max", query: Where("Age").Lt(40.0).OrderBy("Age"), op: AggMax, rows: []string{"Frank", "Bob", "Dave", "Alice"}, agg: 31},
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		for _, tc := range tests {
+			res, agg, err := txn.FindWithAggregate(tc.query, "Age", tc.op)
+			checkErr(t, err)
+			if agg != tc.agg {
+				t.Fatalf("%s: expected aggregate %v, got %v", tc.name, tc.agg, agg)
+			}
+			if tc.rows == nil {
+				if len(res) != tc.query.Limit {
+					t.Fatalf("%s: expected %d rows, got %d", tc.name, tc.query.Limit, len(res))
+				}
+				continue
+			}
+			names := stringFields(res, "Name")
+			if !reflect.DeepEqual(names, tc.rows) {
+				t.Fatalf("%s: expected rows %v, got %v", tc.name, tc.rows, names)
+			}
+		}
+
+		_, agg, err := txn.FindWithAggregate(Where("Age").Gt(100.0), "Age", AggAvg)
+		checkErr(t, err)
+		if !math.IsNaN(agg) {
+			t.Fatalf("expected the average of no values to be NaN, got %v", agg)
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestGroupBy(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithMembers(t)
+	defer clean()
+	// A country named as JSON null doesn't collide with missing countries.
+	_, err := c.Create(util.JSONFromInstance(member{Name: "Gus", Country: "null", Age: 12}))
+	checkErr(t, err)
+
+	tests := []struct {
+		query    *Query
+		field    string
+		expected map[string][]string
+	}{
+		{
+			query: OrderByDesc("Age"),
+			field: "Country",
+			expected: map[string][]string{
+				"US":         {"Alice", "Bob"},
+				"AR":         {"Carol", "Frank"},
+				"DE":         {"Dave"},
+				"null":       {"Gus"},
+				MissingGroup: {"Erin"},
+			},
+		},
+		{
+			query: Where("Age").Gt(20.0).OrderBy("Name").LimitTo(1),
+			field: "Plan",
+			expected: map[string][]string{
+				"pro":  {"Alice", "Carol"},
+				"free": {"Dave", "Erin"},
+			},
+		},
+	}
+	err = c.ReadTxn(func(txn *Txn) error {
+		for _, tc := range tests {
+			groups, err := txn.GroupBy(tc.query, tc.field)
+			checkErr(t, err)
+			grouped := make(map[string][]string, len(groups))
+			for key, group := range groups {
+				grouped[key] = stringFields(group, "Name")
+			}
+			if !reflect.DeepEqual(grouped, tc.expected) {
+				t.Fatalf("expected groups %v, got %v", tc.expected, grouped)
+			}
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestDistinctMulti(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithMembers(t)
+	defer clean()
+
+	// Tuples are rendered as "country/plan", with "-" for missing values.
+	render := func(tuples [][]Value) []string {
+		res := make([]string, len(tuples))
+		for i, tuple := range tuples {
+			parts := make([]string, len(tuple))
+			for j, v := range tuple {
+				parts[j] = "-"
+				if v.String != nil {
+					parts[j] = *v.String
+				}
+			}
+			res[i] = strings.Join(parts, "/")
+		}
+		sort.Strings(res)
+		return res
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		tuples, err := txn.DistinctMulti(&Query{}, "Country", "Plan")
+		checkErr(t, err)
+		if got, expected := render(tuples), []string{"-/free", "AR/-", "AR/pro", "DE/free", "US/free", "US/pro"}; !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected tuples %v, got %v", expected, got)
+		}
+		tuples, err = txn.DistinctMulti(Where("Age").Lt(30.0), "Plan")
+		checkErr(t, err)
+		if got, expected := render(tuples), []string{"-", "free"}; !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected tuples %v, got %v", expected, got)
+		}
+		tuples, err = txn.DistinctMulti(Where("Age").Gt(40.0), "Plan", "Age")
+		checkErr(t, err)
+		if len(tuples) != 2 || tuples[0][1].Float == nil {
+			t.Fatalf("expected 2 tuples with numeric ages, got %v", tuples)
+		}
+		if _, err := txn.DistinctMulti(&Query{}); err == nil {
+			t.Fatal("expected an error without fields")
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestFindOutliers(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithMembers(t)
+	defer clean()
+
+	// Ages have a mean of 31.5 and a standard deviation of about 18.4.
+	tests := []struct {
+		query    *Query
+		sigma    float64
+		expected []string
+	}{
+		{query: &Query{}, sigma: 1.5, expected: []string{"Erin"}},
+		{query: OrderBy("Age"), sigma: 1, expected: []string{"Frank", "Erin"}},
+		{query: OrderBy("Age").SkipNum(1), sigma: 1, expected: []string{"Erin"}},
+		{query: Where("Age").Lt(50.0), sigma: 1.5, expected: []string{"Carol"}},
+		{query: Where("Age").Gt(60.0), sigma: 0, expected: nil},
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		for i, tc := range tests {
+			res, err := txn.FindOutliers(tc.query, "Age", tc.sigma)
+			checkErr(t, err)
+			names := stringFields(res, "Name")
+			if !reflect.DeepEqual(names, tc.expected) {
+				t.Fatalf("%d: expected outliers %v, got %v", i, tc.expected, names)
+			}
+		}
+		if _, err := txn.FindOutliers(&Query{}, "Age", -1); err == nil {
+			t.Fatal("expected an error for a negative sigma")
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestAggregateStream(t *testing.T) {
+	t.Parallel()
+	c, data, clean := createCollectionWithMembers(t)
+	defer clean()
+
+	err := c.ReadTxn(func(txn *Txn) error {
+		var partials []float64
+		var counts []int
+		sum, err := txn.AggregateStream(context.Background(), nil, "Age", AggSum, 4, func(partial float64, scanned int) {
+			partials = append(partials, partial)
+			counts = append(counts, scanned)
+		})
+		checkErr(t, err)
+		if !reflect.DeepEqual(counts, []int{4, len(data)}) {
+			t.Fatalf("expected partials after 4 and %d instances, got: %v", len(data), counts)
+		}
+		if !sort.Float64sAreSorted(partials) {
+			t.Fatalf("expected monotonic partial sums, got: %v", partials)
+		}
+		_, batch, err := txn.FindWithAggregate(nil, "Age", AggSum)
+		checkErr(t, err)
+		if sum != batch || partials[len(partials)-1] != batch {
+			t.Fatalf("expected a final sum of %v, got: %v", batch, sum)
+		}
+
+		for _, op := range []AggOp{AggCount, AggAvg, AggMin, AggMax} {
+			q := Where("Age").Ge(float64(18))
+			got, err := txn.AggregateStream(context.Background(), q, "Age", op, 1, nil)
+			checkErr(t, err)
+			_, expected, err := txn.FindWithAggregate(q, "Age", op)
+			checkErr(t, err)
+			if got != expected {
+				t.Fatalf("op %d: expected %v, got: %v", op, expected, got)
+			}
+		}
+
+		if _, err := txn.AggregateStream(context.Background(), nil, "Age", AggSum, 0, nil); err == nil {
+			t.Fatal("expected an error for a non-positive interval")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := txn.AggregateStream(ctx, nil, "Age", AggSum, 1, nil); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected a canceled aggregate, got: %v", err)
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
@@ -2,14 +2,20 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sync/atomic"
 	"testing"
 
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dse "github.com/textileio/go-datastore-extensions"
 	"github.com/textileio/go-threads/common"
 	"github.com/textileio/go-threads/core/thread"
+	kt "github.com/textileio/go-threads/db/keytransform"
 	"github.com/textileio/go-threads/util"
 	"github.com/tidwall/sjson"
 )
@@ -58,6 +64,11 @@ func checkBenchErr(b *testing.B, err error) {
 }
 
 func createBenchDB(b *testing.B, opts ...NewOption) (*DB, func()) {
+	return createBenchDBWithStore(b, func(s kt.TxnDatastoreExtended) kt.TxnDatastoreExtended { return s }, opts...)
+}
+
+// createBenchDBWithStore is like createBenchDB, with the db datastore wrapped by wrap.
+func createBenchDBWithStore(b *testing.B, wrap func(kt.TxnDatastoreExtended) kt.TxnDatastoreExtended, opts ...NewOption) (*DB, func()) {
 	dir, err := ioutil.TempDir("", "")
 	checkBenchErr(b, err)
 	n, err := common.DefaultNetwork(
@@ -68,7 +79,7 @@ func createBenchDB(b *testing.B, opts ...NewOption) (*DB, func()) {
 	checkBenchErr(b, err)
 	store, err := util.NewBadgerDatastore(dir, "eventstore", false)
 	checkBenchErr(b, err)
-	d, err := NewDB(context.Background(), store, n, thread.NewIDV1(thread.Raw, 32), opts...)
+	d, err := NewDB(context.Background(), wrap(store), n, thread.NewIDV1(thread.Raw, 32), opts...)
 	checkBenchErr(b, err)
 	return d, func() {
 		if err := n.Close(); err != nil {
@@ -257,3 +268,377 @@ func BenchmarkIndexFind(b *testing.B) {
 		}
 	}
 }
+
+// readCounter counts the reads made by the transactions of the datastore
+// it wraps, each a round trip to a remote datastore.
+type readCounter struct {
+	kt.TxnDatastoreExtended
+	reads int64
+}
+
+func (c *readCounter) NewTransactionExtended(readOnly bool) (dse.TxnExt, error) {
+	txn, err := c.TxnDatastoreExtended.NewTransactionExtended(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &countingTxn{TxnExt: txn, counter: c}, nil
+}
+
+type countingTxn struct {
+	dse.TxnExt
+	counter *readCounter
+}
+
+func (t *countingTxn) Get(key ds.Key) ([]byte, error) {
+	atomic.AddInt64(&t.counter.reads, 1)
+	return t.TxnExt.Get(key)
+}
+
+func (t *countingTxn) QueryExtended(q dse.QueryExt) (query.Results, error) {
+	atomic.AddInt64(&t.counter.reads, 1)
+	return t.TxnExt.QueryExtended(q)
+}
+
+func BenchmarkIndexFindPrefetch(b *testing.B) {
+	counter := &readCounter{}
+	db, clean := createBenchDBWithStore(b, func(s kt.TxnDatastoreExtended) kt.TxnDatastoreExtended {
+		counter.TxnDatastoreExtended = s
+		return counter
+	})
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Dog",
+		Schema: util.SchemaFromSchemaString(testBenchSchema),
+		Indexes: []Index{{
+			Path:   "Name",
+			Unique: false,
+		}},
+	})
+	checkBenchErr(b, err)
+
+	for j := 0; j < 10; j++ {
+		for i := 0; i < nameSize; i++ {
+			var benchItem = []byte(`{"_id": "", "Name": "Name", "Age": 7}`)
+			newItem, err := sjson.SetBytes(benchItem, "Name", fmt.Sprintf("Name%d", j))
+			if err != nil {
+				b.Fatalf("Error modifying instance: %s", err)
+			}
+			_, err = collection.Create(newItem)
+			if err != nil {
+				b.Fatalf("Error creating instance: %s", err)
+			}
+		}
+	}
+
+	// Reads per op are the round trips a remote datastore would make.
+	for _, prefetch := range []int{1, iteratorDefaultPrefetch} {
+		prefetch := prefetch
+		b.Run(fmt.Sprintf("Prefetch%d", prefetch), func(b *testing.B) {
+			atomic.StoreInt64(&counter.reads, 0)
+			for i := 0; i < b.N; i++ {
+				q := Where("Name").Eq("Name0").UseIndex("Name").PrefetchNum(prefetch)
+				result, err := collection.Find(q)
+				if err != nil {
+					b.Fatalf("Error finding data: %s", err)
+				}
+				if len(result) != nameSize {
+					b.Fatalf("Unexpected length %d, should be %d", len(result), nameSize)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&counter.reads))/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func BenchmarkNoIndexFindIn(b *testing.B) {
+	db, clean := createBenchDB(b)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{Name: "Dog", Schema: util.SchemaFromSchemaString(testBenchSchema)})
+	checkBenchErr(b, err)
+
+	for j := 0; j < 10; j++ {
+		for i := 0; i < nameSize; i++ {
+			var benchItem = []byte(`{"_id": "", "Name": "Name", "Age": 7}`)
+			newItem, err := sjson.SetBytes(benchItem, "Name", fmt.Sprintf("Name%d", j))
+			if err != nil {
+				b.Fatalf("Error modifying instance: %s", err)
+			}
+			_, err = collection.Create(newItem)
+			if err != nil {
+				b.Fatalf("Error creating instance: %s", err)
+			}
+		}
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		result, err := collection.Find(Where("Name").In("Name0", "Name6"))
+		if err != nil {
+			b.Fatalf("Error finding data: %s", err)
+		}
+		if len(result) != 2*nameSize {
+			b.Fatalf("Unexpected length %d, should be %d", len(result), nameSize)
+		}
+	}
+}
+
+func BenchmarkIndexFindIn(b *testing.B) {
+	db, clean := createBenchDB(b)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Dog",
+		Schema: util.SchemaFromSchemaString(testBenchSchema),
+		Indexes: []Index{{
+			Path:   "Name",
+			Unique: false,
+		}},
+	})
+	checkBenchErr(b, err)
+
+	for j := 0; j < 10; j++ {
+		for i := 0; i < nameSize; i++ {
+			var benchItem = []byte(`{"_id": "", "Name": "Name", "Age": 7}`)
+			newItem, err := sjson.SetBytes(benchItem, "Name", fmt.Sprintf("Name%d", j))
+			if err != nil {
+				b.Fatalf("Error modifying instance: %s", err)
+			}
+			_, err = collection.Create(newItem)
+			if err != nil {
+				b.Fatalf("Error creating instance: %s", err)
+			}
+		}
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		result, err := collection.Find(Where("Name").In("Name0", "Name6").UseIndex("Name"))
+		if err != nil {
+			b.Fatalf("Error finding data: %s", err)
+		}
+		if len(result) != 2*nameSize {
+			b.Fatalf("Unexpected length %d, should be %d", len(result), nameSize)
+		}
+	}
+}
+
+func BenchmarkNoIndexFindStartsWith(b *testing.B) {
+	benchmarkFindStartsWith(b, false)
+}
+
+func BenchmarkIndexFindStartsWith(b *testing.B) {
+	benchmarkFindStartsWith(b, true)
+}
+
+func benchmarkFindStartsWith(b *testing.B, useIndex bool) {
+	db, clean := createBenchDB(b)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Dog",
+		Schema: util.SchemaFromSchemaString(testBenchSchema),
+		Indexes: []Index{{
+			Path:   "Name",
+			Unique: false,
+		}},
+	})
+	checkBenchErr(b, err)
+
+	for j := 0; j < 10; j++ {
+		for i := 0; i < nameSize; i++ {
+			var benchItem = []byte(`{"_id": "", "Name": "Name", "Age": 7}`)
+			newItem, err := sjson.SetBytes(benchItem, "Name", fmt.Sprintf("Name%d", j))
+			if err != nil {
+				b.Fatalf("Error modifying instance: %s", err)
+			}
+			_, err = collection.Create(newItem)
+			if err != nil {
+				b.Fatalf("Error creating instance: %s", err)
+			}
+		}
+	}
+
+	q := Where("Name").StartsWith("Name6")
+	if useIndex {
+		q = q.UseIndex("Name")
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		result, err := collection.Find(q)
+		if err != nil {
+			b.Fatalf("Error finding data: %s", err)
+		}
+		if len(result) != nameSize {
+			b.Fatalf("Unexpected length %d, should be %d", len(result), nameSize)
+		}
+	}
+}
+
+func BenchmarkFindMaps(b *testing.B) {
+	db, clean := createBenchDB(b)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{Name: "Dog", Schema: util.SchemaFromSchemaString(testBenchSchema)})
+	checkBenchErr(b, err)
+
+	for i := 0; i < nameSize; i++ {
+		var benchItem = []byte(`{"_id": "", "Name": "Name", "Age": 7}`)
+		newItem, err := sjson.SetBytes(benchItem, "Name", fmt.Sprintf("Name%d", i%10))
+		if err != nil {
+			b.Fatalf("Error modifying instance: %s", err)
+		}
+		_, err = collection.Create(newItem)
+		if err != nil {
+			b.Fatalf("Error creating instance: %s", err)
+		}
+	}
+	q := Where("Name").Eq("Name0")
+
+	b.Run("FindUnmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := collection.ReadTxn(func(txn *Txn) error {
+				result, err := txn.Find(q)
+				if err != nil {
+					return err
+				}
+				maps := make([]map[string]interface{}, len(result))
+				for j := range result {
+					if err := json.Unmarshal(result[j], &maps[j]); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatalf("Error finding data: %s", err)
+			}
+		}
+	})
+	b.Run("FindMaps", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := collection.ReadTxn(func(txn *Txn) error {
+				_, err := txn.FindMaps(q)
+				return err
+			})
+			if err != nil {
+				b.Fatalf("Error finding data: %s", err)
+			}
+		}
+	})
+}
+
+func BenchmarkTopK(b *testing.B) {
+	db, clean := createBenchDB(b)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{Name: "Dog", Schema: util.SchemaFromSchemaString(testBenchSchema)})
+	checkBenchErr(b, err)
+
+	for i := 0; i < 10*nameSize; i++ {
+		var benchItem = []byte(`{"_id": "", "Name": "Name", "Age": 7}`)
+		newItem, err := sjson.SetBytes(benchItem, "Age", rand.Intn(100))
+		if err != nil {
+			b.Fatalf("Error modifying instance: %s", err)
+		}
+		_, err = collection.Create(newItem)
+		if err != nil {
+			b.Fatalf("Error creating instance: %s", err)
+		}
+	}
+	const k = 10
+	score := func(v map[string]interface{}) float64 {
+		return v["Age"].(float64)
+	}
+
+	b.Run("TopK", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := collection.ReadTxn(func(txn *Txn) error {
+				result, err := txn.TopK(&Query{}, k, score)
+				if err != nil {
+					return err
+				}
+				if len(result) != k {
+					return fmt.Errorf("unexpected length %d, should be %d", len(result), k)
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatalf("Error finding data: %s", err)
+			}
+		}
+	})
+	b.Run("SortThenTruncate", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := collection.ReadTxn(func(txn *Txn) error {
+				result, err := txn.Find(OrderByDesc("Age"))
+				if err != nil {
+					return err
+				}
+				if len(result) < k {
+					return fmt.Errorf("unexpected length %d, should be at least %d", len(result), k)
+				}
+				_ = result[:k]
+				return nil
+			})
+			if err != nil {
+				b.Fatalf("Error finding data: %s", err)
+			}
+		}
+	})
+}
+
+func BenchmarkIndexFindLatest(b *testing.B) {
+	db, clean := createBenchDB(b)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:    "Dog",
+		Schema:  util.SchemaFromSchemaString(testBenchSchema),
+		Indexes: []Index{{Path: "Name"}},
+	})
+	checkBenchErr(b, err)
+
+	for i := 0; i < 10*nameSize; i++ {
+		var benchItem = []byte(`{"_id": "", "Name": "Name", "Age": 7}`)
+		newItem, err := sjson.SetBytes(benchItem, "Name", fmt.Sprintf("2021-03-01T%02d:%02d:%02dZ", i/3600, i/60%60, i%60))
+		if err != nil {
+			b.Fatalf("Error modifying instance: %s", err)
+		}
+		_, err = collection.Create(newItem)
+		if err != nil {
+			b.Fatalf("Error creating instance: %s", err)
+		}
+	}
+
+	// Sorting in memory reads and sorts all the instances, of which the
+	// latest 10 are kept.
+	run := func(b *testing.B, q *Query, n int) {
+		var scanned int
+		q.onScan = func() error {
+			scanned++
+			return nil
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			result, err := collection.Find(q)
+			if err != nil {
+				b.Fatalf("Error finding data: %s", err)
+			}
+			if len(result) != n {
+				b.Fatalf("Unexpected length %d, should be %d", len(result), n)
+			}
+			_ = result[:10]
+		}
+		b.ReportMetric(float64(scanned)/float64(b.N), "instances/op")
+	}
+	b.Run("ReverseIndex", func(b *testing.B) {
+		run(b, OrderByDesc("Name").UseIndex("Name").LimitTo(10), 10)
+	})
+	b.Run("SortInMemory", func(b *testing.B) {
+		run(b, OrderByDesc("Name"), 10*nameSize)
+	})
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// EqBigInt matches fields equal to the integer s, comparing them as
+// arbitrary-precision numbers rather than float64, so that large integer
+// IDs, such as 64-bit snowflake IDs, don't lose precision. Fields may hold
+// the number as a JSON number or as a string.
+func (c *Criterion) EqBigInt(s string) *Query {
+	c.BigInt = true
+	if n, ok := new(big.Int).SetString(s, 10); ok {
+		s = n.String()
+	}
+	return c.Eq(s)
+}
+
+// validateBigInt validates a criterion comparing big integers.
+func (c *Criterion) validateBigInt() error {
+	switch c.Operation {
+	case Eq, Ne, Gt, Lt, Ge, Le:
+	default:
+		return fmt.Errorf("%w: %s can't compare big integers", ErrInvalidOperation, c.Operation)
+	}
+	if c.Value.String == nil {
+		return fmt.Errorf("%w: big integer criteria require a string value", ErrInvalidOperation)
+	}
+	if _, ok := new(big.Int).SetString(*c.Value.String, 10); !ok {
+		return fmt.Errorf("%w: %q isn't an integer", ErrInvalidOperation, *c.Value.String)
+	}
+	return nil
+}
+
+// compareBigInt compares a field value holding a number, or a string
+// representation of one, against the integer critVal exactly. Numbers are
+// compared by raw, their representation in the encoded instance, when
+// it's known, rather than by their float64 value, which may be rounded.
+func compareBigInt(value interface{}, raw string, critVal Value) (int, error) {
+	crit, _ := new(big.Rat).SetString(*critVal.String)
+	var v *big.Rat
+	switch val := value.(type) {
+	case string:
+		v, _ = new(big.Rat).SetString(strings.TrimSpace(val))
+	case float64:
+		if raw != "" {
+			v, _ = new(big.Rat).SetString(raw)
+		} else if v = new(big.Rat); v.SetFloat64(val) == nil {
+			v = nil
+		}
+	}
+	if v == nil || crit == nil {
+		return 0, &ErrTypeMismatch{value, critVal}
+	}
+	return v.Cmp(crit), nil
+}
+
+// hasBigInts returns whether q or its Ors have big integer criteria.
+func (q *Query) hasBigInts() bool {
+	for _, c := range q.Ands {
+		if c.BigInt {
+			return true
+		}
+	}
+	for _, o := range q.Ors {
+		if o.hasBigInts() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDoc is like match, but big integer criteria compare the numbers of
+// v as they're represented in data, the encoded instance v was decoded
+// from. v itself isn't modified, so other criteria and the callers of
+// Find still see float64 numbers.
+func (q *Query) matchDoc(data []byte, v map[string]interface{}) (bool, error) {
+	if q.bigInts {
+		q.setDoc(data)
+		defer q.setDoc(nil)
+	}
+	return q.match(v)
+}
+
+// setDoc sets the encoded instance q and its Ors are being matched
+// against.
+func (q *Query) setDoc(data []byte) {
+	q.doc = data
+	for _, o := range q.Ors {
+		o.setDoc(data)
+	}
+}
+
+// rawNumber returns the representation of the number the criterion field
+// holds in the encoded instance being matched, or "" if it's unknown or
+// the field doesn't hold a number.
+func (c *Criterion) rawNumber() string {
+	if c.query == nil || c.query.doc == nil || isWildcardPath(c.FieldPath) {
+		return ""
+	}
+	res := gjson.GetBytes(c.query.doc, c.FieldPath)
+	if res.Type != gjson.Number {
+		return ""
+	}
+	return res.Raw
+}
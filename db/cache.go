@@ -0,0 +1,124 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// cacheMinSweep is the number of cache entries above which expired
+// entries are swept.
+const cacheMinSweep = 64
+
+// queryCache holds query results keyed by query signature and reader.
+// Expired entries are swept once the entries double since the last sweep,
+// so entries of queries which aren't run again don't pile up.
+type queryCache struct {
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+	sweepAt int
+}
+
+type cacheEntry struct {
+	results [][]byte
+	expires time.Time
+}
+
+func (c *queryCache) get(key string) ([][]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.results, true
+}
+
+func (c *queryCache) put(key string, results [][]byte, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	now := time.Now()
+	if len(c.entries) >= c.sweepAt {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.sweepAt = 2 * len(c.entries)
+		if c.sweepAt < cacheMinSweep {
+			c.sweepAt = cacheMinSweep
+		}
+	}
+	c.entries[key] = cacheEntry{results: results, expires: now.Add(ttl)}
+}
+
+func (c *queryCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = nil
+}
+
+// FindCached is like Find, but serves results from an in-process cache when
+// the same query was run by the same reader less than ttl ago.
+// Cached results may be stale: writes to the collection don't invalidate
+// the cache, so callers should pick a ttl they can tolerate, or call
+// ClearQueryCache after writing. Returned instances must not be modified.
+// Queries with subqueries or a normalizer, which the query signature
+// doesn't cover, are run uncached, and so are partial results returned
+// with ErrTextEvalTimeout.
+func (t *Txn) FindCached(q *Query, ttl time.Duration) ([][]byte, error) {
+	if err := t.collection.db.connector.Validate(t.token, true); err != nil {
+		return nil, err
+	}
+	if q.hasSubqueries() || (q != nil && q.Normalizer != nil) {
+		return t.Find(q)
+	}
+	pk, err := t.token.PubKey()
+	if err != nil {
+		return nil, err
+	}
+	key, err := q.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if q != nil && q.ignoreDefaultFilter {
+		key += "/all"
+	}
+	if pk != nil {
+		key += "/" + pk.String()
+	}
+	if res, ok := t.collection.cache.get(key); ok {
+		return append([][]byte(nil), res...), nil
+	}
+	res, err := t.Find(q)
+	if errors.Is(err, ErrTextEvalTimeout) {
+		return res, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.collection.cache.put(key, res, ttl)
+	return append([][]byte(nil), res...), nil
+}
+
+// FindCached executes a Query and returns the result, serving it from
+// an in-process cache if possible. See Txn.FindCached.
+func (c *Collection) FindCached(q *Query, ttl time.Duration, opts ...TxnOption) (instances [][]byte, err error) {
+	_ = c.ReadTxn(func(txn *Txn) error {
+		instances, err = txn.FindCached(q, ttl)
+		return err
+	}, opts...)
+	return
+}
+
+// ClearQueryCache drops all results cached by FindCached.
+func (c *Collection) ClearQueryCache() {
+	c.cache.clear()
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/textileio/go-threads/util"
+)
+
+func TestQueryHash(t *testing.T) {
+	t.Parallel()
+	hash := func(q *Query) string {
+		h, err := q.Hash()
+		checkErr(t, err)
+		return h
+	}
+	q1 := Where("Author").Eq("Author1").Or(Where("Title").Eq("Title5")).OrderBy("Title")
+	q2 := Where("Author").Eq("Author1").Or(Where("Title").Eq("Title5")).OrderBy("Title")
+	if hash(q1) != hash(q2) {
+		t.Fatal("equal queries should have the same hash")
+	}
+	q3 := Where("Author").Eq("Author1").Or(Where("Title").Eq("Title5")).OrderByDesc("Title")
+	if hash(q1) == hash(q3) {
+		t.Fatal("different queries should have different hashes")
+	}
+	var nilQuery *Query
+	if hash(nilQuery) != hash(&Query{}) {
+		t.Fatal("a nil query should hash like an empty query")
+	}
+	nan := Where("Rating").Eq(math.NaN())
+	if _, err := nan.Hash(); err == nil {
+		t.Fatal("a query which can't be serialized shouldn't hash")
+	}
+	if nan.Equal(nan) {
+		t.Fatal("a query which can't be hashed shouldn't be equal to any query")
+	}
+}
+
+func TestFindCached(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	q := Where("Author").Eq("Author1")
+	ttl := time.Second
+	res, err := c.FindCached(q, ttl)
+	checkErr(t, err)
+	if len(res) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res))
+	}
+
+	_, err = c.Create(util.JSONFromInstance(book{Title: "Title6", Author: "Author1"}))
+	checkErr(t, err)
+
+	// Cache hit, doesn't see the new instance.
+	res, err = c.FindCached(Where("Author").Eq("Author1"), ttl)
+	checkErr(t, err)
+	if len(res) != 3 {
+		t.Fatalf("expected 3 cached results, got %d", len(res))
+	}
+
+	// Cache miss for a different query.
+	res, err = c.FindCached(Where("Author").Eq("Author1").LimitTo(10), ttl)
+	checkErr(t, err)
+	if len(res) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(res))
+	}
+
+	// Entry expired.
+	time.Sleep(ttl)
+	res, err = c.FindCached(q, ttl)
+	checkErr(t, err)
+	if len(res) != 4 {
+		t.Fatalf("expected 4 results after expiry, got %d", len(res))
+	}
+
+	_, err = c.Create(util.JSONFromInstance(book{Title: "Title7", Author: "Author1"}))
+	checkErr(t, err)
+	c.ClearQueryCache()
+	res, err = c.FindCached(q, ttl)
+	checkErr(t, err)
+	if len(res) != 5 {
+		t.Fatalf("expected 5 results after clearing the cache, got %d", len(res))
+	}
+
+	// Normalizers aren't part of the signature, so their queries aren't
+	// cached.
+	upper := func(_ string, v interface{}) interface{} {
+		if s, ok := v.(string); ok {
+			return strings.ToUpper(s)
+		}
+		return v
+	}
+	res, err = c.FindCached(Where("Author").Eq("author1").WithValueNormalizer(upper), ttl)
+	checkErr(t, err)
+	if len(res) != 5 {
+		t.Fatalf("expected 5 normalized results, got %d", len(res))
+	}
+	res, err = c.FindCached(Where("Author").Eq("author1"), ttl)
+	checkErr(t, err)
+	if len(res) != 0 {
+		t.Fatalf("expected no results without the normalizer, got %d", len(res))
+	}
+	res, err = c.FindCached(Where("Author").Eq("author1").WithValueNormalizer(func(_ string, v interface{}) interface{} { return v }), ttl)
+	checkErr(t, err)
+	if len(res) != 0 {
+		t.Fatalf("expected no results with another normalizer, got %d", len(res))
+	}
+}
+
+func TestQueryCacheSweep(t *testing.T) {
+	t.Parallel()
+	var c queryCache
+	for i := 0; i < 1000; i++ {
+		c.put(fmt.Sprintf("expired%d", i), nil, 0)
+	}
+	if len(c.entries) > cacheMinSweep {
+		t.Fatalf("expected expired entries to be swept, got %d entries", len(c.entries))
+	}
+	for i := 0; i < 1000; i++ {
+		c.put(fmt.Sprintf("live%d", i), nil, time.Hour)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, ok := c.get(fmt.Sprintf("live%d", i)); !ok {
+			t.Fatalf("expected live entry %d to be kept", i)
+		}
+	}
+}
+
+func TestFindCachedTextTimeout(t *testing.T) {
+	t.Parallel()
+	const n = 50
+	notes := make([]note, n)
+	for i := range notes {
+		notes[i] = note{Seq: i, Body: "a"}
+	}
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Note"}, notes)
+	defer clean()
+
+	// Each instance takes a while to read, so the timeout lets the first
+	// few matches through, but not all of them.
+	q := Where("Body").StartsWith("a").WithTextTimeout(35 * time.Millisecond)
+	q.onScan = func() error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	res, err := c.FindCached(q, time.Hour)
+	if !errors.Is(err, ErrTextEvalTimeout) {
+		t.Fatalf("expected ErrTextEvalTimeout, got %v", err)
+	}
+	if len(res) == 0 || len(res) >= n {
+		t.Fatalf("expected partial results, got %d", len(res))
+	}
+
+	// Partial results aren't cached.
+	q.onScan = nil
+	res, err = c.FindCached(q, time.Hour)
+	checkErr(t, err)
+	if len(res) != n {
+		t.Fatalf("expected all %d results, got %d", n, len(res))
+	}
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// Canonicalize returns a copy of the query in a canonical form, so that
+// logically equivalent queries built differently have the same Hash. Ands
+// are sorted by field path and operation, duplicate criteria and Or
+// branches are removed, and nested Ors are flattened into their parent.
+// The canonical query matches the same instances as the original one.
+// Since criteria are evaluated in order, and a missing field fails the
+// query, it may however report a missing field which the original query
+// didn't evaluate. Canonicalizing a canonical query returns an equal one.
+func (q *Query) Canonicalize() *Query {
+	if q == nil {
+		return &Query{}
+	}
+	nq := q.Clone()
+	nq.canonicalize()
+	return nq
+}
+
+// Equal returns whether q and other have the same canonical form. Queries
+// which can't be hashed aren't equal to any query, see Hash.
+func (q *Query) Equal(other *Query) bool {
+	h, err := q.Canonicalize().Hash()
+	if err != nil {
+		return false
+	}
+	otherH, err := other.Canonicalize().Hash()
+	return err == nil && h == otherH
+}
+
+func (q *Query) canonicalize() {
+	keys := make([][]byte, len(q.Ands))
+	for i, c := range q.Ands {
+		keys[i] = c.canonicalKey()
+	}
+	sort.Stable(canonicalAnds{ands: q.Ands, keys: keys})
+	ands := q.Ands[:0]
+	for i, c := range q.Ands {
+		if i > 0 && c.dedupable() && q.Ands[i-1].dedupable() && bytes.Equal(keys[i], keys[i-1]) {
+			continue
+		}
+		ands = append(ands, c)
+	}
+	for i := len(ands); i < len(q.Ands); i++ {
+		q.Ands[i] = nil
+	}
+	q.Ands = ands
+
+	if len(q.Ors) == 0 {
+		return
+	}
+	// A branch with Ands and Ors of its own matches like its Ands and its
+	// Ors as separate branches. A branch without Ands matches everything,
+	// so it's kept whole.
+	var ors []*Query
+	seen := make(map[string]bool, len(q.Ors))
+	add := func(o *Query) {
+		h, err := o.Hash()
+		if err != nil {
+			// Branches which can't be hashed are kept, duplicated or not.
+			ors = append(ors, o)
+			return
+		}
+		if !seen[h] {
+			seen[h] = true
+			ors = append(ors, o)
+		}
+	}
+	for _, o := range q.Ors {
+		o.canonicalize()
+		if len(o.Ands) == 0 || len(o.Ors) == 0 {
+			add(o)
+			continue
+		}
+		nested := o.Ors
+		o.Ors = nil
+		add(o)
+		for _, n := range nested {
+			add(n)
+		}
+	}
+	q.Ors = ors
+}
+
+// canonicalKey returns the JSON representation of the criterion, which
+// orders criteria on the same field and operation.
+func (c *Criterion) canonicalKey() []byte {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// dedupable returns whether the criterion is fully described by its JSON
+// representation, so that it can be removed if it's duplicated.
+func (c *Criterion) dedupable() bool {
+	return c.ContextKey == nil && c.subquery == nil
+}
+
+type canonicalAnds struct {
+	ands []*Criterion
+	keys [][]byte
+}
+
+func (a canonicalAnds) Len() int { return len(a.ands) }
+func (a canonicalAnds) Less(i, j int) bool {
+	ci, cj := a.ands[i], a.ands[j]
+	if ci.FieldPath != cj.FieldPath {
+		return ci.FieldPath < cj.FieldPath
+	}
+	if ci.Operation != cj.Operation {
+		return ci.Operation < cj.Operation
+	}
+	return bytes.Compare(a.keys[i], a.keys[j]) < 0
+}
+func (a canonicalAnds) Swap(i, j int) {
+	a.ands[i], a.ands[j] = a.ands[j], a.ands[i]
+	a.keys[i], a.keys[j] = a.keys[j], a.keys[i]
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// ChecksumAlgo is an algorithm checksums are computed with.
+type ChecksumAlgo string
+
+const (
+	// ChecksumCRC32 is the IEEE CRC-32 checksum, in 8 hex digits.
+	ChecksumCRC32 ChecksumAlgo = "crc32"
+	// ChecksumSHA256 is the SHA-256 hash, in 64 hex digits.
+	ChecksumSHA256 ChecksumAlgo = "sha256"
+)
+
+// WhereChecksumMismatch starts a query matching instances whose stored
+// checksum, the hex string of checksumField, isn't the checksum of their
+// contentField computed with algo, e.g. to find instances changed without
+// updating their checksum. String contents are checksummed as is, and other
+// values by their JSON representation. Instances missing either field, or
+// whose checksum isn't a string, can't be verified, so they match too.
+// Checksums are compared ignoring case. The checksum is computed for each
+// instance scanned, so the criterion never uses an index.
+func WhereChecksumMismatch(contentField, checksumField string, algo ChecksumAlgo) *Query {
+	c := &Criterion{FieldPath: contentField, ChecksumField: checksumField, ChecksumAlgo: algo}
+	return c.createcriterion(Ne, nil)
+}
+
+// validateChecksum validates a criterion comparing checksums.
+func (c *Criterion) validateChecksum() error {
+	if c.Operation != Ne {
+		return fmt.Errorf("%w: %s can't compare checksums", ErrInvalidOperation, c.Operation)
+	}
+	switch c.ChecksumAlgo {
+	case ChecksumCRC32, ChecksumSHA256:
+	default:
+		return fmt.Errorf("%w: unknown checksum algorithm %q", ErrInvalidOperation, c.ChecksumAlgo)
+	}
+	if isWildcardPath(c.FieldPath) || isWildcardPath(c.ChecksumField) {
+		return fmt.Errorf("%w: checksum criteria don't support wildcard paths", ErrInvalidOperation)
+	}
+	return nil
+}
+
+// matchChecksum matches v if its checksum field doesn't hold the checksum
+// of its content field.
+func (c *Criterion) matchChecksum(v map[string]interface{}) (bool, error) {
+	consistent, err := c.checksumConsistent(v)
+	if err != nil {
+		return false, err
+	}
+	return consistent == c.Negated, nil
+}
+
+func (c *Criterion) checksumConsistent(v map[string]interface{}) (bool, error) {
+	content, err := c.traverse(v, c.FieldPath)
+	if err != nil || !content.IsValid() {
+		return false, nil
+	}
+	stored, err := c.traverse(v, c.ChecksumField)
+	if err != nil || !stored.IsValid() {
+		return false, nil
+	}
+	sum, ok := stored.Interface().(string)
+	if !ok {
+		return false, nil
+	}
+	var data []byte
+	if s, ok := content.Interface().(string); ok {
+		data = []byte(s)
+	} else if data, err = json.Marshal(content.Interface()); err != nil {
+		return false, err
+	}
+	return strings.EqualFold(sum, c.ChecksumAlgo.sum(data)), nil
+}
+
+// sum returns the hex checksum of data.
+func (a ChecksumAlgo) sum(data []byte) string {
+	switch a {
+	case ChecksumCRC32:
+		return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+	default:
+		h := sha256.Sum256(data)
+		return hex.EncodeToString(h[:])
+	}
+}
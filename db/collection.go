@@ -64,6 +64,8 @@ type Collection struct {
 	writeValidator    goja.Callable
 	rawReadFilter     []byte
 	readFilter        goja.Callable
+	cache             queryCache
+	defaultFilter     *Query
 	sync.Mutex
 }
 
@@ -172,6 +174,17 @@ func (c *Collection) FindByID(id core.InstanceID, opts ...TxnOption) (instance [
 	return
 }
 
+// FindByIDsOrdered finds the instances with the given IDs, in the order
+// of ids, which are InstanceIDs rather than strings. See
+// Txn.FindByIDsOrdered.
+func (c *Collection) FindByIDsOrdered(ids []core.InstanceID, opts ...TxnOption) (instances [][]byte, err error) {
+	err = c.ReadTxn(func(txn *Txn) error {
+		instances, err = txn.FindByIDsOrdered(ids)
+		return err
+	}, opts...)
+	return
+}
+
 // Create creates an instance in the collection.
 func (c *Collection) Create(v []byte, opts ...TxnOption) (id core.InstanceID, err error) {
 	err = c.WriteTxn(func(txn *Txn) error {
@@ -633,6 +646,28 @@ func (t *Txn) FindByID(id core.InstanceID) ([]byte, error) {
 	return bytes, err
 }
 
+// FindByIDsOrdered gets the instances with the given IDs in the current txn
+// scope, e.g. to hydrate ids ranked elsewhere. Each instance is fetched by
+// key, and results are in the order of ids, so that the instance of ids[i]
+// is at index i. Missing instances, and those the read filter denies, are
+// nil placeholders, which callers can skip to omit them. The ids are
+// InstanceIDs, like those of FindByID and the other lookups, rather than
+// plain strings; ids held as strings convert with core.InstanceID(id).
+func (t *Txn) FindByIDsOrdered(ids []core.InstanceID) ([][]byte, error) {
+	res := make([][]byte, len(ids))
+	for i, id := range ids {
+		bytes, err := t.FindByID(id)
+		if errors.Is(err, ErrInstanceNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[i] = bytes
+	}
+	return res, nil
+}
+
 // Commit applies all changes done in the current transaction
 // to the collection. This is a syncrhonous call so changes can
 // be assumed to be applied on function return.
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"reflect"
 	"testing"
@@ -850,6 +851,45 @@ func TestGetInstance(t *testing.T) {
 	})
 }
 
+func TestFindByIDsOrdered(t *testing.T) {
+	t.Parallel()
+
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+
+	var people [][]byte
+	for i := 0; i < 5; i++ {
+		people = append(people, util.JSONFromInstance(Person{Name: fmt.Sprintf("Person%d", i), Age: i}))
+	}
+	ids, err := c.CreateMany(people)
+	checkErr(t, err)
+
+	ordered := []core.InstanceID{ids[3], ids[0], "missing", ids[4], ids[1]}
+	found, err := c.FindByIDsOrdered(ordered)
+	checkErr(t, err)
+	if len(found) != len(ordered) {
+		t.Fatalf("expected %d results, got %d", len(ordered), len(found))
+	}
+	for i, id := range ordered {
+		if id == "missing" {
+			if found[i] != nil {
+				t.Fatalf("expected a nil placeholder at %d, got %s", i, found[i])
+			}
+			continue
+		}
+		p := &Person{}
+		util.InstanceFromJSON(found[i], p)
+		if p.ID != id {
+			t.Fatalf("expected instance %s at %d, got %s", id, i, p.ID)
+		}
+	}
+}
+
 func TestModifiedSince(t *testing.T) {
 	t.Parallel()
 	t.Run("WithSingleCreate", func(t *testing.T) {
@@ -0,0 +1,311 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DetectContradictions returns descriptions of the criteria of q which
+// can't all hold for any instance, e.g. Where("x").Gt(10).And("x").Lt(5),
+// so that users building filters can be warned about them. It's advisory:
+// queries with contradictions are still valid, and match nothing.
+//
+// Only the Ands of q are analyzed, looking for conflicting ranges, Eq and
+// Ne of the same value, and In sets without a value in common, among the
+// Eq, Ne, Gt, Ge, Lt, Le, In and Between criteria on each field. Criteria
+// with other options, such as Fold, AnyValue or parameters, are left out,
+// as are queries with Ors, which may match what the Ands can't, and ones
+// with a normalizer or number or bool coercion, which change what values
+// are equal, so that none are reported wrongly. Criteria on nested paths
+// are left out too, since a path may cross arrays, and its criteria then
+// hold if any element matches: Where("a.b").Eq(1).And("a.b").Eq(2) matches
+// an instance where a is [{"b": 1}, {"b": 2}].
+func (q *Query) DetectContradictions() []string {
+	if q == nil || len(q.Ors) > 0 || q.Normalizer != nil || q.CoerceNumbers || q.CoerceBools {
+		return nil
+	}
+	nq := q.Clone()
+	nq.resolveAliases(nil)
+	var fields []string
+	byField := make(map[string][]*Criterion)
+	for _, c := range nq.Ands {
+		if !c.analyzable() || nq.FieldOrders[c.FieldPath] != nil {
+			continue
+		}
+		if _, ok := byField[c.FieldPath]; !ok {
+			fields = append(fields, c.FieldPath)
+		}
+		byField[c.FieldPath] = append(byField[c.FieldPath], c)
+	}
+	var res []string
+	for _, field := range fields {
+		res = append(res, detectFieldContradictions(field, byField[field])...)
+	}
+	return res
+}
+
+// analyzable returns whether the criterion compares its field against
+// constant values in a way DetectContradictions understands.
+func (c *Criterion) analyzable() bool {
+	switch c.Operation {
+	case Eq, Ne, Gt, Ge, Lt, Le, In, Between:
+	default:
+		return false
+	}
+	if c.Negated {
+		switch c.Operation {
+		case Eq, Ne, In:
+		default:
+			return false
+		}
+	}
+	if c.MatchAnyValue || c.BigInt || c.Folded || c.NullSafe || c.OtherField != "" || c.HighField != "" ||
+		c.ChecksumField != "" || len(c.PresentFields) > 0 || c.ContextKey != nil || c.subquery != nil ||
+		isWildcardPath(c.FieldPath) || isNestedPath(c.FieldPath) {
+		return false
+	}
+	values := c.Values
+	if c.Operation == Between && len(values) != 2 {
+		return false
+	}
+	if c.Operation != In && c.Operation != Between {
+		values = []Value{c.Value}
+	}
+	for _, v := range values {
+		if v.Param != nil || v.value() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isNestedPath returns whether fieldPath has more than one field, so it
+// may cross arrays.
+func isNestedPath(fieldPath string) bool {
+	fields, _, err := parseFieldPath(fieldPath)
+	return err != nil || len(fields) > 1
+}
+
+// bound is a lower or upper bound of a field's range, set by a criterion.
+type bound struct {
+	value     interface{}
+	inclusive bool
+	c         *Criterion
+}
+
+// detectFieldContradictions returns descriptions of the contradictions
+// among the analyzable criteria crits, all on field.
+func detectFieldContradictions(field string, crits []*Criterion) []string {
+	var (
+		allowed   []interface{}
+		allowedBy []*Criterion
+		excluded  []interface{}
+		excludeBy []*Criterion
+		lo, hi    *bound
+		res       []string
+	)
+	restrict := func(c *Criterion, values []interface{}) {
+		if allowedBy != nil {
+			var common []interface{}
+			for _, v := range values {
+				if containsValue(allowed, v) {
+					common = append(common, v)
+				}
+			}
+			values = common
+		}
+		allowed, allowedBy = values, append(allowedBy, c)
+	}
+	exclude := func(c *Criterion, values []interface{}) {
+		for _, v := range values {
+			excluded, excludeBy = append(excluded, v), append(excludeBy, c)
+		}
+	}
+	tighten := func(b **bound, nb bound, lower bool) {
+		if *b == nil {
+			*b = &nb
+			return
+		}
+		cmp, ok := compareConstants(nb.value, (*b).value)
+		if !ok {
+			return
+		}
+		if !lower {
+			cmp = -cmp
+		}
+		if cmp > 0 || (cmp == 0 && !nb.inclusive) {
+			*b = &nb
+		}
+	}
+	for _, c := range crits {
+		v := c.Value.value()
+		switch {
+		case c.Operation == Eq && !c.Negated, c.Operation == Ne && c.Negated:
+			restrict(c, []interface{}{v})
+		case c.Operation == Ne, c.Operation == Eq:
+			exclude(c, []interface{}{v})
+		case c.Operation == In:
+			values := make([]interface{}, len(c.Values))
+			for i, v := range c.Values {
+				values[i] = v.value()
+			}
+			if c.Negated {
+				exclude(c, values)
+			} else {
+				restrict(c, values)
+			}
+		case c.Operation == Gt, c.Operation == Ge:
+			tighten(&lo, bound{value: v, inclusive: c.Operation == Ge, c: c}, true)
+		case c.Operation == Lt, c.Operation == Le:
+			tighten(&hi, bound{value: v, inclusive: c.Operation == Le, c: c}, false)
+		case c.Operation == Between:
+			tighten(&lo, bound{value: c.Values[0].value(), inclusive: true, c: c}, true)
+			tighten(&hi, bound{value: c.Values[1].value(), inclusive: true, c: c}, false)
+		}
+	}
+
+	if allowedBy != nil && len(allowed) == 0 {
+		return append(res, describeContradiction(field, allowedBy))
+	}
+	if lo != nil && hi != nil {
+		if cmp, ok := compareConstants(lo.value, hi.value); ok && (cmp > 0 || (cmp == 0 && !(lo.inclusive && hi.inclusive))) {
+			res = append(res, describeContradiction(field, []*Criterion{lo.c, hi.c}))
+		} else if ok && cmp == 0 && allowedBy == nil {
+			// The range holds a single value, which may be excluded.
+			allowed, allowedBy = []interface{}{lo.value}, []*Criterion{lo.c, hi.c}
+		}
+	}
+	if allowedBy == nil || len(res) > 0 {
+		return res
+	}
+	// Each allowed value has to be within range and not excluded.
+	by := append([]*Criterion(nil), allowedBy...)
+	for _, v := range allowed {
+		var rejectedBy *Criterion
+		if lo != nil {
+			if cmp, ok := compareConstants(v, lo.value); ok && (cmp < 0 || (cmp == 0 && !lo.inclusive)) {
+				rejectedBy = lo.c
+			}
+		}
+		if hi != nil && rejectedBy == nil {
+			if cmp, ok := compareConstants(v, hi.value); ok && (cmp > 0 || (cmp == 0 && !hi.inclusive)) {
+				rejectedBy = hi.c
+			}
+		}
+		for i, e := range excluded {
+			if rejectedBy == nil && equalConstants(v, e) {
+				rejectedBy = excludeBy[i]
+			}
+		}
+		if rejectedBy == nil {
+			return res
+		}
+		by = appendCriterion(by, rejectedBy)
+	}
+	return append(res, describeContradiction(field, by))
+}
+
+// compareConstants compares two values of criteria, if they're both
+// numbers or both strings.
+func compareConstants(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		switch {
+		case !ok:
+			return 0, false
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
+
+// equalConstants returns whether two values of criteria are equal.
+func equalConstants(a, b interface{}) bool {
+	if cmp, ok := compareConstants(a, b); ok {
+		return cmp == 0
+	}
+	ba, okA := a.(bool)
+	bb, okB := b.(bool)
+	return okA && okB && ba == bb
+}
+
+func containsValue(values []interface{}, v interface{}) bool {
+	for _, o := range values {
+		if equalConstants(o, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendCriterion appends c to crits unless it's already there.
+func appendCriterion(crits []*Criterion, c *Criterion) []*Criterion {
+	for _, o := range crits {
+		if o == c {
+			return crits
+		}
+	}
+	return append(crits, c)
+}
+
+// describeContradiction describes the criteria crits on field which
+// can't all hold, e.g. `x: gt 10 and lt 5 can't both hold`.
+func describeContradiction(field string, crits []*Criterion) string {
+	var unique []*Criterion
+	for _, c := range crits {
+		unique = appendCriterion(unique, c)
+	}
+	descs := make([]string, len(unique))
+	for i, c := range unique {
+		descs[i] = c.describe()
+	}
+	switch len(unique) {
+	case 1:
+		return fmt.Sprintf("%s: %s can't hold", field, descs[0])
+	case 2:
+		return fmt.Sprintf("%s: %s can't both hold", field, strings.Join(descs, " and "))
+	default:
+		return fmt.Sprintf("%s: %s can't all hold", field, strings.Join(descs, " and "))
+	}
+}
+
+// describe returns the operation and values of the criterion, e.g.
+// `in ["a" "b"]`.
+func (c *Criterion) describe() string {
+	var desc string
+	switch c.Operation {
+	case In:
+		values := make([]string, len(c.Values))
+		for i, v := range c.Values {
+			values[i] = formatConstant(v.value())
+		}
+		desc = fmt.Sprintf("in [%s]", strings.Join(values, " "))
+	case Between:
+		desc = fmt.Sprintf("between %s and %s", formatConstant(c.Values[0].value()), formatConstant(c.Values[1].value()))
+	default:
+		desc = fmt.Sprintf("%s %s", c.Operation, formatConstant(c.Value.value()))
+	}
+	if c.Negated {
+		desc = "not " + desc
+	}
+	return desc
+}
+
+func formatConstant(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(v)
+}
@@ -34,23 +34,40 @@ type operation int
 
 const (
 	eq operation = iota
-	ne           // !=
-	gt           // >
-	lt           // <
-	ge           // >=
-	le           // <=
-	fn           // func
+	ne              // !=
+	gt              // >
+	lt              // <
+	ge              // >=
+	le              // <=
+	fn              // func
+	eqWithin        // ==, within a relative tolerance
+	containsFold    // substring, ignoring case
+	in              // any of
+	between         // >= low && <= high
+	inCurrentPeriod // within a calendar period
+	matches         // regular expression
+	inRanges        // >= low && <= high, for any of several ranges
+	startsWith      // string prefix
+	mod             // % divisor == remainder
 )
 
-type errTypeMismatch struct {
+// ErrTypeMismatch indicates a value can't be compared with a value of another type.
+type ErrTypeMismatch struct {
 	Value interface{}
 	Other interface{}
 }
 
-func (e *errTypeMismatch) Error() string {
+func (e *ErrTypeMismatch) Error() string {
 	return fmt.Sprintf("%v (%T) cannot be compared with %v (%T)", e.Value, e.Value, e.Other, e.Other)
 }
 
+// Is reports whether target is an *ErrTypeMismatch, so that
+// errors.Is(err, &ErrTypeMismatch{}) matches any type mismatch.
+func (e *ErrTypeMismatch) Is(target error) bool {
+	_, ok := target.(*ErrTypeMismatch)
+	return ok
+}
+
 //Comparer compares a type against the encoded value in the db. The result should be 0 if current==other,
 // -1 if current < other, and +1 if current > other.
 // If a field in a struct doesn't specify a comparer, then the default comparison is used (convert to string and compare)
@@ -69,7 +86,7 @@ func compare(value, other interface{}) (int, error) {
 	case time.Time:
 		tother, ok := other.(time.Time)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(time.Time).Equal(tother) {
@@ -83,7 +100,7 @@ func compare(value, other interface{}) (int, error) {
 	case big.Float:
 		o, ok := other.(big.Float)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		v := value.(big.Float)
@@ -92,7 +109,7 @@ func compare(value, other interface{}) (int, error) {
 	case big.Int:
 		o, ok := other.(big.Int)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		v := value.(big.Int)
@@ -101,7 +118,7 @@ func compare(value, other interface{}) (int, error) {
 	case big.Rat:
 		o, ok := other.(big.Rat)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		v := value.(big.Rat)
@@ -110,7 +127,7 @@ func compare(value, other interface{}) (int, error) {
 	case int:
 		tother, ok := other.(int)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(int) == tother {
@@ -124,7 +141,7 @@ func compare(value, other interface{}) (int, error) {
 	case int8:
 		tother, ok := other.(int8)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(int8) == tother {
@@ -139,7 +156,7 @@ func compare(value, other interface{}) (int, error) {
 	case int16:
 		tother, ok := other.(int16)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(int16) == tother {
@@ -153,7 +170,7 @@ func compare(value, other interface{}) (int, error) {
 	case int32:
 		tother, ok := other.(int32)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(int32) == tother {
@@ -168,7 +185,7 @@ func compare(value, other interface{}) (int, error) {
 	case int64:
 		tother, ok := other.(int64)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(int64) == tother {
@@ -182,7 +199,7 @@ func compare(value, other interface{}) (int, error) {
 	case uint:
 		tother, ok := other.(uint)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(uint) == tother {
@@ -196,7 +213,7 @@ func compare(value, other interface{}) (int, error) {
 	case uint8:
 		tother, ok := other.(uint8)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(uint8) == tother {
@@ -211,7 +228,7 @@ func compare(value, other interface{}) (int, error) {
 	case uint16:
 		tother, ok := other.(uint16)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(uint16) == tother {
@@ -225,7 +242,7 @@ func compare(value, other interface{}) (int, error) {
 	case uint32:
 		tother, ok := other.(uint32)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(uint32) == tother {
@@ -240,7 +257,7 @@ func compare(value, other interface{}) (int, error) {
 	case uint64:
 		tother, ok := other.(uint64)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(uint64) == tother {
@@ -254,7 +271,7 @@ func compare(value, other interface{}) (int, error) {
 	case float32:
 		tother, ok := other.(float32)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(float32) == tother {
@@ -268,7 +285,7 @@ func compare(value, other interface{}) (int, error) {
 	case float64:
 		tother, ok := other.(float64)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(float64) == tother {
@@ -282,7 +299,7 @@ func compare(value, other interface{}) (int, error) {
 	case string:
 		tother, ok := other.(string)
 		if !ok {
-			return 0, &errTypeMismatch{t, other}
+			return 0, &ErrTypeMismatch{t, other}
 		}
 
 		if value.(string) == tother {
@@ -89,6 +89,16 @@ type DB struct {
 
 	localEventsBus      *app.LocalEventsBus
 	stateChangedNotifee *stateChangedNotifee
+
+	patternLimits      PatternLimits
+	maxPathDepth       int
+	maxQueryCriteria   int
+	maxSubqueryResults int
+	countProgressEvery int
+
+	// now returns the current time, which queries resolve current
+	// periods against.
+	now func() time.Time
 }
 
 // NewDB creates a new DB, which will *own* ds and dispatcher for internal use.
@@ -195,6 +205,12 @@ func newDB(s kt.TxnDatastoreExtended, n app.Net, id thread.ID, opts *NewOptions)
 		collections:         make(map[string]*Collection),
 		localEventsBus:      app.NewLocalEventsBus(),
 		stateChangedNotifee: &stateChangedNotifee{},
+		patternLimits:       opts.PatternLimits,
+		maxPathDepth:        opts.MaxPathDepth,
+		maxQueryCriteria:    opts.MaxQueryCriteria,
+		maxSubqueryResults:  opts.MaxSubqueryResults,
+		countProgressEvery:  opts.CountProgressEvery,
+		now:                 time.Now,
 	}
 	if err := d.loadName(); err != nil {
 		return nil, err
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"fmt"
+)
+
+// SetDefaultFilter sets a query ANDed into every query run on the
+// collection, such as by Find, ForEach or CountDistinct, e.g. to exclude
+// soft-deleted instances or to scope instances to a tenant. Only its
+// criteria and Ors apply, and queries calling IgnoreDefaultFilter bypass
+// it. A missing field fails the default filter as it fails any criterion,
+// so it should refer to fields all instances have. A nil q removes it.
+// Cached query results are cleared.
+func (c *Collection) SetDefaultFilter(q *Query) error {
+	if q != nil {
+		if err := q.Validate(); err != nil {
+			return fmt.Errorf("invalid query: %w", err)
+		}
+		q = q.Clone()
+	}
+	c.Lock()
+	c.defaultFilter = q
+	c.Unlock()
+	c.cache.clear()
+	return nil
+}
+
+// getDefaultFilter returns the default filter of the collection, if any.
+func (c *Collection) getDefaultFilter() *Query {
+	c.Lock()
+	defer c.Unlock()
+	return c.defaultFilter
+}
+
+// IgnoreDefaultFilter makes the query bypass the default filter of the
+// collection it's run on, e.g. for admin queries reaching soft-deleted
+// instances. It isn't serialized, so clients decoding queries can't set it.
+func (q *Query) IgnoreDefaultFilter() *Query {
+	q.ignoreDefaultFilter = true
+	return q
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// ResultETag returns a digest of the instances matching q, e.g. to serve
+// as an HTTP ETag clients revalidate cached results with. It doesn't
+// return the instances themselves. The digest folds the key and content
+// of every match, independently of the order they're scanned in, so it
+// changes when a match is created, deleted or updated, and stays the same
+// otherwise. Sort, Skip, Limit and projections are ignored, as the digest
+// covers every match rather than a page of them: changes to matches out
+// of the page change it too, which at worst makes clients refetch.
+// The digest is a hex string, to be quoted as an HTTP entity tag.
+func (t *Txn) ResultETag(q *Query) (string, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return "", err
+	}
+	var acc [sha256.Size]byte
+	var count uint64
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		count++
+		h := sha256.New()
+		_, _ = h.Write([]byte(res.Key))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write(res.Value)
+		for i, b := range h.Sum(nil) {
+			acc[i] ^= b
+		}
+		return true, nil
+	}); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, _ = h.Write(acc[:])
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], count)
+	_, _ = h.Write(n[:])
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
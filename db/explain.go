@@ -0,0 +1,155 @@
+package db
+
+import (
+	"fmt"
+)
+
+// CriterionResult is the outcome of matching a criterion against an
+// instance, as reported by Explain.
+type CriterionResult struct {
+	// FieldPath is the field path of the criterion, with aliases resolved.
+	FieldPath string
+	// Operation is the operation of the criterion.
+	Operation Operation
+	// Branch is the path of indexes into Ors leading to the query the
+	// criterion belongs to. It's empty for criteria of the top query.
+	Branch []int
+	// Value is the field value encountered, nil if the field is missing.
+	// For wildcard paths, it's a slice of the values the path expands to.
+	Value interface{}
+	// Matched is whether the criterion matched, negation included.
+	Matched bool
+	// Err is the error matching the criterion, e.g. a missing field.
+	Err error
+	// Taken is whether the criterion is part of the branch that made the
+	// instance match.
+	Taken bool
+}
+
+// Explain matches the query against the decoded instance v, like Find
+// does, and reports whether it matched along with the result of every
+// criterion, Ors included. All criteria are evaluated, even the ones Find
+// would skip after an earlier criterion decided the match. The returned
+// error is the one Find would return for the instance.
+func (q *Query) Explain(v map[string]interface{}) (bool, []CriterionResult, error) {
+	if err := q.Validate(); err != nil {
+		return false, nil, fmt.Errorf("invalid query: %w", err)
+	}
+	pq := q.prepare()
+	if err := pq.compilePatterns(DefaultPatternLimits); err != nil {
+		return false, nil, err
+	}
+	var results []CriterionResult
+	ok, taken, err := pq.explain(v, nil, &results)
+	for _, i := range taken {
+		results[i].Taken = true
+	}
+	return ok, results, err
+}
+
+// MatchScore returns how many of the branches of the query the decoded
+// instance v satisfies, the criteria of the query itself being a branch,
+// if it has any, and each of its Ors another, e.g. to rank instances by
+// how many facets they match. Unlike matching, it doesn't stop at the
+// first satisfied branch, so all branches are evaluated. Errors matching
+// a branch, e.g. a missing field, are returned as Find would.
+func (q *Query) MatchScore(v map[string]interface{}) (int, error) {
+	if err := q.Validate(); err != nil {
+		return 0, fmt.Errorf("invalid query: %w", err)
+	}
+	pq := q.prepare()
+	if err := pq.compilePatterns(DefaultPatternLimits); err != nil {
+		return 0, err
+	}
+	var score int
+	if len(pq.Ands) > 0 {
+		ok, err := (&Query{Ands: pq.Ands}).match(v)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			score++
+		}
+	}
+	for _, o := range pq.Ors {
+		ok, err := o.match(v)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			score++
+		}
+	}
+	return score, nil
+}
+
+// explain appends the results of the criteria of q and its Ors to results,
+// and returns whether q matched, along with the indexes in results of the
+// criteria of the branch that made it match.
+func (q *Query) explain(v map[string]interface{}, branch []int, results *[]CriterionResult) (bool, []int, error) {
+	var matchErr error
+	var taken []int
+	andOk := true
+	for _, c := range q.Ands {
+		res := c.explain(v, branch)
+		*results = append(*results, res)
+		if !andOk || matchErr != nil {
+			continue
+		}
+		if res.Err != nil {
+			matchErr = res.Err
+			continue
+		}
+		andOk = res.Matched
+		taken = append(taken, len(*results)-1)
+	}
+	matched := andOk && matchErr == nil
+	if !matched {
+		taken = nil
+	}
+
+	for i, o := range q.Ors {
+		orBranch := append(append([]int{}, branch...), i)
+		ok, orTaken, err := o.explain(v, orBranch, results)
+		if matched || matchErr != nil {
+			continue
+		}
+		if err != nil {
+			matchErr = err
+			continue
+		}
+		if ok {
+			matched = true
+			taken = orTaken
+		}
+	}
+
+	if matchErr != nil {
+		return false, nil, matchErr
+	}
+	return matched, taken, nil
+}
+
+// explain matches the criterion against v, recording the field value.
+func (c *Criterion) explain(v map[string]interface{}, branch []int) CriterionResult {
+	res := CriterionResult{
+		FieldPath: c.FieldPath,
+		Operation: c.Operation,
+		Branch:    branch,
+	}
+	if isWildcardPath(c.FieldPath) {
+		if fields, err := traverseWildcardPathMap(v, c.FieldPath, c.maxPathDepth()); err == nil {
+			values := make([]interface{}, 0, len(fields))
+			for _, field := range fields {
+				if field.IsValid() {
+					values = append(values, field.Interface())
+				}
+			}
+			res.Value = values
+		}
+	} else if field, err := c.traverse(v, c.FieldPath); err == nil && field.IsValid() {
+		res.Value = field.Interface()
+	}
+	res.Matched, res.Err = c.matchField(v)
+	return res
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrAmbiguousField is returned by queries matching field paths
+// case-insensitively when an instance has several keys equal to a path
+// segment but for case, and none equal to it exactly.
+var ErrAmbiguousField = errors.New("ambiguous field")
+
+// WithCaseInsensitiveFields makes criteria look up the keys of their field
+// paths case-insensitively when an instance has no key equal to a path
+// segment, for instances whose field casing is inconsistent, e.g. Where(
+// "Email") then matches instances with an "email" field. An instance with
+// several such keys, e.g. both "email" and "EMAIL", fails the query with
+// ErrAmbiguousField rather than arbitrarily matching one of them. Sorts and
+// projections still use exact keys.
+func (q *Query) WithCaseInsensitiveFields() *Query {
+	q.CaseInsensitiveFields = true
+	return q
+}
+
+// traverse returns the value of fieldPath in v, looking up keys as set by
+// the options of the criterion.
+func (c *Criterion) traverse(v map[string]interface{}, fieldPath string) (reflect.Value, error) {
+	return traverseFieldPath(v, fieldPath, c.maxPathDepth(), c.options().CaseInsensitiveFields)
+}
+
+// lookupFold returns the value of the key of m equal to key under case
+// folding, if there's exactly one.
+func lookupFold(m map[string]interface{}, key, fieldPath string) (interface{}, bool, error) {
+	var found interface{}
+	var n int
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			found = v
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, false, fmt.Errorf("%w: %d keys of %s match %s", ErrAmbiguousField, n, fieldPath, key)
+	}
+	return found, n == 1, nil
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// GtFieldPlus is a greater operator against another field of the same
+// instance plus a constant offset, e.g. Where("End").GtFieldPlus("Start",
+// 3600) matches instances ending more than an hour after they start. Both
+// fields must be numbers, or times, which are RFC 3339 strings or Unix
+// timestamps in seconds, and offset is then in seconds. Matching fields of
+// other or different types returns an ErrTypeMismatch naming both fields.
+func (c *Criterion) GtFieldPlus(otherField string, offset float64) *Query {
+	c.OtherField = otherField
+	c.Offset = offset
+	return c.createcriterion(Gt, nil)
+}
+
+// BetweenFields is an inclusive range operator against two other fields
+// of the same instance, e.g. Where("Price").BetweenFields("MinPrice",
+// "MaxPrice") matches instances whose price is within their own bounds.
+// Fields are compared as by GtFieldPlus, without an offset, and a missing
+// bound field is handled as a missing field by other criteria.
+func (c *Criterion) BetweenFields(lowField, highField string) *Query {
+	c.OtherField = lowField
+	c.HighField = highField
+	return c.createcriterion(Between, nil)
+}
+
+// validateFieldComparison validates a criterion comparing two fields, or
+// three for BetweenFields.
+func (c *Criterion) validateFieldComparison() error {
+	switch c.Operation {
+	case Eq, Ne, Gt, Lt, Ge, Le:
+		if c.HighField != "" {
+			return fmt.Errorf("%w: %s can't compare against a high field", ErrInvalidOperation, c.Operation)
+		}
+	case Between:
+		if c.HighField == "" {
+			return fmt.Errorf("%w: %s requires a low and a high field", ErrInvalidOperation, c.Operation)
+		}
+	default:
+		return fmt.Errorf("%w: %s can't compare fields", ErrInvalidOperation, c.Operation)
+	}
+	if isWildcardPath(c.FieldPath) || isWildcardPath(c.OtherField) || isWildcardPath(c.HighField) {
+		return fmt.Errorf("%w: field comparisons don't support wildcard paths", ErrInvalidOperation)
+	}
+	if math.IsNaN(c.Offset) || math.IsInf(c.Offset, 0) {
+		return fmt.Errorf("%w: field comparison offset must be finite", ErrInvalidOperation)
+	}
+	return nil
+}
+
+// matchFieldComparison matches field, a field of v, against the other
+// field of the criterion in v plus its offset.
+func (c *Criterion) matchFieldComparison(v map[string]interface{}, field reflect.Value) (bool, error) {
+	if err := c.assertType(field); err != nil {
+		return false, err
+	}
+	res, err := c.compareField(v, field, c.OtherField, c.Offset)
+	if err != nil {
+		return false, err
+	}
+	var ok bool
+	switch c.Operation {
+	case Between:
+		var high int
+		if high, err = c.compareField(v, field, c.HighField, 0); err != nil {
+			return false, err
+		}
+		ok = res >= 0 && high <= 0
+	case Eq:
+		ok = res == 0
+	case Ne:
+		ok = res != 0
+	case Gt:
+		ok = res > 0
+	case Lt:
+		ok = res < 0
+	case Ge:
+		ok = res >= 0
+	case Le:
+		ok = res <= 0
+	}
+	return ok != c.Negated, nil
+}
+
+// compareField compares field, a field of v, against the field at path in
+// v plus offset.
+func (c *Criterion) compareField(v map[string]interface{}, field reflect.Value, path string, offset float64) (int, error) {
+	other, err := c.traverse(v, path)
+	if err != nil {
+		return 0, err
+	}
+	var a, b interface{}
+	if field.IsValid() {
+		a = field.Interface()
+	}
+	if other.IsValid() {
+		b = other.Interface()
+	}
+	res, err := compareOffset(a, b, offset)
+	if err != nil {
+		return 0, fmt.Errorf("comparing %s with %s: %w", c.FieldPath, path, err)
+	}
+	return res, nil
+}
+
+// compareOffset compares a against b plus offset, if they're both numbers
+// or both times, with offset in seconds.
+func compareOffset(a, b interface{}, offset float64) (int, error) {
+	fa, okA := a.(float64)
+	fb, okB := b.(float64)
+	if okA && okB {
+		return compareFloats(fa, fb+offset), nil
+	}
+	ta, okA := timeValue(a)
+	tb, okB := timeValue(b)
+	if !okA || !okB {
+		return 0, &ErrTypeMismatch{a, b}
+	}
+	tb = tb.Add(time.Duration(offset * float64(time.Second)))
+	switch {
+	case ta.Before(tb):
+		return -1, nil
+	case ta.After(tb):
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// timeValue returns the time v holds as an RFC 3339 string, as time.Time
+// is encoded in JSON, or a Unix timestamp in seconds.
+func timeValue(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case float64:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	default:
+		return time.Time{}, false
+	}
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrValueNotOrdered is returned when comparing or sorting a value missing
+// from the order of its field, with StrictFieldOrders set.
+var ErrValueNotOrdered = errors.New("value not in field order")
+
+// WithFieldOrder defines the order of the string values of field, e.g. a
+// priority stored as "low", "medium" and "high", used instead of their
+// alphabetical order by the Eq, Ne, Gt, Lt, Ge and Le operators and by
+// sorts on field, so that Where("Priority").Ge("medium") matches medium
+// and high priorities. Values not in order come after the listed ones,
+// in alphabetical order, unless WithStrictFieldOrders is set. Values
+// which aren't strings are compared as usual.
+func (q *Query) WithFieldOrder(field string, order []string) *Query {
+	if q.FieldOrders == nil {
+		q.FieldOrders = make(map[string][]string)
+	}
+	q.FieldOrders[field] = append([]string(nil), order...)
+	return q
+}
+
+// WithStrictFieldOrders makes comparing or sorting a value missing from
+// the order of its field fail with ErrValueNotOrdered.
+func (q *Query) WithStrictFieldOrders() *Query {
+	q.StrictFieldOrders = true
+	return q
+}
+
+// compareWith is like the compareWith function, but compares big integers
+// exactly, and strings by the order of the criterion field, if it has one.
+func (c *Criterion) compareWith(value interface{}, critVal Value, opts MatchOptions) (int, error) {
+	if c.BigInt {
+		return compareBigInt(value, c.rawNumber(), critVal)
+	}
+	if order, ok := opts.FieldOrders[c.FieldPath]; ok && critVal.String != nil {
+		if s, ok := value.(string); ok {
+			return compareOrdered(order, opts.StrictFieldOrders, s, *critVal.String)
+		}
+	}
+	return compareWith(value, critVal, opts)
+}
+
+// compareOrdered compares a and b by their position in order. Values
+// missing from order come after the ones in it, or fail if strict.
+func compareOrdered(order []string, strict bool, a, b string) (int, error) {
+	rankA, okA := orderRank(order, a)
+	rankB, okB := orderRank(order, b)
+	if strict && !okA {
+		return 0, fmt.Errorf("%w: %q", ErrValueNotOrdered, a)
+	}
+	if strict && !okB {
+		return 0, fmt.Errorf("%w: %q", ErrValueNotOrdered, b)
+	}
+	switch {
+	case rankA < rankB:
+		return -1, nil
+	case rankA > rankB:
+		return 1, nil
+	case !okA:
+		return strings.Compare(a, b), nil
+	default:
+		return 0, nil
+	}
+}
+
+// orderRank returns the position of s in order, or len(order) and false
+// if it isn't in it.
+func orderRank(order []string, s string) (int, bool) {
+	for i, o := range order {
+		if o == s {
+			return i, true
+		}
+	}
+	return len(order), false
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ErrFieldNotAllowed indicates a query refers to a field it isn't allowed to.
+var ErrFieldNotAllowed = errors.New("field not allowed")
+
+// FieldPaths returns the field paths of instance, a struct or a pointer
+// to one, keyed by the dot separated names of their Go fields. Paths are
+// derived from json tags as encoding/json does, so that queries can refer
+// to struct fields rather than to hand written paths, e.g.
+//
+//	paths := FieldPaths(&Person{})
+//	q := Where(paths["Contact.Email"]).Eq("jane@example.com")
+//
+// Fields tagged "-" and unexported fields are left out, and the fields
+// of embedded structs are promoted. The map can back generated constants,
+// which turn a renamed field into a compile error.
+func FieldPaths(instance interface{}) map[string]string {
+	paths := make(map[string]string)
+	t := structType(reflect.TypeOf(instance))
+	if t == nil {
+		return paths
+	}
+	var walk func(t reflect.Type, goPrefix, jsonPrefix string, seen map[reflect.Type]bool)
+	walk = func(t reflect.Type, goPrefix, jsonPrefix string, seen map[reflect.Type]bool) {
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		for _, f := range jsonFields(t) {
+			goPath, jsonPath := goPrefix+f.goName, jsonPrefix+f.name
+			paths[goPath] = jsonPath
+			if st := structType(f.typ); st != nil {
+				walk(st, goPath+".", jsonPath+".", seen)
+			}
+		}
+	}
+	walk(t, "", "", make(map[reflect.Type]bool))
+	return paths
+}
+
+// ValidateAgainst validates q, and checks that every field path of its
+// criteria, Ors and sort keys is a field of instance, a struct or a pointer
+// to one, as encoded by encoding/json. Paths may continue below map and
+// interface fields, whose keys aren't known. Field aliases are resolved
+// before checking.
+func ValidateAgainst(q *Query, instance interface{}) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	if q == nil {
+		return nil
+	}
+	t := structType(reflect.TypeOf(instance))
+	if t == nil {
+		return fmt.Errorf("%T isn't a struct", instance)
+	}
+	q = q.Clone()
+	q.resolveAliases(nil)
+	return q.validateAgainst(t)
+}
+
+func (q *Query) validateAgainst(t reflect.Type) error {
+	for _, c := range q.Ands {
+		for _, path := range c.paths() {
+			if !hasFieldPath(t, path) {
+				return fmt.Errorf("%w: %s isn't a field of %s", ErrFieldMissing, path, t)
+			}
+		}
+	}
+	for _, o := range q.Ors {
+		if err := o.validateAgainst(t); err != nil {
+			return err
+		}
+	}
+	for _, s := range append([]Sort{q.Sort}, q.ThenSort...) {
+		for _, path := range s.paths() {
+			if !hasFieldPath(t, path) {
+				return fmt.Errorf("%w: %s isn't a field of %s", ErrInvalidSortingField, path, t)
+			}
+		}
+	}
+	return nil
+}
+
+// RestrictFieldsTo checks that the query only refers to allowed field
+// paths, or paths nested below them, in its criteria, Ors and sort keys,
+// e.g. so that API clients can't filter on sensitive fields. Aliases are
+// resolved before checking, and the instance ID is always allowed.
+// The error names the first field path which isn't allowed.
+func (q *Query) RestrictFieldsTo(allowed ...string) error {
+	if q == nil {
+		return nil
+	}
+	nq := q.Clone()
+	nq.resolveAliases(nil)
+	return nq.restrictFieldsTo(allowed)
+}
+
+func (q *Query) restrictFieldsTo(allowed []string) error {
+	for _, c := range q.Ands {
+		for _, path := range c.paths() {
+			if !fieldAllowed(path, allowed) {
+				return fmt.Errorf("%w: %s", ErrFieldNotAllowed, path)
+			}
+		}
+	}
+	for _, o := range q.Ors {
+		if err := o.restrictFieldsTo(allowed); err != nil {
+			return err
+		}
+	}
+	for _, s := range append([]Sort{q.Sort}, q.ThenSort...) {
+		for _, path := range s.paths() {
+			if !fieldAllowed(path, allowed) {
+				return fmt.Errorf("%w: %s", ErrFieldNotAllowed, path)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldAllowed returns whether fieldPath is one of allowed, or nested
+// below one of them.
+func fieldAllowed(fieldPath string, allowed []string) bool {
+	if fieldPath == idFieldName {
+		return true
+	}
+	for _, a := range allowed {
+		if fieldPath == a || strings.HasPrefix(fieldPath, a+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFieldPath returns whether fieldPath is a field of t. The instance
+// ID is always a field.
+func hasFieldPath(t reflect.Type, fieldPath string) bool {
+	if fieldPath == idFieldName {
+		return true
+	}
+	return hasFields(t, fieldPathKeys(fieldPath))
+}
+
+func hasFields(t reflect.Type, fields []string) bool {
+	if len(fields) == 0 {
+		return true
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Map:
+		return hasFields(t.Elem(), fields[1:])
+	case reflect.Struct:
+		for _, f := range jsonFields(t) {
+			if (fields[0] == "*" || fields[0] == f.name) && hasFields(f.typ, fields[1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type jsonField struct {
+	goName string
+	name   string
+	typ    reflect.Type
+}
+
+// jsonFields returns the fields of the struct type t encoding/json encodes,
+// with the fields of untagged embedded structs promoted.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			if st := structType(f.Type); st != nil {
+				fields = append(fields, jsonFields(st)...)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{goName: f.Name, name: name, typ: f.Type})
+	}
+	return fields
+}
+
+// structType returns t if it's a struct, or the struct it points to.
+func structType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
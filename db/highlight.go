@@ -0,0 +1,136 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Highlight is an instance matching a query along with where the query's
+// text criterion matched within a field, for highlighting search results.
+type Highlight struct {
+	// Value is the instance.
+	Value []byte
+	// Start and End are the byte offsets of the match within the field,
+	// or -1 when it can't be located, e.g. if the query normalizes values.
+	Start int
+	End   int
+}
+
+// FindWithHighlights is like Find, but also returns where in field the
+// query's text criterion matched each instance: the first occurrence of
+// the substring of ContainsFold, the leftmost match of the pattern of
+// Matches, or the prefix of StartsWith. It only works for queries with a
+// single, not negated, text criterion on field and no Ors, and fails for
+// others.
+func (t *Txn) FindWithHighlights(q *Query, field string) ([]Highlight, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	field = resolveAlias(q.Aliases, field)
+	crit, err := q.highlightCriterion(field)
+	if err != nil {
+		return nil, err
+	}
+	var res []Highlight
+	values, _, err := t.collect(q, collector{
+		sorted: func(values []MarshaledResult) ([]MarshaledResult, error) {
+			// Projection may remove the highlighted field.
+			res = make([]Highlight, len(values))
+			for i := range values {
+				res[i].Start, res[i].End = crit.highlight(values[i].MarshaledValue)
+			}
+			return values, nil
+		},
+	})
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, err
+	}
+	res = res[:len(values)]
+	for i := range values {
+		res[i].Value = values[i].Value
+	}
+	return res, err
+}
+
+// highlightCriterion returns the single text criterion of q on field.
+func (q *Query) highlightCriterion(field string) (*Criterion, error) {
+	var crit *Criterion
+	if len(q.Ors) == 0 {
+		for _, c := range q.Ands {
+			if c.FieldPath != field {
+				continue
+			}
+			switch c.Operation {
+			case ContainsFold, Matches, StartsWith:
+			default:
+				continue
+			}
+			if crit != nil {
+				return nil, fmt.Errorf("query has more than one text criterion on %s", field)
+			}
+			crit = c
+		}
+	}
+	if crit == nil || crit.Negated || crit.MatchAnyValue || crit.Value.String == nil {
+		return nil, fmt.Errorf("query has no single text criterion on %s to highlight", field)
+	}
+	return crit, nil
+}
+
+// highlight returns the byte offsets of the text criterion match within
+// its field of v, or -1 if it can't be located.
+func (c *Criterion) highlight(v map[string]interface{}) (int, int) {
+	field, err := c.traverse(v, c.FieldPath)
+	if err != nil || !field.IsValid() {
+		return -1, -1
+	}
+	s, ok := field.Interface().(string)
+	if !ok || c.options().Normalizer != nil {
+		return -1, -1
+	}
+	switch c.Operation {
+	case ContainsFold:
+		return foldIndex(s, *c.Value.String)
+	case Matches:
+		re, err := c.pattern(*c.Value.String, c.options())
+		if err != nil {
+			return -1, -1
+		}
+		if loc := re.FindStringIndex(s); loc != nil {
+			return loc[0], loc[1]
+		}
+	case StartsWith:
+		if strings.HasPrefix(s, *c.Value.String) {
+			return 0, len(*c.Value.String)
+		}
+	}
+	return -1, -1
+}
+
+// foldIndex returns the byte offsets in s of the first occurrence of sub
+// under Unicode simple case folding, or -1 if there's none. Folding may
+// change the length of runes, so the offsets are those of s rather than
+// of its folded form.
+func foldIndex(s, sub string) (int, int) {
+	folded := []rune(foldString(sub))
+	for i := range s {
+		j, k := i, 0
+		for ; k < len(folded) && j < len(s); k++ {
+			r, size := utf8.DecodeRuneInString(s[j:])
+			if foldRune(r) != folded[k] {
+				break
+			}
+			j += size
+		}
+		if k == len(folded) {
+			return i, j
+		}
+	}
+	if len(folded) == 0 {
+		return 0, 0
+	}
+	return -1, -1
+}
@@ -10,6 +10,8 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/alecthomas/jsonschema"
 	ds "github.com/ipfs/go-datastore"
@@ -22,6 +24,9 @@ import (
 const (
 	// iteratorKeyMinCacheSize is the size of iterator keys stored in memory before more are fetched.
 	iteratorKeyMinCacheSize = 100
+	// iteratorDefaultPrefetch is the number of indexed instances read per
+	// datastore call, unless overridden by the query.
+	iteratorDefaultPrefetch = 100
 )
 
 var (
@@ -44,6 +49,22 @@ type Index struct {
 	Path string `json:"path"`
 	// Unique indicates that only one instance should exist per field value.
 	Unique bool `json:"unique,omitempty"`
+	// Fields lists the field paths of a compound index, in index order.
+	// When set, Path is derived from Fields and names the index in UseIndex.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// fields returns the field paths covered by the index.
+func (i Index) fields() []string {
+	if len(i.Fields) > 0 {
+		return i.Fields
+	}
+	return []string{i.Path}
+}
+
+// compoundIndexPath returns the path naming a compound index over fields.
+func compoundIndexPath(fields []string) string {
+	return strings.Join(fields, ",")
 }
 
 // GetIndexes returns the current indexes.
@@ -82,20 +103,26 @@ func (c *Collection) addIndex(schema *jsonschema.Schema, index Index, opts ...Op
 		}
 	}
 
-	// Validate path and type.
-	jt, err := getSchemaTypeAtPath(schema, index.Path)
-	if err != nil {
-		return err
+	if len(index.Fields) > 0 {
+		index.Path = compoundIndexPath(index.Fields)
 	}
-	var valid bool
-	for _, t := range indexTypes {
-		if jt.Type == t {
-			valid = true
-			break
+
+	// Validate paths and types.
+	for _, pth := range index.fields() {
+		jt, err := getSchemaTypeAtPath(schema, pth)
+		if err != nil {
+			return err
+		}
+		var valid bool
+		for _, t := range indexTypes {
+			if jt.Type == t {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return ErrNotIndexable
 		}
-	}
-	if !valid {
-		return ErrNotIndexable
 	}
 
 	// Skip if nothing to do
@@ -105,20 +132,20 @@ func (c *Collection) addIndex(schema *jsonschema.Schema, index Index, opts ...Op
 
 	// Ensure collection does not contain multiple instances with the same value at path
 	if index.Unique && index.Path != idFieldName {
-		vals := make(map[interface{}]struct{})
+		vals := make(map[ds.Key]struct{})
 		all, err := c.Find(&Query{}, WithTxnToken(args.Token))
 		if err != nil {
 			return err
 		}
 		for _, i := range all {
-			res := gjson.GetBytes(i, index.Path)
-			if !res.Exists() {
+			val, err := getIndexValue(index, i)
+			if err != nil {
 				continue
 			}
-			if _, ok := vals[res.Value()]; ok {
+			if _, ok := vals[val]; ok {
 				return ErrCantCreateUniqueIndex
 			} else {
-				vals[res.Value()] = struct{}{}
+				vals[val] = struct{}{}
 			}
 		}
 	}
@@ -171,7 +198,7 @@ func (c *Collection) indexDelete(tx ds.Txn, key ds.Key, originalData []byte) err
 
 // indexUpdate adds or removes a specific index on an item.
 func (c *Collection) indexUpdate(field string, index Index, tx ds.Txn, key ds.Key, input []byte, delete bool) error {
-	valueKey, err := getIndexValue(field, input)
+	valueKey, err := getIndexValue(index, input)
 	if err != nil {
 		if errors.Is(err, ErrNotIndexable) {
 			return nil
@@ -213,12 +240,66 @@ func (c *Collection) indexUpdate(field string, index Index, tx ds.Txn, key ds.Ke
 }
 
 // getIndexValue returns the result of a field search on input.
-func getIndexValue(field string, input []byte) (ds.Key, error) {
-	result := gjson.GetBytes(input, field)
-	if !result.Exists() {
-		return ds.Key{}, ErrNotIndexable
+// For compound indexes, the result holds one namespace per field.
+func getIndexValue(index Index, input []byte) (ds.Key, error) {
+	var key ds.Key
+	for i, field := range index.fields() {
+		result := gjson.GetBytes(input, field)
+		if !result.Exists() {
+			return ds.Key{}, ErrNotIndexable
+		}
+		if i == 0 {
+			key = ds.NewKey(result.String())
+		} else {
+			key = key.Child(ds.NewKey(result.String()))
+		}
+	}
+	return key, nil
+}
+
+// indexString returns the value as it's represented in index keys.
+func (v Value) indexString() string {
+	switch {
+	case v.String != nil:
+		return *v.String
+	case v.Bool != nil:
+		return strconv.FormatBool(*v.Bool)
+	case v.Float != nil:
+		return strconv.FormatFloat(*v.Float, 'f', -1, 64)
+	default:
+		return ""
 	}
-	return ds.NewKey(result.String()), nil
+}
+
+// indexEqPrefix returns the index key prefix shared by all instances matching
+// the query equality criteria on leading fields of a compound index.
+// The last index field is never part of the prefix, so that it always
+// denotes a parent of the matching index keys.
+func indexEqPrefix(q *Query, fields []string) (ds.Key, bool) {
+	if len(q.Ors) > 0 {
+		return ds.Key{}, false
+	}
+	var key ds.Key
+	var n int
+	for _, field := range fields[:len(fields)-1] {
+		var value *Value
+		for _, c := range q.Ands {
+			if c.FieldPath == field && c.Operation == Eq && !c.Negated && !c.MatchAnyValue && !c.Folded && !c.matchesNull() && c.OtherField == "" {
+				value = &c.Value
+				break
+			}
+		}
+		if value == nil {
+			break
+		}
+		if n == 0 {
+			key = ds.NewKey(value.indexString())
+		} else {
+			key = key.Child(ds.NewKey(value.indexString()))
+		}
+		n++
+	}
+	return key, n > 0
 }
 
 // keyList is a slice of unique, sorted keys([]byte) such as what an index points to
@@ -267,28 +348,58 @@ type MarshaledResult struct {
 }
 
 type iterator struct {
-	nextKeys func() ([]ds.Key, error)
-	txn      ds.Txn
-	query    *Query
-	keyCache []ds.Key
-	iter     query.Results
+	nextKeys   func() ([]ds.Key, error)
+	txn        dse.TxnExt
+	baseKey    ds.Key
+	query      *Query
+	keyCache   []ds.Key
+	valueCache []MarshaledResult
+	prefetch   int
+	iter       query.Results
+	// seen holds the keys of the instances read through a lookup of
+	// several index values, which is a union of the key lists of their
+	// entries, so that an instance listed by several entries is returned
+	// once. It's nil for other iterators, which list each instance once.
+	seen map[ds.Key]struct{}
 }
 
-func newIterator(txn dse.TxnExt, baseKey ds.Key, q *Query) (*iterator, error) {
+func newIterator(txn dse.TxnExt, baseKey ds.Key, q *Query, index Index) (*iterator, error) {
 	i := &iterator{
-		txn:   txn,
-		query: q,
+		txn:      txn,
+		baseKey:  baseKey,
+		query:    q,
+		prefetch: q.Prefetch,
+	}
+	if i.prefetch <= 0 {
+		i.prefetch = iteratorDefaultPrefetch
+	}
+	if index.Path == "" {
+		index.Path = q.Index
 	}
-	var prefix ds.Key
+	var prefix, scanPrefix ds.Key
+	fields := index.fields()
 	if q.Index == "" {
 		prefix = baseKey
+		scanPrefix = prefix
 	} else {
 		prefix = indexPrefix.Child(baseKey).ChildString(q.Index)
+		scanPrefix = prefix
+		if eqPrefix, ok := indexEqPrefix(q, fields); ok {
+			scanPrefix = prefix.Child(eqPrefix)
+		}
+	}
+
+	if values, ok := indexInValues(q, fields); ok {
+		if len(values) > 1 {
+			i.seen = make(map[ds.Key]struct{})
+		}
+		i.nextKeys = i.lookupKeys(prefix, fields[0], values)
+		return i, nil
 	}
 
 	dsq := dse.QueryExt{
 		Query: query.Query{
-			Prefix: prefix.String(),
+			Prefix: scanPrefix.String(),
 			// Pull out Skip and Limit here because we won't know ahead of time
 			// (due to readFilters) how many to skip/limit
 			// Limit:  q.Limit,
@@ -302,9 +413,20 @@ func newIterator(txn dse.TxnExt, baseKey ds.Key, q *Query) (*iterator, error) {
 			dsq.Orders = []query.Order{query.OrderByKey{}}
 		}
 	}
+	if q.reverseIndex {
+		// Read the greatest indexed values first, see sortsByIndexDesc.
+		dsq.Orders = []query.Order{query.OrderByKeyDescending{}}
+	}
 	if q.Seek != "" {
 		dsq.SeekPrefix = prefix.Child(ds.NewKey(string(q.Seek))).String()
 	}
+	startsWith, prefixScan := indexStartsWith(q, fields)
+	if prefixScan {
+		// Index keys with the prefix are contiguous in key order, so seek to
+		// the first one and stop after the last one.
+		dsq.SeekPrefix = prefix.String() + "/" + startsWith
+		dsq.Orders = []query.Order{query.OrderByKey{}}
+	}
 	iter, err := txn.QueryExtended(dsq)
 	if err != nil {
 		return nil, err
@@ -320,10 +442,10 @@ func newIterator(txn dse.TxnExt, baseKey ds.Key, q *Query) (*iterator, error) {
 	}
 
 	// indexed field, get keys from index
-	first := true
+	first, done := true, false
 	i.nextKeys = func() ([]ds.Key, error) {
 		var nKeys []ds.Key
-		for len(nKeys) < iteratorKeyMinCacheSize {
+		for len(nKeys) < iteratorKeyMinCacheSize && !done {
 			result, ok := i.iter.NextSync()
 			if !ok {
 				if first {
@@ -332,31 +454,48 @@ func newIterator(txn dse.TxnExt, baseKey ds.Key, q *Query) (*iterator, error) {
 				return nKeys, result.Error
 			}
 			first = false
-			// result.Key contains the indexed value, extract here first
-			key := ds.RawKey(result.Key)
-			base := prefix.Name()
-			name := key.Name()
-			val := gjson.Parse(name).Value()
-			if val == nil {
-				val = name
+			// result.Key contains the indexed values, extract here first
+			parts := ds.RawKey(result.Key).Namespaces()[len(prefix.Namespaces()):]
+			if len(parts) < len(fields) {
+				continue
 			}
-			doc, err := sjson.Set("", base, val)
-			if err != nil {
-				return nil, err
+			if prefixScan {
+				if name := strings.Join(parts, "/"); !strings.HasPrefix(name, startsWith) {
+					// Datastores which can't seek start before the prefix.
+					done = name > startsWith
+					continue
+				}
+			}
+			var doc string
+			for j, field := range fields {
+				name := parts[j]
+				if j == len(fields)-1 {
+					name = strings.Join(parts[j:], "/")
+				}
+				var err error
+				if doc, err = setIndexField(doc, field, name); err != nil {
+					return nil, err
+				}
 			}
 			value := make(map[string]interface{})
 			if err := json.Unmarshal([]byte(doc), &value); err != nil {
 				return nil, fmt.Errorf("error when unmarshaling query result: %v", err)
 			}
-			ok, err = q.match(value)
+			matched, err := q.matchDoc([]byte(doc), value)
 			if err != nil {
-				return nil, fmt.Errorf("error when matching entry with query: %v", err)
+				return nil, fmt.Errorf("error when matching entry with query: %w", err)
 			}
-			if ok {
+			if matched {
 				indexValue := make(keyList, 0)
 				if err := DefaultDecode(result.Value, &indexValue); err != nil {
 					return nil, err
 				}
+				if q.reverseIndex {
+					// Break ties by key in the direction of the sort.
+					sort.Slice(indexValue, func(a, b int) bool {
+						return string(indexValue[a]) > string(indexValue[b])
+					})
+				}
 				for _, v := range indexValue {
 					nKeys = append(nKeys, ds.RawKey(string(v)))
 				}
@@ -367,6 +506,125 @@ func newIterator(txn dse.TxnExt, baseKey ds.Key, q *Query) (*iterator, error) {
 	return i, nil
 }
 
+// lookupKeys returns a nextKeys func which fetches the index entry of each
+// value directly, rather than scanning the whole index.
+func (i *iterator) lookupKeys(prefix ds.Key, field string, values []Value) func() ([]ds.Key, error) {
+	return func() ([]ds.Key, error) {
+		var nKeys []ds.Key
+		for len(nKeys) < iteratorKeyMinCacheSize && len(values) > 0 {
+			name := values[0].indexString()
+			values = values[1:]
+			data, err := i.txn.Get(prefix.ChildString(ds.NewKey(name).String()[1:]))
+			if err == ds.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			// The entry may hold a value of another type with the same key,
+			// so match the query against it just like a scan would.
+			doc, err := setIndexField("", field, name)
+			if err != nil {
+				return nil, err
+			}
+			value := make(map[string]interface{})
+			if err := json.Unmarshal([]byte(doc), &value); err != nil {
+				return nil, fmt.Errorf("error when unmarshaling query result: %v", err)
+			}
+			matched, err := i.query.matchDoc([]byte(doc), value)
+			if err != nil {
+				return nil, fmt.Errorf("error when matching entry with query: %w", err)
+			}
+			if !matched {
+				continue
+			}
+			indexValue := make(keyList, 0)
+			if err := DefaultDecode(data, &indexValue); err != nil {
+				return nil, err
+			}
+			for _, v := range indexValue {
+				nKeys = append(nKeys, ds.RawKey(string(v)))
+			}
+		}
+		return nKeys, nil
+	}
+}
+
+// setIndexField sets field in doc to the value parsed from its index key
+// segment. Numbers are set as they appear in the key, so that their exact
+// representation is kept.
+func setIndexField(doc, field, name string) (string, error) {
+	if gjson.Valid(name) && gjson.Parse(name).Type == gjson.Number {
+		return sjson.SetRaw(doc, field, name)
+	}
+	return sjson.Set(doc, field, indexFieldValue(name))
+}
+
+// indexFieldValue parses an indexed value back from its key segment.
+func indexFieldValue(name string) interface{} {
+	if val := gjson.Parse(name).Value(); val != nil {
+		return val
+	}
+	return name
+}
+
+// indexStartsWith returns the prefix of a StartsWith criterion on the field
+// of a single field index, whose index keys can be scanned for instead of
+// the whole index.
+func indexStartsWith(q *Query, fields []string) (string, bool) {
+	if q.Index == "" || len(fields) != 1 || len(q.Ors) > 0 || q.Seek != "" || q.Normalizer != nil {
+		return "", false
+	}
+	for _, c := range q.Ands {
+		if c.FieldPath != fields[0] || c.Operation != StartsWith || c.Negated || c.MatchAnyValue || c.Value.String == nil {
+			continue
+		}
+		// Prefixes which aren't kept as is in keys can't be sought.
+		prefix := *c.Value.String
+		if prefix == "" || ds.NewKey(prefix).String()[1:] != prefix {
+			return "", false
+		}
+		return prefix, true
+	}
+	return "", false
+}
+
+// indexInValues returns the distinct values of an In criterion, or the
+// value of an Eq criterion, on the field of a single field index, which
+// can be looked up instead of scanned for.
+func indexInValues(q *Query, fields []string) ([]Value, bool) {
+	if len(fields) != 1 || len(q.Ors) > 0 || q.Seek != "" {
+		return nil, false
+	}
+	// Normalized or coerced matches can't be found by their key.
+	if q.Normalizer != nil || q.CoerceNumbers || q.CoerceBools {
+		return nil, false
+	}
+	for _, c := range q.Ands {
+		if c.FieldPath != fields[0] || c.Negated || c.MatchAnyValue || c.Folded {
+			continue
+		}
+		if c.Operation == Eq && !c.matchesNull() && c.OtherField == "" {
+			return []Value{c.Value}, true
+		}
+		if c.Operation != In {
+			continue
+		}
+		seen := make(map[string]struct{}, len(c.Values))
+		values := make([]Value, 0, len(c.Values))
+		for _, v := range c.Values {
+			key := v.indexString()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			values = append(values, v)
+		}
+		return values, true
+	}
+	return nil, false
+}
+
 // NextSync returns the next key value that matches the iterators criteria
 // If there is an error, ok is false and result.Error() will return the error
 func (i *iterator) NextSync() (MarshaledResult, bool) {
@@ -374,11 +632,17 @@ func (i *iterator) NextSync() (MarshaledResult, bool) {
 		value := MarshaledResult{}
 		var ok bool
 		for res := range i.iter.Next() {
+			if res.Error == nil && i.query.excludes(ds.RawKey(res.Key)) {
+				continue
+			}
+			if value.Error = i.query.scanned(); value.Error != nil {
+				break
+			}
 			val := make(map[string]interface{})
 			if value.Error = json.Unmarshal(res.Value, &val); value.Error != nil {
 				break
 			}
-			ok, value.Error = i.query.match(val)
+			ok, value.Error = i.query.matchDoc(res.Value, val)
 			if value.Error != nil {
 				break
 			}
@@ -391,49 +655,158 @@ func (i *iterator) NextSync() (MarshaledResult, bool) {
 		}
 		return value, ok
 	}
-	if len(i.keyCache) == 0 {
-		newKeys, err := i.nextKeys()
-		if err != nil {
-			return MarshaledResult{
-				Result: query.Result{
-					Entry: query.Entry{},
-					Error: err,
-				},
-			}, false
-		}
+	res, err := i.nextIndexed()
+	if err != nil {
+		return MarshaledResult{
+			Result: query.Result{
+				Entry: query.Entry{},
+				Error: err,
+			},
+		}, false
+	}
+	return res, res.Key != ""
+}
 
-		if len(newKeys) == 0 {
-			return MarshaledResult{
-				Result: query.Result{
-					Entry: query.Entry{},
-					Error: nil,
-				},
-			}, false
+// nextIndexed returns the next instance listed by the index, or an empty
+// result once there are no more. Instances are read a batch at a time
+// into the value cache.
+func (i *iterator) nextIndexed() (MarshaledResult, error) {
+	if len(i.valueCache) == 0 {
+		if err := i.fill(); err != nil {
+			return MarshaledResult{}, err
+		}
+		if len(i.valueCache) == 0 {
+			return MarshaledResult{}, nil
 		}
-		i.keyCache = append(i.keyCache, newKeys...)
 	}
+	if err := i.query.scanned(); err != nil {
+		return MarshaledResult{}, err
+	}
+	res := i.valueCache[0]
+	i.valueCache[0] = MarshaledResult{}
+	i.valueCache = i.valueCache[1:]
+	val := make(map[string]interface{})
+	if err := json.Unmarshal(res.Value, &val); err != nil {
+		return MarshaledResult{}, err
+	}
+	res.MarshaledValue = val
+	return res, nil
+}
+
+// fill reads the next batch of up to prefetch instances listed by the
+// index into the value cache.
+func (i *iterator) fill() error {
+	var keys []ds.Key
+	for len(keys) < i.prefetch {
+		if len(i.keyCache) == 0 {
+			newKeys, err := i.nextKeys()
+			if err != nil {
+				return err
+			}
+			if len(newKeys) == 0 {
+				break
+			}
+			i.keyCache = append(i.keyCache, newKeys...)
+		}
 
-	key := i.keyCache[0]
-	i.keyCache = i.keyCache[1:]
+		key := i.keyCache[0]
+		i.keyCache = i.keyCache[1:]
+		if i.seen != nil {
+			if _, ok := i.seen[key]; ok {
+				continue
+			}
+			i.seen[key] = struct{}{}
+		}
+		if i.query.excludes(key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
 
-	value, err := i.txn.Get(key)
+	values, err := i.getBatch(keys)
 	if err != nil {
-		return MarshaledResult{
-			Result: query.Result{
-				Entry: query.Entry{},
-				Error: err,
-			}}, false
+		return err
 	}
-	return MarshaledResult{
-		Result: query.Result{
-			Entry: query.Entry{
-				Key:   key.String(),
-				Value: value,
+	for j, key := range keys {
+		i.valueCache = append(i.valueCache, MarshaledResult{
+			Result: query.Result{
+				Entry: query.Entry{
+					Key:   key.String(),
+					Value: values[j],
+				},
 			},
-			Error: nil,
-		}}, true
+		})
+	}
+	return nil
+}
+
+// getBatch returns the values of the instances of keys, in their order.
+// A single key is read directly, while several are read with one range
+// read from the least to the greatest of them, skipping the instances in
+// between which aren't in keys.
+func (i *iterator) getBatch(keys []ds.Key) ([][]byte, error) {
+	if len(keys) == 1 {
+		value, err := i.txn.Get(keys[0])
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{value}, nil
+	}
+	wanted := make(map[string]struct{}, len(keys))
+	first, last := keys[0].String(), keys[0].String()
+	for _, key := range keys {
+		k := key.String()
+		wanted[k] = struct{}{}
+		if k < first {
+			first = k
+		}
+		if k > last {
+			last = k
+		}
+	}
+	res, err := i.txn.QueryExtended(dse.QueryExt{
+		Query: query.Query{
+			Prefix: i.baseKey.String(),
+			Orders: []query.Order{query.OrderByKey{}},
+		},
+		SeekPrefix: first,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	found := make(map[string][]byte, len(keys))
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		if r.Key > last {
+			break
+		}
+		// Datastores which can't seek start before the first key.
+		if _, ok := wanted[r.Key]; ok {
+			found[r.Key] = r.Value
+			if len(found) == len(wanted) {
+				break
+			}
+		}
+	}
+	values := make([][]byte, len(keys))
+	for j, key := range keys {
+		value, ok := found[key.String()]
+		if !ok {
+			return nil, ds.ErrNotFound
+		}
+		values[j] = value
+	}
+	return values, nil
 }
 
 func (i *iterator) Close() {
-	i.iter.Close()
+	if i.iter != nil {
+		i.iter.Close()
+	}
 }
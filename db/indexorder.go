@@ -0,0 +1,65 @@
+package db
+
+// sortsByIndexDesc returns whether q is sorted descending by the field of
+// the single field index it uses, with a limit, so that the first results
+// can be read in reverse index order rather than sorting all the matches,
+// e.g. the latest instances by an indexed creation time. Index keys are
+// ordered by the bytes of the indexed values, as strings are sorted, so
+// criteria mustn't narrow the index range in key order, nor options change
+// how the field compares.
+func (q *Query) sortsByIndexDesc() bool {
+	s := q.Sort
+	if q.Index == "" || q.Limit <= 0 || s.FieldPath != q.Index || !s.Desc {
+		return false
+	}
+	if s.ByLen || s.Collation != nil || s.ByRelevance || s.Numeric || s.ArrayMin || s.ArrayMax || len(s.Weights) > 0 {
+		return false
+	}
+	if len(q.ThenSort) > 0 || q.GroupInValues || q.Seek != "" || len(q.Ors) > 0 || isWildcardPath(q.Index) {
+		return false
+	}
+	if q.Normalizer != nil || q.RuneOrdering || q.FieldOrders[q.Index] != nil {
+		return false
+	}
+	fields := []string{q.Index}
+	if _, ok := indexInValues(q, fields); ok {
+		return false
+	}
+	_, prefixScan := indexStartsWith(q, fields)
+	return !prefixScan
+}
+
+// iterateIndexDesc returns the results of q, which sorts by its index
+// descending, read in reverse index order, with Skip and Limit applied.
+// That's only their sort order if the field is a string in all of them,
+// so it returns false, and the results must be sorted in memory instead,
+// as soon as a result doesn't hold a string.
+func (t *Txn) iterateIndexDesc(q *Query, iso Isolation) ([]MarshaledResult, bool, error) {
+	rq := q.Clone()
+	rq.reverseIndex = true
+	var values []MarshaledResult
+	var count int
+	ordered := true
+	if err := t.iterateIsolated(rq, iso, func(res MarshaledResult) (bool, error) {
+		field, err := traverseFieldPathMap(res.MarshaledValue, q.Sort.FieldPath, q.maxPathDepth)
+		if err != nil || !field.IsValid() {
+			ordered = false
+			return false, nil
+		}
+		if _, ok := field.Interface().(string); !ok {
+			ordered = false
+			return false, nil
+		}
+		count++
+		if count > q.Skip {
+			values = append(values, res)
+		}
+		return len(values) != q.Limit, nil
+	}); err != nil {
+		return nil, false, err
+	}
+	if !ordered {
+		return nil, false, nil
+	}
+	return values, true, nil
+}
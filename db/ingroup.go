@@ -0,0 +1,79 @@
+package db
+
+import (
+	"sort"
+)
+
+// GroupByInValues groups the results of the query by the value of its
+// first In criterion they're equal to, in the order the values are
+// listed, e.g. Where("Status").In("open", "pending", "closed") returns open
+// instances first, then pending, then closed ones, regardless of the
+// index used. Results matching none of the values, e.g. through an Or,
+// come last. Grouping takes precedence over OrderBy, which orders results
+// within each group, and otherwise keeps their order. Like sorts on
+// fields other than _id, grouping applies to results loaded in memory.
+func (q *Query) GroupByInValues() *Query {
+	q.GroupInValues = true
+	return q
+}
+
+// groupingCriterion returns the first non-negated In criterion of q, or
+// nil if it has none.
+func (q *Query) groupingCriterion() *Criterion {
+	for _, c := range q.Ands {
+		if c.Operation == In && !c.Negated {
+			return c
+		}
+	}
+	return nil
+}
+
+// groupInValues stably orders values by the position of their value
+// in the grouping criterion of q.
+func groupInValues(values []MarshaledResult, q *Query) {
+	c := q.groupingCriterion()
+	if c == nil {
+		return
+	}
+	g := inGroups{values: values, groups: make([]int, len(values))}
+	for i, v := range values {
+		g.groups[i] = c.inValueIndex(v.MarshaledValue)
+	}
+	sort.Stable(g)
+}
+
+// inValueIndex returns the index of the first criterion value equal to
+// the field of v, or the number of values if there's none.
+func (c *Criterion) inValueIndex(v map[string]interface{}) int {
+	field, err := c.traverse(v, c.FieldPath)
+	if err != nil || !field.IsValid() {
+		return len(c.Values)
+	}
+	opts := c.options()
+	value := opts.normalize(c.FieldPath, field.Interface())
+	if s, ok := value.(string); ok && c.Folded {
+		value = foldString(s)
+	}
+	for i, cv := range c.Values {
+		critVal, err := c.normalizeValue(cv, opts)
+		if err != nil {
+			continue
+		}
+		if res, err := compareWith(value, critVal, opts); err == nil && res == 0 {
+			return i
+		}
+	}
+	return len(c.Values)
+}
+
+type inGroups struct {
+	values []MarshaledResult
+	groups []int
+}
+
+func (g inGroups) Len() int           { return len(g.values) }
+func (g inGroups) Less(i, j int) bool { return g.groups[i] < g.groups[j] }
+func (g inGroups) Swap(i, j int) {
+	g.values[i], g.values[j] = g.values[j], g.values[i]
+	g.groups[i], g.groups[j] = g.groups[j], g.groups[i]
+}
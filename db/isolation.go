@@ -0,0 +1,62 @@
+package db
+
+import (
+	"errors"
+
+	dse "github.com/textileio/go-datastore-extensions"
+)
+
+// Isolation is the isolation level of the datastore transaction a query
+// reads instances from.
+type Isolation int
+
+const (
+	// Snapshot reads from a consistent snapshot of the datastore, taken
+	// when the query starts, so writes committed while it runs aren't seen.
+	Snapshot Isolation = iota + 1
+	// ReadCommitted reads the latest committed data as the query runs, so
+	// writes committed while it runs may be seen.
+	ReadCommitted
+)
+
+// String returns the name of the isolation level.
+func (i Isolation) String() string {
+	switch i {
+	case Snapshot:
+		return "snapshot"
+	case ReadCommitted:
+		return "read-committed"
+	default:
+		return "default"
+	}
+}
+
+// IsolatedDatastore is implemented by datastores which can open
+// transactions with a chosen isolation level.
+type IsolatedDatastore interface {
+	NewTransactionIsolated(readOnly bool, iso Isolation) (dse.TxnExt, error)
+}
+
+// FindWithIsolation is like Find, but reads instances from a datastore
+// transaction with the isolation level iso, if the db datastore implements
+// IsolatedDatastore. Otherwise, the datastore's own read transactions are
+// used, as in Find. Those of the Badger datastore are snapshots, so they
+// satisfy either level. The datastore of dbs created by a Manager is
+// wrapped, so they always fall back.
+func (t *Txn) FindWithIsolation(q *Query, iso Isolation) ([][]byte, error) {
+	values, err := t.findIsolated(q, iso)
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, err
+	}
+	return resultValues(values), err
+}
+
+// newReadTxn opens a read-only datastore transaction with the isolation
+// level iso. A zero iso, or a datastore which doesn't implement
+// IsolatedDatastore, gets the datastore default.
+func (t *Txn) newReadTxn(iso Isolation) (dse.TxnExt, error) {
+	if ids, ok := t.collection.db.datastore.(IsolatedDatastore); ok && iso != 0 {
+		return ids.NewTransactionIsolated(true, iso)
+	}
+	return t.collection.db.datastore.NewTransactionExtended(true)
+}
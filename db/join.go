@@ -0,0 +1,59 @@
+package db
+
+import "errors"
+
+// FindJoined returns the instances matching q whose localField equals the
+// foreignKey field of an instance of the foreign collection matching
+// foreignQuery, e.g. the orders of customers in a country:
+//
+//	txn.FindJoined(nil, "customerId", customers, "_id", Where("country").Eq("AR"))
+//
+// It's a hash join rather than a general join: the foreignKey values of
+// all matching foreign instances are collected in memory first, then
+// instances of the collection are filtered by them. Values are compared
+// by their JSON representation, so 1 and "1" don't join. Instances where
+// either field is missing or null don't join. Skip and Limit of q apply to
+// the joined results, while those of foreignQuery are ignored.
+func (t *Txn) FindJoined(q *Query, localField string, foreign *Txn, foreignKey string, foreignQuery *Query) ([][]byte, error) {
+	fq, err := foreign.prepareQuery(foreignQuery)
+	if err != nil {
+		return nil, err
+	}
+	foreignKey = resolveAlias(fq.Aliases, foreignKey)
+	keys := make(map[string]struct{})
+	if err := foreign.iterate(fq, func(res MarshaledResult) (bool, error) {
+		key, ok, err := distinctKey(res.MarshaledValue, foreignKey, fq.maxPathDepth)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			keys[key] = struct{}{}
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	q, err = t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	localField = resolveAlias(q.Aliases, localField)
+	if len(keys) == 0 {
+		return [][]byte{}, nil
+	}
+	values, _, err := t.collect(q, collector{
+		keep: func(res MarshaledResult) (bool, error) {
+			key, ok, err := distinctKey(res.MarshaledValue, localField, q.maxPathDepth)
+			if err != nil {
+				return false, err
+			}
+			_, joined := keys[key]
+			return ok && joined, nil
+		},
+	})
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, err
+	}
+	return resultValues(values), err
+}
@@ -421,10 +421,15 @@ func wrapDB(
 		Prefix: dsManagerBaseKey.ChildString(id.String()),
 	})
 	opts := &NewOptions{
-		Name:        name,
-		Collections: append(base.Collections, collections...),
-		EventCodec:  base.EventCodec,
-		Debug:       base.Debug,
+		Name:               name,
+		Collections:        append(base.Collections, collections...),
+		EventCodec:         base.EventCodec,
+		Debug:              base.Debug,
+		PatternLimits:      base.PatternLimits,
+		MaxPathDepth:       base.MaxPathDepth,
+		MaxQueryCriteria:   base.MaxQueryCriteria,
+		MaxSubqueryResults: base.MaxSubqueryResults,
+		CountProgressEvery: base.CountProgressEvery,
 	}
 	return store, opts, nil
 }
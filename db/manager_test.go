@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"reflect"
 	"testing"
 	"time"
 
@@ -284,7 +285,35 @@ func TestManager_DeleteDB(t *testing.T) {
 	}
 }
 
-func createTestManager(t *testing.T) (*Manager, func()) {
+func TestManager_CountProgressEvery(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	man, clean := createTestManager(t, WithNewCountProgressEvery(2))
+	defer clean()
+
+	db, err := man.NewDB(ctx, thread.NewIDV1(thread.Raw, 32))
+	checkErr(t, err)
+	collection, err := db.NewCollection(CollectionConfig{Name: "Person", Schema: util.SchemaFromSchemaString(jsonSchema)})
+	checkErr(t, err)
+	for _, name := range []string{"foo", "bar", "baz"} {
+		_, err = collection.Create([]byte(`{"_id": "", "name": "` + name + `", "age": 21}`))
+		checkErr(t, err)
+	}
+
+	var calls []int
+	err = collection.ReadTxn(func(txn *Txn) error {
+		_, err := txn.CountProgress(ctx, nil, func(scanned int) {
+			calls = append(calls, scanned)
+		})
+		return err
+	})
+	checkErr(t, err)
+	if expected := []int{2, 3}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected progress calls %v, got: %v", expected, calls)
+	}
+}
+
+func createTestManager(t *testing.T, opts ...NewOption) (*Manager, func()) {
 	dir := t.TempDir()
 	n, err := common.DefaultNetwork(
 		common.WithNetBadgerPersistence(dir),
@@ -294,7 +323,7 @@ func createTestManager(t *testing.T) (*Manager, func()) {
 	checkErr(t, err)
 	store, err := util.NewBadgerDatastore(dir, "eventstore", false)
 	checkErr(t, err)
-	m, err := NewManager(store, n, WithNewDebug(true))
+	m, err := NewManager(store, n, append([]NewOption{WithNewDebug(true)}, opts...)...)
 	checkErr(t, err)
 	return m, func() {
 		if err := n.Close(); err != nil {
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// ndjsonFlushInterval is the number of lines FindNDJSON writes between
+// flushes of its buffer.
+const ndjsonFlushInterval = 100
+
+// FindNDJSON writes the instances matching q to w as newline-delimited
+// JSON, one compacted instance per line, and returns the number written.
+// Instances are streamed as by ForEach, and written out every
+// ndjsonFlushInterval instances, so large exports aren't held in memory
+// unless q has to be sorted in memory. Skip and Limit apply as in Find.
+// On error, some instances may already have been written.
+func (t *Txn) FindNDJSON(q *Query, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	var line bytes.Buffer
+	var n int
+	if err := t.ForEach(q, ndjsonFlushInterval, func(batch [][]byte) error {
+		for _, v := range batch {
+			line.Reset()
+			if err := json.Compact(&line, v); err != nil {
+				return err
+			}
+			line.WriteByte('\n')
+			if _, err := bw.Write(line.Bytes()); err != nil {
+				return err
+			}
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		n += len(batch)
+		return nil
+	}); err != nil {
+		return n, err
+	}
+	return n, nil
+}
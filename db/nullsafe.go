@@ -0,0 +1,51 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// EqNullSafe is an equality operator which treats missing and null fields
+// as null values rather than errors: Eq(nil) matches instances where the
+// field is missing or null, and other values never match them. Unlike Eq,
+// a missing field doesn't fail the query.
+func (c *Criterion) EqNullSafe(value interface{}) *Query {
+	c.NullSafe = true
+	return c.createcriterion(Eq, value)
+}
+
+// matchesNull returns whether the criterion matches missing and null
+// fields only.
+func (c *Criterion) matchesNull() bool {
+	return c.NullSafe && c.Value.value() == nil && c.Value.Param == nil
+}
+
+// validateNullSafe validates a null-safe criterion.
+func (c *Criterion) validateNullSafe() error {
+	if c.Operation != Eq {
+		return fmt.Errorf("%w: %s can't be null-safe", ErrInvalidOperation, c.Operation)
+	}
+	if isWildcardPath(c.FieldPath) {
+		return fmt.Errorf("%w: null-safe criteria don't support wildcard paths", ErrInvalidOperation)
+	}
+	if c.matchesNull() {
+		return nil
+	}
+	return c.Value.validate()
+}
+
+// matchNullSafe matches a null-safe criterion against the field found,
+// or not, in an instance.
+func (c *Criterion) matchNullSafe(field reflect.Value, err error) (bool, error) {
+	if errors.Is(err, ErrFieldMissing) || (err == nil && !field.IsValid()) {
+		return c.matchesNull() != c.Negated, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if c.matchesNull() {
+		return c.Negated, nil
+	}
+	return c.match(field)
+}
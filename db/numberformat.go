@@ -0,0 +1,64 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NumberFormat describes how numbers held in strings are written, e.g.
+// with locale-specific separators.
+type NumberFormat struct {
+	// Decimal is the decimal separator. Empty means ".".
+	Decimal string `json:",omitempty"`
+	// Grouping is the digit group separator, which is ignored.
+	Grouping string `json:",omitempty"`
+}
+
+var (
+	// NumberFormatEnglish parses numbers such as "1,234.56".
+	NumberFormatEnglish = NumberFormat{Decimal: ".", Grouping: ","}
+	// NumberFormatGerman parses numbers such as "1.234,56".
+	NumberFormatGerman = NumberFormat{Decimal: ",", Grouping: "."}
+)
+
+// WithNumberFormat sets the format of numbers held in strings, used when
+// they're parsed by number coercion, see WithNumberCoercion, and by
+// numeric sorts, see OrderByNumeric. Group separators are removed and the
+// decimal separator is replaced by "." before parsing the string as a Go
+// float, so group separators aren't checked to be well placed. By default,
+// strings are parsed as Go floats, without group separators.
+func (q *Query) WithNumberFormat(f NumberFormat) *Query {
+	q.NumberFormat = f
+	return q
+}
+
+// validate validates the separators of the format.
+func (f NumberFormat) validate() error {
+	for _, sep := range []string{f.Decimal, f.Grouping} {
+		if r, _ := utf8.DecodeRuneInString(sep); sep != "" && (unicode.IsDigit(r) || strings.ContainsAny(sep, "+-eE")) {
+			return fmt.Errorf("%w: invalid number separator %q", ErrInvalidOperation, sep)
+		}
+	}
+	if f.Decimal != "" && f.Decimal == f.Grouping {
+		return fmt.Errorf("%w: decimal and group separators must differ", ErrInvalidOperation)
+	}
+	return nil
+}
+
+// parse parses s as a number written in the format.
+func (f NumberFormat) parse(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if f.Grouping != "" {
+		s = strings.ReplaceAll(s, f.Grouping, "")
+	}
+	if f.Decimal != "" && f.Decimal != "." {
+		if strings.Contains(s, ".") {
+			return 0, strconv.ErrSyntax
+		}
+		s = strings.Replace(s, f.Decimal, ".", 1)
+	}
+	return strconv.ParseFloat(s, 64)
+}
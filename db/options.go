@@ -13,14 +13,19 @@ func newDefaultEventCodec() core.EventCodec {
 
 // NewOptions defines options for creating a new db.
 type NewOptions struct {
-	Name        string
-	Key         thread.Key
-	LogKey      crypto.Key
-	Collections []CollectionConfig
-	Block       bool
-	EventCodec  core.EventCodec
-	Token       thread.Token
-	Debug       bool
+	Name               string
+	Key                thread.Key
+	LogKey             crypto.Key
+	Collections        []CollectionConfig
+	Block              bool
+	EventCodec         core.EventCodec
+	Token              thread.Token
+	Debug              bool
+	PatternLimits      PatternLimits
+	MaxPathDepth       int
+	MaxQueryCriteria   int
+	MaxSubqueryResults int
+	CountProgressEvery int
 }
 
 // NewOption specifies a new db option.
@@ -76,6 +81,51 @@ func WithNewEventCodec(ec core.EventCodec) NewOption {
 	}
 }
 
+// WithNewPatternLimits bounds the regular expressions queries may use
+// with Matches. By default, DefaultPatternLimits apply.
+func WithNewPatternLimits(limits PatternLimits) NewOption {
+	return func(o *NewOptions) {
+		o.PatternLimits = limits
+	}
+}
+
+// WithNewMaxPathDepth sets the maximum number of fields of the field paths
+// queries traverse, so that deeply nested paths are rejected before being
+// traversed. By default, DefaultMaxPathDepth applies.
+func WithNewMaxPathDepth(depth int) NewOption {
+	return func(o *NewOptions) {
+		o.MaxPathDepth = depth
+	}
+}
+
+// WithNewMaxQueryCriteria sets the maximum number of criteria and Or
+// branches, at any depth, of the queries run on the db, so that overly
+// complex queries, e.g. from API clients, are rejected before scanning.
+// By default, DefaultMaxQueryCriteria applies.
+func WithNewMaxQueryCriteria(max int) NewOption {
+	return func(o *NewOptions) {
+		o.MaxQueryCriteria = max
+	}
+}
+
+// WithNewMaxSubqueryResults sets the maximum number of distinct values
+// the subqueries of InSubquery criteria may yield. By default,
+// DefaultMaxSubqueryResults applies.
+func WithNewMaxSubqueryResults(max int) NewOption {
+	return func(o *NewOptions) {
+		o.MaxSubqueryResults = max
+	}
+}
+
+// WithNewCountProgressEvery sets the number of instances CountProgress
+// scans between calls to its progress callback. By default,
+// DefaultCountProgressEvery applies.
+func WithNewCountProgressEvery(every int) NewOption {
+	return func(o *NewOptions) {
+		o.CountProgressEvery = every
+	}
+}
+
 // WithNewToken provides authorization for interacting with a db.
 func WithNewToken(t thread.Token) NewOption {
 	return func(o *NewOptions) {
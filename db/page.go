@@ -0,0 +1,210 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrInvalidPageToken is returned by FindPaged when the token of the
+// previous page can't be decoded.
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// Page is a page of the instances matching a query, as returned by FindPage.
+type Page struct {
+	// Items are the instances of the page.
+	Items [][]byte
+	// Total is the number of instances matching the query, on all pages.
+	Total int
+	// Page is the page number, starting at 1.
+	Page int
+	// PageSize is the maximum number of instances in a page.
+	PageSize int
+	// HasMore is whether there are pages after this one.
+	HasMore bool
+}
+
+// FindWithCount is like Find, but also returns the number of instances
+// matching q regardless of Skip, Limit and the byte limit, counted in the
+// same scan.
+func (t *Txn) FindWithCount(q *Query) ([][]byte, int, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	values, _, err := t.collect(q, collector{
+		keep: func(MarshaledResult) (bool, error) {
+			total++
+			return true, nil
+		},
+		scanAll: true,
+	})
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, 0, err
+	}
+	return resultValues(values), total, err
+}
+
+// FindPage returns the page-th page of pageSize instances matching q,
+// along with the total number of matches, in a single scan. Pages start
+// at 1, and Skip and Limit of q are replaced.
+func (t *Txn) FindPage(q *Query, page, pageSize int) (*Page, error) {
+	if page < 1 {
+		return nil, fmt.Errorf("page must be at least 1, got %d", page)
+	}
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("page size must be positive, got %d", pageSize)
+	}
+	if q == nil {
+		q = &Query{}
+	}
+	q = q.Clone()
+	q.Skip = (page - 1) * pageSize
+	q.Limit = pageSize
+	items, total, err := t.FindWithCount(q)
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, err
+	}
+	return &Page{
+		Items:    items,
+		Total:    total,
+		Page:     page,
+		PageSize: pageSize,
+		HasMore:  page*pageSize < total,
+	}, err
+}
+
+// window returns values after skipping skip of them, and up to limit
+// if it's positive.
+func window(values []MarshaledResult, skip, limit int) []MarshaledResult {
+	if skip >= len(values) {
+		return nil
+	}
+	if skip > 0 {
+		values = values[skip:]
+	}
+	if limit > 0 && limit < len(values) {
+		values = values[:limit]
+	}
+	return values
+}
+
+// FindPaged returns the first pageSize instances matching q after the one
+// the token after was returned for, in the order of q, and the token for
+// its last instance, empty once there are no more pages. An empty after
+// returns the first page. Tokens are opaque, holding the sort field values
+// of an instance and its key, so pages stay consistent while instances
+// are created or deleted: none is returned twice, and none which existed
+// throughout is skipped. q must have a sort, other than by relevance, and
+// its Skip and Limit are ignored, while its byte limit may cut pages
+// short. Each call scans and sorts all matching instances.
+func (t *Txn) FindPaged(q *Query, pageSize int, after string) ([][]byte, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("page size must be positive, got %d", pageSize)
+	}
+	if q == nil || !q.Sort.enabled() || q.Sort.ByRelevance {
+		return nil, "", fmt.Errorf("%w: paging requires a sort by field", ErrInvalidOperation)
+	}
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, "", err
+	}
+	var cursor *MarshaledResult
+	if after != "" {
+		if cursor, err = decodePageToken(after); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Pages are cut from all the sorted matches rather than by Skip and
+	// Limit, and aren't grouped by In values.
+	q.Skip, q.Limit, q.GroupInValues = 0, 0, false
+	var more bool
+	var toks []pageToken
+	values, truncated, err := t.collect(q, collector{
+		sorted: func(values []MarshaledResult) ([]MarshaledResult, error) {
+			if cursor != nil {
+				sorter := q.resultSorter()
+				var cmpErr error
+				start := sort.Search(len(values), func(i int) bool {
+					res, err := sorter.compare(values[i], *cursor)
+					if err != nil && cmpErr == nil {
+						cmpErr = err
+					}
+					return res > 0
+				})
+				if cmpErr != nil {
+					return nil, fmt.Errorf("%w: %v", ErrInvalidPageToken, cmpErr)
+				}
+				values = values[start:]
+			}
+			if len(values) > pageSize {
+				values, more = values[:pageSize], true
+			}
+			// Projection may remove the sort fields the tokens hold.
+			toks = make([]pageToken, len(values))
+			for i := range values {
+				toks[i] = newPageToken(values[i], q)
+			}
+			return values, nil
+		},
+	})
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, "", err
+	}
+	var next string
+	if (more || truncated) && len(values) > 0 {
+		var encErr error
+		if next, encErr = toks[len(values)-1].encode(); encErr != nil {
+			return nil, "", encErr
+		}
+	}
+	return resultValues(values), next, err
+}
+
+// pageToken is the decoded token of a page returned by FindPaged.
+type pageToken struct {
+	// Fields holds the sort fields of the last instance of the page.
+	Fields map[string]interface{}
+	// Key is the key of the last instance of the page.
+	Key string
+}
+
+// newPageToken returns the token of a page ending with v.
+func newPageToken(v MarshaledResult, q *Query) pageToken {
+	tok := pageToken{Fields: make(map[string]interface{}), Key: v.Key}
+	for _, key := range append([]Sort{q.Sort}, q.ThenSort...) {
+		for _, path := range key.paths() {
+			copyFieldPath(tok.Fields, v.MarshaledValue, fieldPathKeys(path))
+		}
+	}
+	return tok
+}
+
+// encode returns the encoded token.
+func (tok pageToken) encode() (string, error) {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodePageToken returns the last instance of the page of token s, with
+// its sort fields only.
+func decodePageToken(s string) (*MarshaledResult, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	var tok pageToken
+	if err := json.Unmarshal(b, &tok); err != nil || tok.Key == "" {
+		return nil, ErrInvalidPageToken
+	}
+	res := &MarshaledResult{MarshaledValue: tok.Fields}
+	res.Key = tok.Key
+	return res, nil
+}
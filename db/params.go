@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnboundParam indicates a query has a placeholder without a value.
+	ErrUnboundParam = errors.New("unbound query parameter")
+	// ErrUnusedParam indicates a value was bound to a placeholder the
+	// query doesn't have.
+	ErrUnusedParam = errors.New("unused query parameter")
+)
+
+// Param is a named placeholder for a criterion value, to define a query
+// once and bind values to it for each run, e.g.
+//
+//	tmpl := Where("country").Eq(Param("c"))
+//	q, err := tmpl.Bind(map[string]interface{}{"c": "US"})
+//
+// Queries with placeholders fail validation until bound.
+type Param string
+
+// Bind returns a copy of the query with its placeholders, Ors included,
+// replaced by the values of params. Values have the types criteria values
+// have. It fails if a placeholder has no value, or a value no placeholder.
+// The query itself isn't modified, so it can be bound again.
+func (q *Query) Bind(params map[string]interface{}) (*Query, error) {
+	nq := q.Clone()
+	if nq == nil {
+		nq = &Query{}
+	}
+	used := make(map[string]bool, len(params))
+	if err := nq.bind(params, used); err != nil {
+		return nil, err
+	}
+	for name := range params {
+		if !used[name] {
+			return nil, fmt.Errorf("%w: %q", ErrUnusedParam, name)
+		}
+	}
+	return nq, nil
+}
+
+func (q *Query) bind(params map[string]interface{}, used map[string]bool) error {
+	for _, c := range q.Ands {
+		if err := bindValue(&c.Value, params, used); err != nil {
+			return err
+		}
+		for i := range c.Values {
+			if err := bindValue(&c.Values[i], params, used); err != nil {
+				return err
+			}
+		}
+	}
+	for _, o := range q.Ors {
+		if err := o.bind(params, used); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindValue replaces v with the value of its placeholder, if it has one.
+func bindValue(v *Value, params map[string]interface{}, used map[string]bool) error {
+	if v.Param == nil {
+		return nil
+	}
+	name := *v.Param
+	value, ok := params[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnboundParam, name)
+	}
+	nv := createValue(value)
+	if nv.Param != nil || nv.validate() != nil {
+		return fmt.Errorf("%w: parameter %q has unsupported value type %T", ErrInvalidOperation, name, value)
+	}
+	*v = nv.clone()
+	used[name] = true
+	return nil
+}
+
+// ErrContextValueMissing indicates a context lacks a value a query takes
+// from it.
+var ErrContextValueMissing = errors.New("context value missing")
+
+// WhereFromContext starts a query condition on a field whose value is
+// taken from a context when the query is resolved, e.g. to filter by the
+// tenant of a request. See Criterion.FromContext.
+func WhereFromContext(field string, key interface{}) *Criterion {
+	return Where(field).FromContext(key)
+}
+
+// FromContext makes the operator that follows take its value from the
+// context value for key, set by Query.Resolve, so the operator is given
+// a nil value, e.g.
+//
+//	q := Where("status").Eq("open").And("tenantId").FromContext(tenantKey).Eq(nil)
+//	q, err = q.Resolve(ctx)
+//
+// Operators taking several values, and InCurrentPeriod, can't be used.
+// Queries fail validation until resolved.
+func (c *Criterion) FromContext(key interface{}) *Criterion {
+	c.ContextKey = key
+	return c
+}
+
+// validateContextKey validates a criterion taking its value from a context.
+func (c *Criterion) validateContextKey() error {
+	switch c.Operation {
+	case In, Between, InRanges, InCurrentPeriod:
+		return fmt.Errorf("%w: %s can't take its value from a context", ErrInvalidOperation, c.Operation)
+	}
+	if c.Value.value() == nil {
+		return fmt.Errorf("%w: %v isn't resolved", ErrContextValueMissing, c.ContextKey)
+	}
+	return nil
+}
+
+// Resolve returns a copy of the query with the values of its criteria
+// taking them from a context, Ors included, set to the values of ctx.
+// It fails if ctx lacks one of them. The query itself isn't modified, so
+// it can be resolved again with other contexts.
+func (q *Query) Resolve(ctx context.Context) (*Query, error) {
+	nq := q.Clone()
+	if nq == nil {
+		nq = &Query{}
+	}
+	if err := nq.resolve(ctx); err != nil {
+		return nil, err
+	}
+	return nq, nil
+}
+
+func (q *Query) resolve(ctx context.Context) error {
+	for _, c := range q.Ands {
+		if c.ContextKey == nil {
+			continue
+		}
+		value := ctx.Value(c.ContextKey)
+		if value == nil {
+			return fmt.Errorf("%w: %v", ErrContextValueMissing, c.ContextKey)
+		}
+		v := createValue(value)
+		if v.Param != nil || v.validate() != nil {
+			return fmt.Errorf("%w: context value %v has unsupported type %T", ErrInvalidOperation, c.ContextKey, value)
+		}
+		c.Value = v.clone()
+	}
+	for _, o := range q.Ors {
+		if err := o.resolve(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
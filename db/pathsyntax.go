@@ -0,0 +1,107 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidFieldPath indicates a field path with invalid bracket syntax.
+var ErrInvalidFieldPath = errors.New("invalid field path")
+
+// parseFieldPath returns the keys of fieldPath, and whether each was
+// bracketed. Field paths are dot-separated keys, e.g. "Meta.Rating", where
+// a key may also be given in brackets as a quoted literal, e.g.
+// "Data['weird.key']" or `Data["another one"]["0"]`, so that it can hold
+// dots, spaces or any other characters. A bracketed key is never split,
+// nor a wildcard, and backslashes escape its quote and backslashes in it.
+// Bracketed keys follow a key or another bracketed key without a dot.
+func parseFieldPath(fieldPath string) ([]string, []bool, error) {
+	if !strings.Contains(fieldPath, "[") {
+		keys := strings.Split(fieldPath, ".")
+		return keys, make([]bool, len(keys)), nil
+	}
+	var keys []string
+	var literal []bool
+	for i := 0; ; {
+		if i < len(fieldPath) && fieldPath[i] == '[' {
+			key, n, err := parseBracketedKey(fieldPath, i)
+			if err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, key)
+			literal = append(literal, true)
+			i = n
+		} else {
+			end := strings.IndexAny(fieldPath[i:], ".[")
+			if end < 0 {
+				end = len(fieldPath) - i
+			}
+			keys = append(keys, fieldPath[i:i+end])
+			literal = append(literal, false)
+			i += end
+		}
+		if i == len(fieldPath) {
+			return keys, literal, nil
+		}
+		switch fieldPath[i] {
+		case '.':
+			i++
+			if i < len(fieldPath) && fieldPath[i] == '[' {
+				return nil, nil, fmt.Errorf("%w: %s: unexpected [ after . at offset %d", ErrInvalidFieldPath, fieldPath, i)
+			}
+		case '[':
+		default:
+			return nil, nil, fmt.Errorf("%w: %s: expected . or [ at offset %d", ErrInvalidFieldPath, fieldPath, i)
+		}
+	}
+}
+
+// parseBracketedKey parses the bracketed key of fieldPath at offset i,
+// returning it and the offset following it.
+func parseBracketedKey(fieldPath string, i int) (string, int, error) {
+	start := i
+	i++
+	if i == len(fieldPath) || (fieldPath[i] != '\'' && fieldPath[i] != '"') {
+		return "", 0, fmt.Errorf("%w: %s: expected a quote at offset %d", ErrInvalidFieldPath, fieldPath, i)
+	}
+	quote := fieldPath[i]
+	i++
+	var b strings.Builder
+	for ; i < len(fieldPath); i++ {
+		c := fieldPath[i]
+		if c == '\\' && i+1 < len(fieldPath) && (fieldPath[i+1] == quote || fieldPath[i+1] == '\\') {
+			i++
+			b.WriteByte(fieldPath[i])
+			continue
+		}
+		if c == quote {
+			if i+1 == len(fieldPath) || fieldPath[i+1] != ']' {
+				return "", 0, fmt.Errorf("%w: %s: expected ] at offset %d", ErrInvalidFieldPath, fieldPath, i+1)
+			}
+			return b.String(), i + 2, nil
+		}
+		b.WriteByte(c)
+	}
+	return "", 0, fmt.Errorf("%w: %s: unterminated key at offset %d", ErrInvalidFieldPath, fieldPath, start)
+}
+
+// fieldPathKeys returns the keys of fieldPath, which has been validated.
+func fieldPathKeys(fieldPath string) []string {
+	keys, _, err := parseFieldPath(fieldPath)
+	if err != nil {
+		return strings.Split(fieldPath, ".")
+	}
+	return keys
+}
+
+// validateFieldPaths validates the syntax of the field paths of the
+// criterion.
+func (c *Criterion) validateFieldPaths() error {
+	for _, path := range c.paths() {
+		if _, _, err := parseFieldPath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+)
+
+var (
+	// ErrPatternRejected indicates a Matches pattern exceeds the db pattern limits.
+	ErrPatternRejected = errors.New("pattern rejected")
+
+	// DefaultPatternLimits are the pattern limits of dbs which don't set them.
+	DefaultPatternLimits = PatternLimits{MaxLength: 1024, MaxProgSize: 10000}
+)
+
+// PatternLimits bound the regular expressions queries may use with Matches,
+// so that user supplied patterns can't make queries arbitrarily costly.
+// Go regular expressions match in time linear in their input, so there's
+// no catastrophic backtracking, but the cost of compiling and running them
+// still grows with the size of the pattern.
+// Zero values use the defaults of DefaultPatternLimits.
+type PatternLimits struct {
+	// MaxLength is the maximum length of a pattern, in bytes.
+	MaxLength int
+	// MaxProgSize is the maximum number of instructions a compiled pattern
+	// may have. It bounds patterns which are short but expand, e.g. "a{1000}".
+	MaxProgSize int
+}
+
+// compile compiles pattern, if it's within the limits.
+// The length is checked before parsing, and the program size before the
+// pattern is compiled for matching.
+func (l PatternLimits) compile(pattern string) (*regexp.Regexp, error) {
+	maxLength, maxProgSize := l.MaxLength, l.MaxProgSize
+	if maxLength <= 0 {
+		maxLength = DefaultPatternLimits.MaxLength
+	}
+	if maxProgSize <= 0 {
+		maxProgSize = DefaultPatternLimits.MaxProgSize
+	}
+	if len(pattern) > maxLength {
+		return nil, fmt.Errorf("%w: length %d exceeds the maximum of %d", ErrPatternRejected, len(pattern), maxLength)
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOperation, err)
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOperation, err)
+	}
+	if len(prog.Inst) > maxProgSize {
+		return nil, fmt.Errorf("%w: compiled size %d exceeds the maximum of %d", ErrPatternRejected, len(prog.Inst), maxProgSize)
+	}
+	return regexp.Compile(pattern)
+}
+
+// Matches is a regular expression operator against a string field, matching
+// when the field contains a match of pattern, in RE2 syntax. Anchor the
+// pattern with ^ and $ to match whole fields. Patterns are subject to the
+// PatternLimits of the db the query runs in.
+func (c *Criterion) Matches(pattern string) *Query {
+	return c.createcriterion(Matches, pattern)
+}
+
+// compilePatterns compiles the Matches patterns of q and its Ors within limits.
+func (q *Query) compilePatterns(limits PatternLimits) error {
+	q.patternLimits = limits
+	for _, c := range q.Ands {
+		if c.Operation != Matches || c.Value.String == nil {
+			continue
+		}
+		re, err := limits.compile(*c.Value.String)
+		if err != nil {
+			return err
+		}
+		c.re = re
+	}
+	for _, o := range q.Ors {
+		if err := o.compilePatterns(limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchPattern matches if value is a string containing a match of the
+// criterion pattern.
+func (c *Criterion) matchPattern(value interface{}, critVal Value, opts MatchOptions) (bool, error) {
+	s, ok := value.(string)
+	if !ok || critVal.String == nil {
+		return false, &ErrTypeMismatch{value, critVal}
+	}
+	re, err := c.pattern(*critVal.String, opts)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(s), nil
+}
+
+// pattern returns the compiled pattern p of the criterion. Patterns other
+// than the one compiled beforehand, e.g. changed by a normalizer, are
+// compiled within the pattern limits of opts.
+func (c *Criterion) pattern(p string, opts MatchOptions) (*regexp.Regexp, error) {
+	if c.re != nil && c.re.String() == p {
+		return c.re, nil
+	}
+	return opts.patternLimits.compile(p)
+}
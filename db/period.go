@@ -0,0 +1,114 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Period is a calendar period used by InCurrentPeriod.
+type Period string
+
+const (
+	// Day is the calendar day, from midnight to midnight.
+	Day Period = "day"
+	// Week is the ISO week, from Monday to Monday.
+	Week Period = "week"
+	// Month is the calendar month.
+	Month Period = "month"
+)
+
+// bounds returns the start and end of the period containing now, in loc.
+// The start is inclusive, while the end is exclusive.
+func (p Period) bounds(now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	now = now.In(loc)
+	y, m, d := now.Date()
+	switch p {
+	case Day:
+		start := time.Date(y, m, d, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 1), nil
+	case Week:
+		start := time.Date(y, m, d-(int(now.Weekday())+6)%7, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 7), nil
+	case Month:
+		start := time.Date(y, m, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0), nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: unknown period %q", ErrInvalidOperation, p)
+	}
+}
+
+// InCurrentPeriod is an operator against a time field, matching when the
+// field falls within the period p, as of when the query is run, in loc.
+// e.g. Where("Created").InCurrentPeriod(Day, loc) matches instances created
+// today. A nil loc is UTC. Times are RFC 3339 strings, as time.Time is
+// encoded in JSON, or Unix timestamps in seconds.
+//
+// Results depend on when the query is run, so they aren't reproducible
+// across runs, and cached results may be from a past period.
+// Periods start at midnight, or the earliest time after it on days where
+// a DST change skips midnight, so days around DST changes may not last
+// 24 hours, nor weeks and months spanning them a whole number of days.
+func (c *Criterion) InCurrentPeriod(p Period, loc *time.Location) *Query {
+	if loc == nil {
+		loc = time.UTC
+	}
+	c.Period = p
+	c.Location = loc.String()
+	c.loc = loc
+	return c.createcriterion(InCurrentPeriod, nil)
+}
+
+// location returns the location of the criterion period. Locations
+// of deserialized criteria are loaded by name.
+func (c *Criterion) location() (*time.Location, error) {
+	if c.loc != nil {
+		return c.loc, nil
+	}
+	loc, err := time.LoadLocation(c.Location)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s location: %v", ErrInvalidOperation, c.Operation, err)
+	}
+	return loc, nil
+}
+
+// validatePeriod validates an InCurrentPeriod criterion.
+func (c *Criterion) validatePeriod() error {
+	loc, err := c.location()
+	if err != nil {
+		return err
+	}
+	_, _, err = c.Period.bounds(time.Now(), loc)
+	return err
+}
+
+// resolvePeriods sets the bounds of the InCurrentPeriod criteria of q and
+// its Ors to the periods containing now, so that all the instances
+// scanned by a query are matched against the same period.
+func (q *Query) resolvePeriods(now time.Time) {
+	for _, c := range q.Ands {
+		if c.Operation != InCurrentPeriod {
+			continue
+		}
+		loc, err := c.location()
+		if err != nil {
+			continue
+		}
+		c.periodStart, c.periodEnd, _ = c.Period.bounds(now, loc)
+	}
+	for _, o := range q.Ors {
+		o.resolvePeriods(now)
+	}
+}
+
+// matchPeriod matches if value is a time within the resolved period.
+// Unresolved criteria match nothing.
+func (c *Criterion) matchPeriod(value interface{}) (bool, error) {
+	t, ok := timeValue(value)
+	if !ok {
+		return false, &ErrTypeMismatch{value, c.Period}
+	}
+	if c.periodStart.IsZero() {
+		return false, nil
+	}
+	return !t.Before(c.periodStart) && t.Before(c.periodEnd), nil
+}
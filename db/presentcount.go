@@ -0,0 +1,77 @@
+package db
+
+import (
+	"fmt"
+)
+
+// WherePresentCount starts a query matching instances by how many of
+// fields are present, that is neither missing nor null, comparing the
+// count against n with op, one of Eq, Ne, Gt, Lt, Ge and Le, e.g.
+// WherePresentCount([]string{"Email", "Phone", "Address"}, Ge, 2) matches
+// instances with at least two of these fields. Unlike other criteria,
+// missing fields never fail the query.
+func WherePresentCount(fields []string, op Operation, n int) *Query {
+	c := &Criterion{PresentFields: append([]string(nil), fields...)}
+	return c.createcriterion(op, float64(n))
+}
+
+// validatePresentCount validates a criterion counting present fields.
+func (c *Criterion) validatePresentCount() error {
+	switch c.Operation {
+	case Eq, Ne, Gt, Lt, Ge, Le:
+	default:
+		return fmt.Errorf("%w: %s can't compare a present field count", ErrInvalidOperation, c.Operation)
+	}
+	for _, field := range c.PresentFields {
+		if field == "" || isWildcardPath(field) {
+			return fmt.Errorf("%w: invalid present field path %q", ErrInvalidOperation, field)
+		}
+	}
+	if n := c.Value.Float; n == nil || *n < 0 || *n != float64(int(*n)) {
+		return fmt.Errorf("%w: present field count must be a non-negative integer", ErrInvalidOperation)
+	}
+	return nil
+}
+
+// matchPresentCount matches v by the number of present fields of the
+// criterion in it.
+func (c *Criterion) matchPresentCount(v map[string]interface{}) (bool, error) {
+	var count int
+	for _, field := range c.PresentFields {
+		value, err := c.traverse(v, field)
+		if err == nil && value.IsValid() {
+			count++
+		}
+	}
+	res := compareFloats(float64(count), *c.Value.Float)
+	var ok bool
+	switch c.Operation {
+	case Eq:
+		ok = res == 0
+	case Ne:
+		ok = res != 0
+	case Gt:
+		ok = res > 0
+	case Lt:
+		ok = res < 0
+	case Ge:
+		ok = res >= 0
+	case Le:
+		ok = res <= 0
+	}
+	return ok != c.Negated, nil
+}
+
+// paths returns the field paths the criterion refers to.
+func (c *Criterion) paths() []string {
+	if len(c.PresentFields) > 0 {
+		return c.PresentFields
+	}
+	paths := []string{c.FieldPath}
+	for _, path := range []string{c.ChecksumField, c.OtherField, c.HighField} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
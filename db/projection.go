@@ -0,0 +1,135 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Select keeps only the fields at the given paths, and the instance ID, in
+// the results of Find, e.g. to return a subset of large instances. Paths
+// use dot syntax to reach nested fields. Find filters, then sorts, then
+// projects, so criteria and sort keys can refer to any field, selected or
+// not, by the same paths as Select, and field aliases apply to selected
+// paths as they do to sort keys. Missing fields are ignored. Multiple calls
+// accumulate paths. A query can't both select and exclude fields.
+func (q *Query) Select(fields ...string) *Query {
+	q.Selected = append(q.Selected, fields...)
+	return q
+}
+
+// Exclude removes the fields at the given paths from the results of Find,
+// e.g. to leave out large fields which aren't needed. Paths use dot syntax
+// to reach nested fields, and a "*" segment reaches every key of an object.
+// Fields are removed after instances are matched and sorted, so criteria
+// and sort keys can still refer to them. Missing fields are ignored.
+// Multiple calls accumulate paths. A query can't both select and exclude
+// fields.
+func (q *Query) Exclude(fields ...string) *Query {
+	q.Excluded = append(q.Excluded, fields...)
+	return q
+}
+
+// FindMapped is like Find, but applies fn to each result, after sorting and
+// projection, and returns the values it returns, e.g. to redact a field or
+// add a computed one. fn receives the instance as the iterator decoded it,
+// so it's decoded once, and it may modify and return it. An error from fn
+// fails the query.
+func (t *Txn) FindMapped(q *Query, fn func(map[string]interface{}) (map[string]interface{}, error)) ([][]byte, error) {
+	values, findErr := t.find(q)
+	if findErr != nil && !errors.Is(findErr, ErrTextEvalTimeout) {
+		return nil, findErr
+	}
+	res := make([][]byte, len(values))
+	for i := range values {
+		mapped, err := fn(values[i].MarshaledValue)
+		if err != nil {
+			return nil, err
+		}
+		if res[i], err = json.Marshal(mapped); err != nil {
+			return nil, err
+		}
+	}
+	return res, findErr
+}
+
+// projectFields keeps the fields of the decoded values q selects, if any,
+// removes the ones it excludes, and encodes them again.
+func projectFields(values []MarshaledResult, q *Query) error {
+	if len(q.Selected) == 0 && len(q.Excluded) == 0 {
+		return nil
+	}
+	for i := range values {
+		if len(q.Selected) > 0 {
+			values[i].MarshaledValue = selectFields(values[i].MarshaledValue, q.Selected)
+		}
+		for _, p := range q.Excluded {
+			removeFieldPath(values[i].MarshaledValue, fieldPathKeys(p))
+		}
+		b, err := json.Marshal(values[i].MarshaledValue)
+		if err != nil {
+			return err
+		}
+		values[i].Value = b
+	}
+	return nil
+}
+
+// selectFields returns the fields of v at paths, and its instance ID.
+func selectFields(v map[string]interface{}, paths []string) map[string]interface{} {
+	selected := make(map[string]interface{})
+	if id, ok := v[idFieldName]; ok {
+		selected[idFieldName] = id
+	}
+	for _, p := range paths {
+		copyFieldPath(selected, v, fieldPathKeys(p))
+	}
+	return selected
+}
+
+// copyFieldPath copies the field at the path of fields from src to dst,
+// if any, creating the objects leading to it.
+func copyFieldPath(dst, src map[string]interface{}, fields []string) {
+	v, ok := src[fields[0]]
+	if !ok {
+		return
+	}
+	if len(fields) == 1 {
+		dst[fields[0]] = v
+		return
+	}
+	child, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	next, ok := dst[fields[0]].(map[string]interface{})
+	if !ok {
+		next = map[string]interface{}{}
+		dst[fields[0]] = next
+	}
+	copyFieldPath(next, child, fields[1:])
+}
+
+// removeFieldPath removes the field at the path of fields from v, if any.
+func removeFieldPath(v map[string]interface{}, fields []string) {
+	if len(fields) == 1 {
+		if fields[0] == "*" {
+			for k := range v {
+				delete(v, k)
+			}
+			return
+		}
+		delete(v, fields[0])
+		return
+	}
+	if fields[0] == "*" {
+		for _, child := range v {
+			if m, ok := child.(map[string]interface{}); ok {
+				removeFieldPath(m, fields[1:])
+			}
+		}
+		return
+	}
+	if m, ok := v[fields[0]].(map[string]interface{}); ok {
+		removeFieldPath(m, fields[1:])
+	}
+}
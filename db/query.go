@@ -1,20 +1,43 @@
 package db
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
 	dse "github.com/textileio/go-datastore-extensions"
 	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/thread"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
 )
 
 // Query is a json-seriable query representation.
+//
+// Without a Sort, results are returned in the order the underlying
+// datastore yields them. For ordered datastores (e.g. Badger) that is
+// ascending key order when no index is used, or index value order when
+// one is, but no order is guaranteed. Use OrderByKey (or OrderByID) when
+// callers rely on a stable ordering.
+//
+// Running a query never modifies it, so a built Query may be shared by
+// concurrent Find calls. Builder methods modify the query in place and
+// must not be called concurrently with each other or with a running
+// query; use Clone to derive variants of a shared query instead.
 type Query struct {
 	Ands  []*Criterion
 	Ors   []*Query
@@ -23,6 +46,81 @@ type Query struct {
 	Limit int
 	Skip  int
 	Index string
+	// ByteLimit is the maximum total size of the results of Find, in
+	// bytes. Zero means no limit.
+	ByteLimit int `json:",omitempty"`
+	// TextTimeout bounds the time Find spends on a query with text
+	// criteria. Zero means no timeout.
+	TextTimeout time.Duration `json:",omitempty"`
+	// Prefetch is the number of instances read per datastore call while
+	// iterating an index. Zero means the default.
+	Prefetch int `json:",omitempty"`
+	// Aliases maps legacy field paths to their current paths.
+	Aliases map[string]string `json:",omitempty"`
+	// ThenSort lists further sort keys, each breaking ties of the ones
+	// before it, starting with Sort.
+	ThenSort []Sort `json:",omitempty"`
+	// Selected lists the field paths kept in the results of Find.
+	Selected []string `json:",omitempty"`
+	// Excluded lists field paths removed from the results of Find.
+	Excluded []string `json:",omitempty"`
+	// ExcludedIDs lists the IDs of instances left out of the results.
+	ExcludedIDs []core.InstanceID `json:",omitempty"`
+	// GroupInValues groups results by the value of the first In criterion
+	// they're equal to, in the order the values are listed.
+	GroupInValues bool `json:",omitempty"`
+	MatchOptions
+
+	sortErr             error
+	maxPathDepth        int
+	onScan              func() error
+	reverseIndex        bool
+	ignoreDefaultFilter bool
+	excludedIDs         map[core.InstanceID]struct{}
+	defaultFilter       *Query
+	bigInts             bool
+	doc                 []byte
+}
+
+// MatchOptions control how criteria values are compared against instance
+// fields. They're set on the root query and apply to all its Or branches.
+type MatchOptions struct {
+	// CoerceNumbers compares string criteria against numeric fields (and
+	// numeric criteria against string fields) by parsing the string.
+	CoerceNumbers bool `json:",omitempty"`
+	// CoerceBools compares boolean criteria against numeric and string
+	// fields by their truthiness.
+	CoerceBools bool `json:",omitempty"`
+	// MissingMatchesNe makes Ne criteria match instances missing the field.
+	MissingMatchesNe bool `json:",omitempty"`
+	// RuneOrdering compares strings by code point rather than byte.
+	RuneOrdering bool `json:",omitempty"`
+	// FieldOrders map field paths to the explicit order of their string
+	// values, used by comparison operators and sorts.
+	FieldOrders map[string][]string `json:",omitempty"`
+	// NumberFormat is the format of numbers held in strings, parsed by
+	// number coercion and numeric sorts.
+	NumberFormat NumberFormat `json:",omitempty"`
+	// CaseInsensitiveFields looks up keys of criteria field paths missing
+	// from instances case-insensitively.
+	CaseInsensitiveFields bool `json:",omitempty"`
+	// StrictFieldOrders fails comparing and sorting values missing from
+	// their field order, instead of ordering them after the listed ones.
+	StrictFieldOrders bool `json:",omitempty"`
+	// Normalizer transforms field and criteria values before they're
+	// compared or sorted. It isn't serialized.
+	Normalizer func(fieldPath string, v interface{}) interface{} `json:"-"`
+
+	// patternLimits are the limits of the db the query runs in, which
+	// patterns changed by the normalizer are compiled within.
+	patternLimits PatternLimits
+}
+
+func (o MatchOptions) normalize(fieldPath string, v interface{}) interface{} {
+	if o.Normalizer == nil {
+		return v
+	}
+	return o.Normalizer(fieldPath, v)
 }
 
 // Criterion represents a restriction on a field.
@@ -30,7 +128,53 @@ type Criterion struct {
 	FieldPath string
 	Operation Operation
 	Value     Value
-	query     *Query
+	// Tolerance is the relative tolerance used by EqWithin.
+	Tolerance float64 `json:",omitempty"`
+	// Values are the values used by In, the bounds used by Between and
+	// InRanges, as consecutive low and high pairs, or the divisor and
+	// remainder used by Mod.
+	Values []Value `json:",omitempty"`
+	// Negated inverts the result of the criterion.
+	Negated bool `json:",omitempty"`
+	// BigInt compares the value, a string holding an integer, against
+	// fields as arbitrary-precision numbers.
+	BigInt bool `json:",omitempty"`
+	// NullSafe treats missing and null fields as null values, which only
+	// a nil value equals, rather than as errors.
+	NullSafe bool `json:",omitempty"`
+	// OtherField is the field path of the instance field compared against,
+	// plus Offset, by field comparisons such as GtFieldPlus. HighField is
+	// the upper bound of BetweenFields, whose lower bound is OtherField.
+	OtherField string  `json:",omitempty"`
+	Offset     float64 `json:",omitempty"`
+	HighField  string  `json:",omitempty"`
+	// AssertedType is the type the field must have, set by AssertType.
+	AssertedType FieldType `json:",omitempty"`
+	// Folded compares strings under Unicode case folding, set by Fold.
+	Folded bool `json:",omitempty"`
+	// PresentFields are the field paths counted by WherePresentCount,
+	// whose count is compared against the value.
+	PresentFields []string `json:",omitempty"`
+	// ChecksumField is the field path of the checksum of the field, computed
+	// with ChecksumAlgo, compared by WhereChecksumMismatch.
+	ChecksumField string       `json:",omitempty"`
+	ChecksumAlgo  ChecksumAlgo `json:",omitempty"`
+	// MatchAnyValue matches an object field if any of its values match.
+	MatchAnyValue bool `json:",omitempty"`
+	// Period and Location are the period, and the name of the location
+	// it's in, used by InCurrentPeriod.
+	Period   Period `json:",omitempty"`
+	Location string `json:",omitempty"`
+	// ContextKey is the key of the context value Query.Resolve sets as
+	// the criterion value. It isn't serialized.
+	ContextKey interface{} `json:"-"`
+	query      *Query
+	subquery   *subquery
+
+	loc         *time.Location
+	periodStart time.Time
+	periodEnd   time.Time
+	re          *regexp.Regexp
 }
 
 // Value models a single value in JSON.
@@ -38,6 +182,8 @@ type Value struct {
 	String *string
 	Bool   *bool
 	Float  *float64
+	// Param is the name of a placeholder, replaced by Query.Bind.
+	Param *string `json:",omitempty"`
 }
 
 // Validate validates en entire query.
@@ -45,6 +191,47 @@ func (q *Query) Validate() error {
 	if q == nil {
 		return nil
 	}
+	if q.sortErr != nil {
+		return q.sortErr
+	}
+	for _, s := range q.ThenSort {
+		if s.ByRelevance || q.Sort.ByRelevance {
+			return fmt.Errorf("%w: relevance can't be combined with other sort keys", ErrInvalidSortingField)
+		}
+		if (s.FieldPath == "" && len(s.Weights) == 0) || (q.Sort.FieldPath == "" && len(q.Sort.Weights) == 0) {
+			return fmt.Errorf("%w: sort keys must have a field path", ErrInvalidSortingField)
+		}
+	}
+	for _, s := range append([]Sort{q.Sort}, q.ThenSort...) {
+		if err := s.validateWeights(); err != nil {
+			return err
+		}
+	}
+	if err := q.NumberFormat.validate(); err != nil {
+		return err
+	}
+	if q.ByteLimit < 0 {
+		return fmt.Errorf("%w: byte limit can't be negative", ErrInvalidOperation)
+	}
+	if q.TextTimeout < 0 {
+		return fmt.Errorf("%w: text timeout can't be negative", ErrInvalidOperation)
+	}
+	if q.GroupInValues && q.groupingCriterion() == nil {
+		return fmt.Errorf("%w: grouping by In values requires an In criterion", ErrInvalidOperation)
+	}
+	for _, f := range q.Selected {
+		if f == "" {
+			return fmt.Errorf("%w: selected field paths can't be empty", ErrInvalidOperation)
+		}
+	}
+	for _, f := range q.Excluded {
+		if f == "" {
+			return fmt.Errorf("%w: excluded field paths can't be empty", ErrInvalidOperation)
+		}
+	}
+	if len(q.Selected) > 0 && len(q.Excluded) > 0 {
+		return fmt.Errorf("%w: fields can't be both selected and excluded", ErrInvalidOperation)
+	}
 	for _, a := range q.Ands {
 		if err := a.Validate(); err != nil {
 			return err
@@ -63,14 +250,128 @@ func (c *Criterion) Validate() error {
 	if c == nil {
 		return nil
 	}
+	if _, ok := operationNames[c.Operation]; !ok {
+		return fmt.Errorf("%w %s", ErrInvalidOperation, c.Operation)
+	}
+	if c.ContextKey != nil {
+		if err := c.validateContextKey(); err != nil {
+			return err
+		}
+	}
+	if err := c.validateAssertedType(); err != nil {
+		return err
+	}
+	if err := c.validateFieldPaths(); err != nil {
+		return err
+	}
+	if c.Folded && c.OtherField != "" {
+		return fmt.Errorf("%w: field comparisons can't fold case", ErrInvalidOperation)
+	}
+	if len(c.PresentFields) > 0 && (c.Folded || c.AssertedType != "") {
+		return fmt.Errorf("%w: present field counts can't fold case or assert a field type", ErrInvalidOperation)
+	}
+	if c.ChecksumField != "" && (c.Folded || c.AssertedType != "") {
+		return fmt.Errorf("%w: checksum criteria can't fold case or assert a field type", ErrInvalidOperation)
+	}
+	if len(c.PresentFields) > 0 {
+		return c.validatePresentCount()
+	}
+	if c.ChecksumField != "" {
+		return c.validateChecksum()
+	}
+	if c.OtherField != "" {
+		return c.validateFieldComparison()
+	}
+	if c.Folded && c.Operation != Eq && c.Operation != Ne && c.Operation != In {
+		return fmt.Errorf("%w: %s can't fold case", ErrInvalidOperation, c.Operation)
+	}
+	if c.Operation == In {
+		if len(c.Values) == 0 && c.subquery == nil {
+			return fmt.Errorf("%w: %s requires at least one value", ErrInvalidOperation, c.Operation)
+		}
+		for _, v := range c.Values {
+			if err := v.validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if c.Operation == InCurrentPeriod {
+		return c.validatePeriod()
+	}
+	if c.Operation == Mod {
+		return c.validateMod()
+	}
+	if c.Operation == Between && len(c.Values) != 2 {
+		return fmt.Errorf("%w: %s requires a low and a high value", ErrInvalidOperation, c.Operation)
+	}
+	if c.Operation == InRanges && (len(c.Values) == 0 || len(c.Values)%2 != 0) {
+		return fmt.Errorf("%w: %s requires pairs of low and high values", ErrInvalidOperation, c.Operation)
+	}
+	if c.Operation == Between || c.Operation == InRanges {
+		for i := 0; i < len(c.Values); i += 2 {
+			if err := c.validateRange(c.Values[i], c.Values[i+1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if c.NullSafe {
+		return c.validateNullSafe()
+	}
+	if err := c.Value.validate(); err != nil {
+		return err
+	}
+	if c.BigInt {
+		return c.validateBigInt()
+	}
+	if c.Operation == EqWithin {
+		if c.Value.Float == nil {
+			return fmt.Errorf("%w: %s requires a numeric value", ErrInvalidOperation, c.Operation)
+		}
+		if c.Tolerance < 0 {
+			return fmt.Errorf("%w: %s tolerance can't be negative", ErrInvalidOperation, c.Operation)
+		}
+	}
+	if (c.Operation == ContainsFold || c.Operation == Matches || c.Operation == StartsWith) && c.Value.String == nil {
+		return fmt.Errorf("%w: %s requires a string value", ErrInvalidOperation, c.Operation)
+	}
+	return nil
+}
+
+// validateRange validates the bounds of a range.
+func (c *Criterion) validateRange(low, high Value) error {
+	if err := low.validate(); err != nil {
+		return err
+	}
+	if err := high.validate(); err != nil {
+		return err
+	}
+	res, err := compareValue(low.value(), high)
+	if err != nil {
+		return fmt.Errorf("%w: %s bounds must be of the same type", ErrInvalidOperation, c.Operation)
+	}
+	if res > 0 {
+		return fmt.Errorf("%w: %s low value can't be greater than high value", ErrInvalidOperation, c.Operation)
+	}
+	return nil
+}
+
+func (v Value) validate() error {
 	noNil := 0
-	if c.Value.Bool != nil {
+	if v.Bool != nil {
 		noNil++
 	}
-	if c.Value.String != nil {
+	if v.String != nil {
 		noNil++
 	}
-	if c.Value.Float != nil {
+	if v.Float != nil {
+		noNil++
+	}
+	if v.Param != nil {
+		if noNil == 0 {
+			return fmt.Errorf("%w: %q", ErrUnboundParam, *v.Param)
+		}
 		noNil++
 	}
 	if noNil != 1 {
@@ -83,6 +384,104 @@ func (c *Criterion) Validate() error {
 type Sort struct {
 	FieldPath string
 	Desc      bool
+	// ByLen sorts by the length of an array or string field.
+	ByLen bool `json:",omitempty"`
+	// Collation, if set, orders string values by the rules of a language
+	// instead of by their bytes.
+	Collation *CollationOptions `json:",omitempty"`
+	// ByRelevance sorts by relevance to the query's text criteria,
+	// regardless of FieldPath.
+	ByRelevance bool `json:",omitempty"`
+	// Numeric orders strings holding numbers, e.g. "-5" or "1000.50", by
+	// their numeric value. Numbers sort before other values in ascending order.
+	Numeric bool `json:",omitempty"`
+	// ArrayMin and ArrayMax sort by the minimum or maximum number of an
+	// array field.
+	ArrayMin bool `json:",omitempty"`
+	ArrayMax bool `json:",omitempty"`
+	// Weights sorts by the weighted sum of the numeric fields they're
+	// keyed by, regardless of FieldPath.
+	Weights map[string]float64 `json:",omitempty"`
+}
+
+func (s Sort) clone() Sort {
+	ns := s
+	if s.Collation != nil {
+		collation := *s.Collation
+		ns.Collation = &collation
+	}
+	if s.Weights != nil {
+		ns.Weights = make(map[string]float64, len(s.Weights))
+		for field, w := range s.Weights {
+			ns.Weights[field] = w
+		}
+	}
+	return ns
+}
+
+// enabled returns whether the sort orders results at all.
+func (s Sort) enabled() bool {
+	return s.FieldPath != "" || s.ByRelevance || len(s.Weights) > 0
+}
+
+// SortSpec describes the sort order of a query as data, e.g. decoded from
+// an API request, as an alternative to the OrderBy builders.
+type SortSpec struct {
+	// Fields are the sort keys, each breaking ties of the ones before it.
+	Fields []SortField `json:"fields"`
+}
+
+// SortField is a sort key of a SortSpec.
+type SortField struct {
+	// FieldPath is the path of the field to sort by, in dot syntax.
+	FieldPath string `json:"field"`
+	// Desc sorts in descending order.
+	Desc bool `json:"desc,omitempty"`
+	// Collation, if set, orders string values with a collator.
+	Collation *CollationOptions `json:"collation,omitempty"`
+	// Numeric orders strings holding numbers by their numeric value.
+	Numeric bool `json:"numeric,omitempty"`
+}
+
+// Validate validates the sort spec.
+func (s SortSpec) Validate() error {
+	if len(s.Fields) == 0 {
+		return fmt.Errorf("%w: sort spec has no fields", ErrInvalidSortingField)
+	}
+	for i, f := range s.Fields {
+		if f.FieldPath == "" {
+			return fmt.Errorf("%w: sort spec field %d has no field path", ErrInvalidSortingField, i)
+		}
+	}
+	return nil
+}
+
+// CollationOptions controls the ordering of strings in a collated sort.
+type CollationOptions struct {
+	// Locale is a BCP 47 language tag, e.g. "fr" or "de-CH", whose rules
+	// are used. Defaults to the root collation order.
+	Locale string `json:",omitempty"`
+	// IgnoreCase orders strings differing only by case as equal.
+	IgnoreCase bool `json:",omitempty"`
+	// IgnoreAccents orders strings differing only by diacritics as equal.
+	IgnoreAccents bool `json:",omitempty"`
+}
+
+// collator returns a collator for the options.
+// Collators aren't safe for concurrent use, so one is built per sort.
+func (o CollationOptions) collator() *collate.Collator {
+	tag := language.Und
+	if o.Locale != "" {
+		tag = language.Make(o.Locale)
+	}
+	var opts []collate.Option
+	if o.IgnoreCase {
+		opts = append(opts, collate.IgnoreCase)
+	}
+	if o.IgnoreAccents {
+		opts = append(opts, collate.IgnoreDiacritics)
+	}
+	return collate.New(tag, opts...)
 }
 
 // Operation models comparison operators.
@@ -101,21 +500,151 @@ const (
 	Ge = Operation(ge)
 	// Le is "less than or equal to"
 	Le = Operation(le)
+	// EqWithin is "equals within a relative tolerance"
+	EqWithin = Operation(eqWithin)
+	// ContainsFold is "contains substring, ignoring case"
+	ContainsFold = Operation(containsFold)
+	// In is "equal to any of"
+	In = Operation(in)
+	// Between is "greater than or equal to low and less than or equal to high"
+	Between = Operation(between)
+	// InCurrentPeriod is "within the current period"
+	InCurrentPeriod = Operation(inCurrentPeriod)
+	// Matches is "contains a match of the regular expression"
+	Matches = Operation(matches)
+	// InRanges is "between low and high of any of the ranges"
+	InRanges = Operation(inRanges)
+	// StartsWith is "starts with prefix"
+	StartsWith = Operation(startsWith)
+	// Mod is "divided by divisor has remainder"
+	Mod = Operation(mod)
 )
 
+var operationNames = map[Operation]string{
+	Eq:              "eq",
+	Ne:              "ne",
+	Gt:              "gt",
+	Lt:              "lt",
+	Ge:              "ge",
+	Le:              "le",
+	EqWithin:        "eqwithin",
+	ContainsFold:    "containsfold",
+	In:              "in",
+	Between:         "between",
+	InCurrentPeriod: "incurrentperiod",
+	Matches:         "matches",
+	InRanges:        "inranges",
+	StartsWith:      "startswith",
+	Mod:             "mod",
+}
+
+// String returns the short name of the operation, e.g., "eq" or "ge".
+func (o Operation) String() string {
+	if name, ok := operationNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("Operation(%d)", int(o))
+}
+
+// AllOperations returns every valid operation, in declaration order.
+func AllOperations() []Operation {
+	return []Operation{Eq, Ne, Gt, Lt, Ge, Le, EqWithin, ContainsFold, In, Between, InCurrentPeriod, Matches, InRanges, StartsWith, Mod}
+}
+
+// ParseOperation returns the operation named by s, as returned by String.
+// Matching is case-insensitive.
+func ParseOperation(s string) (Operation, error) {
+	name := strings.ToLower(s)
+	for _, o := range AllOperations() {
+		if operationNames[o] == name {
+			return o, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", ErrInvalidOperation, s)
+}
+
 var (
 	// ErrInvalidSortingField is returned when a query sorts a result by a
 	// non-existent field in the collection schema.
 	ErrInvalidSortingField = errors.New("sorting field doesn't correspond to instance type")
+	// ErrFieldMissing is returned when a query criterion refers to a field
+	// which doesn't exist in an instance.
+	ErrFieldMissing = errors.New("instance field doesn't exist")
+	// ErrInvalidOperation is returned when a query criterion has an unknown
+	// operation, or a value its operation can't be used with.
+	ErrInvalidOperation = errors.New("invalid operation")
+	// ErrPathTooDeep is returned when a field path has more fields than
+	// the db allows.
+	ErrPathTooDeep = errors.New("field path too deep")
+	// ErrNoResults is returned by FindRequireResults when a query matches
+	// no instances.
+	ErrNoResults = errors.New("query has no results")
+	// ErrQueryTooComplex is returned when a query has more criteria and
+	// Or branches than the db allows.
+	ErrQueryTooComplex = errors.New("query too complex")
 )
 
+// DefaultMaxPathDepth is the maximum number of fields of the field paths
+// queries traverse, in dbs which don't set one.
+const DefaultMaxPathDepth = 32
+
+// DefaultMaxQueryCriteria is the maximum number of criteria and Or
+// branches of queries, in dbs which don't set one.
+const DefaultMaxQueryCriteria = 256
+
 // Where starts to create a query condition for a field.
+// Use dot syntax to reach nested fields, e.g., "name.last". A "*" segment
+// matches every key of an object, e.g., "prices.*.amount", and the condition
+// matches if it holds for any of them. Wildcard paths visit every key at
+// each wildcard level of every instance, can't be served by indexes,
+// and can't be sorted on. Similarly, a segment reaching an array reaches
+// every element of it, flattening nested arrays, so "Teams.Members.Name"
+// matches if any member of any team has a matching name. Such paths are
+// only expanded for instances where the plain path is missing, and visit
+// every element of the arrays they cross. Keys holding dots or other
+// special characters can be given as quoted literals in brackets, e.g.,
+// "data['weird.key']['another one']", see parseFieldPath.
 func Where(field string) *Criterion {
 	return &Criterion{
 		FieldPath: field,
 	}
 }
 
+// WhereBoundingBox starts a query matching points within a bounding box,
+// given by the latitude and longitude fields of instances. Bounds are
+// inclusive, so points on an edge match. It's a shorthand for two Between
+// conditions, scanning instances without a spatial index, and boxes
+// crossing the antimeridian have to be split into two Or'ed queries.
+func WhereBoundingBox(latField, lngField string, minLat, maxLat, minLng, maxLng float64) *Query {
+	return Where(latField).Between(minLat, maxLat).And(lngField).Between(minLng, maxLng)
+}
+
+// AnyValue makes the condition that follows match an object field, such
+// as a bag of attributes with arbitrary keys, if any of its values match.
+// e.g. Where("Attributes").AnyValue().Eq("red") matches instances with
+// any attribute equal to "red". Fields which aren't objects match as usual.
+func (c *Criterion) AnyValue() *Criterion {
+	c.MatchAnyValue = true
+	return c
+}
+
+// Fold makes the Eq, Ne or In condition that follows compare strings
+// under Unicode case folding, e.g. Where("Role").Fold().In("Admin", "USER")
+// matches roles such as "admin" and "User", and Where("Role").Not().Fold().
+// In("Admin", "USER") matches the others. Values which aren't strings
+// compare as usual.
+func (c *Criterion) Fold() *Criterion {
+	c.Folded = true
+	return c
+}
+
+// Not negates the condition that follows, e.g.
+// Where("Name").Not().ContainsFold("tmp") matches names not containing "tmp".
+func (c *Criterion) Not() *Criterion {
+	c.Negated = !c.Negated
+	return c
+}
+
 // OrderBy specifies ascending order for the query results.
 func OrderBy(field string) *Query {
 	q := &Query{}
@@ -162,6 +691,14 @@ func (q *Query) UseIndex(path string) *Query {
 	return q
 }
 
+// UseCompoundIndex specifies the compound index over paths to use when
+// running this query. Equality criteria on leading index fields narrow
+// the index range that's scanned.
+func (q *Query) UseCompoundIndex(paths ...string) *Query {
+	q.Index = compoundIndexPath(paths)
+	return q
+}
+
 // Or concatenates a new condition that is sufficient
 // for an instance to satisfy, independant of the current Query.
 // Has left-associativity as: (a And b) Or c
@@ -170,38 +707,238 @@ func (q *Query) Or(orQuery *Query) *Query {
 	return q
 }
 
+// ExcludeWhere excludes instances whose field equals value from the results.
+// Instances missing the field, or where it's null, are never excluded, so
+// a nil value excludes those where the field is set instead, e.g.
+// ExcludeWhere("deletedAt", nil) leaves out soft-deleted instances. The
+// condition is null-safe, see EqNullSafe, and it's ANDed onto the query and
+// onto copies of each of its Or branches, so it applies regardless of which
+// branch an instance matched, without modifying branches shared with other
+// queries.
+func (q *Query) ExcludeWhere(field string, value interface{}) *Query {
+	c := &Criterion{FieldPath: field, query: q}
+	if value != nil {
+		c.Not()
+	}
+	c.EqNullSafe(value)
+	for i, o := range q.Ors {
+		q.Ors[i] = o.Clone().ExcludeWhere(field, value)
+	}
+	return q
+}
+
 // OrderBy specifies ascending order for the query results.
-// On multiple calls, only the last one is considered.
+// Multiple calls accumulate sort keys, each breaking ties of the ones
+// before it, e.g. OrderBy("Author").OrderByDesc("Year") sorts by author,
+// and books of the same author newest first. Use ClearSort to start over.
 func (q *Query) OrderBy(field string) *Query {
-	q.Sort.FieldPath = field
-	q.Sort.Desc = false
-	return q
+	return q.addSort(Sort{FieldPath: field})
 }
 
 // OrderByDesc specifies descending order for the query results.
-// On multiple calls, only the last one is considered.
+// Multiple calls accumulate sort keys, as in OrderBy.
 func (q *Query) OrderByDesc(field string) *Query {
-	q.Sort.FieldPath = field
-	q.Sort.Desc = true
-	return q
+	return q.addSort(Sort{FieldPath: field, Desc: true})
 }
 
 // OrderByID specifies ascending ID order for the query results.
-// On multiple calls, only the last one is considered.
+// Multiple calls accumulate sort keys, as in OrderBy.
 func (q *Query) OrderByID() *Query {
-	q.Sort.FieldPath = idFieldName
-	q.Sort.Desc = false
-	return q
+	return q.addSort(Sort{FieldPath: idFieldName})
 }
 
 // OrderByIDDesc specifies descending ID order for the query results.
-// On multiple calls, only the last one is considered.
+// Multiple calls accumulate sort keys, as in OrderBy.
 func (q *Query) OrderByIDDesc() *Query {
-	q.Sort.FieldPath = idFieldName
-	q.Sort.Desc = true
+	return q.addSort(Sort{FieldPath: idFieldName, Desc: true})
+}
+
+// OrderByLen specifies ascending order for the query results by the
+// length of an array or string field. Instances where the field is
+// missing, or isn't an array or string, are sorted as having length 0.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByLen(field string) *Query {
+	return q.addSort(Sort{FieldPath: field, ByLen: true})
+}
+
+// OrderByLenDesc specifies descending order for the query results by the
+// length of an array or string field. See OrderByLen.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByLenDesc(field string) *Query {
+	return q.addSort(Sort{FieldPath: field, Desc: true, ByLen: true})
+}
+
+// OrderByNumeric specifies ascending order for the query results by
+// the numeric value of a field, parsing strings holding numbers, such as
+// "-5", "3" or "1000.50", so that they sort as the numbers they represent
+// rather than lexically. Numbers, parsed or not, sort before strings which
+// aren't numbers, which are compared lexically among themselves.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByNumeric(field string) *Query {
+	return q.addSort(Sort{FieldPath: field, Numeric: true})
+}
+
+// OrderByNumericDesc specifies descending order for the query results by
+// the numeric value of a field. See OrderByNumeric.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByNumericDesc(field string) *Query {
+	return q.addSort(Sort{FieldPath: field, Desc: true, Numeric: true})
+}
+
+// OrderByArrayMax specifies ascending order for the query results by the
+// maximum number of an array field, e.g. the best score of each instance.
+// Elements which aren't numbers are ignored, and a number field counts as
+// an array of itself. Instances where the field is missing, or has no
+// numbers, sort after the others in ascending order, and before them in
+// descending order. Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByArrayMax(field string) *Query {
+	return q.addSort(Sort{FieldPath: field, ArrayMax: true})
+}
+
+// OrderByArrayMaxDesc specifies descending order for the query results by
+// the maximum number of an array field. See OrderByArrayMax.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByArrayMaxDesc(field string) *Query {
+	return q.addSort(Sort{FieldPath: field, Desc: true, ArrayMax: true})
+}
+
+// OrderByArrayMin specifies ascending order for the query results by the
+// minimum number of an array field. See OrderByArrayMax.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByArrayMin(field string) *Query {
+	return q.addSort(Sort{FieldPath: field, ArrayMin: true})
+}
+
+// OrderByArrayMinDesc specifies descending order for the query results by
+// the minimum number of an array field. See OrderByArrayMax.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByArrayMinDesc(field string) *Query {
+	return q.addSort(Sort{FieldPath: field, Desc: true, ArrayMin: true})
+}
+
+// OrderByCollated specifies ascending order for the query results,
+// ordering string values with a collator built from opts, so that e.g.
+// "apple" sorts before "Banana" and "Éclair" before "Zebra".
+// Values other than strings are compared as in OrderBy.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByCollated(field string, opts CollationOptions) *Query {
+	return q.addSort(Sort{FieldPath: field, Collation: &opts})
+}
+
+// OrderByCollatedDesc specifies descending order for the query results,
+// ordering string values with a collator. See OrderByCollated.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByCollatedDesc(field string, opts CollationOptions) *Query {
+	return q.addSort(Sort{FieldPath: field, Desc: true, Collation: &opts})
+}
+
+// OrderByRelevance specifies that results are ordered by descending
+// relevance to the query's text criteria, ContainsFold, Matches and
+// StartsWith ones, most relevant first. Relevance is a simple heuristic
+// rather than full-text ranking: a result scores higher the more matches
+// of each criterion it contains, and the earlier the first one is. Results
+// with equal scores keep their order.
+// Relevance can't be combined with other sort keys, so queries with
+// relevance and other keys fail validation.
+func (q *Query) OrderByRelevance() *Query {
+	return q.addSort(Sort{ByRelevance: true})
+}
+
+// WithSort replaces the query sort order with the one described by spec.
+// An invalid spec makes the query fail validation, returning its error.
+func (q *Query) WithSort(spec SortSpec) *Query {
+	q.setSort(Sort{})
+	if q.sortErr = spec.Validate(); q.sortErr != nil {
+		return q
+	}
+	for i, f := range spec.Fields {
+		s := Sort{FieldPath: f.FieldPath, Desc: f.Desc, Numeric: f.Numeric}
+		if f.Collation != nil {
+			collation := *f.Collation
+			s.Collation = &collation
+		}
+		if i == 0 {
+			q.Sort = s
+		} else {
+			q.ThenSort = append(q.ThenSort, s)
+		}
+	}
+	return q
+}
+
+// addSort adds s as the last sort key of the query.
+func (q *Query) addSort(s Sort) *Query {
+	if !q.Sort.enabled() {
+		q.Sort = s
+	} else {
+		q.ThenSort = append(q.ThenSort, s)
+	}
+	return q
+}
+
+// ClearSort removes all sort keys of the query, so that following OrderBy
+// calls start a new sort order. It also discards an invalid spec given to
+// WithSort.
+func (q *Query) ClearSort() *Query {
+	return q.setSort(Sort{})
+}
+
+// setSort replaces all sort keys of the query with s.
+func (q *Query) setSort(s Sort) *Query {
+	q.Sort = s
+	q.ThenSort = nil
+	q.sortErr = nil
+	return q
+}
+
+// OrderByKey specifies primary key order for the query results.
+// The order is served by the datastore iterator when no index is used,
+// and falls back to an in-memory sort otherwise.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByKey(desc bool) *Query {
+	return q.addSort(Sort{FieldPath: idFieldName, Desc: desc})
+}
+
+// Reverse flips the direction of every sort key of the query, so that
+// results come in the opposite order, e.g. to toggle between ascending and
+// descending order in a UI. Ties are broken by instance key in the
+// direction of the last sort key, so they're reversed too. A query without
+// a sort gets a descending key order, the reverse of the order datastores
+// like Badger yield instances in. Relevance sorts put the least relevant
+// results first.
+func (q *Query) Reverse() *Query {
+	if !q.Sort.enabled() {
+		return q.setSort(Sort{FieldPath: idFieldName, Desc: true})
+	}
+	q.Sort.Desc = !q.Sort.Desc
+	for i := range q.ThenSort {
+		q.ThenSort[i].Desc = !q.ThenSort[i].Desc
+	}
+	return q
+}
+
+// ExcludeIDs leaves the instances with the given IDs out of the results,
+// e.g. to run a filter on all instances except a few deselected ones.
+// Excluded instances are skipped by their key while scanning, before
+// they're read or matched, which is cheaper than a Ne criterion for each.
+// Multiple calls accumulate IDs.
+func (q *Query) ExcludeIDs(ids ...string) *Query {
+	for _, id := range ids {
+		q.ExcludedIDs = append(q.ExcludedIDs, core.InstanceID(id))
+	}
 	return q
 }
 
+// excludes returns whether the instance at key is excluded from the
+// results by its ID.
+func (q *Query) excludes(key ds.Key) bool {
+	if len(q.excludedIDs) == 0 {
+		return false
+	}
+	_, ok := q.excludedIDs[core.InstanceID(key.Name())]
+	return ok
+}
+
 // SeekID seeks to the given ID before returning query results.
 func (q *Query) SeekID(id core.InstanceID) *Query {
 	q.Seek = id
@@ -214,12 +951,93 @@ func (q *Query) LimitTo(limit int) *Query {
 	return q
 }
 
+// MaxBytes limits the total size of the results of Find to n bytes, e.g.
+// to cap response sizes when instances vary widely in size. Results are
+// returned in order for as long as they fit, and the first one which
+// doesn't ends them, even if it's the first result, which then returns
+// none. FindTruncated reports whether results were left out. The limit
+// applies to results as returned, after sorting and projection, and when
+// there are neither, the scan stops at the first result which doesn't fit.
+func (q *Query) MaxBytes(n int) *Query {
+	q.ByteLimit = n
+	return q
+}
+
 // SkipNum skips the given number of results.
 func (q *Query) SkipNum(num int) *Query {
 	q.Skip = num
 	return q
 }
 
+// PrefetchNum sets the number of instances read per datastore call while
+// iterating an index, instead of one call per instance. Each batch is
+// read with a range read over its keys, so larger batches save round
+// trips to remote datastores at the cost of reading more ahead. It
+// doesn't affect results or their order.
+func (q *Query) PrefetchNum(num int) *Query {
+	q.Prefetch = num
+	return q
+}
+
+// WithFieldAliases maps alias field paths to their current paths.
+// Field paths in criteria and sort (including those of Or branches)
+// matching an alias are rewritten to its target when the query runs,
+// so queries using legacy field names keep working.
+func (q *Query) WithFieldAliases(aliases map[string]string) *Query {
+	q.Aliases = aliases
+	return q
+}
+
+// WithNumberCoercion makes criteria compare string values against numeric
+// fields, and numeric values against string fields, by parsing the string
+// as a number. Strings that can't be parsed still cause a type mismatch.
+func (q *Query) WithNumberCoercion() *Query {
+	q.CoerceNumbers = true
+	return q
+}
+
+// WithBoolCoercion makes boolean criteria match fields holding legacy
+// boolean representations: numbers, where 0 is false and any other number
+// true, and the strings "true", "false", "1" and "0". Other values still
+// cause a type mismatch. By default, booleans only match booleans.
+func (q *Query) WithBoolCoercion() *Query {
+	q.CoerceBools = true
+	return q
+}
+
+// WithMissingMatchesNe makes Ne criteria match instances missing their
+// field, e.g. Where("Status").Ne("archived") then matches instances without
+// a Status, and Not().Ne doesn't. By default, a missing field fails the
+// query like for any other operation. Indexes only hold instances having
+// their field, so instances missing it aren't found through UseIndex.
+func (q *Query) WithMissingMatchesNe() *Query {
+	q.MissingMatchesNe = true
+	return q
+}
+
+// WithRuneOrdering makes comparison operators and sorts compare strings
+// code point by code point, decoding them as UTF-8, rather than byte by
+// byte, which is the default. Both orders agree on valid UTF-8, which is
+// all that instance fields decoded from JSON hold, so this only matters
+// for criteria values which aren't valid UTF-8, e.g. built from raw bytes:
+// by bytes, "\xff" sorts after every valid string, while by code points,
+// it's the replacement character U+FFFD, and sorts before "\U0001F600".
+// Collated sorts aren't affected.
+func (q *Query) WithRuneOrdering() *Query {
+	q.RuneOrdering = true
+	return q
+}
+
+// WithValueNormalizer sets a function applied to both instance field values
+// and criteria values before comparing them, e.g., to trim and lowercase
+// strings. It also applies to sort values, so it affects result order.
+// Values returned for criteria must be strings, bools or float64s.
+// Normalizers aren't serialized, and don't take part of the query Hash.
+func (q *Query) WithValueNormalizer(fn func(fieldPath string, v interface{}) interface{}) *Query {
+	q.Normalizer = fn
+	return q
+}
+
 // Criterion helpers
 
 // Eq is an equality operator against a field.
@@ -252,6 +1070,93 @@ func (c *Criterion) Le(value interface{}) *Query {
 	return c.createcriterion(Le, value)
 }
 
+// EqWithin is an equality operator against a numeric field that allows
+// a relative tolerance: it matches when abs(field-value) <= relTol*abs(value).
+// Unlike an absolute epsilon, the allowed difference scales with the
+// magnitude of value. If value is zero, relTol is used as an absolute tolerance.
+func (c *Criterion) EqWithin(value float64, relTol float64) *Query {
+	c.Tolerance = relTol
+	return c.createcriterion(EqWithin, value)
+}
+
+// ContainsFold is a substring operator against a string field, under
+// Unicode case folding. An empty substr matches all strings.
+func (c *Criterion) ContainsFold(substr string) *Query {
+	return c.createcriterion(ContainsFold, substr)
+}
+
+// Mod is a modulo operator against a numeric field, matching when the
+// field is an integer which, divided by divisor, has the given remainder,
+// e.g. Where("Seq").Mod(10, 0) matches one instance in ten, for sampling
+// or splitting work into buckets. Remainders have the sign of the field,
+// as with Go's % operator, so negative fields never match a positive
+// remainder. Numbers which aren't integers don't match, and other values
+// are a type mismatch.
+func (c *Criterion) Mod(divisor, remainder int64) *Query {
+	c.Values = []Value{createValue(float64(divisor)), createValue(float64(remainder))}
+	return c.createcriterion(Mod, nil)
+}
+
+// StartsWith is a prefix operator against a string field, matching when
+// the field starts with prefix, byte for byte. When the query uses a single
+// field index on the field, only the index keys with the prefix are scanned.
+func (c *Criterion) StartsWith(prefix string) *Query {
+	return c.createcriterion(StartsWith, prefix)
+}
+
+// In is a membership operator against a field, matching when the
+// field equals any of values. When the query uses an index on the
+// field, each value is looked up in the index instead of scanning it.
+func (c *Criterion) In(values ...interface{}) *Query {
+	c.Values = make([]Value, len(values))
+	for i, v := range values {
+		c.Values[i] = createValue(v)
+	}
+	return c.createcriterion(In, nil)
+}
+
+// Between is an inclusive range operator against a field, matching when
+// the field is greater than or equal to low and less than or equal to high.
+func (c *Criterion) Between(low, high interface{}) *Query {
+	c.Values = []Value{createValue(low), createValue(high)}
+	return c.createcriterion(Between, nil)
+}
+
+// InRanges is a range operator against a field, matching when the field is
+// within any of ranges, each a low and a high value, inclusive. It's like an
+// Or of Betweens, but as a single criterion. e.g.
+// Where("Hour").InRanges([2]interface{}{9.0, 12.0}, [2]interface{}{14.0, 17.0}).
+func (c *Criterion) InRanges(ranges ...[2]interface{}) *Query {
+	c.Values = make([]Value, 0, 2*len(ranges))
+	for _, r := range ranges {
+		c.Values = append(c.Values, createValue(r[0]), createValue(r[1]))
+	}
+	return c.createcriterion(InRanges, nil)
+}
+
+// NotBetween is an exclusive range operator against a field, matching
+// when the field is strictly less than low or strictly greater than high.
+// It's the negation of Between, e.g. Where("Age").NotBetween(13.0, 19.0)
+// matches ages below 13 or above 19.
+func (c *Criterion) NotBetween(low, high interface{}) *Query {
+	c.Negated = !c.Negated
+	return c.Between(low, high)
+}
+
+// value returns the underlying value, or nil if there's none.
+func (v Value) value() interface{} {
+	switch {
+	case v.String != nil:
+		return *v.String
+	case v.Bool != nil:
+		return *v.Bool
+	case v.Float != nil:
+		return *v.Float
+	default:
+		return nil
+	}
+}
+
 func createValue(value interface{}) Value {
 	s, ok := value.(string)
 	if ok {
@@ -277,6 +1182,11 @@ func createValue(value interface{}) Value {
 	if ok {
 		return Value{Float: fp}
 	}
+	p, ok := value.(Param)
+	if ok {
+		name := string(p)
+		return Value{Param: &name}
+	}
 	return Value{}
 }
 
@@ -292,92 +1202,1077 @@ func (c *Criterion) createcriterion(op Operation, value interface{}) *Query {
 
 // Find queries for instances by Query.
 func (t *Txn) Find(q *Query) ([][]byte, error) {
-	if err := t.collection.db.connector.Validate(t.token, true); err != nil {
+	values, err := t.find(q)
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
 		return nil, err
 	}
-	if q == nil {
-		q = &Query{}
-	}
-	if err := q.Validate(); err != nil {
-		return nil, fmt.Errorf("invalid query: %s", err)
-	}
-	txn, err := t.collection.db.datastore.NewTransactionExtended(true)
-	if err != nil {
-		return nil, fmt.Errorf("error building internal query: %v", err)
+	return resultValues(values), err
+}
+
+// FindTruncated is like Find, but also returns whether results were left
+// out because they didn't fit in the byte limit set by MaxBytes.
+func (t *Txn) FindTruncated(q *Query) ([][]byte, bool, error) {
+	values, truncated, err := t.findCapped(q, 0)
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, false, err
 	}
-	defer txn.Discard()
-	iter, err := newIterator(txn, t.collection.baseKey(), q)
+	return resultValues(values), truncated, err
+}
+
+// FindRequireResults is like Find, but returns ErrNoResults when q
+// matches no instances, for callers which treat that as an error.
+func (t *Txn) FindRequireResults(q *Query) ([][]byte, error) {
+	res, err := t.Find(q)
 	if err != nil {
 		return nil, err
 	}
-	defer iter.Close()
+	if len(res) == 0 {
+		return nil, ErrNoResults
+	}
+	return res, nil
+}
 
-	pk, err := t.token.PubKey()
+// FindByHash returns an instance whose field equals hash, such as a content
+// hash instances are deduplicated by, and whether there's one. When field
+// is indexed, the instance is looked up in the index rather than scanned for.
+func (t *Txn) FindByHash(field, hash string) ([]byte, bool, error) {
+	q := Where(field).Eq(hash)
+	if _, ok := t.collection.indexes[field]; ok {
+		q.UseIndex(field)
+	}
+	q.Limit = 1
+	res, err := t.Find(q)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	var values []MarshaledResult
-	// Use count to track real count of returned values taking into account
-	// read filter and any indexes etc in the query
-	var count = 0
+	if len(res) == 0 {
+		return nil, false, nil
+	}
+	return res[0], true, nil
+}
+
+// FindWithDeadline is like Find, but stops scanning once d has elapsed,
+// returning the results found so far. The returned bool reports whether
+// the scan completed, rather than being cut off by the deadline. Cut off
+// results are sorted among themselves only, so with a sort they're
+// approximate: they aren't necessarily the first results of the query.
+func (t *Txn) FindWithDeadline(q *Query, d time.Duration) ([][]byte, bool, error) {
+	deadline := time.Now().Add(d)
+	return t.findPartial(q, func() error {
+		if time.Now().After(deadline) {
+			return context.DeadlineExceeded
+		}
+		return nil
+	})
+}
+
+// FindWithScanBudget is like Find, but stops scanning once maxScan
+// instances have been read, matching or not, returning the results found
+// among them. The returned bool reports whether the budget was hit, so
+// that instances were left unscanned and the results may be incomplete.
+// As with FindWithDeadline, results are sorted among themselves only, so
+// with a sort they're approximate.
+func (t *Txn) FindWithScanBudget(q *Query, maxScan int) ([][]byte, bool, error) {
+	if maxScan <= 0 {
+		return nil, false, fmt.Errorf("scan budget must be positive, got %d", maxScan)
+	}
+	var scanned int
+	res, complete, err := t.findPartial(q, func() error {
+		if scanned == maxScan {
+			return errScanBudgetExceeded
+		}
+		scanned++
+		return nil
+	})
+	return res, !complete, err
+}
+
+var errScanBudgetExceeded = errors.New("scan budget exceeded")
+
+// findPartial is like Find, but stops scanning once stop returns an error
+// for an instance about to be read. The returned bool reports whether the
+// scan completed.
+func (t *Txn) findPartial(q *Query, stop func() error) ([][]byte, bool, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, false, err
+	}
+	var cutOff bool
+	q.onScan = func() error {
+		if err := stop(); err != nil {
+			cutOff = true
+			return err
+		}
+		return nil
+	}
+	values, _, err := t.collect(q, collector{})
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, false, err
+	}
+	return resultValues(values), !cutOff, err
+}
+
+// FindMaps is like Find, but returns the instances decoded into maps.
+// Instances are already decoded to be matched, so this avoids decoding
+// them again from the results of Find. The maps are decoded per instance
+// and not retained, so they're owned by the caller.
+func (t *Txn) FindMaps(q *Query) ([]map[string]interface{}, error) {
+	values, err := t.find(q)
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, err
+	}
+	res := make([]map[string]interface{}, len(values))
+	for i := range values {
+		res[i] = values[i].MarshaledValue
+	}
+	return res, err
+}
+
+// find returns the sorted results of q.
+func (t *Txn) find(q *Query) ([]MarshaledResult, error) {
+	return t.findIsolated(q, 0)
+}
+
+// findIsolated returns the sorted results of q, read with the isolation
+// level iso.
+func (t *Txn) findIsolated(q *Query, iso Isolation) ([]MarshaledResult, error) {
+	values, _, err := t.findCapped(q, iso)
+	return values, err
+}
+
+// findCapped is like findIsolated, but also returns whether results were
+// left out by the byte limit of q.
+func (t *Txn) findCapped(q *Query, iso Isolation) ([]MarshaledResult, bool, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, false, err
+	}
+	return t.collect(q, collector{iso: iso})
+}
+
+// collector customizes how collect gathers the results of a query.
+type collector struct {
+	// iso is the isolation level instances are read with.
+	iso Isolation
+	// keep reports whether a match is one of the results, e.g. whether
+	// it's in a sample. A nil keep keeps every match.
+	keep func(res MarshaledResult) (bool, error)
+	// scanAll reads every match, even once the results are complete, e.g.
+	// for keep to count them.
+	scanAll bool
+	// sorted is called with the results once they're sorted and windowed,
+	// before they're projected, and returns the ones to project, e.g. to
+	// read fields projection removes. If the byte limit cuts them off, only
+	// a prefix of them is returned.
+	sorted func(values []MarshaledResult) ([]MarshaledResult, error)
+}
+
+// collect returns the results of the prepared query q: the matches kept
+// by c, sorted, with Skip and Limit applied after sorting, projected and
+// cut off at the byte limit of q. It also returns whether the byte limit
+// left results out. If the text timeout of q elapses, it returns the
+// results found so far, sorted among themselves, and ErrTextEvalTimeout.
+func (t *Txn) collect(q *Query, c collector) ([]MarshaledResult, bool, error) {
+	inMemory := q.sortsInMemory()
+	// Results are in their final form as they're found unless they're
+	// sorted or projected, so the byte limit can stop the scan early.
+	capScan := q.ByteLimit > 0 && !inMemory && len(q.Selected) == 0 && len(q.Excluded) == 0
+	timedOut := q.startTextTimeout()
+	var values []MarshaledResult
+	var truncated, indexOrdered bool
+	if c.keep == nil && !c.scanAll && q.sortsByIndexDesc() {
+		var err error
+		if values, indexOrdered, err = t.iterateIndexDesc(q, c.iso); err != nil {
+			return nil, false, err
+		}
+	}
+	if !indexOrdered {
+		var count, size int
+		if err := t.iterateIsolated(q, c.iso, func(res MarshaledResult) (bool, error) {
+			if c.keep != nil {
+				if ok, err := c.keep(res); err != nil || !ok {
+					return err == nil, err
+				}
+			}
+			if inMemory {
+				values = append(values, res)
+				return true, nil
+			}
+			// Use count to track real count of returned values taking into
+			// account read filter and any indexes etc in the query
+			count++
+			if count > q.Skip && !truncated && (q.Limit <= 0 || len(values) < q.Limit) {
+				if capScan {
+					if size += len(res.Value); size > q.ByteLimit {
+						truncated = true
+						return c.scanAll, nil
+					}
+				}
+				values = append(values, res)
+			}
+			return c.scanAll || q.Limit <= 0 || len(values) < q.Limit, nil
+		}); err != nil {
+			return nil, false, err
+		}
+		if err := sortResults(values, q); err != nil {
+			return nil, false, err
+		}
+		if inMemory {
+			values = window(values, q.Skip, q.Limit)
+		}
+	}
+	if c.sorted != nil {
+		var err error
+		if values, err = c.sorted(values); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := projectFields(values, q); err != nil {
+		return nil, false, err
+	}
+	if q.ByteLimit > 0 && !capScan {
+		values, truncated = capBytes(values, q.ByteLimit)
+	}
+	if timedOut() {
+		return values, truncated, ErrTextEvalTimeout
+	}
+	return values, truncated, nil
+}
+
+// capBytes returns the leading values whose total size is at most max
+// bytes, and whether there were more.
+func capBytes(values []MarshaledResult, max int) ([]MarshaledResult, bool) {
+	var size int
+	for i := range values {
+		if size += len(values[i].Value); size > max {
+			return values[:i], true
+		}
+	}
+	return values, false
+}
+
+// resultValues returns the encoded instances of values.
+func resultValues(values []MarshaledResult) [][]byte {
+	res := make([][]byte, len(values))
+	for i := range values {
+		res[i] = values[i].Value
+	}
+	return res
+}
+
+// Clone returns a deep copy of the query, which can be modified
+// without affecting the original.
+func (q *Query) Clone() *Query {
+	if q == nil {
+		return nil
+	}
+	nq := *q
+	if q.Ands != nil {
+		nq.Ands = make([]*Criterion, len(q.Ands))
+		for i, c := range q.Ands {
+			nc := *c
+			nc.Value = c.Value.clone()
+			if c.Values != nil {
+				nc.Values = make([]Value, len(c.Values))
+				for j, v := range c.Values {
+					nc.Values[j] = v.clone()
+				}
+			}
+			if c.PresentFields != nil {
+				nc.PresentFields = append([]string(nil), c.PresentFields...)
+			}
+			nc.query = &nq
+			nq.Ands[i] = &nc
+		}
+	}
+	if q.Ors != nil {
+		nq.Ors = make([]*Query, len(q.Ors))
+		for i, o := range q.Ors {
+			nq.Ors[i] = o.Clone()
+		}
+	}
+	nq.Sort = q.Sort.clone()
+	if q.ThenSort != nil {
+		nq.ThenSort = make([]Sort, len(q.ThenSort))
+		for i, s := range q.ThenSort {
+			nq.ThenSort[i] = s.clone()
+		}
+	}
+	if q.Selected != nil {
+		nq.Selected = append([]string(nil), q.Selected...)
+	}
+	if q.Excluded != nil {
+		nq.Excluded = append([]string(nil), q.Excluded...)
+	}
+	if q.ExcludedIDs != nil {
+		nq.ExcludedIDs = append([]core.InstanceID(nil), q.ExcludedIDs...)
+	}
+	if q.Aliases != nil {
+		nq.Aliases = make(map[string]string, len(q.Aliases))
+		for k, v := range q.Aliases {
+			nq.Aliases[k] = v
+		}
+	}
+	if q.FieldOrders != nil {
+		nq.FieldOrders = make(map[string][]string, len(q.FieldOrders))
+		for k, v := range q.FieldOrders {
+			nq.FieldOrders[k] = append([]string(nil), v...)
+		}
+	}
+	return &nq
+}
+
+func (v Value) clone() Value {
+	var nv Value
+	if v.String != nil {
+		s := *v.String
+		nv.String = &s
+	}
+	if v.Bool != nil {
+		b := *v.Bool
+		nv.Bool = &b
+	}
+	if v.Float != nil {
+		f := *v.Float
+		nv.Float = &f
+	}
+	if v.Param != nil {
+		p := *v.Param
+		nv.Param = &p
+	}
+	return nv
+}
+
+// Hash returns a stable signature of the query, equal for queries
+// with the same JSON representation. It fails for queries which can't be
+// serialized, e.g. holding a NaN value. Fields which aren't serialized,
+// such as the normalizer, are left out.
+func (q *Query) Hash() (string, error) {
+	if q == nil {
+		q = &Query{}
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return "", fmt.Errorf("marshaling query: %v", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// prepare returns a copy of the query ready to be run, with field
+// aliases resolved. The original query isn't modified.
+func (q *Query) prepare() *Query {
+	return q.prepareAt(time.Now())
+}
+
+// prepareAt is like prepare, resolving current periods as of now.
+func (q *Query) prepareAt(now time.Time) *Query {
+	nq := q.Clone()
+	nq.resolveAliases(nil)
+	nq.inheritOptions(nq.MatchOptions)
+	nq.resolvePeriods(now)
+	nq.bigInts = nq.hasBigInts()
+	if len(nq.ExcludedIDs) > 0 {
+		nq.excludedIDs = make(map[core.InstanceID]struct{}, len(nq.ExcludedIDs))
+		for _, id := range nq.ExcludedIDs {
+			nq.excludedIDs[id] = struct{}{}
+		}
+	}
+	return nq
+}
+
+func (q *Query) inheritOptions(opts MatchOptions) {
+	for _, o := range q.Ors {
+		o.MatchOptions = opts
+		o.inheritOptions(opts)
+	}
+}
+
+func (q *Query) resolveAliases(aliases map[string]string) {
+	if len(q.Aliases) > 0 {
+		merged := make(map[string]string, len(aliases)+len(q.Aliases))
+		for k, v := range aliases {
+			merged[k] = v
+		}
+		for k, v := range q.Aliases {
+			merged[k] = v
+		}
+		aliases = merged
+	}
+	for _, c := range q.Ands {
+		c.FieldPath = resolveAlias(aliases, c.FieldPath)
+		if c.OtherField != "" {
+			c.OtherField = resolveAlias(aliases, c.OtherField)
+		}
+		if c.HighField != "" {
+			c.HighField = resolveAlias(aliases, c.HighField)
+		}
+		if c.ChecksumField != "" {
+			c.ChecksumField = resolveAlias(aliases, c.ChecksumField)
+		}
+		for i, field := range c.PresentFields {
+			c.PresentFields[i] = resolveAlias(aliases, field)
+		}
+	}
+	for _, o := range q.Ors {
+		o.resolveAliases(aliases)
+	}
+	q.Sort.resolveAliases(aliases)
+	for i := range q.ThenSort {
+		q.ThenSort[i].resolveAliases(aliases)
+	}
+	for i := range q.Selected {
+		q.Selected[i] = resolveAlias(aliases, q.Selected[i])
+	}
+	for i := range q.Excluded {
+		q.Excluded[i] = resolveAlias(aliases, q.Excluded[i])
+	}
+	if len(q.FieldOrders) > 0 {
+		orders := make(map[string][]string, len(q.FieldOrders))
+		for k, v := range q.FieldOrders {
+			orders[resolveAlias(aliases, k)] = v
+		}
+		q.FieldOrders = orders
+	}
+}
+
+func resolveAlias(aliases map[string]string, fieldPath string) string {
+	if target, ok := aliases[fieldPath]; ok {
+		return target
+	}
+	return fieldPath
+}
+
+// sortsInMemory returns whether results of q have to be sorted after
+// they're collected. Key order is already provided by the iterator, unless
+// results come from an index, in which case they're in index value order.
+func (q *Query) sortsInMemory() bool {
+	if q.GroupInValues {
+		return true
+	}
+	if !q.Sort.enabled() {
+		return false
+	}
+	return q.Sort.ByRelevance || len(q.ThenSort) > 0 || q.Sort.FieldPath != idFieldName || q.Index != "" || q.Sort.ByLen || q.Sort.Collation != nil || q.Sort.Numeric || q.Sort.ArrayMin || q.Sort.ArrayMax
+}
+
+// sortResults sorts values in place by the query sort, then groups them
+// by In values if the query asks to.
+func sortResults(values []MarshaledResult, q *Query) error {
+	if !q.sortsInMemory() {
+		return nil
+	}
+	if q.Sort.enabled() {
+		if err := sortValues(values, q); err != nil {
+			return err
+		}
+	}
+	if q.GroupInValues {
+		groupInValues(values, q)
+	}
+	return nil
+}
+
+// sortValues sorts values in place by the query sort, regardless
+// of the order they're in. Ties of all sort keys are broken by instance
+// key, in the direction of the last sort key.
+func sortValues(values []MarshaledResult, q *Query) error {
+	if q.Sort.ByRelevance {
+		sortByRelevance(values, q)
+		return nil
+	}
+	sorter := q.resultSorter()
+	var fieldErr error
+	var cantCompare bool
+	sort.Slice(values, func(i, j int) bool {
+		res, err := sorter.compare(values[i], values[j])
+		if errors.Is(err, errCantCompare) {
+			cantCompare = true
+			return false
+		}
+		if err != nil {
+			fieldErr = err
+			return false
+		}
+		return res < 0
+	})
+	if errors.Is(fieldErr, ErrPathTooDeep) || errors.Is(fieldErr, ErrValueNotOrdered) {
+		return fieldErr
+	}
+	if fieldErr != nil {
+		return ErrInvalidSortingField
+	}
+	if cantCompare {
+		panic("can't compare while sorting")
+	}
+	return nil
+}
+
+// resultSorter compares results by the sort keys of a query.
+type resultSorter struct {
+	q         *Query
+	keys      []Sort
+	collators []*collate.Collator
+}
+
+// resultSorter returns a sorter by the sort keys of q.
+func (q *Query) resultSorter() resultSorter {
+	keys := append([]Sort{q.Sort}, q.ThenSort...)
+	collators := make([]*collate.Collator, len(keys))
+	for k, key := range keys {
+		if key.Collation != nil && !key.ByLen {
+			collators[k] = key.Collation.collator()
+		}
+	}
+	return resultSorter{q: q, keys: keys, collators: collators}
+}
+
+// compare compares a and b by each sort key in turn, breaking ties of all
+// keys by instance key, in the direction of the last sort key.
+func (s resultSorter) compare(a, b MarshaledResult) (int, error) {
+	for k, key := range s.keys {
+		res, err := s.q.compareSorted(key, s.collators[k], a.MarshaledValue, b.MarshaledValue)
+		if err != nil || res != 0 {
+			return res, err
+		}
+	}
+	res := strings.Compare(a.Key, b.Key)
+	if s.keys[len(s.keys)-1].Desc {
+		res *= -1
+	}
+	return res, nil
+}
+
+var errCantCompare = errors.New("can't compare")
+
+// compareSorted compares the values of a and b for a sort key. Errors
+// other than errCantCompare are due to missing fields.
+func (q *Query) compareSorted(key Sort, collator *collate.Collator, a, b map[string]interface{}) (int, error) {
+	fieldA, err := key.value(a, q.maxPathDepth)
+	if err != nil {
+		return 0, err
+	}
+	fieldB, err := key.value(b, q.maxPathDepth)
+	if err != nil {
+		return 0, err
+	}
+	if !key.ByLen && !key.ArrayMin && !key.ArrayMax && len(key.Weights) == 0 {
+		fieldA = q.normalize(key.FieldPath, fieldA)
+		fieldB = q.normalize(key.FieldPath, fieldB)
+	}
+	var res int
+	strA, okA := fieldA.(string)
+	strB, okB := fieldB.(string)
+	if order, ok := q.FieldOrders[key.FieldPath]; ok && okA && okB && !key.ByLen {
+		if res, err = compareOrdered(order, q.StrictFieldOrders, strA, strB); err != nil {
+			return 0, err
+		}
+	} else if numA, numB, ok := numericSortValues(key, q.NumberFormat, fieldA, fieldB); ok {
+		res = numA.compare(numB)
+	} else if collator != nil && okA && okB {
+		res = collator.CompareString(strA, strB)
+	} else if q.RuneOrdering && okA && okB {
+		res = compareRunes(strA, strB)
+	} else if res, err = compare(fieldA, fieldB); err != nil {
+		return 0, errCantCompare
+	}
+	if key.Desc {
+		res *= -1
+	}
+	return res, nil
+}
+
+// numericValue is a sort value of a numeric sort. Values which aren't
+// numbers sort after the ones which are.
+type numericValue struct {
+	f  float64
+	ok bool
+}
+
+func (n numericValue) compare(o numericValue) int {
+	switch {
+	case n.ok != o.ok:
+		if n.ok {
+			return -1
+		}
+		return 1
+	case n.f < o.f:
+		return -1
+	case n.f > o.f:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// numericSortValues returns the numeric sort values of a and b, strings
+// being parsed in format f, if key is numeric and either is a number.
+// Otherwise, a and b are compared as usual.
+func numericSortValues(key Sort, f NumberFormat, a, b interface{}) (numericValue, numericValue, bool) {
+	if key.ArrayMin || key.ArrayMax || len(key.Weights) > 0 {
+		return a.(numericValue), b.(numericValue), true
+	}
+	if !key.Numeric || key.ByLen {
+		return numericValue{}, numericValue{}, false
+	}
+	numA, numB := parseNumeric(a, f), parseNumeric(b, f)
+	return numA, numB, numA.ok || numB.ok
+}
+
+// parseNumeric parses v as a number, if it's a number or a string holding
+// one in format. NaN isn't considered a number, since it can't be ordered.
+func parseNumeric(v interface{}, format NumberFormat) numericValue {
+	switch t := v.(type) {
+	case float64:
+		return numericValue{f: t, ok: !math.IsNaN(t)}
+	case string:
+		f, err := format.parse(t)
+		return numericValue{f: f, ok: err == nil && !math.IsNaN(f)}
+	default:
+		return numericValue{}
+	}
+}
+
+// sortByRelevance stably sorts values by descending relevance to the
+// text criteria of q.
+func sortByRelevance(values []MarshaledResult, q *Query) {
+	crits := q.textCriteria(nil)
+	scores := make([]float64, len(values))
+	for i := range values {
+		scores[i] = q.relevance(values[i].MarshaledValue, crits)
+	}
+	sort.Stable(relevanceSorter{values: values, scores: scores, leastFirst: q.Sort.Desc})
+}
+
+type relevanceSorter struct {
+	values     []MarshaledResult
+	scores     []float64
+	leastFirst bool
+}
+
+func (s relevanceSorter) Len() int { return len(s.values) }
+func (s relevanceSorter) Less(i, j int) bool {
+	if s.leastFirst {
+		return s.scores[i] < s.scores[j]
+	}
+	return s.scores[i] > s.scores[j]
+}
+func (s relevanceSorter) Swap(i, j int) {
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+
+// textCriteria appends the non-negated ContainsFold, Matches and
+// StartsWith criteria of q and its Ors to crits.
+func (q *Query) textCriteria(crits []*Criterion) []*Criterion {
+	for _, c := range q.Ands {
+		switch c.Operation {
+		case ContainsFold, Matches, StartsWith:
+			if !c.Negated && !c.MatchAnyValue {
+				crits = append(crits, c)
+			}
+		}
+	}
+	for _, o := range q.Ors {
+		crits = o.textCriteria(crits)
+	}
+	return crits
+}
+
+// relevance scores v against text criteria. Each criterion adds the number
+// of its matches in the field, plus up to 1 the closer the first one is to
+// the start of the field.
+func (q *Query) relevance(v map[string]interface{}, crits []*Criterion) float64 {
+	var score float64
+	for _, c := range crits {
+		field, err := c.traverse(v, c.FieldPath)
+		if err != nil || !field.IsValid() || c.Value.String == nil {
+			continue
+		}
+		s, ok := q.normalize(c.FieldPath, field.Interface()).(string)
+		if !ok {
+			continue
+		}
+		sub, ok := q.normalize(c.FieldPath, *c.Value.String).(string)
+		if !ok {
+			sub = *c.Value.String
+		}
+		if n, first := c.occurrences(s, sub); n > 0 {
+			score += float64(n) + 1/float64(1+first)
+		}
+	}
+	return score
+}
+
+// occurrences returns the number of matches in s of the text criterion,
+// whose value is sub, and the byte offset of the first one. Patterns count
+// their non-overlapping matches, and prefixes their occurrences anywhere
+// in s, as long as s starts with one.
+func (c *Criterion) occurrences(s, sub string) (int, int) {
+	switch c.Operation {
+	case Matches:
+		re, err := c.pattern(sub, c.options())
+		if err != nil {
+			return 0, 0
+		}
+		locs := re.FindAllStringIndex(s, -1)
+		if len(locs) == 0 {
+			return 0, 0
+		}
+		return len(locs), locs[0][0]
+	case StartsWith:
+		if sub == "" || !strings.HasPrefix(s, sub) {
+			return 0, 0
+		}
+		return strings.Count(s, sub), 0
+	default:
+		s, sub = foldString(s), foldString(sub)
+		if sub == "" {
+			return 0, 0
+		}
+		return strings.Count(s, sub), strings.Index(s, sub)
+	}
+}
+
+// value returns the value of v the sort compares.
+func (s Sort) value(v map[string]interface{}, maxDepth int) (interface{}, error) {
+	if len(s.Weights) > 0 {
+		return s.weightedSum(v, maxDepth)
+	}
+	field, err := traverseFieldPathMap(v, s.FieldPath, maxDepth)
+	if errors.Is(err, ErrPathTooDeep) {
+		return nil, err
+	}
+	if s.ArrayMin || s.ArrayMax {
+		if err != nil || !field.IsValid() {
+			return numericValue{}, nil
+		}
+		return reduceArray(field.Interface(), s.ArrayMax), nil
+	}
+	if s.ByLen {
+		if err != nil || !field.IsValid() {
+			return float64(0), nil
+		}
+		return float64(valueLen(field.Interface())), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return field.Interface(), nil
+}
+
+// reduceArray returns the maximum number of an array if max is set, or
+// its minimum otherwise. Elements which aren't numbers are skipped, and
+// a number which isn't in an array is its own minimum and maximum.
+func reduceArray(v interface{}, max bool) numericValue {
+	elems, ok := v.([]interface{})
+	if !ok {
+		elems = []interface{}{v}
+	}
+	var res numericValue
+	for _, e := range elems {
+		f, ok := e.(float64)
+		if !ok || math.IsNaN(f) {
+			continue
+		}
+		if !res.ok || (max && f > res.f) || (!max && f < res.f) {
+			res = numericValue{f: f, ok: true}
+		}
+	}
+	return res
+}
+
+// valueLen returns the number of elements of an array, or of runes of
+// a string. Values of other types have no length.
+func valueLen(v interface{}) int {
+	switch t := v.(type) {
+	case []interface{}:
+		return len(t)
+	case string:
+		return utf8.RuneCountInString(t)
+	default:
+		return 0
+	}
+}
+
+// Exists returns whether any instance matches q. It stops at the first
+// match, and ignores the query Sort, Limit and Skip.
+func (t *Txn) Exists(q *Query) (bool, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return false, err
+	}
+	var exists bool
+	if err := t.iterate(q, func(MarshaledResult) (bool, error) {
+		exists = true
+		return false, nil
+	}); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// ForEach calls fn with the instances matching q in batches of up to
+// batchSize, until all have been visited or fn returns an error, which
+// is then returned. Skip and Limit apply as in Find.
+// Instances are streamed, so only a batch is held in memory at a time,
+// except when q can't be sorted while streaming, such as when it sorts on
+// a field other than _id: all matches then have to be loaded to be sorted.
+func (t *Txn) ForEach(q *Query, batchSize int, fn func(batch [][]byte) error) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+	if q != nil && q.sortsInMemory() {
+		res, err := t.Find(q)
+		if err != nil {
+			return err
+		}
+		for len(res) > 0 {
+			n := batchSize
+			if n > len(res) {
+				n = len(res)
+			}
+			if err := fn(res[:n]); err != nil {
+				return err
+			}
+			res = res[n:]
+		}
+		return nil
+	}
+
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return err
+	}
+	batch := make([][]byte, 0, batchSize)
+	var count, n int
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		count++
+		if count <= q.Skip {
+			return true, nil
+		}
+		batch = append(batch, res.Value)
+		n++
+		if len(batch) == batchSize {
+			if err := fn(batch); err != nil {
+				return false, err
+			}
+			batch = make([][]byte, 0, batchSize)
+		}
+		return n != q.Limit, nil
+	}); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
+
+// FindAcross queries several collections sharing a schema as one,
+// e.g. shards of a dataset, with q applying to their combined instances.
+// Sort, Skip and Limit apply to the merged results, so when q is sorted,
+// all matching instances from every collection are held in memory before
+// any are skipped or limited. Unsorted results are in txns order.
+func FindAcross(txns []*Txn, q *Query) ([][]byte, error) {
+	if q == nil {
+		q = &Query{}
+	}
+	var values []MarshaledResult
+	var count int
+	for _, t := range txns {
+		pq, err := t.prepareQuery(q)
+		if err != nil {
+			return nil, err
+		}
+		sorted := pq.Sort.enabled()
+		if err := t.iterate(pq, func(res MarshaledResult) (bool, error) {
+			if sorted {
+				values = append(values, res)
+				return true, nil
+			}
+			count++
+			if count > pq.Skip {
+				values = append(values, res)
+			}
+			return len(values) != pq.Limit, nil
+		}); err != nil {
+			return nil, err
+		}
+		if !sorted && pq.Limit > 0 && len(values) == pq.Limit {
+			break
+		}
+	}
+
+	if q.Sort.enabled() {
+		if err := sortValues(values, q.prepare()); err != nil {
+			return nil, err
+		}
+		if q.Skip >= len(values) {
+			values = nil
+		} else {
+			values = values[q.Skip:]
+		}
+		if q.Limit > 0 && q.Limit < len(values) {
+			values = values[:q.Limit]
+		}
+	}
+
+	res := make([][]byte, len(values))
+	for i := range values {
+		res[i] = values[i].Value
+	}
+	return res, nil
+}
+
+// prepareQuery validates the txn token and q, and returns
+// a copy of q ready to be iterated.
+func (t *Txn) prepareQuery(q *Query) (*Query, error) {
+	if err := t.collection.db.connector.Validate(t.token, true); err != nil {
+		return nil, err
+	}
+	if q == nil {
+		q = &Query{}
+	}
+	if err := q.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	if err := q.checkComplexity(t.collection.db.maxQueryCriteria); err != nil {
+		return nil, err
+	}
+	now := t.collection.db.now()
+	q = q.prepareAt(now)
+	if err := q.compilePatterns(t.collection.db.patternLimits); err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	q.setMaxPathDepth(t.collection.db.maxPathDepth)
+	if err := q.checkPathDepth(); err != nil {
+		return nil, err
+	}
+	if err := q.resolveSubqueries(t.collection.db.maxSubqueryResults); err != nil {
+		return nil, err
+	}
+	if f := t.collection.getDefaultFilter(); f != nil && !q.ignoreDefaultFilter {
+		f = f.prepareAt(now)
+		if err := f.compilePatterns(t.collection.db.patternLimits); err != nil {
+			return nil, fmt.Errorf("invalid default filter: %w", err)
+		}
+		f.setMaxPathDepth(t.collection.db.maxPathDepth)
+		q.defaultFilter = f
+	}
+	return q, nil
+}
+
+// iterate calls fn with each instance matching a prepared query that
+// passes the collection read filter, in iteration order.
+// Iteration stops when fn returns false or an error.
+func (t *Txn) iterate(q *Query, fn func(res MarshaledResult) (bool, error)) error {
+	return t.iterateIsolated(q, 0, fn)
+}
+
+// iterateIsolated is like iterate, reading with the isolation level iso.
+func (t *Txn) iterateIsolated(q *Query, iso Isolation, fn func(res MarshaledResult) (bool, error)) error {
+	mi, err := t.newMatchIterator(q, iso)
+	if err != nil {
+		return err
+	}
+	defer mi.close()
+	for {
+		res, ok, err := mi.next()
+		if err != nil || !ok {
+			return err
+		}
+		if next, err := fn(res); err != nil || !next {
+			return err
+		}
+	}
+}
+
+// matchIterator iterates over the instances matching a prepared query
+// that pass the collection read filter, in iteration order.
+type matchIterator struct {
+	t    *Txn
+	q    *Query
+	txn  dse.TxnExt
+	iter *iterator
+	pk   thread.PubKey
+}
+
+// newMatchIterator returns an iterator over the instances matching q,
+// read with the isolation level iso. It must be closed.
+func (t *Txn) newMatchIterator(q *Query, iso Isolation) (*matchIterator, error) {
+	txn, err := t.newReadTxn(iso)
+	if err != nil {
+		return nil, fmt.Errorf("error building internal query: %v", err)
+	}
+	iter, err := newIterator(txn, t.collection.baseKey(), q, t.collection.indexes[q.Index])
+	if err != nil {
+		txn.Discard()
+		return nil, err
+	}
+	pk, err := t.token.PubKey()
+	if err != nil {
+		iter.Close()
+		txn.Discard()
+		return nil, err
+	}
+	return &matchIterator{t: t, q: q, txn: txn, iter: iter, pk: pk}, nil
+}
+
+// next returns the next matching instance, or false once there are none.
+func (mi *matchIterator) next() (MarshaledResult, bool, error) {
+	t, q := mi.t, mi.q
 	for {
-		res, ok := iter.NextSync()
+		res, ok := mi.iter.NextSync()
 		if !ok {
-			break
+			// Failed type assertions, ambiguous fields and rejected patterns
+			// fail the query, while other errors, such as missing fields,
+			// end the results.
+			if errors.Is(res.Error, &ErrFieldTypeAssertion{}) || errors.Is(res.Error, ErrAmbiguousField) || errors.Is(res.Error, ErrPatternRejected) {
+				return MarshaledResult{}, false, res.Error
+			}
+			return MarshaledResult{}, false, nil
 		}
-		res.Value, err = t.collection.filterRead(pk, res.Value)
+		var err error
+		res.Value, err = t.collection.filterRead(mi.pk, res.Value)
 		if err != nil {
-			return nil, err
-		}
-		if res.Value != nil {
-			// Only count valid values that aren't filtered by the read filter
-			count++
-			if count > q.Skip {
-				values = append(values, res)
-			}
+			return MarshaledResult{}, false, err
 		}
-		if len(values) == q.Limit {
-			break
+		// Only pass on valid values that aren't filtered by the read filter
+		if res.Value == nil {
+			continue
 		}
-	}
-
-	if q.Sort.FieldPath != "" && q.Sort.FieldPath != idFieldName {
-		var wrongField, cantCompare bool
-		sort.Slice(values, func(i, j int) bool {
-			fieldI, err := traverseFieldPathMap(values[i].MarshaledValue, q.Sort.FieldPath)
-			if err != nil {
-				wrongField = true
-				return false
-			}
-			fieldJ, err := traverseFieldPathMap(values[j].MarshaledValue, q.Sort.FieldPath)
-			if err != nil {
-				wrongField = true
-				return false
+		if t.collection.readFilter != nil {
+			res.MarshaledValue = make(map[string]interface{})
+			if err := json.Unmarshal(res.Value, &res.MarshaledValue); err != nil {
+				return MarshaledResult{}, false, err
 			}
-			res, err := compare(fieldI.Interface(), fieldJ.Interface())
+		}
+		if q.defaultFilter != nil {
+			ok, err := q.defaultFilter.matchDoc(res.Value, res.MarshaledValue)
 			if err != nil {
-				cantCompare = true
-				return false
+				return MarshaledResult{}, false, fmt.Errorf("error when matching entry with default filter: %w", err)
 			}
-			if q.Sort.Desc {
-				res *= -1
+			if !ok {
+				continue
 			}
-			return res < 0
-		})
-		if wrongField {
-			return nil, ErrInvalidSortingField
-		}
-		if cantCompare {
-			panic("can't compare while sorting")
 		}
+		return res, true, nil
 	}
+}
 
-	res := make([][]byte, len(values))
-	for i := range values {
-		res[i] = values[i].Value
-	}
+func (mi *matchIterator) close() {
+	mi.iter.Close()
+	mi.txn.Discard()
+}
 
-	return res, nil
+// scanned is called by iterators for each instance they read, matching or
+// not. An error stops the iteration.
+func (q *Query) scanned() error {
+	if q.onScan == nil {
+		return nil
+	}
+	return q.onScan()
 }
 
 func (q *Query) match(v map[string]interface{}) (bool, error) {
@@ -387,11 +2282,7 @@ func (q *Query) match(v map[string]interface{}) (bool, error) {
 
 	andOk := true
 	for _, c := range q.Ands {
-		fieldRes, err := traverseFieldPathMap(v, c.FieldPath)
-		if err != nil {
-			return false, err
-		}
-		ok, err := c.match(fieldRes)
+		ok, err := c.matchField(v)
 		if err != nil {
 			return false, err
 		}
@@ -421,14 +2312,14 @@ func compareValue(value interface{}, critVal Value) (int, error) {
 	if critVal.String != nil {
 		s, ok := value.(string)
 		if !ok {
-			return 0, &errTypeMismatch{value, critVal}
+			return 0, &ErrTypeMismatch{value, critVal}
 		}
 		return strings.Compare(s, *critVal.String), nil
 	}
 	if critVal.Bool != nil {
 		b, ok := value.(bool)
 		if !ok {
-			return 0, &errTypeMismatch{value, critVal}
+			return 0, &ErrTypeMismatch{value, critVal}
 		}
 		if *critVal.Bool == b {
 			return 0, nil
@@ -438,7 +2329,7 @@ func compareValue(value interface{}, critVal Value) (int, error) {
 	if critVal.Float != nil {
 		f, ok := value.(float64)
 		if !ok {
-			return 0, &errTypeMismatch{value, critVal}
+			return 0, &ErrTypeMismatch{value, critVal}
 		}
 		if f == *critVal.Float {
 			return 0, nil
@@ -452,9 +2343,140 @@ func compareValue(value interface{}, critVal Value) (int, error) {
 	return 0, nil
 }
 
+// matchField matches the criterion against the field of v it refers to.
+// For a wildcard path, it matches if any of the expanded fields matches.
+func (c *Criterion) matchField(v map[string]interface{}) (bool, error) {
+	if len(c.PresentFields) > 0 {
+		return c.matchPresentCount(v)
+	}
+	if c.ChecksumField != "" {
+		return c.matchChecksum(v)
+	}
+	if !isWildcardPath(c.FieldPath) {
+		fieldRes, err := c.traverse(v, c.FieldPath)
+		if c.NullSafe {
+			return c.matchNullSafe(fieldRes, err)
+		}
+		if c.OtherField != "" {
+			if err != nil {
+				return false, err
+			}
+			return c.matchFieldComparison(v, fieldRes)
+		}
+		if errors.Is(err, ErrFieldMissing) {
+			// The path may cross arrays, whose elements it reaches.
+			if fields, err := traverseWildcardPathMap(v, c.FieldPath, c.maxPathDepth()); err == nil {
+				return c.matchAny(fields)
+			}
+		}
+		if errors.Is(err, ErrFieldMissing) && c.Operation == Ne && c.options().MissingMatchesNe {
+			return !c.Negated, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return c.match(fieldRes)
+	}
+	fields, err := traverseWildcardPathMap(v, c.FieldPath, c.maxPathDepth())
+	if err != nil {
+		return false, err
+	}
+	return c.matchAny(fields)
+}
+
+// matchAny matches if the criterion holds for any of fields, skipping
+// those which can't be compared with it.
+func (c *Criterion) matchAny(fields []reflect.Value) (bool, error) {
+	var ok bool
+	var err error
+	for _, field := range fields {
+		if !field.IsValid() {
+			continue
+		}
+		ok, err = c.matchPositive(field)
+		if errors.Is(err, &ErrTypeMismatch{}) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			break
+		}
+	}
+	return ok != c.Negated, nil
+}
+
 func (c *Criterion) match(value reflect.Value) (bool, error) {
-	valueInterface := value.Interface()
-	result, err := compareValue(valueInterface, c.Value)
+	ok, err := c.matchPositive(value)
+	if err != nil {
+		return false, err
+	}
+	return ok != c.Negated, nil
+}
+
+// matchPositive matches the criterion against value, ignoring negation.
+func (c *Criterion) matchPositive(value reflect.Value) (bool, error) {
+	if err := c.assertType(value); err != nil {
+		return false, err
+	}
+	if c.MatchAnyValue && value.Kind() == reflect.Map {
+		return c.matchAnyValue(value)
+	}
+	return c.matchValue(value)
+}
+
+// matchAnyValue matches if any value of an object matches. Values
+// which can't be compared with the criterion are skipped.
+func (c *Criterion) matchAnyValue(value reflect.Value) (bool, error) {
+	iter := value.MapRange()
+	for iter.Next() {
+		v := iter.Value().Elem()
+		if !v.IsValid() {
+			continue
+		}
+		ok, err := c.matchValue(v)
+		if errors.Is(err, &ErrTypeMismatch{}) {
+			continue
+		}
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (c *Criterion) matchValue(value reflect.Value) (bool, error) {
+	opts := c.options()
+	valueInterface := opts.normalize(c.FieldPath, value.Interface())
+	if s, ok := valueInterface.(string); ok && c.Folded {
+		valueInterface = foldString(s)
+	}
+	switch c.Operation {
+	case In:
+		return c.matchIn(valueInterface, opts)
+	case Between, InRanges:
+		return c.matchRanges(valueInterface, opts)
+	case InCurrentPeriod:
+		return c.matchPeriod(valueInterface)
+	case Mod:
+		return c.matchMod(valueInterface)
+	}
+	critVal, err := c.normalizeValue(c.Value, opts)
+	if err != nil {
+		return false, err
+	}
+	switch c.Operation {
+	case EqWithin:
+		return c.matchWithin(valueInterface, critVal)
+	case ContainsFold:
+		return matchContainsFold(valueInterface, critVal)
+	case Matches:
+		return c.matchPattern(valueInterface, critVal, opts)
+	case StartsWith:
+		return matchStartsWith(valueInterface, critVal)
+	}
+	result, err := c.compareWith(valueInterface, critVal, opts)
 	if err != nil {
 		return false, err
 	}
@@ -474,22 +2496,472 @@ func (c *Criterion) match(value reflect.Value) (bool, error) {
 	default:
 		panic("invalid operation")
 	}
+}
+
+// options returns the match options of the query owning the criterion.
+func (c *Criterion) options() MatchOptions {
+	if c.query == nil {
+		return MatchOptions{}
+	}
+	return c.query.MatchOptions
+}
+
+// normalizeValue folds critVal if the criterion folds case, and applies
+// the normalizer in opts, if any, to it.
+func (c *Criterion) normalizeValue(critVal Value, opts MatchOptions) (Value, error) {
+	if c.Folded && critVal.String != nil {
+		folded := foldString(*critVal.String)
+		critVal.String = &folded
+	}
+	if opts.Normalizer == nil {
+		return critVal, nil
+	}
+	nv := createValue(opts.normalize(c.FieldPath, critVal.value()))
+	if nv.value() == nil {
+		return Value{}, fmt.Errorf("normalized value for %s must be a string, bool or float64", c.FieldPath)
+	}
+	return nv, nil
+}
+
+// compareWith compares value against critVal, coercing numbers if enabled.
+func compareWith(value interface{}, critVal Value, opts MatchOptions) (int, error) {
+	if s, ok := value.(string); ok && opts.RuneOrdering && critVal.String != nil {
+		return compareRunes(s, *critVal.String), nil
+	}
+	result, err := compareValue(value, critVal)
+	if err != nil && opts.CoerceNumbers {
+		result, err = compareCoerced(value, critVal, opts.NumberFormat)
+	}
+	if err != nil && opts.CoerceBools && critVal.Bool != nil {
+		if b, ok := truthy(value); ok {
+			result, err = compareValue(b, critVal)
+		}
+	}
+	return result, err
+}
+
+// truthy coerces a legacy boolean representation to a bool: 0 is false
+// and other numbers are true, as are the strings "true" and "1", while
+// "false" and "0" are false. Other values can't be coerced.
+func truthy(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v != 0, true
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "1":
+			return true, true
+		case "false", "0":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// matchIn matches if value equals any of the criterion values. Values of
+// a type that can't be compared with value are skipped, unless none can.
+func (c *Criterion) matchIn(value interface{}, opts MatchOptions) (bool, error) {
+	var mismatch error
+	var comparable bool
+	for _, v := range c.Values {
+		critVal, err := c.normalizeValue(v, opts)
+		if err != nil {
+			return false, err
+		}
+		res, err := compareWith(value, critVal, opts)
+		if err != nil {
+			mismatch = err
+			continue
+		}
+		if res == 0 {
+			return true, nil
+		}
+		comparable = true
+	}
+	if comparable {
+		return false, nil
+	}
+	return false, mismatch
+}
+
+// matchRanges matches if value is within any of the criterion ranges.
+// Ranges of a type that can't be compared with value are skipped, unless
+// none can.
+func (c *Criterion) matchRanges(value interface{}, opts MatchOptions) (bool, error) {
+	var mismatch error
+	var comparable bool
+	for i := 0; i+1 < len(c.Values); i += 2 {
+		ok, err := c.matchRange(value, c.Values[i], c.Values[i+1], opts)
+		if errors.Is(err, &ErrTypeMismatch{}) {
+			mismatch = err
+			continue
+		}
+		if err != nil || ok {
+			return ok, err
+		}
+		comparable = true
+	}
+	if comparable {
+		return false, nil
+	}
+	return false, mismatch
+}
+
+// matchRange matches if value is within low and high, inclusive.
+func (c *Criterion) matchRange(value interface{}, low, high Value, opts MatchOptions) (bool, error) {
+	low, err := c.normalizeValue(low, opts)
+	if err != nil {
+		return false, err
+	}
+	high, err = c.normalizeValue(high, opts)
+	if err != nil {
+		return false, err
+	}
+	res, err := compareWith(value, low, opts)
+	if err != nil || res < 0 {
+		return false, err
+	}
+	res, err = compareWith(value, high, opts)
+	if err != nil {
+		return false, err
+	}
+	return res <= 0, nil
+}
+
+// compareRunes compares a and b code point by code point, as decoded from
+// UTF-8, invalid bytes being U+FFFD.
+func compareRunes(a, b string) int {
+	for a != "" && b != "" {
+		ra, na := utf8.DecodeRuneInString(a)
+		rb, nb := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			if ra < rb {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[na:], b[nb:]
+	}
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+// compareCoerced compares value against critVal after parsing
+// whichever of them is a string into a number, written in format.
+func compareCoerced(value interface{}, critVal Value, format NumberFormat) (int, error) {
+	switch v := value.(type) {
+	case float64:
+		if critVal.String != nil {
+			f, err := format.parse(*critVal.String)
+			if err != nil {
+				return 0, &ErrTypeMismatch{value, critVal}
+			}
+			return compareValue(v, Value{Float: &f})
+		}
+	case string:
+		if critVal.Float != nil {
+			f, err := format.parse(v)
+			if err != nil {
+				return 0, &ErrTypeMismatch{value, critVal}
+			}
+			return compareValue(f, critVal)
+		}
+	}
+	return 0, &ErrTypeMismatch{value, critVal}
+}
+
+func (c *Criterion) matchWithin(value interface{}, critVal Value) (bool, error) {
+	f, ok := value.(float64)
+	if !ok || critVal.Float == nil {
+		return false, &ErrTypeMismatch{value, critVal}
+	}
+	target := *critVal.Float
+	tolerance := c.Tolerance * math.Abs(target)
+	if target == 0 {
+		tolerance = c.Tolerance
+	}
+	return math.Abs(f-target) <= tolerance, nil
+}
+
+func matchContainsFold(value interface{}, critVal Value) (bool, error) {
+	s, ok := value.(string)
+	if !ok || critVal.String == nil {
+		return false, &ErrTypeMismatch{value, critVal}
+	}
+	return strings.Contains(foldString(s), foldString(*critVal.String)), nil
+}
+
+// validateMod validates the divisor and remainder of a Mod criterion.
+func (c *Criterion) validateMod() error {
+	if len(c.Values) != 2 || c.Values[0].Float == nil || c.Values[1].Float == nil {
+		return fmt.Errorf("%w: %s requires a divisor and a remainder", ErrInvalidOperation, c.Operation)
+	}
+	divisor, remainder := *c.Values[0].Float, *c.Values[1].Float
+	if divisor != math.Trunc(divisor) || remainder != math.Trunc(remainder) {
+		return fmt.Errorf("%w: %s divisor and remainder must be integers", ErrInvalidOperation, c.Operation)
+	}
+	if divisor == 0 {
+		return fmt.Errorf("%w: %s divisor can't be zero", ErrInvalidOperation, c.Operation)
+	}
+	return nil
+}
+
+// matchMod matches if value is an integer with the criterion remainder
+// when divided by its divisor.
+func (c *Criterion) matchMod(value interface{}) (bool, error) {
+	var n int64
+	switch v := value.(type) {
+	case float64:
+		if v != math.Trunc(v) || math.Abs(v) >= 1<<63 {
+			return false, nil
+		}
+		n = int64(v)
+	default:
+		return false, &ErrTypeMismatch{value, c.Values[0]}
+	}
+	return n%int64(*c.Values[0].Float) == int64(*c.Values[1].Float), nil
+}
+
+func matchStartsWith(value interface{}, critVal Value) (bool, error) {
+	s, ok := value.(string)
+	if !ok || critVal.String == nil {
+		return false, &ErrTypeMismatch{value, critVal}
+	}
+	return strings.HasPrefix(s, *critVal.String), nil
+}
+
+// foldString maps each rune of s to the smallest rune equivalent under
+// Unicode simple case folding, so folded strings can be compared directly.
+func foldString(s string) string {
+	return strings.Map(foldRune, s)
+}
+
+// foldRune returns the smallest rune equivalent to r under Unicode simple
+// case folding.
+func foldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
+// splitFieldPath splits fieldPath into its fields, failing if there are
+// more than maxDepth of them. A maxDepth of zero is DefaultMaxPathDepth.
+func splitFieldPath(fieldPath string, maxDepth int) ([]string, error) {
+	fields, _, err := splitWildcardPath(fieldPath, maxDepth)
+	return fields, err
+}
+
+// splitWildcardPath is like splitFieldPath, but also returns whether each
+// field is a wildcard.
+func splitWildcardPath(fieldPath string, maxDepth int) ([]string, []bool, error) {
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxPathDepth
+	}
+	if depth := strings.Count(fieldPath, ".") + 1; depth > maxDepth && !strings.Contains(fieldPath, "[") {
+		return nil, nil, fmt.Errorf("%w: %d fields exceed the maximum of %d", ErrPathTooDeep, depth, maxDepth)
+	}
+	fields, literal, err := parseFieldPath(fieldPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fields) > maxDepth {
+		return nil, nil, fmt.Errorf("%w: %d fields exceed the maximum of %d", ErrPathTooDeep, len(fields), maxDepth)
+	}
+	wild := make([]bool, len(fields))
+	for i := range fields {
+		wild[i] = fields[i] == "*" && !literal[i]
+	}
+	return fields, wild, nil
+}
+
+// checkComplexity returns ErrQueryTooComplex if q has more than max
+// criteria and Or branches. A max of zero is DefaultMaxQueryCriteria.
+func (q *Query) checkComplexity(max int) error {
+	if max <= 0 {
+		max = DefaultMaxQueryCriteria
+	}
+	if n := q.complexity(); n > max {
+		return fmt.Errorf("%w: %d criteria and branches, at most %d allowed", ErrQueryTooComplex, n, max)
+	}
+	return nil
+}
+
+// complexity returns the number of criteria and Or branches of q, at
+// any depth.
+func (q *Query) complexity() int {
+	n := len(q.Ands)
+	for _, o := range q.Ors {
+		n += 1 + o.complexity()
+	}
+	return n
+}
+
+// setMaxPathDepth sets the maximum depth of the field paths q and its Ors
+// traverse.
+func (q *Query) setMaxPathDepth(depth int) {
+	q.maxPathDepth = depth
+	for _, o := range q.Ors {
+		o.setMaxPathDepth(depth)
+	}
+}
+
+// checkPathDepth returns ErrPathTooDeep if a field path of the criteria
+// or sorts of q or its Ors is deeper than q.maxPathDepth, so that the
+// query fails whether or not there are instances to traverse.
+func (q *Query) checkPathDepth() error {
+	var paths []string
+	for _, c := range q.Ands {
+		paths = append(paths, c.FieldPath, c.OtherField, c.HighField, c.ChecksumField)
+		paths = append(paths, c.PresentFields...)
+	}
+	for _, s := range append([]Sort{q.Sort}, q.ThenSort...) {
+		paths = append(paths, s.paths()...)
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if _, _, err := splitWildcardPath(path, q.maxPathDepth); errors.Is(err, ErrPathTooDeep) {
+			return err
+		}
+	}
+	for _, o := range q.Ors {
+		if err := o.checkPathDepth(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxPathDepth returns the maximum depth of the field paths the criterion
+// traverses.
+func (c *Criterion) maxPathDepth() int {
+	if c.query == nil {
+		return 0
+	}
+	return c.query.maxPathDepth
+}
+
+// isWildcardPath returns whether fieldPath has a "*" segment.
+func isWildcardPath(fieldPath string) bool {
+	fields, literal, err := parseFieldPath(fieldPath)
+	if err != nil {
+		return false
+	}
+	for i, field := range fields {
+		if field == "*" && !literal[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// traverseWildcardPathMap returns the values at fieldPath, where each "*"
+// segment expands to every key of the object at that level, and each array
+// reached before the last segment expands to its elements, flattened.
+// Fields missing below a wildcard or an array are left out, while fields
+// missing above one are errors.
+func traverseWildcardPathMap(value map[string]interface{}, fieldPath string, maxDepth int) ([]reflect.Value, error) {
+	fields, wild, err := splitWildcardPath(fieldPath, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	currs := []interface{}{value}
+	var expanded bool
+	for i := range fields {
+		var crossed bool
+		currs, crossed = flattenArrays(currs)
+		expanded = expanded || crossed
+		var next []interface{}
+		for _, curr := range currs {
+			m, ok := curr.(map[string]interface{})
+			if !ok {
+				if expanded {
+					continue
+				}
+				return nil, fmt.Errorf("%w: %s in type %s", ErrFieldMissing, fieldPath, value)
+			}
+			if wild[i] {
+				for _, v := range m {
+					next = append(next, v)
+				}
+				continue
+			}
+			v, ok := m[fields[i]]
+			if !ok {
+				if expanded {
+					continue
+				}
+				return nil, fmt.Errorf("%w: %s in type %s", ErrFieldMissing, fieldPath, value)
+			}
+			next = append(next, v)
+		}
+		expanded = expanded || wild[i]
+		currs = next
+	}
+	res := make([]reflect.Value, len(currs))
+	for i, curr := range currs {
+		res[i] = reflect.ValueOf(curr)
+	}
+	return res, nil
+}
+
+// flattenArrays returns values with arrays replaced by their elements, at
+// any depth, and whether there were any.
+func flattenArrays(values []interface{}) ([]interface{}, bool) {
+	var flat []interface{}
+	var crossed bool
+	for _, v := range values {
+		arr, ok := v.([]interface{})
+		if !ok {
+			flat = append(flat, v)
+			continue
+		}
+		crossed = true
+		elems, _ := flattenArrays(arr)
+		flat = append(flat, elems...)
+	}
+	return flat, crossed
+}
 
+func traverseFieldPathMap(value map[string]interface{}, fieldPath string, maxDepth int) (reflect.Value, error) {
+	return traverseFieldPath(value, fieldPath, maxDepth, false)
 }
 
-func traverseFieldPathMap(value map[string]interface{}, fieldPath string) (reflect.Value, error) {
-	fields := strings.Split(fieldPath, ".")
+// traverseFieldPath is like traverseFieldPathMap, but if fold is set, keys
+// missing from value are looked up case-insensitively.
+func traverseFieldPath(value map[string]interface{}, fieldPath string, maxDepth int, fold bool) (reflect.Value, error) {
+	fields, err := splitFieldPath(fieldPath, maxDepth)
+	if err != nil {
+		return reflect.Value{}, err
+	}
 
 	var curr interface{}
 	curr = value
 	for i := range fields {
 		m, ok := curr.(map[string]interface{})
 		if !ok {
-			return reflect.Value{}, fmt.Errorf("instance field %s doesn't exist in type %s", fieldPath, value)
+			return reflect.Value{}, fmt.Errorf("%w: %s in type %s", ErrFieldMissing, fieldPath, value)
 		}
 		v, ok := m[fields[i]]
+		if !ok && fold {
+			if v, ok, err = lookupFold(m, fields[i], fieldPath); err != nil {
+				return reflect.Value{}, err
+			}
+		}
 		if !ok {
-			return reflect.Value{}, fmt.Errorf("instance field %s doesn't exist in type %s", fieldPath, value)
+			return reflect.Value{}, fmt.Errorf("%w: %s in type %s", ErrFieldMissing, fieldPath, value)
 		}
 		curr = v
 	}
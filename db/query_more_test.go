@@ -1,13 +1,23 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ipfs/go-datastore/query"
+	dse "github.com/textileio/go-datastore-extensions"
 	core "github.com/textileio/go-threads/core/db"
+	kt "github.com/textileio/go-threads/db/keytransform"
 	"github.com/textileio/go-threads/util"
 )
 
@@ -94,6 +104,58 @@ var (
 		{name: "LimitTotalReadsInside", query: Where("Meta.TotalReads").Lt(float64(100)).LimitTo(2), resIdx: []int{0, 1}},
 
 		{name: "LimitWithSkip", query: Where("Meta.TotalReads").Gt(float64(0)).SkipNum(1).LimitTo(3), resIdx: []int{1, 2, 3}},
+
+		{name: "ExcludeWhere", query: Where("Author").Eq("Author1").ExcludeWhere("Title", "Title2"), resIdx: []int{0, 2}},
+		{name: "ExcludeWhereAnds", query: Where("Author").Eq("Author1").And("Meta.TotalReads").Gt(float64(10)).ExcludeWhere("Title", "Title3"), resIdx: []int{1}},
+		{name: "ExcludeWhereOrs", query: Where("Author").Eq("Author1").Or(Where("Author").Eq("Author3")).ExcludeWhere("Title", "Title5"), resIdx: []int{0, 1, 2}},
+		{name: "EqWithinBoundary", query: Where("Meta.TotalReads").EqWithin(100, 0.14), resIdx: []int{3}},
+		{name: "EqWithinOutside", query: Where("Meta.TotalReads").EqWithin(100, 0.13), resIdx: []int{}},
+		{name: "EqWithinZeroBoundary", query: Where("Meta.TotalReads").EqWithin(0, 10), resIdx: []int{0}},
+		{name: "EqWithinZeroOutside", query: Where("Meta.TotalReads").EqWithin(0, 9.99), resIdx: []int{}},
+		{name: "InAuthor", query: Where("Author").In("Author2", "Author3"), resIdx: []int{3, 4}},
+		{name: "InTotalReadsNone", query: Where("Meta.TotalReads").In(float64(11), float64(12)), resIdx: []int{}},
+		{name: "InMixedTypes", query: Where("Author").In(float64(1), "Author3"), resIdx: []int{4}},
+		{name: "InMixedTypesReversed", query: Where("Author").In("Author3", float64(1)), resIdx: []int{4}},
+		{name: "InCoerced", query: Where("Meta.TotalReads").In("30", "11").WithNumberCoercion(), resIdx: []int{2}},
+		{name: "NotEq", query: Where("Author").Not().Eq("Author1"), resIdx: []int{3, 4}},
+		{name: "NotContainsFold", query: Where("Title").Not().ContainsFold("title1"), resIdx: []int{1, 2, 3, 4}},
+		{name: "NotAndOr", query: Where("Author").Eq("Author1").And("Title").Not().Eq("Title2").Or(Where("Meta.TotalReads").Not().Lt(float64(500))), resIdx: []int{0, 2, 4}},
+		{name: "NotNot", query: Where("Author").Not().Not().Eq("Author2"), resIdx: []int{3}},
+		{name: "BetweenTotalReads", query: Where("Meta.TotalReads").Between(float64(20), float64(114)), resIdx: []int{1, 2, 3}},
+		{name: "ModTen", query: Where("Meta.TotalReads").Mod(10, 0), resIdx: []int{0, 1, 2, 4}},
+		{name: "ModThree", query: Where("Meta.TotalReads").Mod(3, 0), resIdx: []int{2, 3}},
+		{name: "ModSevenRemainder", query: Where("Meta.TotalReads").Mod(7, 2), resIdx: []int{2, 3}},
+		{name: "ModFourRemainder", query: Where("Meta.TotalReads").Mod(4, 2), resIdx: []int{0, 2, 3}},
+		{name: "ModNonInteger", query: Where("Meta.Rating").Mod(1, 0), resIdx: []int{3}},
+		{name: "NotMod", query: Where("Meta.TotalReads").Not().Mod(10, 0), resIdx: []int{3}},
+		{name: "NotBetweenTotalReads", query: Where("Meta.TotalReads").NotBetween(float64(20), float64(114)), resIdx: []int{0, 4}},
+		{name: "NotBetweenBoundaries", query: Where("Meta.TotalReads").NotBetween(float64(10), float64(500)), resIdx: []int{}},
+		{name: "NotBetweenJustInside", query: Where("Meta.TotalReads").NotBetween(10.01, 499.99), resIdx: []int{0, 4}},
+		{name: "NotBetweenJustOutside", query: Where("Meta.TotalReads").NotBetween(20.01, 113.99), resIdx: []int{0, 1, 3, 4}},
+		{name: "NotBetweenPoint", query: Where("Meta.TotalReads").NotBetween(float64(30), float64(30)), resIdx: []int{0, 1, 3, 4}},
+		{name: "NotBetweenAuthor", query: Where("Author").NotBetween("Author1", "Author2"), resIdx: []int{4}},
+		{name: "NotNotBetween", query: Where("Author").Not().NotBetween("Author1", "Author2"), resIdx: []int{0, 1, 2, 3}},
+		{name: "MatchesTitle", query: Where("Title").Matches(`^Title[1-3]$`), resIdx: []int{0, 1, 2}},
+		{name: "MatchesSubstring", query: Where("Author").Matches(`or[23]`), resIdx: []int{3, 4}},
+		{name: "NotMatches", query: Where("Title").Not().Matches(`[45]`), resIdx: []int{0, 1, 2}},
+		{name: "InRangesDisjoint", query: Where("Meta.TotalReads").InRanges([2]interface{}{float64(5), float64(15)}, [2]interface{}{float64(100), float64(200)}), resIdx: []int{0, 3}},
+		{name: "InRangesOverlapping", query: Where("Meta.TotalReads").InRanges([2]interface{}{float64(10), float64(25)}, [2]interface{}{float64(20), float64(30)}), resIdx: []int{0, 1, 2}},
+		{name: "InRangesGap", query: Where("Meta.TotalReads").InRanges([2]interface{}{float64(0), float64(19)}, [2]interface{}{float64(21), float64(29)}), resIdx: []int{0}},
+		{name: "InRangesBoundaries", query: Where("Meta.TotalReads").InRanges([2]interface{}{float64(20), float64(20)}, [2]interface{}{float64(114), float64(500)}), resIdx: []int{1, 3, 4}},
+		{name: "InRangesMixedTypes", query: Where("Author").InRanges([2]interface{}{float64(1), float64(2)}, [2]interface{}{"Author3", "Author9"}), resIdx: []int{4}},
+		{name: "InRangesMixedTypesReversed", query: Where("Author").InRanges([2]interface{}{"Author3", "Author9"}, [2]interface{}{float64(1), float64(2)}), resIdx: []int{4}},
+		{name: "ContainsFold", query: Where("Title").ContainsFold("tLE1"), resIdx: []int{0}},
+		{name: "ContainsFoldAll", query: Where("Author").ContainsFold("AUTHOR"), resIdx: []int{0, 1, 2, 3, 4}},
+		{name: "ContainsFoldEmpty", query: Where("Title").ContainsFold(""), resIdx: []int{0, 1, 2, 3, 4}},
+		{name: "ContainsFoldNone", query: Where("Title").ContainsFold("author"), resIdx: []int{}},
+		{name: "CoercedEq", query: Where("Meta.TotalReads").Eq("30").WithNumberCoercion(), resIdx: []int{2}},
+		{name: "CoercedGe", query: Where("Meta.TotalReads").Ge(" 114 ").WithNumberCoercion(), resIdx: []int{3, 4}},
+		{name: "CoercedInOr", query: Where("Author").Eq("Author3").Or(Where("Meta.Rating").Lt("3.5")).WithNumberCoercion(), resIdx: []int{0, 4}},
+		{name: "AliasedField", query: Where("Writer").Eq("Author1").WithFieldAliases(map[string]string{"Writer": "Author"}), resIdx: []int{0, 1, 2}},
+		{name: "AliasedFieldInOr", query: Where("Author").Eq("Author2").Or(Where("Writer").Eq("Author3")).WithFieldAliases(map[string]string{"Writer": "Author"}), resIdx: []int{3, 4}},
+		{name: "AliasedSort", query: Where("Meta.TotalReads").Gt(float64(20)).OrderByDesc("Reads").WithFieldAliases(map[string]string{"Reads": "Meta.TotalReads"}), resIdx: []int{4, 3, 2}, ordered: true},
+		{name: "NonAliasedField", query: Where("Author").Eq("Author2").WithFieldAliases(map[string]string{"Writer": "Author"}), resIdx: []int{3}},
+		{name: "ExcludeWhereBeforeOr", query: Where("Author").Eq("Author1").ExcludeWhere("Title", "Title1").Or(Where("Author").Eq("Author2")), resIdx: []int{1, 2, 3}},
 	}
 )
 
@@ -171,3 +233,3712 @@ func createCollectionWithData(t *testing.T) (*Collection, []book, func()) {
 	}
 	return c, sampleDataCopy, clean
 }
+
+func TestOperationStringParse(t *testing.T) {
+	t.Parallel()
+	ops := AllOperations()
+	if len(ops) != 15 {
+		t.Fatalf("expected 15 operations, got %d", len(ops))
+	}
+	for _, op := range ops {
+		parsed, err := ParseOperation(op.String())
+		if err != nil {
+			t.Fatalf("error parsing operation %s: %v", op, err)
+		}
+		if parsed != op {
+			t.Fatalf("round-trip mismatch, expected: %v, got: %v", op, parsed)
+		}
+	}
+	if op, err := ParseOperation("GE"); err != nil || op != Ge {
+		t.Fatalf("parsing should be case-insensitive, got: %v, %v", op, err)
+	}
+	if _, err := ParseOperation("like"); err == nil {
+		t.Fatal("parsing an unknown operation should fail")
+	}
+}
+
+func TestQueryConcurrentFind(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	shared := Where("Author").Eq("Author1").
+		Or(Where("Meta.Rating").Gt(4.5)).
+		OrderByDesc("Meta.TotalReads").
+		WithFieldAliases(map[string]string{"Writer": "Author"})
+	expected, err := c.Find(shared)
+	checkErr(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.Find(shared)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !reflect.DeepEqual(expected, res) {
+				errs <- errors.New("concurrent query results don't match")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryClone(t *testing.T) {
+	t.Parallel()
+	q := Where("Author").Eq("Author1").Or(Where("Title").Eq("Title5"))
+	clone := q.Clone()
+	if !reflect.DeepEqual(q, clone) {
+		t.Fatalf("clone doesn't match original, expected: %v, got: %v", q, clone)
+	}
+	clone.And("Title").Eq("Title1")
+	clone.Ors[0].Ands[0].FieldPath = "Other"
+	if len(q.Ands) != 1 || q.Ors[0].Ands[0].FieldPath != "Title" {
+		t.Fatal("modifying the clone shouldn't modify the original")
+	}
+}
+
+func TestQueryCompoundIndex(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{
+		Name: "Book",
+		Indexes: []Index{{
+			Fields: []string{"Author", "Meta.TotalReads"},
+		}},
+	}, sampleData)
+	defer clean()
+
+	tests := []struct {
+		name   string
+		query  *Query
+		titles []string
+	}{
+		{
+			name:   "FullIndex",
+			query:  Where("Author").Eq("Author1").And("Meta.TotalReads").Ge(float64(20)).UseCompoundIndex("Author", "Meta.TotalReads"),
+			titles: []string{"Title2", "Title3"},
+		},
+		{
+			name:   "FullIndexEq",
+			query:  Where("Author").Eq("Author1").And("Meta.TotalReads").Eq(float64(10)).UseCompoundIndex("Author", "Meta.TotalReads"),
+			titles: []string{"Title1"},
+		},
+		{
+			name:   "IndexPrefix",
+			query:  Where("Author").Eq("Author1").UseCompoundIndex("Author", "Meta.TotalReads"),
+			titles: []string{"Title1", "Title2", "Title3"},
+		},
+		{
+			name:  "IndexPrefixNoMatch",
+			query: Where("Author").Eq("Author9").UseCompoundIndex("Author", "Meta.TotalReads"),
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := c.Find(tc.query)
+			checkErr(t, err)
+			titles := stringFields(res, "Title")
+			sort.Strings(titles)
+			if !reflect.DeepEqual(tc.titles, titles) {
+				t.Fatalf("wrong query results, expected: %v, got: %v", tc.titles, titles)
+			}
+		})
+	}
+}
+
+func TestContainsFold(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		value  interface{}
+		substr string
+		match  bool
+		err    bool
+	}{
+		{value: "Hello World", substr: "o w", match: true},
+		{value: "Hello World", substr: "WORLD", match: true},
+		{value: "Hello World", substr: "worlds", match: false},
+		{value: "Hello World", substr: "", match: true},
+		{value: "Σίσυφος", substr: "ΣΥΦΟΣ", match: true},
+		{value: "\u212Aelvin", substr: "kel", match: true},
+		{value: "straße", substr: "STRASSE", match: false},
+		{value: 3.0, substr: "3", err: true},
+	}
+	for _, tc := range tests {
+		q := Where("Field").ContainsFold(tc.substr)
+		match, err := q.match(map[string]interface{}{"Field": tc.value})
+		if tc.err {
+			if err == nil {
+				t.Fatalf("expected type mismatch error for %v", tc.value)
+			}
+			continue
+		}
+		checkErr(t, err)
+		if match != tc.match {
+			t.Fatalf("wrong match result for %v contains %q, expected: %v, got: %v", tc.value, tc.substr, tc.match, match)
+		}
+	}
+}
+
+func TestExists(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{
+		Name: "Book",
+		ReadFilter: `
+			scanned = (typeof scanned === "undefined" ? 0 : scanned) + 1
+			return instance
+		`,
+	}, sampleData)
+	defer clean()
+	scanned := func() int64 {
+		c.Lock()
+		defer c.Unlock()
+		v := c.vm.Get("scanned")
+		if v == nil {
+			return 0
+		}
+		return v.ToInteger()
+	}
+
+	var exists bool
+	start := scanned()
+	err := c.ReadTxn(func(txn *Txn) (err error) {
+		exists, err = txn.Exists(Where("Meta.TotalReads").Gt(float64(0)).OrderBy("Missing").SkipNum(10))
+		return err
+	})
+	checkErr(t, err)
+	if !exists {
+		t.Fatal("a matching instance should exist")
+	}
+	if n := scanned() - start; n != 1 {
+		t.Fatalf("exists should stop at the first match, scanned: %d", n)
+	}
+
+	err = c.ReadTxn(func(txn *Txn) (err error) {
+		exists, err = txn.Exists(Where("Author").Eq("Author9"))
+		return err
+	})
+	checkErr(t, err)
+	if exists {
+		t.Fatal("no matching instance should exist")
+	}
+}
+
+func TestNumberCoercion(t *testing.T) {
+	t.Parallel()
+	instance := map[string]interface{}{"Age": 30.0, "Code": "042"}
+	tests := []struct {
+		name  string
+		query *Query
+		match bool
+		err   bool
+	}{
+		{name: "StrictStringCriterion", query: Where("Age").Eq("30"), err: true},
+		{name: "StrictNumberCriterion", query: Where("Code").Eq(42.0), err: true},
+		{name: "StringCriterion", query: Where("Age").Eq("30").WithNumberCoercion(), match: true},
+		{name: "StringCriterionLt", query: Where("Age").Lt("30.5").WithNumberCoercion(), match: true},
+		{name: "NumberCriterion", query: Where("Code").Eq(42.0).WithNumberCoercion(), match: true},
+		{name: "NumberCriterionGt", query: Where("Code").Gt(42.0).WithNumberCoercion(), match: false},
+		{name: "FailedCoercion", query: Where("Age").Eq("thirty").WithNumberCoercion(), err: true},
+		{name: "BoolNotCoerced", query: Where("Age").Eq(true).WithNumberCoercion(), err: true},
+	}
+	for _, tc := range tests {
+		match, err := tc.query.prepare().match(instance)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("%s: expected a type mismatch error", tc.name)
+			}
+			continue
+		}
+		checkErr(t, err)
+		if match != tc.match {
+			t.Fatalf("%s: wrong match result, expected: %v, got: %v", tc.name, tc.match, match)
+		}
+	}
+}
+
+func TestBoolCoercion(t *testing.T) {
+	t.Parallel()
+	legacy := []struct {
+		value  interface{}
+		truthy bool
+	}{
+		{value: 1.0, truthy: true},
+		{value: 0.0, truthy: false},
+		{value: 2.0, truthy: true},
+		{value: "true", truthy: true},
+		{value: "false", truthy: false},
+		{value: "1", truthy: true},
+		{value: "0", truthy: false},
+		{value: true, truthy: true},
+		{value: false, truthy: false},
+	}
+	for _, l := range legacy {
+		instance := map[string]interface{}{"Active": l.value}
+		for _, crit := range []bool{true, false} {
+			match, err := Where("Active").Eq(crit).WithBoolCoercion().prepare().match(instance)
+			checkErr(t, err)
+			if match != (l.truthy == crit) {
+				t.Fatalf("%#v: wrong match result against %v, expected: %v, got: %v", l.value, crit, l.truthy == crit, match)
+			}
+			if _, isBool := l.value.(bool); isBool {
+				continue
+			}
+			if _, err := Where("Active").Eq(crit).prepare().match(instance); err == nil {
+				t.Fatalf("%#v: expected a type mismatch error without coercion", l.value)
+			}
+		}
+	}
+	instance := map[string]interface{}{"Active": "yes"}
+	if _, err := Where("Active").Eq(true).WithBoolCoercion().prepare().match(instance); !errors.Is(err, &ErrTypeMismatch{}) {
+		t.Fatalf("expected a type mismatch error, got: %v", err)
+	}
+	instance = map[string]interface{}{"Active": 1.0}
+	if _, err := Where("Active").Eq("1").WithBoolCoercion().prepare().match(instance); err == nil {
+		t.Fatal("expected non-boolean criteria not to be coerced")
+	}
+}
+
+type tagged struct {
+	ID   core.InstanceID `json:"_id"`
+	Name string
+	Tags []string `json:",omitempty"`
+}
+
+func TestQueryOrderByLen(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Tagged"}, []tagged{
+		{Name: "two", Tags: []string{"a", "b"}},
+		{Name: "none"},
+		{Name: "three", Tags: []string{"a", "b", "c"}},
+		{Name: "one", Tags: []string{"a"}},
+	})
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "Asc", query: (&Query{}).OrderByLen("Tags"), names: []string{"none", "one", "two", "three"}},
+		{name: "Desc", query: (&Query{}).OrderByLenDesc("Tags"), names: []string{"three", "two", "one", "none"}},
+		{name: "Cleared", query: (&Query{}).OrderByLen("Tags").ClearSort().OrderByDesc("Name"), names: []string{"two", "three", "one", "none"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(tc.names, names) {
+			t.Fatalf("%s: wrong order, expected: %v, got: %v", tc.name, tc.names, names)
+		}
+	}
+}
+
+func TestValueNormalizer(t *testing.T) {
+	t.Parallel()
+	normalize := func(_ string, v interface{}) interface{} {
+		if s, ok := v.(string); ok {
+			return strings.ToLower(strings.TrimSpace(s))
+		}
+		return v
+	}
+	instance := map[string]interface{}{"Name": "  Alice ", "Age": 30.0}
+	tests := []struct {
+		name  string
+		query *Query
+		match bool
+	}{
+		{name: "Unnormalized", query: Where("Name").Eq("alice"), match: false},
+		{name: "NormalizedField", query: Where("Name").Eq("alice").WithValueNormalizer(normalize), match: true},
+		{name: "NormalizedCriterion", query: Where("Name").Eq(" ALICE").WithValueNormalizer(normalize), match: true},
+		{name: "NormalizedInOr", query: Where("Age").Lt(18.0).Or(Where("Name").Eq("Alice")).WithValueNormalizer(normalize), match: true},
+		{name: "NonString", query: Where("Age").Eq(30.0).WithValueNormalizer(normalize), match: true},
+	}
+	for _, tc := range tests {
+		match, err := tc.query.prepare().match(instance)
+		checkErr(t, err)
+		if match != tc.match {
+			t.Fatalf("%s: wrong match result, expected: %v, got: %v", tc.name, tc.match, match)
+		}
+	}
+
+	values := []MarshaledResult{
+		{MarshaledValue: map[string]interface{}{"Name": "bob"}},
+		{MarshaledValue: map[string]interface{}{"Name": " Carol"}},
+		{MarshaledValue: map[string]interface{}{"Name": "Alice"}},
+	}
+	err := sortResults(values, OrderBy("Name").WithValueNormalizer(normalize).prepare())
+	checkErr(t, err)
+	var names []string
+	for _, v := range values {
+		names = append(names, v.MarshaledValue["Name"].(string))
+	}
+	if expected := []string{"Alice", "bob", " Carol"}; !reflect.DeepEqual(expected, names) {
+		t.Fatalf("wrong normalized sort order, expected: %v, got: %v", expected, names)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	t.Parallel()
+	// The instances are created in a single txn, as creating them one by
+	// one is slow.
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Book"}, []book{})
+	defer clean()
+	const total = 1050
+	instances := make([][]byte, total)
+	for i := range instances {
+		instances[i] = util.JSONFromInstance(book{Title: fmt.Sprintf("Title%d", i), Meta: bookStats{TotalReads: i}})
+	}
+	ids, err := c.CreateMany(instances)
+	checkErr(t, err)
+
+	visit := func(q *Query, batchSize int) (map[core.InstanceID]int, []int) {
+		visited := make(map[core.InstanceID]int)
+		var sizes []int
+		err := c.ReadTxn(func(txn *Txn) error {
+			return txn.ForEach(q, batchSize, func(batch [][]byte) error {
+				sizes = append(sizes, len(batch))
+				for _, b := range batch {
+					var res book
+					util.InstanceFromJSON(b, &res)
+					visited[res.ID]++
+				}
+				return nil
+			})
+		})
+		checkErr(t, err)
+		return visited, sizes
+	}
+
+	visited, sizes := visit(nil, 100)
+	if len(visited) != total {
+		t.Fatalf("expected %d visited instances, got %d", total, len(visited))
+	}
+	for _, id := range ids {
+		if n := visited[id]; n != 1 {
+			t.Fatalf("instance %s visited %d times", id, n)
+		}
+	}
+	if len(sizes) != 11 || sizes[0] != 100 || sizes[10] != 50 {
+		t.Fatalf("unexpected batch sizes: %v", sizes)
+	}
+
+	visited, _ = visit(Where("Meta.TotalReads").Ge(float64(1000)).SkipNum(10).LimitTo(30), 7)
+	if len(visited) != 30 {
+		t.Fatalf("expected 30 visited instances, got %d", len(visited))
+	}
+
+	_, sizes = visit(OrderByDesc("Meta.TotalReads"), 500)
+	if !reflect.DeepEqual(sizes, []int{500, 500, 50}) {
+		t.Fatalf("unexpected sorted batch sizes: %v", sizes)
+	}
+
+	errStop := errors.New("stop")
+	var calls int
+	err = c.ReadTxn(func(txn *Txn) error {
+		return txn.ForEach(nil, 10, func([][]byte) error {
+			calls++
+			return errStop
+		})
+	})
+	if !errors.Is(err, errStop) || calls != 1 {
+		t.Fatalf("expected iteration to stop with fn error, got: %v after %d calls", err, calls)
+	}
+}
+
+func TestNegatedCriterionJSON(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+	b, err := json.Marshal(Where("Title").Not().ContainsFold("TITLE2").And("Author").Not().Eq("Author3"))
+	checkErr(t, err)
+	q := &Query{}
+	checkErr(t, json.Unmarshal(b, q))
+	if !q.Ands[0].Negated || !q.Ands[1].Negated {
+		t.Fatal("negation should survive serialization")
+	}
+	res, err := c.Find(q)
+	checkErr(t, err)
+	if len(res) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res))
+	}
+	for _, r := range res {
+		var b book
+		util.InstanceFromJSON(r, &b)
+		if b.Title == "Title2" || b.Author == "Author3" {
+			t.Fatalf("unexpected result: %+v", b)
+		}
+	}
+}
+
+func TestFindAcross(t *testing.T) {
+	t.Parallel()
+	all, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Book"}, sampleData)
+	defer clean()
+	var shards []*Collection
+	for _, name := range []string{"BookShard0", "BookShard1"} {
+		c, err := all.db.NewCollection(CollectionConfig{Name: name, Schema: util.SchemaFromInstance(&book{}, false)})
+		checkErr(t, err)
+		shards = append(shards, c)
+	}
+	for i := range sampleData {
+		_, err := shards[i%2].Create(util.JSONFromInstance(sampleData[i]))
+		checkErr(t, err)
+	}
+	findAcross := func(q *Query) (res [][]byte, err error) {
+		err = shards[0].ReadTxn(func(txn0 *Txn) error {
+			return shards[1].ReadTxn(func(txn1 *Txn) error {
+				res, err = FindAcross([]*Txn{txn0, txn1}, q)
+				return err
+			})
+		})
+		return
+	}
+
+	tests := []struct {
+		query       *Query
+		skip, limit int
+	}{
+		{query: OrderByDesc("Meta.TotalReads")},
+		{query: OrderBy("Title"), skip: 1, limit: 3},
+		{query: Where("Author").Eq("Author1").OrderByDesc("Meta.Rating"), limit: 2},
+		{query: Where("Meta.TotalReads").Gt(float64(1000)).OrderBy("Title")},
+	}
+	for _, tc := range tests {
+		// Find limits before sorting, so compare against the full sorted set.
+		expected, err := all.Find(tc.query)
+		checkErr(t, err)
+		expected = expected[tc.skip:]
+		if tc.limit > 0 {
+			expected = expected[:tc.limit]
+		}
+		res, err := findAcross(tc.query.Clone().SkipNum(tc.skip).LimitTo(tc.limit))
+		checkErr(t, err)
+		if exp, got := stringFields(expected, "Title"), stringFields(res, "Title"); !reflect.DeepEqual(exp, got) {
+			t.Fatalf("merged results differ, expected: %v, got: %v", exp, got)
+		}
+	}
+
+	res, err := findAcross(Where("Author").Eq("Author1").SkipNum(1).LimitTo(1))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("expected 1 unsorted result, got %d", len(res))
+	}
+}
+
+func TestQueryErrorClasses(t *testing.T) {
+	t.Parallel()
+	instance := map[string]interface{}{"Name": "Alice", "Age": 30.0}
+
+	_, err := Where("Missing").Eq("x").prepare().match(instance)
+	if !errors.Is(err, ErrFieldMissing) {
+		t.Fatalf("expected missing field error, got: %v", err)
+	}
+
+	_, err = Where("Age").Eq("thirty").prepare().match(instance)
+	if !errors.Is(err, &ErrTypeMismatch{}) {
+		t.Fatalf("expected type mismatch error, got: %v", err)
+	}
+	var mismatch *ErrTypeMismatch
+	if !errors.As(err, &mismatch) || mismatch.Value != 30.0 {
+		t.Fatalf("expected type mismatch details, got: %v", err)
+	}
+	if errors.Is(err, ErrFieldMissing) {
+		t.Fatal("type mismatch shouldn't be a missing field error")
+	}
+
+	if _, err = ParseOperation("like"); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid operation error, got: %v", err)
+	}
+	q := &Query{Ands: []*Criterion{{FieldPath: "Name", Operation: Operation(100), Value: createValue("Alice")}}}
+	if err = q.Validate(); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid operation error, got: %v", err)
+	}
+
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+	_, err = c.Find(Where("Title").EqWithin(float64(1), -1))
+	if !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid operation error from find, got: %v", err)
+	}
+}
+
+func TestQueryOrderByCollated(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Book"}, []book{
+		{Title: "Zebra"}, {Title: "apple"}, {Title: "Éclair"}, {Title: "banana"},
+		{Title: "eclairs"}, {Title: "ebb"}, {Title: "EBD"}, {Title: "ébc"},
+	})
+	defer clean()
+
+	tests := []struct {
+		name   string
+		query  *Query
+		titles []string
+	}{
+		{
+			name:   "Bytes",
+			query:  OrderBy("Title"),
+			titles: []string{"EBD", "Zebra", "apple", "banana", "ebb", "eclairs", "Éclair", "ébc"},
+		},
+		{
+			name:   "Collated",
+			query:  (&Query{}).OrderByCollated("Title", CollationOptions{}),
+			titles: []string{"apple", "banana", "ebb", "ébc", "EBD", "Éclair", "eclairs", "Zebra"},
+		},
+		{
+			name:   "CollatedDescIgnoringCaseAndAccents",
+			query:  Where("Title").Lt("c").OrderByCollatedDesc("Title", CollationOptions{Locale: "fr", IgnoreCase: true, IgnoreAccents: true}),
+			titles: []string{"Zebra", "EBD", "banana", "apple"},
+		},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		titles := stringFields(res, "Title")
+		if !reflect.DeepEqual(tc.titles, titles) {
+			t.Fatalf("%s: wrong order, expected: %v, got: %v", tc.name, tc.titles, titles)
+		}
+	}
+
+	coll := CollationOptions{IgnoreCase: true, IgnoreAccents: true}.collator()
+	if coll.CompareString("Zoé", "zoe") != 0 {
+		t.Fatal("strings differing by case and accents should collate equal")
+	}
+}
+
+func TestBetweenValidation(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		query *Query
+		valid bool
+	}{
+		{name: "Ordered", query: Where("Age").NotBetween(13.0, 19.0), valid: true},
+		{name: "Equal", query: Where("Age").NotBetween(13.0, 13.0), valid: true},
+		{name: "Reversed", query: Where("Age").NotBetween(19.0, 13.0)},
+		{name: "MixedTypes", query: Where("Age").NotBetween(13.0, "19")},
+		{name: "MissingBound", query: &Query{Ands: []*Criterion{{FieldPath: "Age", Operation: Between, Values: []Value{createValue(13.0)}}}}},
+		{name: "Ranges", query: Where("Age").InRanges([2]interface{}{1.0, 2.0}, [2]interface{}{2.0, 5.0}), valid: true},
+		{name: "NoRanges", query: Where("Age").InRanges()},
+		{name: "RangeReversed", query: Where("Age").InRanges([2]interface{}{1.0, 2.0}, [2]interface{}{5.0, 3.0})},
+		{name: "RangeMixedTypes", query: Where("Age").InRanges([2]interface{}{"1", 2.0})},
+		{name: "Mod", query: Where("Age").Mod(-3, 1), valid: true},
+		{name: "ModZeroDivisor", query: Where("Age").Mod(0, 0)},
+		{name: "ModNonInteger", query: &Query{Ands: []*Criterion{{FieldPath: "Age", Operation: Mod, Values: []Value{createValue(2.5), createValue(0.0)}}}}},
+	}
+	for _, tc := range tests {
+		err := tc.query.Validate()
+		if tc.valid && err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidOperation) {
+			t.Fatalf("%s: expected invalid operation error, got: %v", tc.name, err)
+		}
+	}
+}
+
+func TestQueryAnyValue(t *testing.T) {
+	t.Parallel()
+	type item struct {
+		ID         core.InstanceID `json:"_id"`
+		Name       string
+		Attributes map[string]interface{}
+	}
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Item"}, []item{
+		{Name: "Shirt", Attributes: map[string]interface{}{"color": "red", "size": 42.0}},
+		{Name: "Mug", Attributes: map[string]interface{}{"glaze": "red", "volume": 350.0}},
+		{Name: "Lamp", Attributes: map[string]interface{}{"shade": "blue", "watts": 40.0}},
+		{Name: "Chair", Attributes: map[string]interface{}{}},
+	})
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "AnyEq", query: Where("Attributes").AnyValue().Eq("red"), names: []string{"Mug", "Shirt"}},
+		{name: "AnyGt", query: Where("Attributes").AnyValue().Gt(100.0), names: []string{"Mug"}},
+		{name: "AnyNone", query: Where("Attributes").AnyValue().Eq("green"), names: nil},
+		{name: "NotAny", query: Where("Attributes").Not().AnyValue().Eq("red"), names: []string{"Chair", "Lamp"}},
+		{name: "AnyInAnd", query: Where("Name").Ne("Shirt").And("Attributes").AnyValue().ContainsFold("RE"), names: []string{"Mug"}},
+		{name: "NonObjectField", query: Where("Name").AnyValue().Eq("Lamp"), names: []string{"Lamp"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		sort.Strings(names)
+		if !reflect.DeepEqual(tc.names, names) {
+			t.Fatalf("%s: wrong results, expected: %v, got: %v", tc.name, tc.names, names)
+		}
+	}
+}
+
+func TestQueryOrderByRelevance(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Book"}, []book{
+		{Title: "A Tale of Go", Author: "Author"},
+		{Title: "Go Programming", Author: "Author"},
+		{Title: "Learning to Go, Go, Go", Author: "Author"},
+		{Title: "Rust", Author: "Author"},
+	})
+	defer clean()
+
+	tests := []struct {
+		name   string
+		query  *Query
+		titles []string
+	}{
+		{
+			name:   "PositionAndCount",
+			query:  Where("Title").ContainsFold("go").OrderByRelevance(),
+			titles: []string{"Learning to Go, Go, Go", "Go Programming", "A Tale of Go"},
+		},
+		{
+			name:   "InOr",
+			query:  Where("Title").ContainsFold("rust").Or(Where("Title").ContainsFold("tale")).OrderByRelevance(),
+			titles: []string{"Rust", "A Tale of Go"},
+		},
+		{
+			name:   "Matches",
+			query:  Where("Title").Matches(`Go\b`).OrderByRelevance(),
+			titles: []string{"Learning to Go, Go, Go", "Go Programming", "A Tale of Go"},
+		},
+		{
+			name:   "MatchesPosition",
+			query:  Where("Title").Matches(`o`).OrderByRelevance(),
+			titles: []string{"Learning to Go, Go, Go", "Go Programming", "A Tale of Go"},
+		},
+		{
+			name:   "StartsWith",
+			query:  Where("Title").ContainsFold("go").Or(Where("Title").StartsWith("Go")).OrderByRelevance(),
+			titles: []string{"Go Programming", "Learning to Go, Go, Go", "A Tale of Go"},
+		},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		titles := stringFields(res, "Title")
+		if !reflect.DeepEqual(tc.titles, titles) {
+			t.Fatalf("%s: wrong order, expected: %v, got: %v", tc.name, tc.titles, titles)
+		}
+	}
+}
+
+func TestQueryWildcardPath(t *testing.T) {
+	t.Parallel()
+	type product struct {
+		ID     core.InstanceID `json:"_id"`
+		Name   string
+		Prices map[string]float64
+		Stock  map[string]map[string]float64
+	}
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Product"}, []product{
+		{Name: "Phone", Prices: map[string]float64{"USD": 90, "EUR": 120, "GBP": 80}, Stock: map[string]map[string]float64{"eu": {"units": 5}}},
+		{Name: "Case", Prices: map[string]float64{"USD": 10, "EUR": 9}, Stock: map[string]map[string]float64{"us": {"units": 0}, "eu": {"reserved": 3}}},
+		{Name: "Laptop", Prices: map[string]float64{"JPY": 150000}, Stock: map[string]map[string]float64{}},
+	})
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "AnyPriceGt", query: Where("Prices.*").Gt(float64(100)), names: []string{"Laptop", "Phone"}},
+		{name: "AnyPriceLt", query: Where("Prices.*").Lt(float64(10)), names: []string{"Case"}},
+		{name: "NoPriceGt", query: Where("Prices.*").Not().Gt(float64(100)), names: []string{"Case"}},
+		{name: "NestedWildcard", query: Where("Stock.*.units").Gt(float64(0)), names: []string{"Phone"}},
+		{name: "NestedWildcardMissing", query: Where("Stock.*.reserved").Ge(float64(0)), names: []string{"Case"}},
+		{name: "WildcardInOr", query: Where("Name").Eq("Laptop").Or(Where("Prices.*").Eq(float64(120))), names: []string{"Laptop", "Phone"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		sort.Strings(names)
+		if !reflect.DeepEqual(tc.names, names) {
+			t.Fatalf("%s: wrong results, expected: %v, got: %v", tc.name, tc.names, names)
+		}
+	}
+
+	_, err := Where("Missing.*").Eq(float64(1)).prepare().match(map[string]interface{}{})
+	if !errors.Is(err, ErrFieldMissing) {
+		t.Fatalf("expected missing field error above the wildcard, got: %v", err)
+	}
+}
+
+func TestFindMaps(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+	q := Where("Author").Eq("Author1").OrderByDesc("Meta.TotalReads")
+	var maps []map[string]interface{}
+	err := c.ReadTxn(func(txn *Txn) (err error) {
+		maps, err = txn.FindMaps(q)
+		return err
+	})
+	checkErr(t, err)
+	res, err := c.Find(q)
+	checkErr(t, err)
+	if len(maps) != len(res) || len(maps) != 3 {
+		t.Fatalf("expected 3 maps, got %d", len(maps))
+	}
+	for i := range res {
+		var expected map[string]interface{}
+		util.InstanceFromJSON(res[i], &expected)
+		if !reflect.DeepEqual(expected, maps[i]) {
+			t.Fatalf("wrong map result, expected: %v, got: %v", expected, maps[i])
+		}
+	}
+}
+
+func TestQueryInCurrentPeriod(t *testing.T) {
+	t.Parallel()
+	type event struct {
+		ID      core.InstanceID `json:"_id"`
+		Name    string
+		Created time.Time
+	}
+	// A Wednesday in the middle of the month, so that the day before is in
+	// the current week and month.
+	loc := time.FixedZone("UTC+13", 13*60*60)
+	now := time.Date(2024, time.May, 15, 12, 0, 0, 0, loc)
+	dayStart, dayEnd, err := Day.bounds(now, loc)
+	checkErr(t, err)
+	monthStart, _, err := Month.bounds(now, loc)
+	checkErr(t, err)
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Event"}, []event{
+		{Name: "Yesterday", Created: dayStart.Add(-time.Second)},
+		{Name: "Today", Created: dayStart.Add(time.Second).UTC()},
+		{Name: "Tomorrow", Created: dayEnd},
+		{Name: "LastMonth", Created: monthStart.Add(-time.Second)},
+	})
+	defer clean()
+	c.db.now = func() time.Time { return now }
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "Day", query: Where("Created").InCurrentPeriod(Day, loc), names: []string{"Today"}},
+		{name: "NotDay", query: Where("Created").Not().InCurrentPeriod(Day, loc), names: []string{"LastMonth", "Tomorrow", "Yesterday"}},
+		{
+			name:  "Week",
+			query: Where("Created").InCurrentPeriod(Week, loc).And("Name").In("Yesterday", "Today"),
+			names: []string{"Today", "Yesterday"},
+		},
+		{
+			name:  "Month",
+			query: Where("Created").InCurrentPeriod(Month, loc).And("Name").Ne("Tomorrow"),
+			names: []string{"Today", "Yesterday"},
+		},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		sort.Strings(names)
+		if !reflect.DeepEqual(tc.names, names) {
+			t.Fatalf("%s: wrong results, expected: %v, got: %v", tc.name, tc.names, names)
+		}
+	}
+
+	// Deserialized criteria load their location by name.
+	b, err := json.Marshal(Where("Created").InCurrentPeriod(Day, time.UTC))
+	checkErr(t, err)
+	q := &Query{}
+	checkErr(t, json.Unmarshal(b, q))
+	_, err = c.Find(q)
+	checkErr(t, err)
+	q.Ands[0].Location = "Nowhere/Unknown"
+	if _, err = c.Find(q); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid operation error for unknown location, got: %v", err)
+	}
+}
+
+func TestQueryWithSort(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	var spec SortSpec
+	checkErr(t, json.Unmarshal([]byte(`{"fields": [{"field": "Author"}, {"field": "Meta.TotalReads", "desc": true}]}`), &spec))
+	q := Where("Meta.TotalReads").Gt(float64(0)).WithSort(spec)
+	expected := []string{"Title3", "Title2", "Title1", "Title4", "Title5"}
+	titles := func(q *Query) []string {
+		res, err := c.Find(q)
+		checkErr(t, err)
+		var titles []string
+		for _, r := range res {
+			var b book
+			util.InstanceFromJSON(r, &b)
+			titles = append(titles, b.Title)
+		}
+		return titles
+	}
+	if got := titles(q); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("wrong order, expected: %v, got: %v", expected, got)
+	}
+
+	// The sort survives serialization, e.g. for remote execution.
+	b, err := json.Marshal(q)
+	checkErr(t, err)
+	rq := &Query{}
+	checkErr(t, json.Unmarshal(b, rq))
+	if got := titles(rq); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("wrong order after serialization, expected: %v, got: %v", expected, got)
+	}
+
+	for _, invalid := range []string{`{"fields": []}`, `{"fields": [{"field": "Author"}, {"desc": true}]}`} {
+		var spec SortSpec
+		checkErr(t, json.Unmarshal([]byte(invalid), &spec))
+		if _, err := c.Find(OrderBy("Title").WithSort(spec)); !errors.Is(err, ErrInvalidSortingField) {
+			t.Fatalf("expected invalid sort error for %s, got: %v", invalid, err)
+		}
+	}
+}
+
+func TestPatternLimits(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	long := strings.Repeat("a", DefaultPatternLimits.MaxLength+1)
+	if _, err := c.Find(Where("Title").Matches(long)); !errors.Is(err, ErrPatternRejected) {
+		t.Fatalf("expected over-length pattern to be rejected, got: %v", err)
+	}
+	if _, err := c.Find(Where("Title").Matches(`a{1000}b{1000}c{1000}d{1000}e{1000}f{1000}g{1000}h{1000}i{1000}j{1000}k{1000}`)); !errors.Is(err, ErrPatternRejected) {
+		t.Fatalf("expected expanding pattern to be rejected, got: %v", err)
+	}
+	if _, err := c.Find(Where("Author").Eq("Author1").Or(Where("Title").Matches(long))); !errors.Is(err, ErrPatternRejected) {
+		t.Fatalf("expected over-length pattern in or to be rejected, got: %v", err)
+	}
+	if _, err := c.Find(Where("Title").Matches(`(`)); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid pattern error, got: %v", err)
+	}
+
+	lc, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Book"}, sampleData[:1], WithNewPatternLimits(PatternLimits{MaxLength: 8}))
+	defer clean()
+	res, err := lc.Find(Where("Title").Matches(`^Title1$`))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(res))
+	}
+	if _, err := lc.Find(Where("Title").Matches(`^Title[0-9]+$`)); !errors.Is(err, ErrPatternRejected) {
+		t.Fatalf("expected pattern over the db limit to be rejected, got: %v", err)
+	}
+	// Patterns a normalizer changes are held to the db limits too.
+	expand := func(_ string, v interface{}) interface{} {
+		if s, ok := v.(string); ok {
+			return strings.Replace(s, "T", "Title", 1)
+		}
+		return v
+	}
+	if _, err := lc.Find(Where("Title").Matches(`^T[1]$`).WithValueNormalizer(expand)); !errors.Is(err, ErrPatternRejected) {
+		t.Fatalf("expected normalized pattern over the db limit to be rejected, got: %v", err)
+	}
+}
+
+func TestQueryExplain(t *testing.T) {
+	t.Parallel()
+	instance := map[string]interface{}{
+		"Title":      "Title1",
+		"Banned":     false,
+		"Meta":       map[string]interface{}{"TotalReads": float64(100)},
+		"Categories": map[string]interface{}{"a": "Fiction"},
+	}
+	q := Where("Title").Eq("Title1").
+		And("Meta.TotalReads").Gt(float64(200)).
+		And("Missing").Eq("x").
+		Or(Where("Banned").Eq(true)).
+		Or(Where("Categories.*").Eq("Fiction").And("Meta.TotalReads").Lt(float64(200)))
+
+	ok, results, err := q.Explain(instance)
+	checkErr(t, err)
+	if !ok {
+		t.Fatal("expected instance to match the second or branch")
+	}
+	expected := []CriterionResult{
+		{FieldPath: "Title", Operation: Eq, Value: "Title1", Matched: true},
+		{FieldPath: "Meta.TotalReads", Operation: Gt, Value: float64(100)},
+		{FieldPath: "Missing", Operation: Eq},
+		{FieldPath: "Banned", Operation: Eq, Branch: []int{0}, Value: false},
+		{FieldPath: "Categories.*", Operation: Eq, Branch: []int{1}, Value: []interface{}{"Fiction"}, Matched: true, Taken: true},
+		{FieldPath: "Meta.TotalReads", Operation: Lt, Branch: []int{1}, Value: float64(100), Matched: true, Taken: true},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	if !errors.Is(results[2].Err, ErrFieldMissing) {
+		t.Fatalf("expected missing field error, got: %v", results[2].Err)
+	}
+	results[2].Err = nil
+	for i := range expected {
+		if !reflect.DeepEqual(expected[i], results[i]) {
+			t.Fatalf("result %d: expected %+v, got %+v", i, expected[i], results[i])
+		}
+	}
+
+	// The first failing criterion decides the match, so the error of a
+	// later one isn't returned, as in Find.
+	ok, _, err = Where("Title").Eq("Title2").And("Missing").Eq("x").Explain(instance)
+	checkErr(t, err)
+	if ok {
+		t.Fatal("expected instance not to match")
+	}
+	ok, results, err = Where("Missing").Eq("x").And("Title").Eq("Title1").Explain(instance)
+	if ok || !errors.Is(err, ErrFieldMissing) {
+		t.Fatalf("expected missing field error, got: %v", err)
+	}
+	if len(results) != 2 || !results[1].Matched {
+		t.Fatalf("expected all criteria to be evaluated, got %+v", results)
+	}
+}
+
+func TestQueryOrderByNumeric(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Tagged"}, []tagged{
+		{Name: "10"}, {Name: "-5"}, {Name: "abc"}, {Name: "1000.50"}, {Name: "3"}, {Name: "2.5"},
+	})
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "Lexical", query: OrderBy("Name"), names: []string{"-5", "10", "1000.50", "2.5", "3", "abc"}},
+		{name: "Asc", query: (&Query{}).OrderByNumeric("Name"), names: []string{"-5", "2.5", "3", "10", "1000.50", "abc"}},
+		{name: "Desc", query: (&Query{}).OrderByNumericDesc("Name"), names: []string{"abc", "1000.50", "10", "3", "2.5", "-5"}},
+		{name: "Spec", query: OrderByID().WithSort(SortSpec{Fields: []SortField{{FieldPath: "Name", Numeric: true}}}), names: []string{"-5", "2.5", "3", "10", "1000.50", "abc"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(tc.names, names) {
+			t.Fatalf("%s: wrong order, expected: %v, got: %v", tc.name, tc.names, names)
+		}
+	}
+}
+
+func TestMaxPathDepth(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	deep := strings.Repeat("Meta.", DefaultMaxPathDepth) + "TotalReads"
+	if _, err := c.Find(Where(deep).Eq(float64(1))); !errors.Is(err, ErrPathTooDeep) {
+		t.Fatalf("expected path over the default depth to be rejected, got: %v", err)
+	}
+	if _, err := c.Find(Where("Title").Eq("Title1").Or(Where(deep).Eq(float64(1)))); !errors.Is(err, ErrPathTooDeep) {
+		t.Fatalf("expected path over the default depth in or to be rejected, got: %v", err)
+	}
+
+	lc, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Book"}, sampleData[:2], WithNewMaxPathDepth(2))
+	defer clean()
+	res, err := lc.Find(Where("Meta.TotalReads").Ge(float64(0)))
+	checkErr(t, err)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res))
+	}
+	// The path is rejected before reaching the missing field.
+	if _, err := lc.Find(Where("Meta.TotalReads.Missing").Eq(float64(1))); !errors.Is(err, ErrPathTooDeep) {
+		t.Fatalf("expected path over the db depth to be rejected, got: %v", err)
+	}
+	if _, err := lc.Find(OrderBy("Meta.TotalReads.Missing")); !errors.Is(err, ErrPathTooDeep) {
+		t.Fatalf("expected sort path over the db depth to be rejected, got: %v", err)
+	}
+
+	// Paths are checked up front, so they fail without instances too.
+	ec, err := lc.db.NewCollection(CollectionConfig{
+		Name:   "Empty",
+		Schema: util.SchemaFromInstance(&book{}, false),
+	})
+	checkErr(t, err)
+	if _, err := ec.Find(Where("Meta.TotalReads.Missing").Eq(float64(1))); !errors.Is(err, ErrPathTooDeep) {
+		t.Fatalf("expected path over the db depth to be rejected on an empty collection, got: %v", err)
+	}
+	if _, err := ec.Find(Where("Title").Eq("Title1").Or(Where("Meta.TotalReads.Missing").Eq(float64(1)))); !errors.Is(err, ErrPathTooDeep) {
+		t.Fatalf("expected path over the db depth in or to be rejected on an empty collection, got: %v", err)
+	}
+}
+
+func TestQueryChainedOrderBy(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	q := OrderBy("Author").OrderByDesc("Meta.TotalReads")
+	if len(q.ThenSort) != 1 || q.Sort.FieldPath != "Author" || q.ThenSort[0].FieldPath != "Meta.TotalReads" || !q.ThenSort[0].Desc {
+		t.Fatalf("expected a two-key sort, got %+v then %+v", q.Sort, q.ThenSort)
+	}
+	res, err := c.Find(q)
+	checkErr(t, err)
+	books := make([]book, len(res))
+	for i := range res {
+		util.InstanceFromJSON(res[i], &books[i])
+	}
+	expected := make([]book, len(sampleData))
+	copy(expected, sampleData)
+	sort.SliceStable(expected, func(i, j int) bool {
+		if expected[i].Author != expected[j].Author {
+			return expected[i].Author < expected[j].Author
+		}
+		return expected[i].Meta.TotalReads > expected[j].Meta.TotalReads
+	})
+	for i := range expected {
+		if books[i].Author != expected[i].Author || books[i].Meta.TotalReads != expected[i].Meta.TotalReads {
+			t.Fatalf("wrong order at %d, expected: %+v, got: %+v", i, expected[i], books[i])
+		}
+	}
+
+	q.ClearSort()
+	if q.Sort.enabled() || len(q.ThenSort) != 0 {
+		t.Fatalf("expected no sort keys, got %+v then %+v", q.Sort, q.ThenSort)
+	}
+	if _, err := c.Find(Where("Title").ContainsFold("title").OrderBy("Author").OrderByRelevance()); !errors.Is(err, ErrInvalidSortingField) {
+		t.Fatalf("expected relevance combined with other keys to be rejected, got: %v", err)
+	}
+}
+
+type contact struct {
+	Email string `json:"email"`
+	Phone string `json:"phone,omitempty"`
+}
+
+type audited struct {
+	Created int64 `json:"created"`
+}
+
+type person struct {
+	ID      core.InstanceID `json:"_id"`
+	Name    string          `json:"name"`
+	Contact contact         `json:"contact"`
+	Backup  *contact
+	Attrs   map[string]string `json:"attrs"`
+	Secret  string            `json:"-"`
+	audited
+}
+
+func TestFieldPaths(t *testing.T) {
+	t.Parallel()
+	expected := map[string]string{
+		"ID":            "_id",
+		"Name":          "name",
+		"Contact":       "contact",
+		"Contact.Email": "contact.email",
+		"Contact.Phone": "contact.phone",
+		"Backup":        "Backup",
+		"Backup.Email":  "Backup.email",
+		"Backup.Phone":  "Backup.phone",
+		"Attrs":         "attrs",
+		"Created":       "created",
+	}
+	if paths := FieldPaths(&person{}); !reflect.DeepEqual(expected, paths) {
+		t.Fatalf("expected paths %v, got %v", expected, paths)
+	}
+	if paths := FieldPaths("not a struct"); len(paths) != 0 {
+		t.Fatalf("expected no paths, got %v", paths)
+	}
+}
+
+func TestValidateAgainst(t *testing.T) {
+	t.Parallel()
+	paths := FieldPaths(person{})
+	valid := []*Query{
+		Where(paths["Contact.Email"]).Eq("a@b.c").OrderBy(paths["Name"]),
+		Where("Backup.phone").Eq("1").Or(Where("created").Gt(float64(0))),
+		Where("attrs.color").Eq("red").And("contact.*").Eq("x"),
+		Where("old").Eq("x").WithFieldAliases(map[string]string{"old": "name"}),
+		OrderByID(),
+	}
+	for i, q := range valid {
+		if err := ValidateAgainst(q, &person{}); err != nil {
+			t.Fatalf("query %d: expected valid query, got: %v", i, err)
+		}
+	}
+	invalid := []struct {
+		query *Query
+		err   error
+	}{
+		{query: Where("Contact.email").Eq("x"), err: ErrFieldMissing},
+		{query: Where("contact.email.domain").Eq("x"), err: ErrFieldMissing},
+		{query: Where("Secret").Eq("x"), err: ErrFieldMissing},
+		{query: Where("name").Eq("x").Or(Where("audited.created").Eq(float64(1))), err: ErrFieldMissing},
+		{query: Where("name").Eq("x").OrderBy("name").OrderBy("contact.fax"), err: ErrInvalidSortingField},
+		{query: Where("name").In(), err: ErrInvalidOperation},
+	}
+	for i, tc := range invalid {
+		if err := ValidateAgainst(tc.query, person{}); !errors.Is(err, tc.err) {
+			t.Fatalf("query %d: expected %v, got: %v", i, tc.err, err)
+		}
+	}
+}
+
+func TestQueryExclude(t *testing.T) {
+	t.Parallel()
+	c, data, clean := createCollectionWithData(t)
+	defer clean()
+
+	res, err := c.Find(Where("Author").Eq("Author1").OrderBy("Title").Exclude("Title", "Meta.Rating", "Missing.Field"))
+	checkErr(t, err)
+	if len(res) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res))
+	}
+	for i := range res {
+		var v map[string]interface{}
+		checkErr(t, json.Unmarshal(res[i], &v))
+		if _, ok := v["Title"]; ok {
+			t.Fatalf("expected Title to be excluded, got %v", v)
+		}
+		meta, ok := v["Meta"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("expected Meta to be kept, got %v", v)
+		}
+		if _, ok := meta["Rating"]; ok {
+			t.Fatalf("expected Meta.Rating to be excluded, got %v", v)
+		}
+		b := book{}
+		util.InstanceFromJSON(res[i], &b)
+		expected := data[i]
+		expected.Title, expected.Meta.Rating = "", 0
+		if !reflect.DeepEqual(expected, b) {
+			t.Fatalf("expected the rest of the instance intact, expected: %+v, got: %+v", expected, b)
+		}
+	}
+
+	if _, err := c.Find(Where("Author").Eq("Author1").Exclude("")); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected empty excluded path to be rejected, got: %v", err)
+	}
+}
+
+type isolationRecorder struct {
+	kt.TxnDatastoreExtended
+	lock sync.Mutex
+	isos []Isolation
+}
+
+func (r *isolationRecorder) NewTransactionIsolated(readOnly bool, iso Isolation) (dse.TxnExt, error) {
+	r.lock.Lock()
+	r.isos = append(r.isos, iso)
+	r.lock.Unlock()
+	return r.NewTransactionExtended(readOnly)
+}
+
+func TestFindWithIsolation(t *testing.T) {
+	t.Parallel()
+	recorder := &isolationRecorder{}
+	c, _, clean := createCollectionWithStore(t, func(s kt.TxnDatastoreExtended) kt.TxnDatastoreExtended {
+		recorder.TxnDatastoreExtended = s
+		return recorder
+	}, CollectionConfig{Name: "Book"}, sampleData[:1])
+	defer clean()
+
+	for _, iso := range []Isolation{Snapshot, ReadCommitted} {
+		var res [][]byte
+		err := c.ReadTxn(func(txn *Txn) (err error) {
+			res, err = txn.FindWithIsolation(Where("Title").Eq("Title1"), iso)
+			return
+		})
+		checkErr(t, err)
+		if len(res) != 1 {
+			t.Fatalf("%s: expected 1 result, got %d", iso, len(res))
+		}
+	}
+	_, err := c.Find(Where("Title").Eq("Title1"))
+	checkErr(t, err)
+	expected := []Isolation{Snapshot, ReadCommitted}
+	if !reflect.DeepEqual(expected, recorder.isos) {
+		t.Fatalf("expected isolation levels %v, got %v", expected, recorder.isos)
+	}
+}
+
+func TestQueryBind(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	tmpl := Where("Author").Eq(Param("author")).
+		Or(Where("Title").In(Param("title"), "Title5").And("Meta.TotalReads").Ge(Param("reads")))
+	if _, err := c.Find(tmpl); !errors.Is(err, ErrUnboundParam) {
+		t.Fatalf("expected unbound template to fail, got: %v", err)
+	}
+
+	q, err := tmpl.Bind(map[string]interface{}{"author": "Author1", "title": "Title4", "reads": float64(100)})
+	checkErr(t, err)
+	res, err := c.Find(q)
+	checkErr(t, err)
+	if len(res) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(res))
+	}
+	q, err = tmpl.Bind(map[string]interface{}{"author": "Author2", "title": "Title1", "reads": float64(200)})
+	checkErr(t, err)
+	res, err = c.Find(q)
+	checkErr(t, err)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results binding the template again, got %d", len(res))
+	}
+	if *tmpl.Ands[0].Value.Param != "author" {
+		t.Fatal("expected the template not to be modified")
+	}
+
+	if _, err := tmpl.Bind(map[string]interface{}{"author": "Author1", "title": "Title4"}); !errors.Is(err, ErrUnboundParam) {
+		t.Fatalf("expected missing param error, got: %v", err)
+	}
+	if _, err := tmpl.Bind(map[string]interface{}{"author": "Author1", "title": "Title4", "reads": float64(1), "extra": "x"}); !errors.Is(err, ErrUnusedParam) {
+		t.Fatalf("expected unused param error, got: %v", err)
+	}
+	if _, err := tmpl.Bind(map[string]interface{}{"author": 1, "title": "Title4", "reads": float64(1)}); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected unsupported value type error, got: %v", err)
+	}
+}
+
+func TestWhereBoundingBox(t *testing.T) {
+	t.Parallel()
+	q := WhereBoundingBox("lat", "lng", 10, 20, -5, 5).prepare()
+	tests := []struct {
+		name     string
+		lat, lng float64
+		match    bool
+	}{
+		{name: "Inside", lat: 15, lng: 0, match: true},
+		{name: "OnLatEdge", lat: 20, lng: 1, match: true},
+		{name: "OnCorner", lat: 10, lng: -5, match: true},
+		{name: "OutsideLat", lat: 21, lng: 0},
+		{name: "OutsideLng", lat: 15, lng: -5.5},
+	}
+	for _, tc := range tests {
+		match, err := q.match(map[string]interface{}{"lat": tc.lat, "lng": tc.lng})
+		checkErr(t, err)
+		if match != tc.match {
+			t.Fatalf("%s: wrong match result, expected: %v, got: %v", tc.name, tc.match, match)
+		}
+	}
+	if err := WhereBoundingBox("lat", "lng", 20, 10, -5, 5).Validate(); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected inverted box to fail validation, got: %v", err)
+	}
+}
+
+type tenantKey struct{}
+
+func TestQueryResolve(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	tmpl := WhereFromContext("Author", tenantKey{}).Eq(nil).
+		And("Meta.TotalReads").Gt(float64(15))
+	if _, err := c.Find(tmpl); !errors.Is(err, ErrContextValueMissing) {
+		t.Fatalf("expected unresolved query to fail, got: %v", err)
+	}
+
+	q, err := tmpl.Resolve(context.WithValue(context.Background(), tenantKey{}, "Author1"))
+	checkErr(t, err)
+	res, err := c.Find(q)
+	checkErr(t, err)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res))
+	}
+	for _, r := range res {
+		b := book{}
+		util.InstanceFromJSON(r, &b)
+		if b.Author != "Author1" {
+			t.Fatalf("expected books of Author1, got %+v", b)
+		}
+	}
+
+	if _, err := tmpl.Resolve(context.Background()); !errors.Is(err, ErrContextValueMissing) {
+		t.Fatalf("expected missing context value error, got: %v", err)
+	}
+	if _, err := c.Find(Where("Title").FromContext(tenantKey{}).In("Title1")); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected In from context to be rejected, got: %v", err)
+	}
+}
+
+func TestFindRequireResults(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	err := c.ReadTxn(func(txn *Txn) error {
+		res, err := txn.FindRequireResults(Where("Author").Eq("Author1"))
+		checkErr(t, err)
+		if len(res) != 3 {
+			t.Fatalf("expected 3 results, got %d", len(res))
+		}
+		if _, err := txn.FindRequireResults(Where("Author").Eq("Nobody")); !errors.Is(err, ErrNoResults) {
+			t.Fatalf("expected no results error, got: %v", err)
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestQueryMatchScore(t *testing.T) {
+	t.Parallel()
+	instance := map[string]interface{}{"Title": "Title1", "Author": "Author1", "Meta": map[string]interface{}{"TotalReads": float64(10)}}
+	q := Where("Author").Eq("Author1").
+		Or(Where("Title").Eq("Title2")).
+		Or(Where("Meta.TotalReads").Lt(float64(20)))
+	score, err := q.MatchScore(instance)
+	checkErr(t, err)
+	if score != 2 {
+		t.Fatalf("expected a score of 2, got %d", score)
+	}
+	score, err = Where("Author").Eq("Author2").MatchScore(instance)
+	checkErr(t, err)
+	if score != 0 {
+		t.Fatalf("expected a score of 0, got %d", score)
+	}
+	if _, err := Where("Author").Eq("Author1").Or(Where("Missing").Eq("x")).MatchScore(instance); !errors.Is(err, ErrFieldMissing) {
+		t.Fatalf("expected missing field error, got: %v", err)
+	}
+}
+
+func TestQueryRestrictFieldsTo(t *testing.T) {
+	t.Parallel()
+	allowed := []string{"Title", "Meta"}
+	valid := []*Query{
+		Where("Title").Eq("Title1").OrderBy("Meta.TotalReads"),
+		Where("Meta.Rating").Gt(float64(3)).Or(Where("Title").Eq("Title2")).OrderByID(),
+		Where("Name").Eq("Title1").WithFieldAliases(map[string]string{"Name": "Title"}),
+	}
+	for i, q := range valid {
+		if err := q.RestrictFieldsTo(allowed...); err != nil {
+			t.Fatalf("query %d: expected allowed query, got: %v", i, err)
+		}
+	}
+	invalid := []struct {
+		query *Query
+		field string
+	}{
+		{query: Where("Author").Eq("Author1"), field: "Author"},
+		{query: Where("Title").Eq("Title1").Or(Where("Title").Eq("Title2").And("Author").Eq("Author1")), field: "Author"},
+		{query: Where("Title").Eq("Title1").OrderBy("Author"), field: "Author"},
+		{query: Where("Titles").Eq("x"), field: "Titles"},
+	}
+	for i, tc := range invalid {
+		err := tc.query.RestrictFieldsTo(allowed...)
+		if !errors.Is(err, ErrFieldNotAllowed) || !strings.HasSuffix(err.Error(), tc.field) {
+			t.Fatalf("query %d: expected %s not to be allowed, got: %v", i, tc.field, err)
+		}
+	}
+}
+
+func TestFindPage(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	tests := []struct {
+		name    string
+		page    int
+		titles  []string
+		hasMore bool
+	}{
+		{name: "First", page: 1, titles: []string{"Title1", "Title2"}, hasMore: true},
+		{name: "Middle", page: 2, titles: []string{"Title3", "Title4"}, hasMore: true},
+		{name: "LastPartial", page: 3, titles: []string{"Title5"}, hasMore: false},
+		{name: "PastLast", page: 4, titles: []string{}, hasMore: false},
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		for _, tc := range tests {
+			p, err := txn.FindPage(OrderBy("Title"), tc.page, 2)
+			checkErr(t, err)
+			if p.Total != 5 || p.Page != tc.page || p.PageSize != 2 || p.HasMore != tc.hasMore {
+				t.Fatalf("%s: unexpected page %+v", tc.name, p)
+			}
+			if len(p.Items) != len(tc.titles) {
+				t.Fatalf("%s: expected %d items, got %d", tc.name, len(tc.titles), len(p.Items))
+			}
+			for i, item := range p.Items {
+				b := &book{}
+				util.InstanceFromJSON(item, b)
+				if b.Title != tc.titles[i] {
+					t.Fatalf("%s: expected %s at %d, got %s", tc.name, tc.titles[i], i, b.Title)
+				}
+			}
+		}
+		if _, err := txn.FindPage(nil, 0, 2); err == nil {
+			t.Fatal("expected an error for page 0")
+		}
+		if _, err := txn.FindPage(nil, 1, 0); err == nil {
+			t.Fatal("expected an error for an empty page size")
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestFindPaged(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	queries := []*Query{
+		OrderBy("Title"),
+		OrderByDesc("Meta.Rating"),
+		// Ties of Author are broken by instance key across pages.
+		OrderBy("Author"),
+		OrderByDesc("Author").Select("Title"),
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		for _, q := range queries {
+			all, err := txn.Find(q)
+			checkErr(t, err)
+			var paged [][]byte
+			var after string
+			for pages := 0; ; pages++ {
+				if pages > len(sampleData) {
+					t.Fatal("expected paging to end")
+				}
+				res, next, err := txn.FindPaged(q, 2, after)
+				checkErr(t, err)
+				paged = append(paged, res...)
+				if next == "" {
+					break
+				}
+				if len(res) != 2 {
+					t.Fatalf("expected full pages before the last one, got %d results", len(res))
+				}
+				after = next
+			}
+			if !reflect.DeepEqual(paged, all) {
+				t.Fatalf("expected pages to hold every result once in order")
+			}
+		}
+
+		if _, _, err := txn.FindPaged(&Query{}, 2, ""); !errors.Is(err, ErrInvalidOperation) {
+			t.Fatalf("expected invalid operation error, got: %v", err)
+		}
+		if _, _, err := txn.FindPaged(OrderBy("Title"), 2, "not a token"); !errors.Is(err, ErrInvalidPageToken) {
+			t.Fatalf("expected invalid page token error, got: %v", err)
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestQueryGroupByInValues(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	res, err := c.Find(Where("Author").In("Author3", "Author1", "Author2").GroupByInValues())
+	checkErr(t, err)
+	got := stringFields(res, "Title")
+	if len(got) != 5 || got[0] != "Title5" || got[4] != "Title4" {
+		t.Fatalf("expected Author3, Author1 then Author2 instances, got %v", got)
+	}
+
+	res, err = c.Find(Where("Author").In("Author3", "Author1", "Author2").GroupByInValues().OrderByDesc("Title"))
+	checkErr(t, err)
+	expected := []string{"Title5", "Title3", "Title2", "Title1", "Title4"}
+	if got := stringFields(res, "Title"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	// Folded values are grouped regardless of case.
+	res, err = c.Find(Where("Author").Fold().In("AUTHOR3", "author1", "Author2").GroupByInValues().OrderByDesc("Title"))
+	checkErr(t, err)
+	if got := stringFields(res, "Title"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v folded, got %v", expected, got)
+	}
+
+	if _, err := c.Find(Where("Author").Eq("Author1").GroupByInValues()); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid operation error, got: %v", err)
+	}
+}
+
+type queryRecorder struct {
+	kt.TxnDatastoreExtended
+	lock     sync.Mutex
+	prefixes []string
+}
+
+func (r *queryRecorder) NewTransactionExtended(readOnly bool) (dse.TxnExt, error) {
+	txn, err := r.TxnDatastoreExtended.NewTransactionExtended(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingTxn{TxnExt: txn, recorder: r}, nil
+}
+
+type recordingTxn struct {
+	dse.TxnExt
+	recorder *queryRecorder
+}
+
+func (t *recordingTxn) QueryExtended(q dse.QueryExt) (query.Results, error) {
+	t.recorder.lock.Lock()
+	t.recorder.prefixes = append(t.recorder.prefixes, q.Prefix)
+	t.recorder.lock.Unlock()
+	return t.TxnExt.QueryExtended(q)
+}
+
+func (r *queryRecorder) reset() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	prefixes := r.prefixes
+	r.prefixes = nil
+	return prefixes
+}
+
+func TestFindByHash(t *testing.T) {
+	t.Parallel()
+	recorder := &queryRecorder{}
+	c, _, clean := createCollectionWithStore(t, func(s kt.TxnDatastoreExtended) kt.TxnDatastoreExtended {
+		recorder.TxnDatastoreExtended = s
+		return recorder
+	}, CollectionConfig{Name: "Book", Indexes: []Index{{Path: "Title"}}}, sampleData)
+	defer clean()
+
+	recorder.reset()
+	err := c.ReadTxn(func(txn *Txn) error {
+		res, ok, err := txn.FindByHash("Title", "Title3")
+		checkErr(t, err)
+		b := &book{}
+		util.InstanceFromJSON(res, b)
+		if !ok || b.Title != "Title3" {
+			t.Fatalf("expected Title3, got %v, %v", ok, b.Title)
+		}
+		if _, ok, err = txn.FindByHash("Title", "Missing"); err != nil || ok {
+			t.Fatalf("expected no instance, got %v, %v", ok, err)
+		}
+		return nil
+	})
+	checkErr(t, err)
+	if prefixes := recorder.reset(); len(prefixes) != 0 {
+		t.Fatalf("expected point lookups, got scans of %v", prefixes)
+	}
+
+	err = c.ReadTxn(func(txn *Txn) error {
+		res, ok, err := txn.FindByHash("Author", "Author2")
+		checkErr(t, err)
+		b := &book{}
+		util.InstanceFromJSON(res, b)
+		if !ok || b.Title != "Title4" {
+			t.Fatalf("expected Title4, got %v, %v", ok, b.Title)
+		}
+		return nil
+	})
+	checkErr(t, err)
+	if prefixes := recorder.reset(); len(prefixes) != 1 {
+		t.Fatalf("expected a scan of an unindexed field, got %v", prefixes)
+	}
+}
+
+func TestFindWithDeadline(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	err := c.ReadTxn(func(txn *Txn) error {
+		res, complete, err := txn.FindWithDeadline(Where("Author").Eq("Author1"), time.Minute)
+		checkErr(t, err)
+		if !complete || len(res) != 3 {
+			t.Fatalf("expected 3 results of a complete scan, got %d, %v", len(res), complete)
+		}
+
+		// Slow down matching each instance so the deadline passes mid-scan.
+		slow := Where("Author").Ne("Nobody")
+		slow.Normalizer = func(_ string, v interface{}) interface{} {
+			time.Sleep(50 * time.Millisecond)
+			return v
+		}
+		res, complete, err = txn.FindWithDeadline(slow, 75*time.Millisecond)
+		checkErr(t, err)
+		if complete {
+			t.Fatal("expected the scan to be cut off")
+		}
+		if len(res) == 0 || len(res) >= len(sampleData) {
+			t.Fatalf("expected partial results, got %d", len(res))
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestFindWithScanBudget(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	err := c.ReadTxn(func(txn *Txn) error {
+		res, truncated, err := txn.FindWithScanBudget(&Query{}, 3)
+		checkErr(t, err)
+		if !truncated || len(res) != 3 {
+			t.Fatalf("expected 3 results of a truncated scan, got %d, %v", len(res), truncated)
+		}
+		// The budget counts scanned instances, not matching ones.
+		res, truncated, err = txn.FindWithScanBudget(Where("Title").Eq("Nothing"), 3)
+		checkErr(t, err)
+		if !truncated || len(res) != 0 {
+			t.Fatalf("expected no results of a truncated scan, got %d, %v", len(res), truncated)
+		}
+
+		res, truncated, err = txn.FindWithScanBudget(&Query{}, len(sampleData))
+		checkErr(t, err)
+		if truncated || len(res) != len(sampleData) {
+			t.Fatalf("expected %d results of a complete scan, got %d, %v", len(sampleData), len(res), truncated)
+		}
+
+		if _, _, err := txn.FindWithScanBudget(&Query{}, 0); err == nil {
+			t.Fatal("expected an error for an empty budget")
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestDefaultFilter(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithMembers(t)
+	defer clean()
+
+	err := c.SetDefaultFilter(Where("Age").Ge(float64(18)))
+	checkErr(t, err)
+	res, err := c.Find(nil)
+	checkErr(t, err)
+	if len(res) != 4 {
+		t.Fatalf("expected 4 adults, got %d", len(res))
+	}
+	res, err = c.Find(Where("Name").Eq("Bob"))
+	checkErr(t, err)
+	if len(res) != 0 {
+		t.Fatalf("expected the default filter to exclude Bob, got %d results", len(res))
+	}
+	res, err = c.Find(Where("Name").Eq("Bob").IgnoreDefaultFilter())
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("expected Bob when ignoring the default filter, got %d results", len(res))
+	}
+	res, err = c.Find((&Query{}).IgnoreDefaultFilter())
+	checkErr(t, err)
+	if len(res) != len(members) {
+		t.Fatalf("expected %d members, got %d", len(members), len(res))
+	}
+
+	checkErr(t, c.SetDefaultFilter(nil))
+	res, err = c.Find(nil)
+	checkErr(t, err)
+	if len(res) != len(members) {
+		t.Fatalf("expected %d members without a default filter, got %d", len(members), len(res))
+	}
+	if err := c.SetDefaultFilter(Where("Age").In()); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid operation error, got: %v", err)
+	}
+}
+
+func TestFindNDJSON(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		count int
+	}{
+		{name: "All", query: nil, count: 5},
+		{name: "Author1", query: Where("Author").Eq("Author1"), count: 3},
+		{name: "Limit", query: Where("Author").Eq("Author1").LimitTo(2), count: 2},
+		{name: "Sorted", query: OrderByDesc("Title").LimitTo(4), count: 4},
+		{name: "NoMatches", query: Where("Author").Eq("Nobody"), count: 0},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		var n int
+		err := c.ReadTxn(func(txn *Txn) (err error) {
+			n, err = txn.FindNDJSON(tc.query, &buf)
+			return
+		})
+		checkErr(t, err)
+		if n != tc.count {
+			t.Fatalf("%s: expected %d instances written, got %d", tc.name, tc.count, n)
+		}
+		lines := strings.Split(buf.String(), "\n")
+		if lines[len(lines)-1] != "" {
+			t.Fatalf("%s: expected a trailing newline", tc.name)
+		}
+		lines = lines[:len(lines)-1]
+		if len(lines) != tc.count {
+			t.Fatalf("%s: expected %d lines, got %d", tc.name, tc.count, len(lines))
+		}
+		for _, l := range lines {
+			b := &book{}
+			if err := json.Unmarshal([]byte(l), b); err != nil || b.Title == "" {
+				t.Fatalf("%s: invalid instance line %q: %v", tc.name, l, err)
+			}
+		}
+	}
+}
+
+type order struct {
+	ID         core.InstanceID `json:"_id"`
+	CustomerID string
+	Total      float64
+}
+
+func TestFindJoined(t *testing.T) {
+	t.Parallel()
+	customers, data, clean := createCollectionWithMembers(t)
+	defer clean()
+	orders, err := customers.db.NewCollection(CollectionConfig{
+		Name:   "Order",
+		Schema: util.SchemaFromInstance(&order{}, false),
+	})
+	checkErr(t, err)
+	// Alice and Bob are from the US, Carol from AR.
+	for _, o := range []order{
+		{CustomerID: data[0].ID.String(), Total: 10},
+		{CustomerID: data[0].ID.String(), Total: 20},
+		{CustomerID: data[1].ID.String(), Total: 30},
+		{CustomerID: data[2].ID.String(), Total: 40},
+		{CustomerID: "unknown", Total: 50},
+	} {
+		_, err := orders.Create(util.JSONFromInstance(o))
+		checkErr(t, err)
+	}
+
+	tests := []struct {
+		name         string
+		query        *Query
+		foreignQuery *Query
+		totals       []float64
+	}{
+		{name: "US", foreignQuery: Where("Name").In("Alice", "Bob"), totals: []float64{10, 20, 30}},
+		{name: "USOver15", query: Where("Total").Gt(float64(15)), foreignQuery: Where("Name").In("Alice", "Bob"), totals: []float64{20, 30}},
+		{name: "Carol", foreignQuery: Where("Name").Eq("Carol"), totals: []float64{40}},
+		{name: "NoCustomers", foreignQuery: Where("Name").Eq("Nobody"), totals: []float64{}},
+		{name: "SortedLimit", query: OrderByDesc("Total").LimitTo(2), foreignQuery: nil, totals: []float64{40, 30}},
+	}
+	for _, tc := range tests {
+		var res [][]byte
+		err := customers.ReadTxn(func(foreign *Txn) error {
+			return orders.ReadTxn(func(txn *Txn) (err error) {
+				res, err = txn.FindJoined(tc.query, "CustomerID", foreign, "_id", tc.foreignQuery)
+				return
+			})
+		})
+		checkErr(t, err)
+		totals := make([]float64, len(res))
+		for i, r := range res {
+			o := &order{}
+			util.InstanceFromJSON(r, o)
+			totals[i] = o.Total
+		}
+		if tc.query == nil || !tc.query.Sort.enabled() {
+			sort.Float64s(totals)
+		}
+		if !reflect.DeepEqual(totals, tc.totals) {
+			t.Fatalf("%s: expected totals %v, got %v", tc.name, tc.totals, totals)
+		}
+	}
+}
+
+func TestMissingMatchesNe(t *testing.T) {
+	t.Parallel()
+	with := map[string]interface{}{"Country": "US"}
+	other := map[string]interface{}{"Country": "AR"}
+	without := map[string]interface{}{"Name": "Erin"}
+
+	tests := []struct {
+		name     string
+		query    *Query
+		instance map[string]interface{}
+		match    bool
+		missing  bool
+	}{
+		{name: "Equal", query: Where("Country").Ne("US"), instance: with, match: false},
+		{name: "NotEqual", query: Where("Country").Ne("US"), instance: other, match: true},
+		{name: "MissingDefault", query: Where("Country").Ne("US"), instance: without, missing: true},
+		{name: "MissingMatches", query: Where("Country").Ne("US").WithMissingMatchesNe(), instance: without, match: true},
+		{name: "MissingNegated", query: Where("Country").Not().Ne("US").WithMissingMatchesNe(), instance: without, match: false},
+		{name: "MissingOtherOperation", query: Where("Country").Eq("US").WithMissingMatchesNe(), instance: without, missing: true},
+		{name: "MissingInOr", query: Where("Name").Eq("Bob").Or(Where("Country").Ne("US")).WithMissingMatchesNe(), instance: without, match: true},
+	}
+	for _, tc := range tests {
+		match, err := tc.query.prepare().match(tc.instance)
+		if tc.missing {
+			if !errors.Is(err, ErrFieldMissing) {
+				t.Fatalf("%s: expected missing field error, got: %v", tc.name, err)
+			}
+			continue
+		}
+		checkErr(t, err)
+		if match != tc.match {
+			t.Fatalf("%s: expected match %v, got %v", tc.name, tc.match, match)
+		}
+	}
+
+	c, _, clean := createCollectionWithMembers(t)
+	defer clean()
+	res, err := c.Find(Where("Country").Ne("US").WithMissingMatchesNe())
+	checkErr(t, err)
+	if len(res) != 4 {
+		t.Fatalf("expected 4 members outside the US, got %d", len(res))
+	}
+}
+
+func TestMaxQueryCriteria(t *testing.T) {
+	t.Parallel()
+	recorder := &queryRecorder{}
+	c, _, clean := createCollectionWithStore(t, func(s kt.TxnDatastoreExtended) kt.TxnDatastoreExtended {
+		recorder.TxnDatastoreExtended = s
+		return recorder
+	}, CollectionConfig{Name: "Book"}, sampleData, WithNewMaxQueryCriteria(4))
+	defer clean()
+
+	// Two criteria, and an Or branch with one.
+	res, err := c.Find(Where("Author").Eq("Author1").And("Title").Ne("Title2").Or(Where("Title").Eq("Title5")))
+	checkErr(t, err)
+	if len(res) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res))
+	}
+
+	recorder.reset()
+	nested := Where("Title").Eq("Title1").Or(Where("Title").Eq("Title2").Or(Where("Title").Eq("Title3")))
+	if _, err := c.Find(nested); !errors.Is(err, ErrQueryTooComplex) {
+		t.Fatalf("expected query too complex error, got: %v", err)
+	}
+	if prefixes := recorder.reset(); len(prefixes) != 0 {
+		t.Fatalf("expected no scan of a rejected query, got scans of %v", prefixes)
+	}
+
+	dc, _, clean := createCollectionWithData(t)
+	defer clean()
+	q := Where("Title").Eq("Title0")
+	for i := 1; i <= DefaultMaxQueryCriteria; i++ {
+		q = q.Or(Where("Title").Eq(fmt.Sprintf("Title%d", i)))
+	}
+	if _, err := dc.Find(q); !errors.Is(err, ErrQueryTooComplex) {
+		t.Fatalf("expected query over the default limit to be rejected, got: %v", err)
+	}
+}
+
+type task struct {
+	ID       core.InstanceID `json:"_id"`
+	Name     string
+	Priority string
+}
+
+func TestQueryWithFieldOrder(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Task"}, []task{
+		{Name: "a", Priority: "high"},
+		{Name: "b", Priority: "low"},
+		{Name: "c", Priority: "urgent"},
+		{Name: "d", Priority: "medium"},
+		{Name: "e", Priority: "low"},
+	})
+	defer clean()
+	order := []string{"low", "medium", "high"}
+
+	res, err := c.Find(OrderBy("Priority").WithFieldOrder("Priority", order))
+	checkErr(t, err)
+	expected := []string{"low", "low", "medium", "high", "urgent"}
+	if got := stringFields(res, "Priority"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	res, err = c.Find(OrderByDesc("Priority").WithFieldOrder("Priority", order))
+	checkErr(t, err)
+	expected = []string{"urgent", "high", "medium", "low", "low"}
+	if got := stringFields(res, "Priority"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	res, err = c.Find(Where("Priority").Ge("medium").WithFieldOrder("Priority", order).OrderBy("Priority"))
+	checkErr(t, err)
+	expected = []string{"medium", "high", "urgent"}
+	if got := stringFields(res, "Priority"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	res, err = c.Find(Where("Priority").Lt("high").WithFieldOrder("Priority", order).OrderBy("Priority"))
+	checkErr(t, err)
+	expected = []string{"low", "low", "medium"}
+	if got := stringFields(res, "Priority"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := c.Find(OrderBy("Priority").WithFieldOrder("Priority", order).WithStrictFieldOrders()); !errors.Is(err, ErrValueNotOrdered) {
+		t.Fatalf("expected value not ordered error, got: %v", err)
+	}
+}
+
+func TestQueryReverse(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	reversed := func(res [][]byte) [][]byte {
+		rev := make([][]byte, len(res))
+		for i, r := range res {
+			rev[len(res)-1-i] = r
+		}
+		return rev
+	}
+	tests := []struct {
+		name    string
+		query   *Query
+		reverse *Query
+		desc    *Query
+	}{
+		{
+			name:    "Single",
+			query:   OrderBy("Title"),
+			reverse: OrderBy("Title").Reverse(),
+			desc:    OrderByDesc("Title"),
+		},
+		{
+			name:    "Ties",
+			query:   OrderBy("Author"),
+			reverse: OrderBy("Author").Reverse(),
+			desc:    OrderByDesc("Author"),
+		},
+		{
+			name:    "MultiKey",
+			query:   OrderBy("Author").OrderByDesc("Meta.TotalReads"),
+			reverse: OrderBy("Author").OrderByDesc("Meta.TotalReads").Reverse(),
+			desc:    OrderByDesc("Author").OrderBy("Meta.TotalReads"),
+		},
+		{
+			name:    "Unsorted",
+			query:   OrderByID(),
+			reverse: (&Query{}).Reverse(),
+			desc:    OrderByIDDesc(),
+		},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		rev, err := c.Find(tc.reverse)
+		checkErr(t, err)
+		desc, err := c.Find(tc.desc)
+		checkErr(t, err)
+		if !reflect.DeepEqual(rev, desc) {
+			t.Fatalf("%s: expected the reversed query to equal the descending one", tc.name)
+		}
+		if !reflect.DeepEqual(rev, reversed(res)) {
+			t.Fatalf("%s: expected the reversed results in opposite order", tc.name)
+		}
+	}
+}
+
+type player struct {
+	ID     core.InstanceID `json:"_id"`
+	Name   string
+	Scores []float64
+}
+
+func TestQueryOrderByArray(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Player"}, []player{
+		{Name: "a", Scores: []float64{5, 1, 9}},
+		{Name: "b", Scores: []float64{7}},
+		{Name: "c", Scores: []float64{}},
+		{Name: "d", Scores: []float64{3, 8}},
+		{Name: "e"},
+	})
+	defer clean()
+
+	// Empty and missing arrays come last in ascending order, and first in
+	// descending order, tied by instance key.
+	tests := []struct {
+		name  string
+		query *Query
+		want  []string
+	}{
+		{name: "Max", query: (&Query{}).OrderByArrayMax("Scores").OrderBy("Name"), want: []string{"b", "d", "a", "c", "e"}},
+		{name: "MaxDesc", query: (&Query{}).OrderByArrayMaxDesc("Scores").OrderBy("Name"), want: []string{"c", "e", "a", "d", "b"}},
+		{name: "Min", query: (&Query{}).OrderByArrayMin("Scores").OrderBy("Name"), want: []string{"a", "d", "b", "c", "e"}},
+		{name: "MinDesc", query: (&Query{}).OrderByArrayMinDesc("Scores").OrderBy("Name"), want: []string{"c", "e", "b", "d", "a"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		if got := stringFields(res, "Name"); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+type tweet struct {
+	ID        core.InstanceID `json:"_id"`
+	Snowflake int64
+	Ref       string
+}
+
+func TestQueryEqBigInt(t *testing.T) {
+	t.Parallel()
+	// 2^53+1 isn't representable as a float64, which rounds it to 2^53.
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{
+		Name:    "Tweet",
+		Indexes: []Index{{Path: "Snowflake"}},
+	}, []tweet{
+		{Snowflake: 9007199254740993, Ref: "9007199254740993"},
+		{Snowflake: 9007199254740992, Ref: "9007199254740992"},
+	})
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		want  int64
+	}{
+		{name: "Number", query: Where("Snowflake").EqBigInt("9007199254740993"), want: 9007199254740993},
+		{name: "NumberRounded", query: Where("Snowflake").EqBigInt("9007199254740992"), want: 9007199254740992},
+		{name: "String", query: Where("Ref").EqBigInt("9007199254740993"), want: 9007199254740993},
+		{name: "Index", query: Where("Snowflake").EqBigInt("9007199254740993").UseIndex("Snowflake"), want: 9007199254740993},
+		{name: "Or", query: Where("Ref").Eq("none").Or(Where("Snowflake").EqBigInt("9007199254740993")), want: 9007199254740993},
+		{name: "WithFloat", query: Where("Snowflake").EqBigInt("9007199254740993").And("Snowflake").Gt(float64(0)), want: 9007199254740993},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		if len(res) != 1 {
+			t.Fatalf("%s: expected 1 result, got %d", tc.name, len(res))
+		}
+		tw := &tweet{}
+		checkErr(t, json.Unmarshal(res[0], tw))
+		if tw.Snowflake != tc.want {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.want, tw.Snowflake)
+		}
+	}
+
+	// Matching exactly doesn't change the numbers other readers decode.
+	err := c.ReadTxn(func(txn *Txn) error {
+		_, max, err := txn.FindWithAggregate(Where("Snowflake").EqBigInt("9007199254740993"), "Snowflake", AggMax)
+		checkErr(t, err)
+		if max != float64(9007199254740993) {
+			t.Fatalf("expected max %v, got %v", float64(9007199254740993), max)
+		}
+		return nil
+	})
+	checkErr(t, err)
+
+	if _, err := c.Find(Where("Snowflake").EqBigInt("1.5")); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid operation error, got: %v", err)
+	}
+}
+
+func TestQuerySelect(t *testing.T) {
+	t.Parallel()
+	c, data, clean := createCollectionWithData(t)
+	defer clean()
+
+	tests := []struct {
+		name     string
+		query    *Query
+		resIdx   []int
+		expected func(b book) map[string]interface{}
+	}{
+		{
+			name:   "SortBySelected",
+			query:  Where("Author").Eq("Author1").Select("Title", "Meta.TotalReads").OrderByDesc("Meta.TotalReads"),
+			resIdx: []int{2, 1, 0},
+			expected: func(b book) map[string]interface{} {
+				return map[string]interface{}{"_id": string(b.ID), "Title": b.Title, "Meta": map[string]interface{}{"TotalReads": float64(b.Meta.TotalReads)}}
+			},
+		},
+		{
+			name:   "SortByUnselected",
+			query:  OrderBy("Meta.Rating").Select("Author"),
+			resIdx: []int{0, 1, 2, 3, 4},
+			expected: func(b book) map[string]interface{} {
+				return map[string]interface{}{"_id": string(b.ID), "Author": b.Author}
+			},
+		},
+		{
+			name:   "SortByAlias",
+			query:  OrderByDesc("reads").Select("reads").WithFieldAliases(map[string]string{"reads": "Meta.TotalReads"}),
+			resIdx: []int{4, 3, 2, 1, 0},
+			expected: func(b book) map[string]interface{} {
+				return map[string]interface{}{"_id": string(b.ID), "Meta": map[string]interface{}{"TotalReads": float64(b.Meta.TotalReads)}}
+			},
+		},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		if len(res) != len(tc.resIdx) {
+			t.Fatalf("%s: expected %d results, got %d", tc.name, len(tc.resIdx), len(res))
+		}
+		for i, idx := range tc.resIdx {
+			var v map[string]interface{}
+			checkErr(t, json.Unmarshal(res[i], &v))
+			if expected := tc.expected(data[idx]); !reflect.DeepEqual(expected, v) {
+				t.Fatalf("%s: expected %v at %d, got %v", tc.name, expected, i, v)
+			}
+		}
+	}
+
+	if _, err := c.Find(OrderBy("Title").Select("Title").Exclude("_id")); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected selecting and excluding fields to be rejected, got: %v", err)
+	}
+}
+
+func TestQueryInSubquery(t *testing.T) {
+	t.Parallel()
+	customers, ids, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Member"}, members, WithNewMaxSubqueryResults(3))
+	defer clean()
+	orders, err := customers.db.NewCollection(CollectionConfig{
+		Name:   "Order",
+		Schema: util.SchemaFromInstance(&order{}, false),
+	})
+	checkErr(t, err)
+	// Alice and Dave are adults, Bob is a minor.
+	for _, o := range []order{
+		{CustomerID: ids[0].String(), Total: 10},
+		{CustomerID: ids[0].String(), Total: 20},
+		{CustomerID: ids[1].String(), Total: 30},
+		{CustomerID: ids[3].String(), Total: 40},
+	} {
+		_, err := orders.Create(util.JSONFromInstance(o))
+		checkErr(t, err)
+	}
+
+	tests := []struct {
+		name   string
+		query  func(customers *Txn) *Query
+		totals []float64
+		err    error
+	}{
+		{
+			name: "Adults",
+			query: func(customers *Txn) *Query {
+				return Where("CustomerID").InSubquery(customers, Where("Name").In("Alice", "Bob", "Carol").And("Age").Ge(float64(18)), "_id")
+			},
+			totals: []float64{10, 20},
+		},
+		{
+			name: "Or",
+			query: func(customers *Txn) *Query {
+				return Where("Total").Eq(float64(40)).Or(Where("CustomerID").InSubquery(customers, Where("Name").Eq("Bob"), "_id"))
+			},
+			totals: []float64{30, 40},
+		},
+		{
+			name: "Empty",
+			query: func(customers *Txn) *Query {
+				return Where("CustomerID").InSubquery(customers, Where("Name").Eq("Nobody"), "_id")
+			},
+			totals: []float64{},
+		},
+		{
+			name: "TooLarge",
+			query: func(customers *Txn) *Query {
+				return Where("CustomerID").InSubquery(customers, nil, "_id")
+			},
+			err: ErrSubqueryTooLarge,
+		},
+	}
+	for _, tc := range tests {
+		var res [][]byte
+		err := customers.ReadTxn(func(ct *Txn) error {
+			return orders.ReadTxn(func(txn *Txn) (err error) {
+				res, err = txn.Find(tc.query(ct))
+				return
+			})
+		})
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("%s: expected error %v, got: %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		checkErr(t, err)
+		totals := make([]float64, len(res))
+		for i, r := range res {
+			o := &order{}
+			util.InstanceFromJSON(r, o)
+			totals[i] = o.Total
+		}
+		sort.Float64s(totals)
+		if !reflect.DeepEqual(totals, tc.totals) {
+			t.Fatalf("%s: expected totals %v, got %v", tc.name, tc.totals, totals)
+		}
+	}
+}
+
+func TestQueryCanonicalize(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	q1 := Where("Author").Eq("Author1").And("Meta.TotalReads").Ge(20.0).
+		Or(Where("Title").Eq("Title4").Or(Where("Title").Eq("Title5")))
+	q2 := Where("Meta.TotalReads").Ge(20.0).And("Author").Eq("Author1").And("Meta.TotalReads").Ge(20.0).
+		Or(Where("Title").Eq("Title4")).
+		Or(Where("Title").Eq("Title5")).
+		Or(Where("Title").Eq("Title5"))
+	hash := func(q *Query) string {
+		h, err := q.Hash()
+		checkErr(t, err)
+		return h
+	}
+	c1, c2 := q1.Canonicalize(), q2.Canonicalize()
+	if hash(c1) != hash(c2) {
+		t.Fatal("equivalent queries should have the same canonical form")
+	}
+	if !q1.Equal(q2) {
+		t.Fatal("equivalent queries should be equal")
+	}
+	if hash(c1.Canonicalize()) != hash(c1) {
+		t.Fatal("canonicalizing should be idempotent")
+	}
+	if q1.Equal(Where("Author").Eq("Author1")) {
+		t.Fatal("different queries shouldn't be equal")
+	}
+	if len(q2.Ands) != 3 || len(q2.Ors) != 3 {
+		t.Fatal("canonicalizing shouldn't modify the original query")
+	}
+
+	for _, q := range []*Query{q1, q2} {
+		res, err := c.Find(q)
+		checkErr(t, err)
+		canonical, err := c.Find(q.Canonicalize())
+		checkErr(t, err)
+		if !reflect.DeepEqual(res, canonical) {
+			t.Fatal("the canonical query should match the same instances")
+		}
+		if len(res) != 4 {
+			t.Fatalf("expected 4 results, got %d", len(res))
+		}
+	}
+}
+
+func TestNewQuery(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	author := Where("Author")
+	author.Eq("Author1")
+	q := NewQuery(
+		WithFilter(author),
+		WithFilter(Where("Meta.TotalReads").Ge(20.0).Ands[0]),
+		WithSort("Meta.TotalReads", true),
+		WithSort("Title", false),
+		WithLimit(1),
+		WithSkip(1),
+		WithIndex("Author"),
+	)
+	fluent := Where("Author").Eq("Author1").And("Meta.TotalReads").Ge(20.0).
+		OrderByDesc("Meta.TotalReads").OrderBy("Title").
+		LimitTo(1).SkipNum(1).UseIndex("Author")
+	if !q.Equal(fluent) {
+		t.Fatal("the query built with options should equal the fluent one")
+	}
+	if q.Equal(NewQuery(WithFilter(author))) {
+		t.Fatal("different queries shouldn't be equal")
+	}
+	if author.query == q {
+		t.Fatal("filters should be copied into the query")
+	}
+
+	res, err := c.Find(q)
+	checkErr(t, err)
+	expected, err := c.Find(fluent)
+	checkErr(t, err)
+	if len(res) != 1 || !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected %s, got %s", expected, res)
+	}
+}
+
+type profile struct {
+	ID    core.InstanceID `json:"_id"`
+	Name  string
+	Email *string `json:",omitempty"`
+	Phone *string
+}
+
+func TestQueryEqNullSafe(t *testing.T) {
+	t.Parallel()
+	email, phone := "a@example.com", "555"
+	// The Email of b is missing, and its Phone is null.
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Profile"}, []profile{
+		{Name: "a", Email: &email, Phone: &phone},
+		{Name: "b"},
+		{Name: "c", Email: &email},
+	})
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "MissingEqNull", query: Where("Email").EqNullSafe(nil), names: []string{"b"}},
+		{name: "NullEqNull", query: Where("Phone").EqNullSafe(nil), names: []string{"b", "c"}},
+		{name: "MissingEqValue", query: Where("Email").EqNullSafe(email), names: []string{"a", "c"}},
+		{name: "NullEqValue", query: Where("Phone").EqNullSafe(phone), names: []string{"a"}},
+		{name: "NotNull", query: Where("Phone").Not().EqNullSafe(nil), names: []string{"a"}},
+		{name: "NotValue", query: Where("Email").Not().EqNullSafe(email), names: []string{"b"}},
+		{name: "And", query: Where("Email").EqNullSafe(email).And("Phone").EqNullSafe(nil), names: []string{"c"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query.OrderBy("Name"))
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.names, names)
+		}
+	}
+
+	if _, err := c.Find(Where("Email").Eq(nil)); err == nil {
+		t.Fatal("expected Eq with a nil value to be invalid")
+	}
+}
+
+func TestQueryExcludeWhereNullSafe(t *testing.T) {
+	t.Parallel()
+	email, phone := "a@example.com", "555"
+	// The Email of b is missing, and the Phone of b and c is null.
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Profile"}, []profile{
+		{Name: "a", Email: &email, Phone: &phone},
+		{Name: "b"},
+		{Name: "c", Email: &email},
+	})
+	defer clean()
+
+	shared := Where("Name").Eq("b")
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "Missing", query: Where("Name").Ne("").ExcludeWhere("Email", email), names: []string{"b"}},
+		{name: "Null", query: Where("Name").Ne("").ExcludeWhere("Phone", phone), names: []string{"b", "c"}},
+		{name: "NilMissing", query: Where("Name").Ne("").ExcludeWhere("Email", nil), names: []string{"b"}},
+		{name: "NilNull", query: Where("Name").Ne("").ExcludeWhere("Phone", nil), names: []string{"b", "c"}},
+		{name: "Ors", query: Where("Name").Eq("a").Or(shared).ExcludeWhere("Phone", nil), names: []string{"b"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query.OrderBy("Name"))
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.names, names)
+		}
+	}
+
+	// The shared Or branch must be left as it was.
+	if len(shared.Ands) != 1 {
+		t.Fatalf("expected the Or branch not to be modified, got %d criteria", len(shared.Ands))
+	}
+	res, err := c.Find(shared)
+	checkErr(t, err)
+	if names := stringFields(res, "Name"); !reflect.DeepEqual(names, []string{"b"}) {
+		t.Fatalf("expected [b], got %v", names)
+	}
+}
+
+func TestFindMapped(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	redact := func(v map[string]interface{}) (map[string]interface{}, error) {
+		delete(v, "Author")
+		v["Redacted"] = true
+		return v, nil
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		res, err := txn.FindMapped(OrderBy("Title"), redact)
+		checkErr(t, err)
+		if len(res) != len(sampleData) {
+			t.Fatalf("expected %d results, got %d", len(sampleData), len(res))
+		}
+		for i, r := range res {
+			var v map[string]interface{}
+			checkErr(t, json.Unmarshal(r, &v))
+			if _, ok := v["Author"]; ok {
+				t.Fatalf("expected the author to be redacted, got %s", r)
+			}
+			if v["Redacted"] != true || v["Title"] != sampleData[i].Title {
+				t.Fatalf("unexpected mapped result %s", r)
+			}
+		}
+
+		errMap := errors.New("map failed")
+		if _, err := txn.FindMapped(&Query{}, func(map[string]interface{}) (map[string]interface{}, error) {
+			return nil, errMap
+		}); !errors.Is(err, errMap) {
+			t.Fatalf("expected the map error, got: %v", err)
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+type league struct {
+	ID     core.InstanceID `json:"_id"`
+	Name   string
+	Teams  []team
+	Squads [][]teamMember
+}
+
+type team struct {
+	Name    string
+	Members []teamMember
+}
+
+type teamMember struct {
+	Name string
+}
+
+func TestQueryNestedArrayPaths(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "League"}, []league{
+		{
+			Name: "a",
+			Teams: []team{
+				{Name: "red", Members: []teamMember{{Name: "ann"}, {Name: "bob"}}},
+				{Name: "blue", Members: []teamMember{{Name: "cat"}, {Name: "dan"}}},
+			},
+			Squads: [][]teamMember{{{Name: "eve"}}, {{Name: "fay"}, {Name: "gus"}}},
+		},
+		{
+			Name:   "b",
+			Teams:  []team{{Name: "green", Members: []teamMember{{Name: "hal"}}}},
+			Squads: [][]teamMember{},
+		},
+		{Name: "c", Teams: []team{}, Squads: [][]teamMember{}},
+	})
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "Deep", query: Where("Teams.Members.Name").Eq("dan"), names: []string{"a"}},
+		{name: "Absent", query: Where("Teams.Members.Name").Eq("zed"), names: nil},
+		{name: "Shallow", query: Where("Teams.Name").Eq("green"), names: []string{"b"}},
+		{name: "NestedArrays", query: Where("Squads.Name").Eq("gus"), names: []string{"a"}},
+		{name: "Negated", query: Where("Teams.Members.Name").Not().Eq("hal"), names: []string{"a", "c"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query.OrderBy("Name"))
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.names, names)
+		}
+	}
+}
+
+type shift struct {
+	ID      core.InstanceID `json:"_id"`
+	Name    string
+	Start   float64
+	End     float64
+	StartAt time.Time
+	EndAt   time.Time
+}
+
+func TestQueryGtFieldPlus(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Shift"}, []shift{
+		{Name: "long", Start: 0, End: 7200, StartAt: start, EndAt: start.Add(2 * time.Hour)},
+		{Name: "exact", Start: 100, End: 3700, StartAt: start, EndAt: start.Add(time.Hour)},
+		{Name: "short", Start: 50, End: 650, StartAt: start, EndAt: start.Add(10 * time.Minute)},
+	})
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "Numbers", query: Where("End").GtFieldPlus("Start", 3600), names: []string{"long"}},
+		{name: "Times", query: Where("EndAt").GtFieldPlus("StartAt", 3600), names: []string{"long"}},
+		{name: "NegativeOffset", query: Where("End").GtFieldPlus("Start", -3600), names: []string{"exact", "long", "short"}},
+		{name: "Negated", query: Where("EndAt").Not().GtFieldPlus("StartAt", 3600), names: []string{"exact", "short"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query.OrderBy("Name"))
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.names, names)
+		}
+	}
+
+	instance := map[string]interface{}{"Name": "long", "End": 7200.0}
+	if _, err := Where("End").GtFieldPlus("Name", 0).prepare().match(instance); !errors.Is(err, &ErrTypeMismatch{}) {
+		t.Fatalf("expected a type mismatch, got: %v", err)
+	}
+}
+
+type listing struct {
+	ID      core.InstanceID `json:"_id"`
+	Name    string
+	PriceEN string
+	PriceDE string
+}
+
+func TestQueryWithNumberFormat(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Listing"}, []listing{
+		{Name: "a", PriceEN: "1,234.56", PriceDE: "1.234,56"},
+		{Name: "b", PriceEN: "99.5", PriceDE: "99,5"},
+		{Name: "c", PriceEN: "12,000", PriceDE: "12.000"},
+	})
+	defer clean()
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "English", query: Where("PriceEN").Eq(1234.56).WithNumberCoercion().WithNumberFormat(NumberFormatEnglish), names: []string{"a"}},
+		{name: "German", query: Where("PriceDE").Eq(1234.56).WithNumberCoercion().WithNumberFormat(NumberFormatGerman), names: []string{"a"}},
+		{name: "GermanRange", query: Where("PriceDE").Gt(1000.0).WithNumberCoercion().WithNumberFormat(NumberFormatGerman).OrderBy("Name"), names: []string{"a", "c"}},
+		{name: "EnglishSort", query: (&Query{}).OrderByNumeric("PriceEN").WithNumberFormat(NumberFormatEnglish), names: []string{"b", "a", "c"}},
+		{name: "GermanSort", query: (&Query{}).OrderByNumeric("PriceDE").WithNumberFormat(NumberFormatGerman), names: []string{"b", "a", "c"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		if got := stringFields(res, "Name"); !reflect.DeepEqual(got, tc.names) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.names, got)
+		}
+	}
+
+	// Go float parsing doesn't accept group separators.
+	res, err := c.Find(Where("PriceEN").Eq(1234.56).WithNumberCoercion())
+	checkErr(t, err)
+	if len(res) != 0 {
+		t.Fatalf("expected no results without a number format, got %d", len(res))
+	}
+	if _, err := c.Find((&Query{}).WithNumberFormat(NumberFormat{Decimal: ",", Grouping: ","})); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid operation error, got: %v", err)
+	}
+}
+
+func TestQueryExcludeIDs(t *testing.T) {
+	t.Parallel()
+	c, data, clean := createCollectionWithData(t)
+	defer clean()
+
+	res, err := c.Find(Where("Author").Eq("Author1").ExcludeIDs(data[0].ID.String(), data[2].ID.String()))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(res))
+	}
+	b := &book{}
+	util.InstanceFromJSON(res[0], b)
+	if b.ID != data[1].ID {
+		t.Fatalf("expected %s, got %s", data[1].ID, b.ID)
+	}
+
+	// IDs of instances which don't match, or don't exist, are ignored.
+	res, err = c.Find((&Query{}).ExcludeIDs(data[3].ID.String(), "missing").OrderBy("Title"))
+	checkErr(t, err)
+	titles := stringFields(res, "Title")
+	expected := []string{"Title1", "Title2", "Title3", "Title5"}
+	if !reflect.DeepEqual(titles, expected) {
+		t.Fatalf("expected %v, got %v", expected, titles)
+	}
+}
+
+func TestQueryUnionDeduplicated(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Book", Indexes: []Index{{Path: "Author"}}}, sampleData)
+	defer clean()
+
+	// Title1 matches both branches.
+	tests := []struct {
+		name  string
+		query *Query
+		count int
+	}{
+		{name: "Or", query: Where("Author").Eq("Author1").Or(Where("Title").Eq("Title1")), count: 3},
+		{name: "OrIndex", query: Where("Author").Eq("Author1").Or(Where("Author").In("Author1", "Author2")).UseIndex("Author"), count: 4},
+		{name: "InIndex", query: Where("Author").In("Author1", "Author2", "Author1").UseIndex("Author"), count: 4},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query)
+		checkErr(t, err)
+		ids := make(map[core.InstanceID]struct{})
+		for _, r := range res {
+			b := &book{}
+			util.InstanceFromJSON(r, b)
+			ids[b.ID] = struct{}{}
+		}
+		if len(res) != tc.count || len(ids) != tc.count {
+			t.Fatalf("%s: expected %d distinct results, got %d with %d distinct", tc.name, tc.count, len(res), len(ids))
+		}
+	}
+}
+
+func TestQueryAssertType(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	res, err := c.Find(Where("Author").AssertType(FieldTypeString).Eq("Author1"))
+	checkErr(t, err)
+	if len(res) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(res))
+	}
+	res, err = c.Find(Where("Meta.TotalReads").AssertType(FieldTypeNumber).Gt(100.0))
+	checkErr(t, err)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res))
+	}
+
+	_, err = c.Find(Where("Meta.TotalReads").AssertType(FieldTypeString).Eq("10"))
+	var assertErr *ErrFieldTypeAssertion
+	if !errors.As(err, &assertErr) {
+		t.Fatalf("expected a type assertion error, got: %v", err)
+	}
+	if assertErr.FieldPath != "Meta.TotalReads" || assertErr.Expected != FieldTypeString || assertErr.Actual != FieldTypeNumber {
+		t.Fatalf("unexpected type assertion error: %v", assertErr)
+	}
+	if _, err := c.Find(Where("Author").AssertType("date").Eq("Author1")); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected invalid operation error, got: %v", err)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	tests := []struct {
+		name   string
+		query  string
+		titles []string
+	}{
+		{name: "Comparison", query: `Meta.TotalReads >= 114`, titles: []string{"Title4", "Title5"}},
+		{name: "And", query: `Author = "Author1" AND Meta.Rating > 3.5`, titles: []string{"Title2", "Title3"}},
+		// AND binds tighter than OR.
+		{name: "Precedence", query: `Author == "Author2" OR Author = "Author1" and Meta.TotalReads < 20`, titles: []string{"Title1", "Title4"}},
+		{name: "Parentheses", query: `(Author = "Author2" OR Author = "Author1") AND Meta.TotalReads < 20`, titles: []string{"Title1"}},
+		{name: "Nested", query: `((Title = "Title5")) or (Meta.Rating <= 3.3 AND (Title != "Title2"))`, titles: []string{"Title1", "Title5"}},
+		{name: "Negative", query: `Meta.TotalReads > -1e3 AND Title = "Title3"`, titles: []string{"Title3"}},
+	}
+	for _, tc := range tests {
+		q, err := ParseQuery(tc.query)
+		checkErr(t, err)
+		res, err := c.Find(q.OrderBy("Title"))
+		checkErr(t, err)
+		titles := stringFields(res, "Title")
+		if !reflect.DeepEqual(titles, tc.titles) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.titles, titles)
+		}
+	}
+
+	q, err := ParseQuery(`Name = "Ann \"The Pen\" Lee" AND Active = TRUE`)
+	checkErr(t, err)
+	if len(q.Ands) != 2 || *q.Ands[0].Value.String != `Ann "The Pen" Lee` || !*q.Ands[1].Value.Bool {
+		t.Fatalf("unexpected parsed query: %v", q)
+	}
+
+	_, err = ParseQuery(`Age >= 18 AND (Country = "US"`)
+	if !errors.Is(err, ErrQuerySyntax) {
+		t.Fatalf("expected a syntax error, got: %v", err)
+	}
+	if expected := "query syntax error at offset 29: expected ), got end of input"; err.Error() != expected {
+		t.Fatalf("expected error %q, got %q", expected, err.Error())
+	}
+	for _, s := range []string{``, `Age >`, `Age 18`, `"Age" = 18`, `Age = 18 18`, `Name = "open`} {
+		if _, err := ParseQuery(s); !errors.Is(err, ErrQuerySyntax) {
+			t.Fatalf("%q: expected a syntax error, got: %v", s, err)
+		}
+	}
+}
+
+type note struct {
+	ID   core.InstanceID `json:"_id"`
+	Seq  int
+	Body string
+}
+
+func TestQueryMaxBytes(t *testing.T) {
+	t.Parallel()
+	var notes []note
+	for i, size := range []int{10, 500, 20, 2000, 30} {
+		notes = append(notes, note{Seq: i, Body: strings.Repeat("x", size)})
+	}
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Note"}, notes)
+	defer clean()
+
+	err := c.ReadTxn(func(txn *Txn) error {
+		for _, q := range []*Query{OrderByID(), OrderBy("Seq")} {
+			all, err := txn.Find(q)
+			checkErr(t, err)
+			// The limit fits the first two results and part of the third.
+			limit := len(all[0]) + len(all[1]) + len(all[2])/2
+			res, truncated, err := txn.FindTruncated(q.Clone().MaxBytes(limit))
+			checkErr(t, err)
+			if !truncated || !reflect.DeepEqual(res, all[:2]) {
+				t.Fatalf("expected the first 2 results truncated, got %d, %v", len(res), truncated)
+			}
+			res, err = txn.Find(q.Clone().MaxBytes(limit))
+			checkErr(t, err)
+			if len(res) != 2 {
+				t.Fatalf("expected 2 results, got %d", len(res))
+			}
+
+			// A first result larger than the limit returns no results.
+			res, truncated, err = txn.FindTruncated(q.Clone().MaxBytes(len(all[0]) - 1))
+			checkErr(t, err)
+			if !truncated || len(res) != 0 {
+				t.Fatalf("expected no results truncated, got %d, %v", len(res), truncated)
+			}
+
+			var total int
+			for _, r := range all {
+				total += len(r)
+			}
+			res, truncated, err = txn.FindTruncated(q.Clone().MaxBytes(total))
+			checkErr(t, err)
+			if truncated || len(res) != len(all) {
+				t.Fatalf("expected all results, got %d, %v", len(res), truncated)
+			}
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestQueryWithRuneOrdering(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Task"}, []task{
+		{Name: "a"},
+		{Name: "é"},
+		{Name: "\U0001F600"},
+	})
+	defer clean()
+
+	// By bytes, the invalid "\xff" is greater than any valid string, while
+	// by code points it's U+FFFD, which is less than U+1F600.
+	res, err := c.Find(Where("Name").Ge("\xff"))
+	checkErr(t, err)
+	if got := stringFields(res, "Name"); len(got) != 0 {
+		t.Fatalf("expected no results by bytes, got %v", got)
+	}
+	res, err = c.Find(Where("Name").Ge("\xff").WithRuneOrdering())
+	checkErr(t, err)
+	if got, expected := stringFields(res, "Name"), []string{"\U0001F600"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v by code points, got %v", expected, got)
+	}
+	res, err = c.Find(Where("Name").Lt("\xff").WithRuneOrdering().OrderBy("Name"))
+	checkErr(t, err)
+	if got, expected := stringFields(res, "Name"), []string{"a", "é"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v by code points, got %v", expected, got)
+	}
+
+	// Valid strings sort alike either way.
+	byBytes, err := c.Find(OrderBy("Name"))
+	checkErr(t, err)
+	byRunes, err := c.Find(OrderBy("Name").WithRuneOrdering())
+	checkErr(t, err)
+	if !reflect.DeepEqual(stringFields(byBytes, "Name"), stringFields(byRunes, "Name")) {
+		t.Fatal("expected valid strings to sort alike by bytes and code points")
+	}
+}
+
+func TestFindSample(t *testing.T) {
+	t.Parallel()
+	const n = 200
+	tasks := make([]task, n)
+	for i := range tasks {
+		tasks[i].Name = fmt.Sprintf("task%03d", i)
+	}
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Task"}, tasks)
+	defer clean()
+
+	err := c.ReadTxn(func(txn *Txn) error {
+		first, err := txn.FindSample(&Query{}, 0.25, 42)
+		checkErr(t, err)
+		if len(first) == 0 || len(first) == n {
+			t.Fatalf("expected a proper sample, got %d of %d instances", len(first), n)
+		}
+		second, err := txn.FindSample(&Query{}, 0.25, 42)
+		checkErr(t, err)
+		if !reflect.DeepEqual(first, second) {
+			t.Fatal("expected the same sample for the same seed")
+		}
+		other, err := txn.FindSample(&Query{}, 0.25, 7)
+		checkErr(t, err)
+		if reflect.DeepEqual(first, other) {
+			t.Fatal("expected a different sample for a different seed")
+		}
+
+		// Narrowing the query keeps the sampled instances that still match.
+		narrowed, err := txn.FindSample(Where("Name").Lt("task100"), 0.25, 42)
+		checkErr(t, err)
+		var expected [][]byte
+		for _, r := range first {
+			tk := &task{}
+			util.InstanceFromJSON(r, tk)
+			if tk.Name < "task100" {
+				expected = append(expected, r)
+			}
+		}
+		if !reflect.DeepEqual(narrowed, expected) {
+			t.Fatalf("expected %d sampled matches, got %d", len(expected), len(narrowed))
+		}
+
+		all, err := txn.FindSample(&Query{}, 1, 42)
+		checkErr(t, err)
+		if len(all) != n {
+			t.Fatalf("expected all %d instances, got %d", n, len(all))
+		}
+		for _, fraction := range []float64{0, -0.5, 1.5, math.NaN()} {
+			if _, err := txn.FindSample(&Query{}, fraction, 42); err == nil {
+				t.Fatalf("expected an error for fraction %v", fraction)
+			}
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+func TestQueryFold(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Task", Indexes: []Index{{Path: "Priority"}}}, []task{
+		{Name: "a", Priority: "High"},
+		{Name: "b", Priority: "low"},
+		{Name: "c", Priority: "MEDIUM"},
+		{Name: "d", Priority: "Straße"},
+	})
+	defer clean()
+
+	tests := []struct {
+		name     string
+		query    *Query
+		expected []string
+	}{
+		{name: "in", query: Where("Priority").Fold().In("HIGH", "Low"), expected: []string{"a", "b"}},
+		{name: "not in", query: Where("Priority").Not().Fold().In("HIGH", "Low"), expected: []string{"c", "d"}},
+		{name: "case sensitive in", query: Where("Priority").In("HIGH", "Low"), expected: nil},
+		{name: "eq", query: Where("Priority").Fold().Eq("medium"), expected: []string{"c"}},
+		{name: "ne", query: Where("Priority").Fold().Ne("medium"), expected: []string{"a", "b", "d"}},
+		{name: "unicode", query: Where("Priority").Fold().In("STRASSE", "STRAßE"), expected: []string{"d"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query.OrderBy("Name"))
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.expected, names)
+		}
+	}
+
+	if _, err := c.Find(Where("Priority").Fold().Gt("low")); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected ErrInvalidOperation folding Gt, got %v", err)
+	}
+	if _, err := c.Find(Where("Priority").Fold().GtFieldPlus("Name", 0)); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected ErrInvalidOperation folding a field comparison, got %v", err)
+	}
+}
+
+func TestFindWithHighlights(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Note"}, []note{
+		{Seq: 0, Body: "Go is fun"},
+		{Seq: 1, Body: "Learning GO quickly"},
+		{Seq: 2, Body: "Ünïcode at 3 \u212Aelvin"},
+		{Seq: 3, Body: "nothing here"},
+	})
+	defer clean()
+
+	tests := []struct {
+		name     string
+		query    *Query
+		expected []string
+	}{
+		{name: "contains", query: Where("Body").ContainsFold("gO"), expected: []string{"Go", "GO"}},
+		{name: "contains folded rune", query: Where("Body").ContainsFold("kel"), expected: []string{"\u212Ael"}},
+		{name: "matches", query: Where("Body").Matches("[a-z]+ly"), expected: []string{"quickly"}},
+		{name: "starts with", query: Where("Body").StartsWith("Ünï"), expected: []string{"Ünï"}},
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		for _, tc := range tests {
+			res, err := txn.FindWithHighlights(tc.query.OrderBy("Seq"), "Body")
+			checkErr(t, err)
+			var got []string
+			for _, h := range res {
+				n := &note{}
+				util.InstanceFromJSON(h.Value, n)
+				got = append(got, n.Body[h.Start:h.End])
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("%s: expected highlights %q, got %q", tc.name, tc.expected, got)
+			}
+		}
+
+		if _, err := txn.FindWithHighlights(Where("Seq").Eq(1.0), "Body"); err == nil {
+			t.Fatal("expected an error without a text criterion on the field")
+		}
+		if _, err := txn.FindWithHighlights(Where("Body").ContainsFold("go").And("Body").StartsWith("G"), "Body"); err == nil {
+			t.Fatal("expected an error with several text criteria on the field")
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+type survey struct {
+	ID      core.InstanceID `json:"_id"`
+	Name    string
+	Age     *int    `json:",omitempty"`
+	City    *string `json:",omitempty"`
+	Email   *string `json:",omitempty"`
+	Phone   *string
+	Details *struct {
+		Job string
+	} `json:",omitempty"`
+}
+
+func TestWherePresentCount(t *testing.T) {
+	t.Parallel()
+	age, city, email, phone := 30, "Paris", "a@b.c", "555"
+	details := &struct{ Job string }{Job: "dev"}
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Survey"}, []survey{
+		{Name: "none"},
+		{Name: "two", Age: &age, City: &city},
+		{Name: "three", Age: &age, Email: &email, Phone: &phone},
+		{Name: "all", Age: &age, City: &city, Email: &email, Phone: &phone, Details: details},
+		{Name: "nested", City: &city, Phone: &phone, Details: details},
+	})
+	defer clean()
+
+	fields := []string{"Age", "City", "Email", "Phone", "Details.Job"}
+	tests := []struct {
+		query    *Query
+		expected []string
+	}{
+		{query: WherePresentCount(fields, Ge, 3), expected: []string{"all", "nested", "three"}},
+		{query: WherePresentCount(fields, Lt, 3), expected: []string{"none", "two"}},
+		{query: WherePresentCount(fields, Eq, 0), expected: []string{"none"}},
+		{query: WherePresentCount(fields, Ge, 3).And("Name").Ne("all"), expected: []string{"nested", "three"}},
+		{query: WherePresentCount([]string{"Age", "Phone"}, Ne, 1).WithFieldAliases(map[string]string{"Age": "Email"}), expected: []string{"all", "none", "three", "two"}},
+	}
+	for i, tc := range tests {
+		res, err := c.Find(tc.query.OrderBy("Name"))
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Fatalf("%d: expected %v, got %v", i, tc.expected, names)
+		}
+	}
+
+	folded := WherePresentCount(fields, Ge, 1)
+	folded.Ands[0].Fold()
+	asserted := WherePresentCount(fields, Ge, 1)
+	asserted.Ands[0].AssertType(FieldTypeString)
+	for _, q := range []*Query{
+		WherePresentCount(fields, Ge, -1),
+		WherePresentCount(fields, In, 1),
+		WherePresentCount([]string{"Tags.*"}, Ge, 1),
+		folded,
+		asserted,
+	} {
+		if _, err := c.Find(q); !errors.Is(err, ErrInvalidOperation) {
+			t.Fatalf("expected ErrInvalidOperation, got %v", err)
+		}
+	}
+}
+
+func TestQueryWithTextTimeout(t *testing.T) {
+	t.Parallel()
+	const n = 50
+	notes := make([]note, n)
+	for i := range notes {
+		notes[i] = note{Seq: i, Body: strings.Repeat("a", 10000)}
+	}
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Note"}, notes)
+	defer clean()
+
+	slow := func() *Query { return Where("Body").Matches(`(a|aa)+(b|a{2,9}c)`) }
+	res, err := c.Find(slow().WithTextTimeout(time.Nanosecond))
+	if !errors.Is(err, ErrTextEvalTimeout) {
+		t.Fatalf("expected ErrTextEvalTimeout, got %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("expected no matches collected, got %d", len(res))
+	}
+	res, err = c.Find(slow().WithTextTimeout(time.Minute))
+	checkErr(t, err)
+	if len(res) != 0 {
+		t.Fatalf("expected no matches, got %d", len(res))
+	}
+
+	// Whatever was collected before the timeout is returned.
+	res, err = c.Find(Where("Body").StartsWith("a").WithTextTimeout(time.Nanosecond))
+	if !errors.Is(err, ErrTextEvalTimeout) {
+		t.Fatalf("expected ErrTextEvalTimeout, got %v", err)
+	}
+	if len(res) >= n {
+		t.Fatalf("expected partial results, got %d", len(res))
+	}
+
+	// Queries without text criteria aren't bounded.
+	res, err = c.Find(Where("Seq").Ge(0.0).WithTextTimeout(time.Nanosecond))
+	checkErr(t, err)
+	if len(res) != n {
+		t.Fatalf("expected %d results, got %d", n, len(res))
+	}
+	if _, err := c.Find(slow().WithTextTimeout(-time.Second)); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected ErrInvalidOperation for a negative timeout, got %v", err)
+	}
+}
+
+func TestTextTimeoutPartialResults(t *testing.T) {
+	t.Parallel()
+	const n = 50
+	notes := make([]note, n)
+	for i := range notes {
+		notes[i] = note{Seq: i, Body: "a"}
+	}
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Note"}, notes)
+	defer clean()
+
+	// Each instance takes a while to read, so the timeout lets the first
+	// few matches through, but not all of them.
+	query := func() *Query {
+		q := Where("Body").StartsWith("a").OrderBy("Seq").WithTextTimeout(35 * time.Millisecond)
+		q.onScan = func() error {
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}
+		return q
+	}
+	partial := func(what string, got int) {
+		if got == 0 || got >= n {
+			t.Fatalf("expected partial results from %s, got %d", what, got)
+		}
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		res, total, err := txn.FindWithCount(query())
+		if !errors.Is(err, ErrTextEvalTimeout) {
+			t.Fatalf("expected ErrTextEvalTimeout from FindWithCount, got %v", err)
+		}
+		partial("FindWithCount", len(res))
+		if total != len(res) {
+			t.Fatalf("expected a total of the %d matches found, got %d", len(res), total)
+		}
+
+		p, err := txn.FindPage(query(), 1, n)
+		if !errors.Is(err, ErrTextEvalTimeout) {
+			t.Fatalf("expected ErrTextEvalTimeout from FindPage, got %v", err)
+		}
+		partial("FindPage", len(p.Items))
+
+		res, next, err := txn.FindPaged(query(), n, "")
+		if !errors.Is(err, ErrTextEvalTimeout) {
+			t.Fatalf("expected ErrTextEvalTimeout from FindPaged, got %v", err)
+		}
+		partial("FindPaged", len(res))
+		if next != "" {
+			t.Fatalf("expected no next page token for a partial page, got %q", next)
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+type upload struct {
+	ID       core.InstanceID `json:"_id"`
+	Name     string
+	Content  string
+	Checksum string `json:",omitempty"`
+}
+
+func TestWhereChecksumMismatch(t *testing.T) {
+	t.Parallel()
+	const (
+		crc    = "3610a686"
+		sha256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	)
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Upload"}, []upload{
+		{Name: "crc", Content: "hello", Checksum: crc},
+		{Name: "crc upper", Content: "hello", Checksum: strings.ToUpper(crc)},
+		{Name: "sha256", Content: "hello", Checksum: sha256},
+		{Name: "tampered", Content: "hello!", Checksum: sha256},
+		{Name: "unsummed", Content: "hello"},
+	})
+	defer clean()
+
+	tests := []struct {
+		query    *Query
+		expected []string
+	}{
+		{query: WhereChecksumMismatch("Content", "Checksum", ChecksumCRC32), expected: []string{"sha256", "tampered", "unsummed"}},
+		{query: WhereChecksumMismatch("Content", "Checksum", ChecksumSHA256), expected: []string{"crc", "crc upper", "tampered", "unsummed"}},
+		{query: WhereChecksumMismatch("Content", "Checksum", ChecksumSHA256).And("Name").Ne("unsummed"), expected: []string{"crc", "crc upper", "tampered"}},
+	}
+	for i, tc := range tests {
+		res, err := c.Find(tc.query.OrderBy("Name"))
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Fatalf("%d: expected %v, got %v", i, tc.expected, names)
+		}
+	}
+
+	if _, err := c.Find(WhereChecksumMismatch("Content", "Checksum", "md5")); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected ErrInvalidOperation for an unknown algorithm, got %v", err)
+	}
+	folded := WhereChecksumMismatch("Content", "Checksum", ChecksumSHA256)
+	folded.Ands[0].Fold()
+	asserted := WhereChecksumMismatch("Content", "Checksum", ChecksumSHA256)
+	asserted.Ands[0].AssertType(FieldTypeString)
+	for _, q := range []*Query{folded, asserted} {
+		if _, err := c.Find(q); !errors.Is(err, ErrInvalidOperation) {
+			t.Fatalf("expected ErrInvalidOperation, got %v", err)
+		}
+	}
+}
+
+func TestFindIterator(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	queries := []*Query{
+		{},
+		Where("Author").Eq("Author1").SkipNum(1),
+		(&Query{}).LimitTo(2),
+		Where("Meta.Rating").Gt(3.5).OrderByDesc("Meta.TotalReads"),
+		OrderBy("Title").Select("Title"),
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		for i, q := range queries {
+			expected, err := txn.Find(q)
+			checkErr(t, err)
+			it, err := txn.FindIterator(q)
+			checkErr(t, err)
+			var got [][]byte
+			for it.Next() {
+				got = append(got, it.Value())
+				b := &book{}
+				checkErr(t, it.Decode(b))
+				if b.Title == "" {
+					t.Fatalf("%d: expected a decoded book, got %v", i, b)
+				}
+			}
+			checkErr(t, it.Err())
+			it.Close()
+			if len(got) != len(expected) {
+				t.Fatalf("%d: expected %d results, got %d", i, len(expected), len(got))
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("%d: expected the results of Find", i)
+			}
+		}
+
+		// Closing the iterator early releases it.
+		it, err := txn.FindIterator(&Query{})
+		checkErr(t, err)
+		if !it.Next() {
+			t.Fatal("expected a result")
+		}
+		it.Close()
+		if it.Next() {
+			t.Fatal("expected no results after closing")
+		}
+		checkErr(t, it.Err())
+		return nil
+	})
+	checkErr(t, err)
+}
+
+type record struct {
+	ID         core.InstanceID `json:"_id"`
+	Name       string
+	Email      string `json:"email,omitempty"`
+	EmailUpper string `json:"EMAIL,omitempty"`
+}
+
+func TestQueryWithCaseInsensitiveFields(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Record"}, []record{
+		{Name: "a", Email: "a@x"},
+		{Name: "b", EmailUpper: "b@x"},
+		{Name: "c", Email: "c@x", EmailUpper: "c@y"},
+	})
+	defer clean()
+
+	res, err := c.Find(Where("Name").Ne("c").And("Email").Ne("").OrderBy("Name"))
+	checkErr(t, err)
+	if got := stringFields(res, "Name"); len(got) != 0 {
+		t.Fatalf("expected no matches by exact keys, got %v", got)
+	}
+	res, err = c.Find(Where("Name").Ne("c").And("Email").Ne("").OrderBy("Name").WithCaseInsensitiveFields())
+	checkErr(t, err)
+	if got, expected := stringFields(res, "Name"), []string{"a", "b"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v matched via folded keys, got %v", expected, got)
+	}
+	// Exact keys are preferred, so they're never ambiguous.
+	res, err = c.Find(Where("email").Eq("c@x").WithCaseInsensitiveFields())
+	checkErr(t, err)
+	if got, expected := stringFields(res, "Name"), []string{"c"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v matched by its exact key, got %v", expected, got)
+	}
+
+	_, err = c.Find(Where("Name").Eq("c").And("Email").Eq("c@x").WithCaseInsensitiveFields())
+	if !errors.Is(err, ErrAmbiguousField) {
+		t.Fatalf("expected ErrAmbiguousField, got %v", err)
+	}
+}
+
+type quote struct {
+	ID       core.InstanceID `json:"_id"`
+	Name     string
+	Price    float64
+	MinPrice float64
+	MaxPrice float64
+}
+
+func TestQueryBetweenFields(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Quote"}, []quote{
+		{Name: "inside", Price: 15, MinPrice: 10, MaxPrice: 20},
+		{Name: "low edge", Price: 10, MinPrice: 10, MaxPrice: 20},
+		{Name: "high edge", Price: 5, MinPrice: 1, MaxPrice: 5},
+		{Name: "below", Price: 9, MinPrice: 10, MaxPrice: 20},
+		{Name: "above", Price: 100, MinPrice: 10, MaxPrice: 99.5},
+	})
+	defer clean()
+
+	tests := []struct {
+		query    *Query
+		expected []string
+	}{
+		{query: Where("Price").BetweenFields("MinPrice", "MaxPrice"), expected: []string{"high edge", "inside", "low edge"}},
+		{query: Where("Price").Not().BetweenFields("MinPrice", "MaxPrice"), expected: []string{"above", "below"}},
+		{query: Where("Price").BetweenFields("Min", "MaxPrice").WithFieldAliases(map[string]string{"Min": "MinPrice"}), expected: []string{"high edge", "inside", "low edge"}},
+	}
+	for i, tc := range tests {
+		res, err := c.Find(tc.query.OrderBy("Name"))
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Fatalf("%d: expected %v, got %v", i, tc.expected, names)
+		}
+	}
+
+	res, err := c.Find(Where("Price").BetweenFields("MinPrice", "Missing"))
+	checkErr(t, err)
+	if len(res) != 0 {
+		t.Fatalf("expected a missing bound field to end the results, got %d", len(res))
+	}
+	if _, err := c.Find(Where("Price").BetweenFields("MinPrice", "")); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("expected ErrInvalidOperation without a high field, got %v", err)
+	}
+}
+
+func TestTopK(t *testing.T) {
+	t.Parallel()
+	c, data, clean := createCollectionWithData(t)
+	defer clean()
+
+	// Scores of the books by index: 13.3, 23.6, 33.9, 118, 504.8.
+	score := func(v map[string]interface{}) float64 {
+		meta := v["Meta"].(map[string]interface{})
+		return meta["TotalReads"].(float64) + meta["Rating"].(float64)
+	}
+	err := c.ReadTxn(func(txn *Txn) error {
+		res, err := txn.TopK(&Query{}, 3, score)
+		checkErr(t, err)
+		if got, expected := stringFields(res, "Title"), []string{data[4].Title, data[3].Title, data[2].Title}; !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected top %v, got %v", expected, got)
+		}
+		res, err = txn.TopK(Where("Author").Eq("Author1").OrderBy("Title").LimitTo(1), 2, func(v map[string]interface{}) float64 {
+			return -score(v)
+		})
+		checkErr(t, err)
+		if got, expected := stringFields(res, "Title"), []string{data[0].Title, data[1].Title}; !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected top %v, got %v", expected, got)
+		}
+		res, err = txn.TopK(&Query{}, 10, score)
+		checkErr(t, err)
+		if len(res) != len(data) {
+			t.Fatalf("expected all %d books, got %d", len(data), len(res))
+		}
+
+		// Ties are broken by key.
+		res, err = txn.TopK(&Query{}, 2, func(map[string]interface{}) float64 { return 1 })
+		checkErr(t, err)
+		ids := make([]string, len(res))
+		for i, r := range res {
+			b := &book{}
+			util.InstanceFromJSON(r, b)
+			ids[i] = b.ID.String()
+		}
+		all := make([]string, len(data))
+		for i, b := range data {
+			all[i] = b.ID.String()
+		}
+		sort.Strings(all)
+		if !reflect.DeepEqual(ids, all[:2]) {
+			t.Fatalf("expected ties broken by key, got %v", ids)
+		}
+
+		if _, err := txn.TopK(&Query{}, 0, score); err == nil {
+			t.Fatal("expected an error for k of 0")
+		}
+		return nil
+	})
+	checkErr(t, err)
+}
+
+type payload struct {
+	ID   core.InstanceID `json:"_id"`
+	Name string
+	Data map[string]interface{}
+}
+
+func TestQueryBracketFieldPaths(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "Payload"}, []payload{
+		{Name: "a", Data: map[string]interface{}{"weird.key": "w", "another one": "space", "0": "zero", "a.b": map[string]interface{}{"c": 1}, "*": "star", "it's": "quoted"}},
+		{Name: "b", Data: map[string]interface{}{"weird.key": "star", "another one": "x", "0": "y", "a.b": map[string]interface{}{"c": 2}, "*": "none", "it's": "no"}},
+	})
+	defer clean()
+
+	tests := []struct {
+		query    *Query
+		expected []string
+	}{
+		{query: Where("Data['weird.key']").Eq("w"), expected: []string{"a"}},
+		{query: Where(`Data["another one"]`).Eq("space"), expected: []string{"a"}},
+		{query: Where("Data['0']").Eq("zero"), expected: []string{"a"}},
+		{query: Where("Data['a.b'].c").Eq(2.0), expected: []string{"b"}},
+		{query: Where(`Data['it\'s']`).Eq("quoted"), expected: []string{"a"}},
+		{query: Where("Data['*']").Eq("star"), expected: []string{"a"}},
+		{query: Where("Data.*").Eq("star"), expected: []string{"a", "b"}},
+	}
+	for _, tc := range tests {
+		res, err := c.Find(tc.query.OrderBy("Name"))
+		checkErr(t, err)
+		names := stringFields(res, "Name")
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Fatalf("%s: expected %v, got %v", tc.query.Ands[0].FieldPath, tc.expected, names)
+		}
+	}
+
+	res, err := c.Find(Where("Name").Eq("a").Select("Data['a.b']"))
+	checkErr(t, err)
+	p := &payload{}
+	util.InstanceFromJSON(res[0], p)
+	if expected := map[string]interface{}{"a.b": map[string]interface{}{"c": 1.0}}; !reflect.DeepEqual(p.Data, expected) {
+		t.Fatalf("expected selected data %v, got %v", expected, p.Data)
+	}
+
+	for _, path := range []string{"Data['x", "Data[x]", "Data.['x']", "Data['x']y"} {
+		if _, err := c.Find(Where(path).Eq("x")); !errors.Is(err, ErrInvalidFieldPath) {
+			t.Fatalf("%s: expected ErrInvalidFieldPath, got %v", path, err)
+		}
+	}
+}
+
+type activity struct {
+	ID        core.InstanceID `json:"_id"`
+	Name      string
+	CreatedAt string
+	Seq       int
+}
+
+func TestQueryIndexedSortDesc(t *testing.T) {
+	t.Parallel()
+	base := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	var activities []activity
+	for i, offset := range []int{5, 1, 9, 3, 9, 7, 2, 100, 10} {
+		activities = append(activities, activity{
+			Name:      fmt.Sprintf("a%d", i),
+			CreatedAt: base.Add(time.Duration(offset) * time.Hour).Format(time.RFC3339),
+			Seq:       offset,
+		})
+	}
+	c, _, clean := createCollectionWithInstances(t, CollectionConfig{
+		Name:    "Activity",
+		Indexes: []Index{{Path: "CreatedAt"}, {Path: "Seq"}},
+	}, activities)
+	defer clean()
+	all, err := c.Find(OrderByDesc("CreatedAt"))
+	checkErr(t, err)
+
+	var scanned int
+	q := OrderByDesc("CreatedAt").UseIndex("CreatedAt").LimitTo(3)
+	q.onScan = func() error {
+		scanned++
+		return nil
+	}
+	res, err := c.Find(q)
+	checkErr(t, err)
+	if got, expected := stringFields(res, "Name"), stringFields(all[:3], "Name"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected newest %v, got %v", expected, got)
+	}
+	if scanned != 3 {
+		t.Fatalf("expected 3 instances read in reverse index order, read %d", scanned)
+	}
+	res, err = c.Find(OrderByDesc("CreatedAt").UseIndex("CreatedAt").SkipNum(2).LimitTo(3))
+	checkErr(t, err)
+	if got, expected := stringFields(res, "Name"), stringFields(all[2:5], "Name"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// Numbers aren't in index order, so they're sorted in memory before
+	// the limit, rather than read from the index in reverse.
+	res, err = c.Find(OrderByDesc("Seq").UseIndex("Seq").LimitTo(2))
+	checkErr(t, err)
+	if got, expected := stringFields(res, "Name"), []string{"a7", "a8"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected the highest Seq %v, got %v", expected, got)
+	}
+	res, err = c.Find(OrderByDesc("Seq").UseIndex("Seq").LimitTo(2).WithRuneOrdering())
+	checkErr(t, err)
+	if got, expected := stringFields(res, "Name"), []string{"a7", "a8"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected the highest Seq %v with rune ordering, got %v", expected, got)
+	}
+}
+
+func TestResultETag(t *testing.T) {
+	t.Parallel()
+	c, books, clean := createCollectionWithData(t)
+	defer clean()
+
+	q := Where("Author").Eq("Author1")
+	etag := func(q *Query) string {
+		var tag string
+		err := c.ReadTxn(func(txn *Txn) error {
+			var err error
+			tag, err = txn.ResultETag(q)
+			return err
+		})
+		checkErr(t, err)
+		return tag
+	}
+	original := etag(q)
+	if etag(q) != original {
+		t.Fatal("expected the same etag for the same results")
+	}
+	if etag(q.Clone().OrderByDesc("Meta.TotalReads").LimitTo(1)) != original {
+		t.Fatal("expected the etag to be independent of sort and limit")
+	}
+	if etag(Where("Author").Eq("Author2")) == original {
+		t.Fatal("expected a different etag for different results")
+	}
+
+	// Changes to instances which don't match keep the etag.
+	_, err := c.Create(util.JSONFromInstance(book{Title: "Title6", Author: "Author2"}))
+	checkErr(t, err)
+	other := books[3]
+	other.Meta.TotalReads++
+	checkErr(t, c.Save(util.JSONFromInstance(other)))
+	if etag(q) != original {
+		t.Fatal("expected unrelated changes to keep the etag")
+	}
+
+	id, err := c.Create(util.JSONFromInstance(book{Title: "Title7", Author: "Author1"}))
+	checkErr(t, err)
+	created := etag(q)
+	if created == original {
+		t.Fatal("expected a created match to change the etag")
+	}
+	checkErr(t, c.Delete(id))
+	if etag(q) != original {
+		t.Fatal("expected deleting the created match to restore the etag")
+	}
+
+	updated := books[0]
+	updated.Meta.Rating = 5
+	checkErr(t, c.Save(util.JSONFromInstance(updated)))
+	if tag := etag(q); tag == original || tag == created {
+		t.Fatal("expected an updated match to change the etag")
+	}
+	checkErr(t, c.Delete(books[1].ID))
+	if etag(q) == original {
+		t.Fatal("expected a deleted match to change the etag")
+	}
+}
+
+func TestQueryOrderByWeightedSum(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	// 100*Rating - TotalReads is 320, 340, 360, 286 and -20 for Title1 to
+	// Title5. Title isn't a number and Missing isn't a field, so they add 0.
+	terms := map[string]float64{"Meta.Rating": 100, "Meta.TotalReads": -1, "Title": 5, "Missing": 1}
+	q := (&Query{}).OrderByWeightedSum(terms, true)
+	res, err := c.Find(q)
+	checkErr(t, err)
+	expected := []string{"Title3", "Title2", "Title1", "Title4", "Title5"}
+	if got := stringFields(res, "Title"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	res, err = c.Find((&Query{}).OrderByWeightedSum(terms, false))
+	checkErr(t, err)
+	expected = []string{"Title5", "Title4", "Title1", "Title2", "Title3"}
+	if got := stringFields(res, "Title"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// The sort survives serialization.
+	b, err := json.Marshal(q)
+	checkErr(t, err)
+	decoded := &Query{}
+	checkErr(t, json.Unmarshal(b, decoded))
+	res, err = c.Find(decoded)
+	checkErr(t, err)
+	expected = []string{"Title3", "Title2", "Title1", "Title4", "Title5"}
+	if got := stringFields(res, "Title"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// Ties are broken by following sort keys.
+	res, err = c.Find(Where("Author").Eq("Author1").
+		OrderByWeightedSum(map[string]float64{"Missing": 1}, false).OrderByDesc("Title"))
+	checkErr(t, err)
+	expected = []string{"Title3", "Title2", "Title1"}
+	if got := stringFields(res, "Title"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	for _, terms := range []map[string]float64{{}, {"": 1}, {"Meta.Rating": math.NaN()}} {
+		if _, err := c.Find((&Query{}).OrderByWeightedSum(terms, false)); !errors.Is(err, ErrInvalidSortingField) {
+			t.Fatalf("expected invalid sort for %v, got %v", terms, err)
+		}
+	}
+}
+
+func TestQueryDetectContradictions(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name     string
+		q        *Query
+		expected []string
+	}{
+		{
+			name:     "conflicting ranges",
+			q:        Where("x").Gt(10.0).And("x").Lt(5.0),
+			expected: []string{"x: gt 10 and lt 5 can't both hold"},
+		},
+		{
+			name:     "empty range at a bound",
+			q:        Where("x").Ge(5.0).And("x").Lt(5.0),
+			expected: []string{"x: ge 5 and lt 5 can't both hold"},
+		},
+		{
+			name:     "inverted between",
+			q:        Where("x").Between(5.0, 1.0),
+			expected: []string{"x: between 5 and 1 can't hold"},
+		},
+		{
+			name:     "eq and ne of the same value",
+			q:        Where("Author").Eq("Author1").And("Title").Eq("Title1").And("Author").Ne("Author1"),
+			expected: []string{`Author: eq "Author1" and ne "Author1" can't both hold`},
+		},
+		{
+			name:     "different eq values",
+			q:        Where("x").Eq(true).And("x").Not().Ne(false),
+			expected: []string{"x: eq true and not ne false can't both hold"},
+		},
+		{
+			name:     "disjoint in sets",
+			q:        Where("Plan").In("free", "pro").And("Plan").In("team", "enterprise"),
+			expected: []string{`Plan: in ["free" "pro"] and in ["team" "enterprise"] can't both hold`},
+		},
+		{
+			name: "in values all ruled out",
+			q:    Where("x").In(1.0, 2.0, 3.0).And("x").Ne(2.0).And("x").Not().In(3.0).And("x").Ge(1.5),
+			expected: []string{
+				"x: in [1 2 3] and ge 1.5 and ne 2 and not in [3] can't all hold",
+			},
+		},
+		{
+			name:     "single value range excluded",
+			q:        Where("x").Ge(3.0).And("x").Le(3.0).And("x").Ne(3.0),
+			expected: []string{"x: ge 3 and le 3 and ne 3 can't all hold"},
+		},
+		{
+			name: "contradictions on several fields",
+			q:    Where("b").Lt("a").And("a").Eq(1.0).And("b").Gt("c").And("a").Eq(2.0),
+			expected: []string{
+				`b: gt "c" and lt "a" can't both hold`,
+				"a: eq 1 and eq 2 can't both hold",
+			},
+		},
+		{
+			name: "consistent",
+			q: Where("x").Gt(1.0).And("x").Lt(10.0).And("x").Ne(5.0).
+				And("y").In("a", "b").And("y").Ne("a").
+				And("z").Ge(3.0).And("z").Le(3.0),
+		},
+		{
+			name: "values of different types",
+			q:    Where("x").Gt(10.0).And("x").Lt("5").And("y").Eq("a").And("y").Ne(true),
+		},
+		{
+			name: "folded values",
+			q:    Where("x").Fold().Eq("A").And("x").Ne("a"),
+		},
+		{
+			name: "normalized values",
+			q: Where("x").Eq("A").And("x").Eq("a").
+				WithValueNormalizer(func(_ string, v interface{}) interface{} { return v }),
+		},
+		{
+			name: "parameters",
+			q:    Where("x").Gt(10.0).And("x").Lt(Param("max")),
+		},
+		{
+			name: "contradictory ands with an alternative",
+			q:    Where("x").Gt(10.0).And("x").Lt(5.0).Or(Where("y").Eq(1.0)),
+		},
+	}
+	for _, c := range cases {
+		if got := c.q.DetectContradictions(); !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("%s: expected %q, got %q", c.name, c.expected, got)
+		}
+	}
+
+	aliased := Where("n").Gt(10.0).And("Count").Lt(5.0).WithFieldAliases(map[string]string{"n": "Count"})
+	if got := aliased.DetectContradictions(); len(got) != 1 {
+		t.Fatalf("expected aliased fields to be analyzed together, got %q", got)
+	}
+	if got := Where("x").Gt(10.0).Or(Where("x").Lt(5.0)).DetectContradictions(); got != nil {
+		t.Fatalf("expected alternatives to be consistent, got %q", got)
+	}
+
+	// Criteria on a path crossing an array may hold for different elements.
+	lc, _, clean := createCollectionWithInstances(t, CollectionConfig{Name: "League"}, []league{
+		{
+			Name:   "a",
+			Teams:  []team{{Name: "red", Members: []teamMember{}}, {Name: "blue", Members: []teamMember{}}},
+			Squads: [][]teamMember{},
+		},
+	})
+	defer clean()
+	crossing := Where("Teams.Name").Eq("red").And("Teams.Name").Eq("blue").And("Teams.Name").Gt("q").And("Teams.Name").Lt("c")
+	if got := crossing.DetectContradictions(); got != nil {
+		t.Fatalf("expected criteria on a path crossing arrays to be consistent, got %q", got)
+	}
+	res, err := lc.Find(crossing)
+	checkErr(t, err)
+	if names := stringFields(res, "Name"); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Fatalf("expected [a], got %v", names)
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/textileio/go-threads/core/db"
+	kt "github.com/textileio/go-threads/db/keytransform"
 	"github.com/textileio/go-threads/util"
 )
 
@@ -243,17 +245,67 @@ var (
 			query:   Where("Meta.Rating").Gt(&ratingMid).OrderByDesc("Meta.TotalReads"),
 			ordered: true,
 		},
+		{
+			name:   "InTitle",
+			resIdx: []int{1, 2},
+			query:  Where("Title").In(&title1, &title3, &title),
+		},
+		{
+			name:   "InMixedTypes",
+			resIdx: []int{0},
+			query:  Where("Meta.TotalReads").In(&title0, &totreadEq1, &boolTrue),
+		},
 		// Indexing
 		{
 			name:   "EqTitle1OrTitle3UseIndex",
 			resIdx: []int{0, 2},
 			query:  Where("Title").Eq(&title0).Or(Where("Title").Eq(&title3)).UseIndex("Title"),
 		},
+		{
+			name:   "InTitle1Title3UseIndex",
+			resIdx: []int{0, 2},
+			query:  Where("Title").In(&title0, &title3, &title0, &titleMax).UseIndex("Title"),
+		},
+		{
+			name:   "InTotalReadsUseIndex",
+			resIdx: []int{0, 3},
+			query:  Where("Meta.TotalReads").In(&totreadEq1, 1000.0, &totreadMid).UseIndex("Meta.TotalReads"),
+		},
+		{
+			name:   "InTitleOrUseIndex",
+			resIdx: []int{0, 1},
+			query:  Where("Title").In(&title0).Or(Where("Title").Eq(&title1)).UseIndex("Title"),
+		},
 		{
 			name:   "GeByTotalReadsMinUseIndex",
 			resIdx: []int{0, 1, 2, 3},
 			query:  Where("Meta.TotalReads").Ge(&totreadMin).UseIndex("Meta.TotalReads"),
 		},
+		{
+			name:   "StartsWithTitle",
+			resIdx: []int{0, 1, 2, 3},
+			query:  Where("Title").StartsWith("Title"),
+		},
+		{
+			name:   "StartsWithTitleUseIndex",
+			resIdx: []int{0, 1, 2, 3},
+			query:  Where("Title").StartsWith("Title").UseIndex("Title"),
+		},
+		{
+			name:   "StartsWithTitle2UseIndex",
+			resIdx: []int{1},
+			query:  Where("Title").StartsWith("Title2").UseIndex("Title"),
+		},
+		{
+			name:   "StartsWithNoneUseIndex",
+			resIdx: []int{},
+			query:  Where("Title").StartsWith("A").UseIndex("Title"),
+		},
+		{
+			name:   "NotStartsWithTitle2UseIndex",
+			resIdx: []int{0, 2, 3},
+			query:  Where("Title").Not().StartsWith("Title2").UseIndex("Title"),
+		},
 		{
 			name:   "InvalidIndex",
 			resIdx: []int{},
@@ -330,3 +382,81 @@ func createCollectionWithJSONData(t *testing.T) (*Collection, []Book, func()) {
 	}
 	return c, dataCopy, clean
 }
+
+func TestQueryOrderByKey(t *testing.T) {
+	c, _, clean := createCollectionWithJSONData(t)
+	defer clean()
+
+	for _, useIndex := range []bool{false, true} {
+		for _, desc := range []bool{false, true} {
+			q := (&Query{}).OrderByKey(desc)
+			if useIndex {
+				q.UseIndex("Title")
+			}
+			res, err := c.Find(q)
+			checkErr(t, err)
+			if len(res) != len(data) {
+				t.Fatalf("query results length doesn't match, expected: %d, got: %d", len(data), len(res))
+			}
+			ids := make([]string, len(res))
+			for i := range res {
+				book := Book{}
+				util.InstanceFromJSON(res[i], &book)
+				ids[i] = book.ID.String()
+			}
+			sorted := sort.SliceIsSorted(ids, func(i, j int) bool {
+				if desc {
+					return ids[i] > ids[j]
+				}
+				return ids[i] < ids[j]
+			})
+			if !sorted {
+				t.Fatalf("results aren't in key order (desc: %v, index: %v): %v", desc, useIndex, ids)
+			}
+		}
+	}
+}
+
+func TestQueryPrefetch(t *testing.T) {
+	c, _, clean := createCollectionWithJSONData(t)
+	defer clean()
+
+	for _, q := range jsonQueries {
+		if q.query.Index == "" {
+			continue
+		}
+		q := q
+		t.Run(q.name, func(t *testing.T) {
+			batched, err := c.Find(q.query)
+			checkErr(t, err)
+			unbatched, err := c.Find(q.query.Clone().PrefetchNum(1))
+			checkErr(t, err)
+			if !reflect.DeepEqual(batched, unbatched) {
+				t.Fatalf("batched results don't match unbatched results, expected: %v, got: %v", unbatched, batched)
+			}
+		})
+	}
+
+	counter := &readCounter{}
+	rc, _, clean := createCollectionWithStore(t, func(s kt.TxnDatastoreExtended) kt.TxnDatastoreExtended {
+		counter.TxnDatastoreExtended = s
+		return counter
+	}, CollectionConfig{Name: "Book", Indexes: []Index{{Path: "Author"}}}, data)
+	defer clean()
+	reads := func(q *Query) ([][]byte, int64) {
+		atomic.StoreInt64(&counter.reads, 0)
+		res, err := rc.Find(q)
+		checkErr(t, err)
+		return res, atomic.LoadInt64(&counter.reads)
+	}
+	q := Where("Author").Ge("Author1").UseIndex("Author")
+	batched, batchedReads := reads(q)
+	unbatched, unbatchedReads := reads(q.Clone().PrefetchNum(1))
+	if len(batched) != len(data) || !reflect.DeepEqual(batched, unbatched) {
+		t.Fatalf("expected the same %d results batched and unbatched, got %d and %d", len(data), len(batched), len(unbatched))
+	}
+	// The instances take one read batched, and one each unbatched.
+	if saved := unbatchedReads - batchedReads; saved != int64(len(data)-1) {
+		t.Fatalf("expected %d reads saved by batching, got %d", len(data)-1, saved)
+	}
+}
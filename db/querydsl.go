@@ -0,0 +1,308 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrQuerySyntax is returned by ParseQuery when its input isn't a valid
+// query.
+var ErrQuerySyntax = errors.New("query syntax error")
+
+// ParseQuery parses a query written in a small filter language, e.g.
+//
+//	age >= 18 AND (country = "US" OR country = "CA")
+//
+// The grammar is:
+//
+//	query      = and { "OR" and }
+//	and        = term { "AND" term }
+//	term       = comparison | "(" query ")"
+//	comparison = field operator value
+//	operator   = "=" | "==" | "!=" | "<" | "<=" | ">" | ">="
+//	value      = string | number | "true" | "false"
+//
+// AND binds tighter than OR, and keywords are case-insensitive. Fields are
+// dot-separated paths, as in Where, of letters, digits, "_" and "*".
+// Strings are double-quoted, with \" and \\ escaping quotes and
+// backslashes, and numbers are decimal, as in JSON. The parsed query is an
+// Or of And groups, so groupings are expanded, e.g. (a OR b) AND c becomes
+// a AND c OR b AND c, and expressions expanding to more than
+// DefaultMaxQueryCriteria groups are rejected with ErrQueryTooComplex.
+func ParseQuery(s string) (*Query, error) {
+	p := &queryParser{lexer: queryLexer{input: s}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	groups, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenEOF {
+		return nil, p.errorf("expected AND, OR or end of input, got %s", p.tok)
+	}
+	var q *Query
+	for _, group := range groups {
+		gq := &Query{}
+		for _, cmp := range group {
+			gq.Ands = append(gq.Ands, &Criterion{
+				FieldPath: cmp.field,
+				Operation: cmp.op,
+				Value:     createValue(cmp.value),
+				query:     gq,
+			})
+		}
+		if q == nil {
+			q = gq
+		} else {
+			q.Ors = append(q.Ors, gq)
+		}
+	}
+	return q, nil
+}
+
+// comparison is a parsed comparison of a field against a value.
+type comparison struct {
+	field string
+	op    Operation
+	value interface{}
+}
+
+// queryParser is a recursive descent parser of the ParseQuery language,
+// parsing expressions into Or'ed groups of And'ed comparisons.
+type queryParser struct {
+	lexer queryLexer
+	tok   token
+}
+
+func (p *queryParser) advance() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w at offset %d: %s", ErrQuerySyntax, p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *queryParser) parseOr() ([][]comparison, error) {
+	groups, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.isKeyword("OR") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		more, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, more...)
+		if len(groups) > DefaultMaxQueryCriteria {
+			return nil, fmt.Errorf("%w: more than %d groups", ErrQueryTooComplex, DefaultMaxQueryCriteria)
+		}
+	}
+	return groups, nil
+}
+
+func (p *queryParser) parseAnd() ([][]comparison, error) {
+	groups, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.isKeyword("AND") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if len(groups)*len(right) > DefaultMaxQueryCriteria {
+			return nil, fmt.Errorf("%w: more than %d groups", ErrQueryTooComplex, DefaultMaxQueryCriteria)
+		}
+		// Distribute the And over the groups of both sides.
+		product := make([][]comparison, 0, len(groups)*len(right))
+		for _, l := range groups {
+			for _, r := range right {
+				group := make([]comparison, 0, len(l)+len(r))
+				group = append(group, l...)
+				product = append(product, append(group, r...))
+			}
+		}
+		groups = product
+	}
+	return groups, nil
+}
+
+func (p *queryParser) parseTerm() ([][]comparison, error) {
+	if p.tok.kind == tokenLParen {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		groups, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenRParen {
+			return nil, p.errorf("expected ), got %s", p.tok)
+		}
+		return groups, p.advance()
+	}
+	if p.tok.kind != tokenIdent || p.tok.isKeyword("AND") || p.tok.isKeyword("OR") {
+		return nil, p.errorf("expected a field or (, got %s", p.tok)
+	}
+	cmp := comparison{field: p.tok.text}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	op, ok := dslOperations[p.tok.text]
+	if p.tok.kind != tokenOperator || !ok {
+		return nil, p.errorf("expected a comparison operator after %s, got %s", cmp.field, p.tok)
+	}
+	cmp.op = op
+	opText := p.tok.text
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	switch {
+	case p.tok.kind == tokenString:
+		cmp.value = p.tok.text
+	case p.tok.kind == tokenNumber:
+		f, err := strconv.ParseFloat(p.tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", p.tok.text)
+		}
+		cmp.value = f
+	case p.tok.isKeyword("true"):
+		cmp.value = true
+	case p.tok.isKeyword("false"):
+		cmp.value = false
+	default:
+		return nil, p.errorf("expected a string, number or bool after %s %s, got %s", cmp.field, opText, p.tok)
+	}
+	return [][]comparison{{cmp}}, p.advance()
+}
+
+var dslOperations = map[string]Operation{
+	"=":  Eq,
+	"==": Eq,
+	"!=": Ne,
+	"<":  Lt,
+	"<=": Le,
+	">":  Gt,
+	">=": Ge,
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) isKeyword(k string) bool {
+	return t.kind == tokenIdent && strings.EqualFold(t.text, k)
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of input"
+	case tokenString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// queryLexer splits the input of ParseQuery into tokens.
+type queryLexer struct {
+	input string
+	pos   int
+}
+
+func (l *queryLexer) next() (token, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos == len(l.input) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+	c := l.input[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{kind: tokenLParen, text: "(", pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokenRParen, text: ")", pos: start}, nil
+	case c == '"':
+		return l.lexString()
+	case strings.IndexByte("=!<>", c) >= 0:
+		l.pos++
+		if l.pos < len(l.input) && l.input[l.pos] == '=' {
+			l.pos++
+		}
+		return token{kind: tokenOperator, text: l.input[start:l.pos], pos: start}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		l.pos++
+		for l.pos < len(l.input) && strings.IndexByte("0123456789.eE+-", l.input[l.pos]) >= 0 {
+			l.pos++
+		}
+		return token{kind: tokenNumber, text: l.input[start:l.pos], pos: start}, nil
+	case isIdentByte(c):
+		for l.pos < len(l.input) && (isIdentByte(l.input[l.pos]) || l.input[l.pos] == '.' || (l.input[l.pos] >= '0' && l.input[l.pos] <= '9')) {
+			l.pos++
+		}
+		return token{kind: tokenIdent, text: l.input[start:l.pos], pos: start}, nil
+	default:
+		return token{}, fmt.Errorf("%w at offset %d: unexpected character %q", ErrQuerySyntax, start, c)
+	}
+}
+
+func (l *queryLexer) lexString() (token, error) {
+	start := l.pos
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			return token{kind: tokenString, text: b.String(), pos: start}, nil
+		case '\\':
+			if l.pos == len(l.input) || (l.input[l.pos] != '"' && l.input[l.pos] != '\\') {
+				return token{}, fmt.Errorf("%w at offset %d: invalid escape in string", ErrQuerySyntax, l.pos-1)
+			}
+			b.WriteByte(l.input[l.pos])
+			l.pos++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return token{}, fmt.Errorf("%w at offset %d: unterminated string", ErrQuerySyntax, start)
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '*' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
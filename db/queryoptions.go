@@ -0,0 +1,63 @@
+package db
+
+// QueryOption configures a Query built by NewQuery.
+type QueryOption func(*Query)
+
+// NewQuery returns a query configured by opts, applied in order, as an
+// alternative to chaining builders when the parts of a query are decided
+// separately, e.g.
+//
+//	opts := []QueryOption{WithLimit(10)}
+//	if author != "" {
+//		opts = append(opts, WithFilter(Where("Author").Eq(author).Ands[0]))
+//	}
+//	q := NewQuery(opts...)
+//
+// Options mutate the query as their builder counterparts do.
+func NewQuery(opts ...QueryOption) *Query {
+	q := &Query{}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// WithFilter adds the condition c to the query, as And does. c is copied,
+// so it can be shared by several queries.
+func WithFilter(c *Criterion) QueryOption {
+	return func(q *Query) {
+		nc := *c
+		nc.query = q
+		q.Ands = append(q.Ands, &nc)
+	}
+}
+
+// WithSort adds a sort key on field, as OrderBy or OrderByDesc do, so
+// that several WithSort options accumulate sort keys.
+func WithSort(field string, desc bool) QueryOption {
+	return func(q *Query) {
+		q.addSort(Sort{FieldPath: field, Desc: desc})
+	}
+}
+
+// WithLimit limits the number of results, as LimitTo does.
+func WithLimit(n int) QueryOption {
+	return func(q *Query) {
+		q.LimitTo(n)
+	}
+}
+
+// WithSkip skips the first n results, as SkipNum does.
+func WithSkip(n int) QueryOption {
+	return func(q *Query) {
+		q.SkipNum(n)
+	}
+}
+
+// WithIndex specifies the index to use when running the query, as
+// UseIndex does.
+func WithIndex(path string) QueryOption {
+	return func(q *Query) {
+		q.UseIndex(path)
+	}
+}
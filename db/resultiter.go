@@ -0,0 +1,152 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ResultIterator iterates over the results of a query one at a time,
+// rather than materializing them all as Find does:
+//
+//	it, err := txn.FindIterator(q)
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		var p Person
+//		if err := it.Decode(&p); err != nil {
+//			return err
+//		}
+//	}
+//	return it.Err()
+type ResultIterator struct {
+	mi       *matchIterator
+	q        *Query
+	buffered []MarshaledResult
+	sorted   bool
+	skipped  int
+	returned int
+	size     int
+	timedOut func() bool
+	cur      MarshaledResult
+	err      error
+}
+
+// FindIterator returns an iterator over the results of q, which reads and
+// matches instances as it's advanced. Skip, Limit and the byte limit are
+// applied as it goes, but a query sorted in memory buffers and sorts all
+// its matches before returning, as Find does. If the text timeout of q
+// elapses, the iteration ends and Err returns ErrTextEvalTimeout. The
+// iterator must be used within the transaction, and closed once done,
+// unless it's exhausted.
+func (t *Txn) FindIterator(q *Query) (*ResultIterator, error) {
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if q.sortsInMemory() {
+		values, _, err := t.collect(q, collector{})
+		if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+			return nil, err
+		}
+		timedOut := err != nil
+		return &ResultIterator{q: q, buffered: values, sorted: true, timedOut: func() bool {
+			return timedOut
+		}}, nil
+	}
+	timedOut := q.startTextTimeout()
+	mi, err := t.newMatchIterator(q, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &ResultIterator{mi: mi, q: q, timedOut: timedOut}, nil
+}
+
+// Next advances the iterator to the next result, returning false once
+// there are no more or an error occurred, see Err.
+func (it *ResultIterator) Next() bool {
+	res, ok := it.advance()
+	if !ok {
+		it.Close()
+		it.cur = MarshaledResult{}
+		return false
+	}
+	// Buffered results are already projected and cut off at the byte limit.
+	if !it.sorted {
+		values := []MarshaledResult{res}
+		if it.err = projectFields(values, it.q); it.err != nil {
+			it.Close()
+			return false
+		}
+		res = values[0]
+		if it.q.ByteLimit > 0 {
+			if it.size += len(res.Value); it.size > it.q.ByteLimit {
+				it.Close()
+				it.cur = MarshaledResult{}
+				return false
+			}
+		}
+	}
+	it.cur = res
+	it.returned++
+	return true
+}
+
+func (it *ResultIterator) advance() (MarshaledResult, bool) {
+	if it.err != nil {
+		return MarshaledResult{}, false
+	}
+	if it.sorted {
+		if len(it.buffered) == 0 {
+			return MarshaledResult{}, false
+		}
+		res := it.buffered[0]
+		it.buffered = it.buffered[1:]
+		return res, true
+	}
+	if it.mi == nil || (it.q.Limit > 0 && it.returned == it.q.Limit) {
+		return MarshaledResult{}, false
+	}
+	for {
+		res, ok, err := it.mi.next()
+		if err != nil || !ok {
+			it.err = err
+			return MarshaledResult{}, false
+		}
+		if it.skipped < it.q.Skip {
+			it.skipped++
+			continue
+		}
+		return res, true
+	}
+}
+
+// Value returns the current result.
+func (it *ResultIterator) Value() []byte {
+	return it.cur.Value
+}
+
+// Decode decodes the current result into v.
+func (it *ResultIterator) Decode(v interface{}) error {
+	return json.Unmarshal(it.cur.Value, v)
+}
+
+// Err returns the error which stopped the iteration, if any, or
+// ErrTextEvalTimeout if the text timeout of the query elapsed.
+func (it *ResultIterator) Err() error {
+	if it.err == nil && it.timedOut != nil && it.timedOut() {
+		return ErrTextEvalTimeout
+	}
+	return it.err
+}
+
+// Close releases the resources of the iterator. It's safe to call more
+// than once.
+func (it *ResultIterator) Close() {
+	if it.mi != nil {
+		it.mi.close()
+		it.mi = nil
+	}
+	it.buffered = nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// FindSample returns a random sample of the instances matching q, each of
+// which is included with probability fraction. Whether an instance is
+// sampled is decided by a hash of seed and the instance key, so the same
+// seed yields the same sample as long as the instance matches, without
+// sorting or shuffling the matches. Sort, Skip and Limit apply to the
+// sampled instances.
+func (t *Txn) FindSample(q *Query, fraction float64, seed int64) ([][]byte, error) {
+	if !(fraction > 0 && fraction <= 1) {
+		return nil, fmt.Errorf("sample fraction must be in (0, 1], got %v", fraction)
+	}
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	values, _, err := t.collect(q, collector{
+		keep: func(res MarshaledResult) (bool, error) {
+			return sampleKey(res.Key, seed, fraction), nil
+		},
+	})
+	if err != nil && !errors.Is(err, ErrTextEvalTimeout) {
+		return nil, err
+	}
+	return resultValues(values), err
+}
+
+// sampleKey reports whether the instance with key is in the sample of the
+// given fraction for seed.
+func sampleKey(key string, seed int64, fraction float64) bool {
+	if fraction >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(seed))
+	_, _ = h.Write(b[:])
+	_, _ = h.Write([]byte(key))
+	// The top 53 bits of the hash, scaled to [0, 1), as Float64 does.
+	return float64(h.Sum64()>>11)/(1<<53) < fraction
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSubqueryTooLarge is returned when a subquery yields more distinct
+// values than the db allows.
+var ErrSubqueryTooLarge = errors.New("subquery too large")
+
+// DefaultMaxSubqueryResults is the maximum number of distinct values a
+// subquery may yield, in dbs which don't set one.
+const DefaultMaxSubqueryResults = 10000
+
+// subquery is a query whose field values are the values of an In.
+type subquery struct {
+	txn   *Txn
+	query *Query
+	field string
+}
+
+// InSubquery matches when the field equals the field value of any instance
+// matching sub in the collection of t, e.g. the orders of VIP customers:
+//
+//	Where("customerId").InSubquery(customers, Where("vip").Eq(true), "_id")
+//
+// The subquery is materialized rather than correlated: it runs once when
+// the query is executed, its distinct string, bool and number values are
+// collected, and the query runs as an In with them. Subqueries yielding
+// more values than the db allows, DefaultMaxSubqueryResults by default,
+// fail with ErrSubqueryTooLarge. Queries with subqueries aren't
+// serialized, and aren't cached by FindCached.
+func (c *Criterion) InSubquery(t *Txn, sub *Query, field string) *Query {
+	c.Values = nil
+	c.subquery = &subquery{txn: t, query: sub, field: field}
+	return c.createcriterion(In, nil)
+}
+
+// hasSubqueries returns whether q or its Ors have subquery criteria.
+func (q *Query) hasSubqueries() bool {
+	if q == nil {
+		return false
+	}
+	for _, c := range q.Ands {
+		if c.subquery != nil {
+			return true
+		}
+	}
+	for _, o := range q.Ors {
+		if o.hasSubqueries() {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSubqueries runs the subqueries of q and its Ors, setting their
+// values as the values of their criteria.
+func (q *Query) resolveSubqueries(max int) error {
+	if max <= 0 {
+		max = DefaultMaxSubqueryResults
+	}
+	for _, c := range q.Ands {
+		if c.subquery == nil {
+			continue
+		}
+		values, err := c.subquery.values(max)
+		if err != nil {
+			return err
+		}
+		c.Values = values
+		c.subquery = nil
+	}
+	for _, o := range q.Ors {
+		if err := o.resolveSubqueries(max); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// values returns the distinct values of the subquery field, failing if
+// there are more than max of them.
+func (s *subquery) values(max int) ([]Value, error) {
+	q, err := s.txn.prepareQuery(s.query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subquery: %w", err)
+	}
+	field := resolveAlias(q.Aliases, s.field)
+	seen := make(map[string]struct{})
+	var values []Value
+	if err := s.txn.iterate(q, func(res MarshaledResult) (bool, error) {
+		key, ok, err := distinctKey(res.MarshaledValue, field, q.maxPathDepth)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return true, nil
+		}
+		if _, ok := seen[key]; ok {
+			return true, nil
+		}
+		value, _ := traverseFieldPathMap(res.MarshaledValue, field, q.maxPathDepth)
+		v := createValue(value.Interface())
+		if v.value() == nil {
+			return true, nil
+		}
+		if len(values) == max {
+			return false, fmt.Errorf("%w: more than %d values", ErrSubqueryTooLarge, max)
+		}
+		seen[key] = struct{}{}
+		values = append(values, v)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
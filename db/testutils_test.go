@@ -4,11 +4,14 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/textileio/go-threads/common"
+	core "github.com/textileio/go-threads/core/db"
 	"github.com/textileio/go-threads/core/thread"
+	kt "github.com/textileio/go-threads/db/keytransform"
 	"github.com/textileio/go-threads/util"
 )
 
@@ -20,6 +23,11 @@ func checkErr(t *testing.T, err error) {
 }
 
 func createTestDB(t *testing.T, opts ...NewOption) (*DB, func()) {
+	return createTestDBWithStore(t, func(s kt.TxnDatastoreExtended) kt.TxnDatastoreExtended { return s }, opts...)
+}
+
+// createTestDBWithStore is like createTestDB, with the db datastore wrapped by wrap.
+func createTestDBWithStore(t *testing.T, wrap func(kt.TxnDatastoreExtended) kt.TxnDatastoreExtended, opts ...NewOption) (*DB, func()) {
 	dir, err := ioutil.TempDir("", "")
 	checkErr(t, err)
 	n, err := common.DefaultNetwork(
@@ -30,7 +38,7 @@ func createTestDB(t *testing.T, opts ...NewOption) (*DB, func()) {
 	checkErr(t, err)
 	store, err := util.NewBadgerDatastore(dir, "eventstore", false)
 	checkErr(t, err)
-	d, err := NewDB(context.Background(), store, n, thread.NewIDV1(thread.Raw, 32), opts...)
+	d, err := NewDB(context.Background(), wrap(store), n, thread.NewIDV1(thread.Raw, 32), opts...)
 	checkErr(t, err)
 	return d, func() {
 		time.Sleep(time.Second) // Give threads a chance to finish work
@@ -43,3 +51,42 @@ func createTestDB(t *testing.T, opts ...NewOption) (*DB, func()) {
 		_ = os.RemoveAll(dir)
 	}
 }
+
+// createCollectionWithInstances creates a collection with config in a new
+// test db, and creates each of the slice instances in it. The schema
+// defaults to that of the instances type. It returns the collection, the
+// ids of the instances and the db cleanup.
+func createCollectionWithInstances(t *testing.T, config CollectionConfig, instances interface{}, opts ...NewOption) (*Collection, []core.InstanceID, func()) {
+	return createCollectionWithStore(t, func(s kt.TxnDatastoreExtended) kt.TxnDatastoreExtended { return s }, config, instances, opts...)
+}
+
+// createCollectionWithStore is like createCollectionWithInstances, with the
+// db datastore wrapped by wrap.
+func createCollectionWithStore(t *testing.T, wrap func(kt.TxnDatastoreExtended) kt.TxnDatastoreExtended, config CollectionConfig, instances interface{}, opts ...NewOption) (*Collection, []core.InstanceID, func()) {
+	db, clean := createTestDBWithStore(t, wrap, opts...)
+	v := reflect.ValueOf(instances)
+	if config.Schema == nil {
+		config.Schema = util.SchemaFromInstance(reflect.New(v.Type().Elem()).Interface(), false)
+	}
+	c, err := db.NewCollection(config)
+	checkErr(t, err)
+	ids := make([]core.InstanceID, v.Len())
+	for i := range ids {
+		ids[i], err = c.Create(util.JSONFromInstance(v.Index(i).Interface()))
+		checkErr(t, err)
+	}
+	return c, ids, clean
+}
+
+// stringFields returns the top-level string field of each of the
+// instances res, empty if it's missing.
+func stringFields(res [][]byte, field string) []string {
+	var values []string
+	for _, r := range res {
+		var v map[string]interface{}
+		util.InstanceFromJSON(r, &v)
+		s, _ := v[field].(string)
+		values = append(values, s)
+	}
+	return values
+}
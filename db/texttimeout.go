@@ -0,0 +1,63 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTextEvalTimeout is returned by Find, along with the results found so
+// far, when evaluating the text criteria of a query outlasts the timeout
+// set by WithTextTimeout.
+var ErrTextEvalTimeout = errors.New("text evaluation timed out")
+
+// WithTextTimeout bounds the time Find spends on a query with text
+// criteria, ContainsFold, Matches or StartsWith ones, whose patterns may
+// be slow to evaluate over many long strings. Once d has elapsed, Find
+// stops scanning and returns the results found so far, sorted among
+// themselves, along with ErrTextEvalTimeout. The deadline is checked
+// between instances, so evaluating a single instance isn't interrupted.
+// Queries without text criteria aren't bounded. Zero means no timeout.
+func (q *Query) WithTextTimeout(d time.Duration) *Query {
+	q.TextTimeout = d
+	return q
+}
+
+// hasTextCriteria returns whether q or its Ors have text criteria.
+func (q *Query) hasTextCriteria() bool {
+	for _, c := range q.Ands {
+		switch c.Operation {
+		case ContainsFold, Matches, StartsWith:
+			return true
+		}
+	}
+	for _, o := range q.Ors {
+		if o.hasTextCriteria() {
+			return true
+		}
+	}
+	return false
+}
+
+// startTextTimeout starts the text timeout of the prepared query q, if it
+// has one and text criteria, so that scanning stops once it elapses. It
+// returns whether it has elapsed.
+func (q *Query) startTextTimeout() func() bool {
+	var timedOut bool
+	if q.TextTimeout > 0 && q.hasTextCriteria() {
+		deadline := time.Now().Add(q.TextTimeout)
+		onScan := q.onScan
+		q.onScan = func() error {
+			if time.Now().After(deadline) {
+				timedOut = true
+				return ErrTextEvalTimeout
+			}
+			if onScan != nil {
+				return onScan()
+			}
+			return nil
+		}
+	}
+	return func() bool {
+		return timedOut
+	}
+}
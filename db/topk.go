@@ -0,0 +1,78 @@
+package db
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+// TopK returns the k instances matching q with the highest score, highest
+// first, with ties broken by instance key. score is called with each match
+// decoded, and only the best k matches so far are kept while scanning, in
+// a bounded min-heap, rather than sorting all of them. Sort, Limit and
+// Skip are ignored.
+func (t *Txn) TopK(q *Query, k int, score func(map[string]interface{}) float64) ([][]byte, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("k must be positive, got %d", k)
+	}
+	q, err := t.prepareQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	h := &scoredHeap{}
+	if err := t.iterate(q, func(res MarshaledResult) (bool, error) {
+		s := scoredResult{res: res, score: score(res.MarshaledValue)}
+		if h.Len() < k {
+			heap.Push(h, s)
+		} else if h.less(h.items[0], s) {
+			h.items[0] = s
+			heap.Fix(h, 0)
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(sort.Reverse(h))
+	values := make([]MarshaledResult, h.Len())
+	for i, s := range h.items {
+		values[i] = s.res
+	}
+	if err := projectFields(values, q); err != nil {
+		return nil, err
+	}
+	res := make([][]byte, len(values))
+	for i := range values {
+		res[i] = values[i].Value
+	}
+	return res, nil
+}
+
+type scoredResult struct {
+	res   MarshaledResult
+	score float64
+}
+
+// scoredHeap is a min-heap of scored results, the worst at the top.
+type scoredHeap struct {
+	items []scoredResult
+}
+
+// less reports whether a ranks below b: it has a lower score, or an equal
+// one and a greater key.
+func (h *scoredHeap) less(a, b scoredResult) bool {
+	if a.score != b.score {
+		return a.score < b.score
+	}
+	return a.res.Key > b.res.Key
+}
+
+func (h *scoredHeap) Len() int           { return len(h.items) }
+func (h *scoredHeap) Less(i, j int) bool { return h.less(h.items[i], h.items[j]) }
+func (h *scoredHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *scoredHeap) Push(x interface{}) { h.items = append(h.items, x.(scoredResult)) }
+func (h *scoredHeap) Pop() interface{} {
+	s := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return s
+}
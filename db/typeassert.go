@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// FieldType is the JSON type of an instance field.
+type FieldType string
+
+const (
+	// FieldTypeString is the type of strings.
+	FieldTypeString FieldType = "string"
+	// FieldTypeNumber is the type of numbers.
+	FieldTypeNumber FieldType = "number"
+	// FieldTypeBool is the type of booleans.
+	FieldTypeBool FieldType = "bool"
+	// FieldTypeObject is the type of objects.
+	FieldTypeObject FieldType = "object"
+	// FieldTypeArray is the type of arrays.
+	FieldTypeArray FieldType = "array"
+	// FieldTypeNull is the type of null.
+	FieldTypeNull FieldType = "null"
+)
+
+// ErrFieldTypeAssertion is returned by queries when a field doesn't have
+// the type asserted by AssertType.
+type ErrFieldTypeAssertion struct {
+	FieldPath string
+	Expected  FieldType
+	Actual    FieldType
+}
+
+func (e *ErrFieldTypeAssertion) Error() string {
+	return fmt.Sprintf("field %s is a %s, expected a %s", e.FieldPath, e.Actual, e.Expected)
+}
+
+// Is reports whether target is an *ErrFieldTypeAssertion, so that
+// errors.Is(err, &ErrFieldTypeAssertion{}) matches any failed assertion.
+func (e *ErrFieldTypeAssertion) Is(target error) bool {
+	_, ok := target.(*ErrFieldTypeAssertion)
+	return ok
+}
+
+// AssertType asserts that the field has type t in every instance the
+// criterion is matched against, e.g. Where("Price").AssertType(
+// FieldTypeNumber).Gt(10.0). An instance where it doesn't fails the query
+// with an ErrFieldTypeAssertion, rather than ending the results early as
+// type mismatches do, so that schema drift of critical fields is noticed.
+// Instances missing the field are handled as by the operator.
+func (c *Criterion) AssertType(t FieldType) *Criterion {
+	c.AssertedType = t
+	return c
+}
+
+// validateAssertedType validates the type asserted by the criterion.
+func (c *Criterion) validateAssertedType() error {
+	switch c.AssertedType {
+	case "", FieldTypeString, FieldTypeNumber, FieldTypeBool, FieldTypeObject, FieldTypeArray, FieldTypeNull:
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown field type %q", ErrInvalidOperation, c.AssertedType)
+	}
+}
+
+// assertType returns an ErrFieldTypeAssertion if the criterion asserts
+// a type which value, a field of an instance, doesn't have.
+func (c *Criterion) assertType(value reflect.Value) error {
+	if c.AssertedType == "" {
+		return nil
+	}
+	if t := fieldType(value); t != c.AssertedType {
+		return &ErrFieldTypeAssertion{FieldPath: c.FieldPath, Expected: c.AssertedType, Actual: t}
+	}
+	return nil
+}
+
+// fieldType returns the JSON type of a decoded field value.
+func fieldType(value reflect.Value) FieldType {
+	if !value.IsValid() {
+		return FieldTypeNull
+	}
+	switch value.Interface().(type) {
+	case string:
+		return FieldTypeString
+	case float64:
+		return FieldTypeNumber
+	case bool:
+		return FieldTypeBool
+	case map[string]interface{}:
+		return FieldTypeObject
+	case []interface{}:
+		return FieldTypeArray
+	default:
+		return FieldTypeNull
+	}
+}
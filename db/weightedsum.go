@@ -0,0 +1,96 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// OrderByWeightedSum specifies order for the query results by the sum of
+// the numeric values of the fields of terms, each multiplied by its weight,
+// e.g. a ranking of 0.7*Recency + 0.3*Popularity is
+//
+//	q.OrderByWeightedSum(map[string]float64{"Recency": 0.7, "Popularity": 0.3}, true)
+//
+// Fields which are missing or aren't numbers contribute 0. Unlike sorting
+// with a closure, the sort is data, so the query can be serialized.
+// Multiple calls accumulate sort keys, as in OrderBy.
+func (q *Query) OrderByWeightedSum(terms map[string]float64, desc bool) *Query {
+	weights := make(map[string]float64, len(terms))
+	for field, w := range terms {
+		weights[field] = w
+	}
+	return q.addSort(Sort{Desc: desc, Weights: weights})
+}
+
+// validateWeights validates the terms of a weighted sum sort.
+func (s Sort) validateWeights() error {
+	if s.Weights == nil {
+		return nil
+	}
+	if len(s.Weights) == 0 {
+		return fmt.Errorf("%w: weighted sum has no terms", ErrInvalidSortingField)
+	}
+	if s.FieldPath != "" || s.ByRelevance || s.ByLen || s.Numeric || s.ArrayMin || s.ArrayMax || s.Collation != nil {
+		return fmt.Errorf("%w: weighted sum can't be combined with other sort options", ErrInvalidSortingField)
+	}
+	for field, w := range s.Weights {
+		if field == "" {
+			return fmt.Errorf("%w: weighted sum term has no field path", ErrInvalidSortingField)
+		}
+		if math.IsNaN(w) || math.IsInf(w, 0) {
+			return fmt.Errorf("%w: weight of %s must be finite, got %v", ErrInvalidSortingField, field, w)
+		}
+	}
+	return nil
+}
+
+// weightedSum returns the weighted sum of the numeric fields of v.
+func (s Sort) weightedSum(v map[string]interface{}, maxDepth int) (numericValue, error) {
+	var sum float64
+	for _, field := range s.paths() {
+		value, err := traverseFieldPathMap(v, field, maxDepth)
+		if errors.Is(err, ErrPathTooDeep) {
+			return numericValue{}, err
+		}
+		if err != nil || !value.IsValid() {
+			continue
+		}
+		if f, ok := value.Interface().(float64); ok && !math.IsNaN(f) {
+			sum += s.Weights[field] * f
+		}
+	}
+	return numericValue{f: sum, ok: true}, nil
+}
+
+// resolveAliases rewrites the field paths of s matching an alias to its
+// target.
+func (s *Sort) resolveAliases(aliases map[string]string) {
+	s.FieldPath = resolveAlias(aliases, s.FieldPath)
+	if len(s.Weights) == 0 {
+		return
+	}
+	weights := make(map[string]float64, len(s.Weights))
+	for field, w := range s.Weights {
+		weights[resolveAlias(aliases, field)] += w
+	}
+	s.Weights = weights
+}
+
+// paths returns the field paths s sorts by, in lexical order for weighted
+// sums.
+func (s Sort) paths() []string {
+	if len(s.Weights) == 0 {
+		if s.FieldPath == "" {
+			return nil
+		}
+		return []string{s.FieldPath}
+	}
+	paths := make([]string, 0, len(s.Weights))
+	for field := range s.Weights {
+		paths = append(paths, field)
+	}
+	sort.Strings(paths)
+	return paths
+}